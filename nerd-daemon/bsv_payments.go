@@ -10,6 +10,7 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"sort"
 	"strings" // Added for strings.ToLower
 	"sync"
 	"time"
@@ -19,6 +20,7 @@ import (
 	"github.com/bsv-blockchain/go-sdk/transaction"
 	"github.com/bsv-blockchain/go-sdk/transaction/template/p2pkh"
 	"github.com/nerd-daemon/messages"
+	"google.golang.org/protobuf/proto"
 )
 
 // BSVPaymentConfig holds configuration for BSV payment system
@@ -31,6 +33,7 @@ type BSVPaymentConfig struct {
 	NetworkType          string  // "mainnet" or "testnet", used for constructing API URLs
 	BroadcastURL         string  // URL for broadcasting transactions (e.g., Whatsonchain API for testnet: https://api.whatsonchain.com/v1/bsv/test/tx/raw)
 	UTXOFetchURLFormat   string  // URL format for fetching UTXOs, e.g., "https://api.whatsonchain.com/v1/bsv/%s/address/%s/unspent" (%s for network, %s for address)
+	TxFetchURLFormat     string  // URL format for fetching a raw transaction, e.g., "https://api.whatsonchain.com/v1/bsv/%s/tx/%s/hex" (%s for network, %s for txid); payment proofs are not trusted without it
 	// UTXOFetchAPIKey      string  // API key if UTXO fetching service requires it (not used by Whatsonchain public)
 }
 
@@ -44,14 +47,16 @@ type UTXO struct {
 
 // BSVPaymentSystem manages BSV micropayments and payment channels
 type BSVPaymentSystem struct {
-	config          *BSVPaymentConfig
-	privateKey      *primitives.PrivateKey
-	paymentChannels map[string]*PaymentChannel
-	pendingPayments map[string]*PendingPayment
-	walletBalance   int64
-	mu              sync.RWMutex
-	isRunning       bool
-	isTestnet       bool // Added to easily check network type based on config
+	config           *BSVPaymentConfig
+	privateKey       *primitives.PrivateKey
+	paymentChannels  map[string]*PaymentChannel
+	pendingPayments  map[string]*PendingPayment
+	receivedPayments map[string][]ReceivedPayment // Verified payment proofs from peers, keyed by identity or address
+	verifying        map[string]bool              // Transaction IDs of payment proofs being checked on-chain
+	walletBalance    int64
+	mu               sync.RWMutex
+	isRunning        bool
+	isTestnet        bool // Added to easily check network type based on config
 }
 
 // PaymentChannel represents a bidirectional payment channel
@@ -84,6 +89,13 @@ type PendingPayment struct {
 	Status      string // "pending", "confirmed", "failed"
 }
 
+// ReceivedPayment is a payment proof a peer sent us for content we serve
+type ReceivedPayment struct {
+	TxID       string
+	PieceIndex uint32
+	ReceivedAt time.Time
+}
+
 // PaymentRequest represents a request for payment
 type PaymentRequest struct {
 	RequestID  string
@@ -127,11 +139,13 @@ func NewBSVPaymentSystem(config *BSVPaymentConfig) (*BSVPaymentSystem, error) {
 	}
 
 	return &BSVPaymentSystem{
-		config:          config,
-		privateKey:      privKey,
-		paymentChannels: make(map[string]*PaymentChannel),
-		pendingPayments: make(map[string]*PendingPayment),
-		isTestnet:       isTest,
+		config:           config,
+		privateKey:       privKey,
+		paymentChannels:  make(map[string]*PaymentChannel),
+		pendingPayments:  make(map[string]*PendingPayment),
+		receivedPayments: make(map[string][]ReceivedPayment),
+		verifying:        make(map[string]bool),
+		isTestnet:        isTest,
 	}, nil
 }
 
@@ -182,6 +196,11 @@ func (bps *BSVPaymentSystem) Stop() error {
 	return nil
 }
 
+// Identity returns the peer identity derived from the payment key
+func (bps *BSVPaymentSystem) Identity() (*Identity, error) {
+	return NewIdentity(bps.privateKey)
+}
+
 // GetAddress returns the BSV address for this payment system
 func (bps *BSVPaymentSystem) GetAddress() string {
 	pubKey := bps.privateKey.PubKey()
@@ -752,6 +771,7 @@ func (bps *BSVPaymentSystem) GetPaymentStats() map[string]interface{} {
 	stats["pending_payments"] = len(bps.pendingPayments)
 	stats["open_channels"] = 0
 	stats["total_channels"] = len(bps.paymentChannels)
+	stats["paying_peers"] = len(bps.receivedPayments)
 
 	var totalChannelValue int64
 	for _, channel := range bps.paymentChannels {
@@ -880,6 +900,217 @@ func (bps *BSVPaymentSystem) ProcessProtocolPaymentRequest(msg *messages.Payment
 	return nil
 }
 
+// Limits on the payment proofs kept per peer
+const (
+	receivedPaymentRetention   = 24 * time.Hour
+	maxReceivedPaymentsPerPeer = 100
+	maxPaymentVerifications    = 32 // Proofs checked on-chain at once; more are dropped until some finish
+)
+
+// VerifyPaymentProof checks a payment proof sent by a peer in the background.
+// The proof is recorded, and onVerified called, only once the transaction is
+// found on the network paying our address at least MinPaymentSatoshis.
+// Unknown transactions, underpaying ones and transactions already credited to
+// a peer are dropped, as are all proofs when no transaction source is configured.
+func (bps *BSVPaymentSystem) VerifyPaymentProof(fromPeer string, txID string, pieceIndex uint32, onVerified func()) {
+	if bps.config.TxFetchURLFormat == "" {
+		log.Printf("[BSV] Ignoring payment proof from %s: no transaction source configured to verify it", fromPeer)
+		return
+	}
+	if id, err := hex.DecodeString(txID); err != nil || len(id) != 32 {
+		log.Printf("[BSV] Ignoring payment proof from %s: invalid txid %q", fromPeer, txID)
+		return
+	}
+
+	bps.mu.Lock()
+	credited := bps.verifying[txID] || len(bps.verifying) >= maxPaymentVerifications
+	for _, payments := range bps.receivedPayments {
+		for _, payment := range payments {
+			credited = credited || payment.TxID == txID
+		}
+	}
+	if !credited {
+		bps.verifying[txID] = true
+	}
+	bps.mu.Unlock()
+	if credited {
+		log.Printf("[BSV] Ignoring payment proof from %s: txid %s is already credited or being checked", fromPeer, txID)
+		return
+	}
+
+	go func() {
+		err := bps.checkPaymentTransaction(txID)
+
+		bps.mu.Lock()
+		delete(bps.verifying, txID)
+		bps.mu.Unlock()
+
+		if err != nil {
+			log.Printf("[BSV] Rejected payment proof from %s: txid %s: %v", fromPeer, txID, err)
+			return
+		}
+		bps.RecordPaymentProof(fromPeer, txID, pieceIndex)
+		if onVerified != nil {
+			onVerified()
+		}
+	}()
+}
+
+// checkPaymentTransaction fetches a transaction and checks that one of its
+// outputs pays our address at least MinPaymentSatoshis
+func (bps *BSVPaymentSystem) checkPaymentTransaction(txID string) error {
+	networkStr := "main"
+	if bps.isTestnet {
+		networkStr = "test"
+	}
+	fetchURL := fmt.Sprintf(bps.config.TxFetchURLFormat, networkStr, txID)
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Get(fetchURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch transaction from %s: %v", fetchURL, err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read transaction from %s: %v", fetchURL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("transaction fetch from %s failed with status %s", fetchURL, resp.Status)
+	}
+
+	tx, err := transaction.NewTransactionFromHex(strings.TrimSpace(string(bodyBytes)))
+	if err != nil {
+		return fmt.Errorf("invalid transaction from %s: %v", fetchURL, err)
+	}
+	if tx.TxID().String() != txID {
+		return fmt.Errorf("transaction from %s has txid %s", fetchURL, tx.TxID().String())
+	}
+
+	address, err := script.NewAddressFromString(bps.GetAddress())
+	if err != nil {
+		return fmt.Errorf("failed to parse our address: %v", err)
+	}
+	lockingScript, err := p2pkh.Lock(address)
+	if err != nil {
+		return fmt.Errorf("failed to create our locking script: %v", err)
+	}
+	for _, output := range tx.Outputs {
+		if output.LockingScript != nil && output.LockingScript.Equals(lockingScript) &&
+			output.Satoshis >= uint64(bps.config.MinPaymentSatoshis) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no output pays %s at least %d satoshis", address.AddressString, bps.config.MinPaymentSatoshis)
+}
+
+// RecordPaymentProof records a verified payment proof sent by a peer. The
+// choker gives peers with recent payments reserved upload slots.
+func (bps *BSVPaymentSystem) RecordPaymentProof(fromPeer string, txID string, pieceIndex uint32) {
+	bps.mu.Lock()
+	defer bps.mu.Unlock()
+
+	now := time.Now()
+	payments := bps.receivedPayments[fromPeer]
+
+	// Drop expired proofs and keep the list bounded
+	kept := payments[:0]
+	for _, payment := range payments {
+		if now.Sub(payment.ReceivedAt) < receivedPaymentRetention {
+			kept = append(kept, payment)
+		}
+	}
+	if len(kept) >= maxReceivedPaymentsPerPeer {
+		kept = kept[len(kept)-maxReceivedPaymentsPerPeer+1:]
+	}
+
+	bps.receivedPayments[fromPeer] = append(kept, ReceivedPayment{
+		TxID:       txID,
+		PieceIndex: pieceIndex,
+		ReceivedAt: now,
+	})
+
+	log.Printf("[BSV] Recorded payment proof from %s: txid %s for piece %d", fromPeer, txID, pieceIndex)
+}
+
+// RestorePaymentProof re-adds a payment proof saved before a restart. Proofs
+// older than the retention period are dropped.
+func (bps *BSVPaymentSystem) RestorePaymentProof(fromPeer string, payment ReceivedPayment) {
+	if time.Since(payment.ReceivedAt) >= receivedPaymentRetention {
+		return
+	}
+
+	bps.mu.Lock()
+	defer bps.mu.Unlock()
+
+	payments := bps.receivedPayments[fromPeer]
+	for _, existing := range payments {
+		if existing.TxID == payment.TxID && existing.PieceIndex == payment.PieceIndex {
+			return
+		}
+	}
+	payments = append(payments, payment)
+	sort.Slice(payments, func(i, j int) bool { return payments[i].ReceivedAt.Before(payments[j].ReceivedAt) })
+	if len(payments) > maxReceivedPaymentsPerPeer {
+		payments = payments[len(payments)-maxReceivedPaymentsPerPeer:]
+	}
+	bps.receivedPayments[fromPeer] = payments
+}
+
+// HasRecentPayment reports whether a peer's payment proof was verified within window
+func (bps *BSVPaymentSystem) HasRecentPayment(peer string, window time.Duration) bool {
+	bps.mu.RLock()
+	defer bps.mu.RUnlock()
+
+	payments := bps.receivedPayments[peer]
+	return len(payments) > 0 && time.Since(payments[len(payments)-1].ReceivedAt) < window
+}
+
+// RegisterHandlers routes payment messages from peers to the payment system
+func (bps *BSVPaymentSystem) RegisterHandlers(r *MessageRegistry) error {
+	if err := r.Register(MsgTypePaymentRequest, "payment request",
+		ProtobufDecoder(func() proto.Message { return &messages.PaymentRequestMsg{} }),
+		func(ctx *MessageContext, payload proto.Message) error {
+			paymentReq := payload.(*messages.PaymentRequestMsg)
+			log.Printf("Payment request from %s: %d satoshis for piece %d",
+				ctx.Peer.accountKey(), paymentReq.AmountSatoshis, paymentReq.PieceIndex)
+			return nil
+		}); err != nil {
+		return err
+	}
+
+	if err := r.Register(MsgTypePaymentProof, "payment proof",
+		ProtobufDecoder(func() proto.Message { return &messages.PaymentProofMsg{} }),
+		func(ctx *MessageContext, payload proto.Message) error {
+			paymentProof := payload.(*messages.PaymentProofMsg)
+			log.Printf("Payment proof from %s: tx %x for piece %d",
+				ctx.Peer.accountKey(), paymentProof.TransactionId, paymentProof.PieceIndex)
+			txID := hex.EncodeToString(paymentProof.TransactionId)
+			conn, peer, choker := ctx.Peer, ctx.Peer.accountKey(), ctx.Session.choker
+			bps.VerifyPaymentProof(peer, txID, paymentProof.PieceIndex, func() {
+				conn.torrent.RecordPayment(paymentProof.PieceIndex, peer, txID)
+				choker.Trigger()
+				// The paid piece can be fetched right away, before the next choking round
+				if err := conn.allowFast(paymentProof.PieceIndex); err != nil {
+					log.Printf("[BSV] Failed to allow paid piece %d to %s: %v", paymentProof.PieceIndex, peer, err)
+				}
+			})
+			return nil
+		}); err != nil {
+		return err
+	}
+
+	return r.Register(MsgTypeTokenBalance, "token balance",
+		ProtobufDecoder(func() proto.Message { return &messages.TokenBalanceMsg{} }),
+		func(ctx *MessageContext, payload proto.Message) error {
+			tokenBalance := payload.(*messages.TokenBalanceMsg)
+			log.Printf("Token balance from %s: %d $NERD tokens, quality score: %d",
+				ctx.Peer.accountKey(), tokenBalance.NerdBalance, tokenBalance.QualityScore)
+			return nil
+		})
+}
+
 // Helper functions
 
 func generatePaymentID() string {
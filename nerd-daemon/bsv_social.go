@@ -92,6 +92,7 @@ type CreatorProfile struct {
 	ContentCount   uint32    `json:"content_count"`
 	TotalEarnings  uint64    `json:"total_earnings"`
 	FollowerCount  uint32    `json:"follower_count"`
+	Signature      []byte    `json:"bsv_signature,omitempty"` // Creator's signature, so the profile can be passed on
 }
 
 // Social message type constants (200-299)
@@ -266,6 +267,37 @@ func (s *BSVSocialSystem) ProcessSocialMessage(msgType uint32, payload []byte) e
 	}
 }
 
+// RegisterHandlers routes social protocol messages (200-208) from peers to
+// ProcessSocialMessage. Messages that fail verification are logged and dropped
+// without closing the connection.
+func (s *BSVSocialSystem) RegisterHandlers(r *MessageRegistry) error {
+	names := map[uint32]string{
+		SocialFollowMsgType:       "social follow",
+		SocialCommentMsgType:      "social comment",
+		SocialReactionMsgType:     "social reaction",
+		SocialShareMsgType:        "social share",
+		SocialNotificationMsgType: "social notification",
+		SocialDirectMsgType:       "social direct message",
+		SocialProfileMsgType:      "social profile",
+		SocialStatusMsgType:       "social status",
+		SocialDiscoveryMsgType:    "social discovery",
+	}
+
+	handler := func(ctx *MessageContext, _ proto.Message) error {
+		if err := s.ProcessSocialMessage(ctx.Message.MessageId, ctx.Message.Payload); err != nil {
+			log.Printf("Social: Dropped message type %d from %s: %v", ctx.Message.MessageId, ctx.Peer.accountKey(), err)
+		}
+		return nil
+	}
+	for msgType, name := range names {
+		// ProcessSocialMessage decodes the payload itself
+		if err := r.Register(msgType, name, nil, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Social message handlers
 func (s *BSVSocialSystem) handleFollowMessage(msg *messages.SocialFollowMsg) error {
 	// Verify BSV signature
@@ -427,6 +459,7 @@ func (s *BSVSocialSystem) handleProfileMessage(msg *messages.SocialProfileMsg) e
 		ContentCount:   msg.ContentCount,
 		TotalEarnings:  msg.TotalEarnings,
 		FollowerCount:  msg.FollowerCount,
+		Signature:      msg.BsvSignature,
 	}
 
 	s.socialGraph.mu.Lock()
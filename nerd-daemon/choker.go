@@ -0,0 +1,241 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Choking algorithm parameters
+const (
+	ChokeInterval             = 10 * time.Second // How often unchoke slots are reassigned
+	OptimisticUnchokeInterval = 30 * time.Second // How long an optimistic unchoke lasts
+	UploadSlots               = 4                // Peers unchoked for reciprocity
+	PaidUploadSlots           = 2                // Slots reserved for peers that paid recently
+	PaymentWindow             = 10 * time.Minute // How recent a payment must be to earn a paid slot
+	NewcomerPeriod            = time.Minute      // Peers connected this recently are favoured for optimistic unchokes
+)
+
+// Choker decides which interested peers we upload to, across every torrent in a session.
+// Paid slots go to peers with recent BSV payments, regular slots to the peers
+// with the best reciprocity (download rate from them while we leech, upload
+// rate to them while we seed), and one optimistic slot rotates among the rest.
+type Choker struct {
+	session      *Session
+	optimistic   *PeerConn
+	optimisticAt time.Time
+	lastTotals   map[*PeerConn]int64 // Transfer totals at the previous timed round, for rates
+	rates        map[*PeerConn]int64 // Bytes per second measured at the previous timed round
+	measuredAt   time.Time           // When lastTotals were taken
+	trigger      chan struct{}
+	stop         chan struct{}
+	stopOnce     sync.Once
+	mu           sync.Mutex // Serialises rounds
+}
+
+// chokeCandidate is an interested peer ranked in a choking round
+type chokeCandidate struct {
+	pc   *PeerConn
+	rate int64 // Bytes per second over the last measured interval
+	paid bool
+}
+
+// NewChoker creates a choker for the session's peers
+func NewChoker(session *Session) *Choker {
+	return &Choker{
+		session:    session,
+		lastTotals: make(map[*PeerConn]int64),
+		rates:      make(map[*PeerConn]int64),
+		trigger:    make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+}
+
+// Start runs choking rounds every ChokeInterval and whenever triggered. Rates
+// are only measured on the timed rounds; triggered rounds reuse them.
+func (c *Choker) Start() {
+	go func() {
+		ticker := time.NewTicker(ChokeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.rechoke(true)
+			case <-c.trigger:
+				c.rechoke(false)
+			}
+		}
+	}()
+}
+
+// Stop ends the choking rounds
+func (c *Choker) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+// Trigger asks for a round soon, e.g. when a peer becomes interested or leaves
+func (c *Choker) Trigger() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// rechoke assigns upload slots and sends Choke/Unchoke to peers whose state
+// changed. With measure set it first updates every peer's rate from the bytes
+// transferred since the previous measuring round.
+func (c *Choker) rechoke(measure bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	var peers []*PeerConn
+	var candidates []chokeCandidate
+	totals := make(map[*PeerConn]int64)
+	rates := make(map[*PeerConn]int64)
+
+	for _, torrent := range c.session.Torrents() {
+		seeding := torrent.IsComplete()
+		for _, pc := range torrent.connectedPeers() {
+			peers = append(peers, pc)
+
+			uploaded, downloaded := pc.state.TransferTotals()
+			total := downloaded
+			if seeding {
+				total = uploaded // Seeds favour the peers that take data fastest
+			}
+			totals[pc] = total
+			rates[pc] = c.rates[pc]
+			if measure {
+				rates[pc] = c.measureRate(pc, total, now)
+			}
+
+			if !pc.state.PeerInterested() {
+				continue
+			}
+
+			candidates = append(candidates, chokeCandidate{
+				pc:   pc,
+				rate: rates[pc],
+				paid: c.hasPaid(pc),
+			})
+		}
+	}
+	if measure {
+		c.lastTotals = totals
+		c.measuredAt = now
+	}
+	c.rates = rates // Also forgets peers that disconnected
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].rate > candidates[j].rate
+	})
+
+	// Paid slots first, then reciprocity; paying peers beyond their slots compete normally
+	unchoke := make(map[*PeerConn]string)
+	paidSlots := PaidUploadSlots
+	for _, cand := range candidates {
+		if cand.paid && paidSlots > 0 {
+			unchoke[cand.pc] = "paid"
+			paidSlots--
+		}
+	}
+	regularSlots := UploadSlots
+	for _, cand := range candidates {
+		if regularSlots == 0 {
+			break
+		}
+		if _, ok := unchoke[cand.pc]; !ok {
+			unchoke[cand.pc] = "reciprocity"
+			regularSlots--
+		}
+	}
+
+	// Keep the optimistic peer for its full period unless it left, lost
+	// interest or earned a regular slot
+	_, earned := unchoke[c.optimistic]
+	if earned || !c.isCandidate(c.optimistic, candidates) || now.Sub(c.optimisticAt) >= OptimisticUnchokeInterval {
+		c.optimistic = c.pickOptimistic(candidates, unchoke, now)
+		c.optimisticAt = now
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = "optimistic"
+	}
+
+	for _, pc := range peers {
+		reason, unchoked := unchoke[pc]
+		changed, err := pc.setChoking(!unchoked)
+		if err != nil {
+			log.Printf("[Choker] Failed to update choke state of %s: %v", pc.addr, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if unchoked {
+			log.Printf("[Choker] Unchoked %s (%s)", pc.addr, reason)
+		} else {
+			log.Printf("[Choker] Choked %s", pc.addr)
+		}
+	}
+}
+
+// measureRate returns the bytes per second transferred with the peer since the
+// previous measuring round, or since it connected if that was later
+func (c *Choker) measureRate(pc *PeerConn, total int64, now time.Time) int64 {
+	since := c.measuredAt
+	if connectedAt := pc.state.ConnectedAt(); connectedAt.After(since) {
+		since = connectedAt
+	}
+	elapsed := now.Sub(since)
+	if elapsed < time.Second {
+		elapsed = time.Second // Too short to measure; avoid inflating the first bytes
+	}
+	return int64(float64(max(total-c.lastTotals[pc], 0)) / elapsed.Seconds())
+}
+
+// hasPaid reports whether the peer sent a payment proof within PaymentWindow
+func (c *Choker) hasPaid(pc *PeerConn) bool {
+	bsvSystem := c.session.bsvSystem
+	return bsvSystem != nil && bsvSystem.HasRecentPayment(pc.accountKey(), PaymentWindow)
+}
+
+// isCandidate reports whether pc is among this round's interested peers
+func (c *Choker) isCandidate(pc *PeerConn, candidates []chokeCandidate) bool {
+	for _, cand := range candidates {
+		if cand.pc == pc {
+			return true
+		}
+	}
+	return false
+}
+
+// pickOptimistic chooses a random interested peer without a slot; newcomers
+// are three times as likely to be picked so they can get their first pieces
+func (c *Choker) pickOptimistic(candidates []chokeCandidate, unchoke map[*PeerConn]string, now time.Time) *PeerConn {
+	var pool []*PeerConn
+	for _, cand := range candidates {
+		if _, ok := unchoke[cand.pc]; ok {
+			continue
+		}
+		weight := 1
+		if now.Sub(cand.pc.state.ConnectedAt()) < NewcomerPeriod {
+			weight = 3
+		}
+		for i := 0; i < weight; i++ {
+			pool = append(pool, cand.pc)
+		}
+	}
+
+	if len(pool) == 0 {
+		return nil
+	}
+	return pool[rand.Intn(len(pool))]
+}
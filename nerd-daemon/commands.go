@@ -0,0 +1,671 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runCommand handles command-line subcommands and returns the process exit code.
+// Commands are sent to a running daemon through the control API; if none is
+// running they are applied to the data directory so the next start picks them up.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "create":
+		return runCreateCommand(args[1:])
+	case "add":
+		return runAddCommand(args[1:])
+	case "magnet":
+		return runMagnetCommand(args[1:])
+	case "mode":
+		return runModeCommand(args[1:])
+	case "limit":
+		return runLimitCommand(args[1:])
+	case "dht-put":
+		return runDHTPutCommand(args[1:])
+	case "dht-get":
+		return runDHTGetCommand(args[1:])
+	case "dht-query":
+		return runDHTQueryCommand(args[1:])
+	case "help", "-h", "--help":
+		printUsage(os.Stdout)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		printUsage(os.Stderr)
+		return 2
+	}
+}
+
+// printUsage lists the available subcommands
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage:")
+	fmt.Fprintln(w, "  nerd-daemon                                   Run the daemon")
+	fmt.Fprintln(w, "  nerd-daemon create [options] <file-or-dir>    Create a .torrent and seed it")
+	fmt.Fprintln(w, "  nerd-daemon add [options] <file.torrent>      Add a .torrent to the daemon")
+	fmt.Fprintln(w, "  nerd-daemon magnet [options] <magnet-uri>     Add a magnet link to the daemon")
+	fmt.Fprintln(w, "  nerd-daemon mode <info-hash> <mode>           Pick pieces rarest-first or sequential (streaming)")
+	fmt.Fprintln(w, "  nerd-daemon limit [options] [info-hash]       Show or change global, per-peer or torrent rate limits")
+	fmt.Fprintln(w, "  nerd-daemon dht-put [options] [value]         Store a value in the DHT (BEP 44)")
+	fmt.Fprintln(w, "  nerd-daemon dht-get [options] <key>           Fetch a value from the DHT by key or public key")
+	fmt.Fprintln(w, "  nerd-daemon dht-query [options] <addr> <q>    Ask a NERD overlay node for its quality, balance or a profile")
+}
+
+// runCreateCommand implements "nerd-daemon create"
+func runCreateCommand(args []string) int {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	output := fs.String("o", "", "Output .torrent path (default: <data dir>/torrents/<name>.torrent)")
+	pieceLength := fs.Int64("piece-length", 0, "Piece length in bytes (default: chosen from content size)")
+	comment := fs.String("comment", "", "Comment stored in the torrent")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: nerd-daemon create [options] <file-or-dir>")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	sourcePath, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid path: %v\n", err)
+		return 1
+	}
+	outPath := *output
+	if outPath != "" {
+		if outPath, err = filepath.Abs(outPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid output path: %v\n", err)
+			return 1
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	form := url.Values{}
+	form.Set("source_path", sourcePath)
+	form.Set("output_path", outPath)
+	form.Set("comment", *comment)
+	if *pieceLength > 0 {
+		form.Set("piece_length", strconv.FormatInt(*pieceLength, 10))
+	}
+
+	status, err := postControl(cfg, "/torrents/create", form)
+	if err == errDaemonNotRunning {
+		// No daemon to hand the torrent to; create and register it for the next start
+		opts := NewCreateTorrentOptions(cfg, sourcePath)
+		opts.PieceLength = *pieceLength
+		opts.Comment = *comment
+
+		var torrent *Torrent
+		torrent, err = offlineSession(cfg).CreateAndSeed(opts, outPath)
+		if err == nil {
+			s := torrent.Status()
+			status = &s
+			fmt.Println("Daemon not running; torrent will be seeded on next start")
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create torrent: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Created torrent %s\n", status.Name)
+	fmt.Printf("Info hash: %s\n", status.InfoHash)
+	fmt.Printf("Pieces:    %d\n", status.Pieces)
+	return 0
+}
+
+// runAddCommand implements "nerd-daemon add"
+func runAddCommand(args []string) int {
+	fs := flag.NewFlagSet("add", flag.ContinueOnError)
+	savePath := fs.String("save", "", "Directory holding (or receiving) the torrent data (default: data dir)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: nerd-daemon add [options] <file.torrent>")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	torrentPath, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid path: %v\n", err)
+		return 1
+	}
+	save := *savePath
+	if save != "" {
+		if save, err = filepath.Abs(save); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid save path: %v\n", err)
+			return 1
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	form := url.Values{}
+	form.Set("torrent_file", torrentPath)
+	form.Set("save_path", save)
+
+	status, err := postControl(cfg, "/torrents/add", form)
+	if err == errDaemonNotRunning {
+		var torrent *Torrent
+		torrent, err = offlineSession(cfg).AddTorrentFile(torrentPath, save)
+		if err == nil {
+			s := torrent.Status()
+			status = &s
+			fmt.Println("Daemon not running; torrent will be loaded on next start")
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to add torrent: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Added torrent %s\n", status.Name)
+	fmt.Printf("Info hash: %s\n", status.InfoHash)
+	fmt.Printf("Have:      %d/%d pieces\n", status.Have, status.Pieces)
+	return 0
+}
+
+// runMagnetCommand implements "nerd-daemon magnet"
+func runMagnetCommand(args []string) int {
+	fs := flag.NewFlagSet("magnet", flag.ContinueOnError)
+	savePath := fs.String("save", "", "Directory receiving the torrent data (default: data dir)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: nerd-daemon magnet [options] <magnet-uri>")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	save := *savePath
+	if save != "" {
+		var err error
+		if save, err = filepath.Abs(save); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid save path: %v\n", err)
+			return 1
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	form := url.Values{}
+	form.Set("magnet", fs.Arg(0))
+	form.Set("save_path", save)
+
+	status, err := postControl(cfg, "/torrents/magnet", form)
+	if err == errDaemonNotRunning {
+		var torrent *Torrent
+		torrent, err = offlineSession(cfg).AddMagnet(fs.Arg(0), save)
+		if err == nil {
+			s := torrent.Status()
+			status = &s
+			fmt.Println("Daemon not running; metadata will be fetched on next start")
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to add magnet: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Added magnet %s\n", status.Name)
+	fmt.Printf("Info hash: %s\n", status.InfoHash)
+	return 0
+}
+
+// runModeCommand implements "nerd-daemon mode"
+func runModeCommand(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: nerd-daemon mode <info-hash> <%s|%s>\n", PickRarestFirst, PickSequential)
+		return 2
+	}
+
+	infoHash, err := parseInfoHash(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid info hash: %v\n", err)
+		return 2
+	}
+	mode, err := ParsePickMode(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	form := url.Values{}
+	form.Set("info_hash", args[0])
+	form.Set("mode", mode)
+
+	_, err = postControl(cfg, "/torrents/mode", form)
+	if err == errDaemonNotRunning {
+		err = offlineSession(cfg).SetPickMode(infoHash, mode)
+		if err == nil {
+			fmt.Println("Daemon not running; mode will apply on next start")
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set mode: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Torrent %s now picks pieces %s\n", args[0], mode)
+	return 0
+}
+
+// runLimitCommand implements "nerd-daemon limit". Without options it shows the
+// daemon's limits; with an info hash it changes that torrent's limits.
+func runLimitCommand(args []string) int {
+	fs := flag.NewFlagSet("limit", flag.ContinueOnError)
+	fs.String("up", "", "Upload limit, e.g. 512K, 2M or unlimited")
+	fs.String("down", "", "Download limit")
+	fs.String("peer-up", "", "Upload limit of each connection (not with an info hash)")
+	fs.String("peer-down", "", "Download limit of each connection (not with an info hash)")
+	fs.String("schedule", "", "Comma-separated windows such as \"unlimited 01:00-07:00\"; empty clears (not with an info hash)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: nerd-daemon limit [options] [info-hash]")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	// Only the options given are sent, so the others keep their current values
+	fields := map[string]string{
+		"up":        "upload_rate",
+		"down":      "download_rate",
+		"peer-up":   "peer_upload_rate",
+		"peer-down": "peer_download_rate",
+	}
+	form := url.Values{}
+	var invalid error
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "schedule" {
+			form["schedule"] = strings.Split(f.Value.String(), ",")
+			return
+		}
+		if _, err := ParseRate(f.Value.String()); err != nil && invalid == nil {
+			invalid = fmt.Errorf("-%s: %v", f.Name, err)
+		}
+		form.Set(fields[f.Name], f.Value.String())
+	})
+	if invalid != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", invalid)
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	if fs.NArg() == 1 {
+		return setTorrentLimits(cfg, fs.Arg(0), form)
+	}
+
+	var status RateLimitStatus
+	if len(form) == 0 {
+		err = getControlJSON(cfg, "/limits", &status)
+	} else {
+		err = postControlJSON(cfg, "/limits", form, &status)
+	}
+	if err == errDaemonNotRunning {
+		fmt.Fprintln(os.Stderr, "Daemon not running; set global limits under rate_limits in config.json")
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set limits: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Global:     upload %s, download %s\n", FormatRate(status.Global.Upload), FormatRate(status.Global.Download))
+	fmt.Printf("Per peer:   upload %s, download %s\n", FormatRate(status.Peer.Upload), FormatRate(status.Peer.Download))
+	for _, window := range status.Schedule {
+		fmt.Printf("Schedule:   %s\n", window)
+	}
+	if status.Active != "" {
+		fmt.Printf("In force:   upload %s, download %s (%s)\n",
+			FormatRate(status.Current.Upload), FormatRate(status.Current.Download), status.Active)
+	}
+	return 0
+}
+
+// runDHTPutCommand implements "nerd-daemon dht-put"
+func runDHTPutCommand(args []string) int {
+	fs := flag.NewFlagSet("dht-put", flag.ContinueOnError)
+	file := fs.String("file", "", "Read the value from a file instead of the command line")
+	mutable := fs.Bool("mutable", false, "Sign the value with the daemon's item key so it can be replaced later")
+	salt := fs.String("salt", "", "Salt telling apart several mutable items of one key")
+	cas := fs.Int64("cas", 0, "Only replace the mutable item if its sequence number is still this")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 || (*file == "") != (fs.NArg() == 1) {
+		fmt.Fprintln(os.Stderr, "Usage: nerd-daemon dht-put [options] <value>")
+		fmt.Fprintln(os.Stderr, "       nerd-daemon dht-put [options] -file <path>")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	value := []byte(fs.Arg(0))
+	if *file != "" {
+		var err error
+		if value, err = os.ReadFile(*file); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read value: %v\n", err)
+			return 1
+		}
+	}
+
+	form := url.Values{}
+	form.Set("value", string(value))
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "salt":
+			form.Set("salt", *salt)
+		case "cas":
+			form.Set("cas", strconv.FormatInt(*cas, 10))
+		}
+	})
+	if *mutable {
+		form.Set("mutable", "true")
+	} else if form.Has("salt") || form.Has("cas") {
+		fmt.Fprintln(os.Stderr, "-salt and -cas need -mutable")
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	var item DHTItemStatus
+	err = postControlJSON(cfg, "/dht/items", form, &item)
+	if err == errDaemonNotRunning {
+		fmt.Fprintln(os.Stderr, "Daemon not running; the DHT is only reachable through a running daemon")
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to store value: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Key: %s\n", item.Key)
+	if item.Mutable {
+		fmt.Printf("Public key: %s\n", item.PublicKey)
+		fmt.Printf("Sequence: %d\n", item.Seq)
+	}
+	return 0
+}
+
+// runDHTGetCommand implements "nerd-daemon dht-get". A 40-character hex key
+// fetches an immutable item, a 64-character public key the latest mutable
+// item under it. The value is written to stdout.
+func runDHTGetCommand(args []string) int {
+	fs := flag.NewFlagSet("dht-get", flag.ContinueOnError)
+	salt := fs.String("salt", "", "Salt of the mutable item")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: nerd-daemon dht-get [options] <key|public-key>")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	query := url.Values{}
+	switch key := fs.Arg(0); len(key) {
+	case 40:
+		query.Set("key", key)
+	case 64:
+		query.Set("public_key", key)
+		query.Set("salt", *salt)
+	default:
+		fmt.Fprintln(os.Stderr, "Expected a 40-character key or a 64-character public key")
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	var item DHTItemStatus
+	err = getControlJSON(cfg, "/dht/items?"+query.Encode(), &item)
+	if err == errDaemonNotRunning {
+		fmt.Fprintln(os.Stderr, "Daemon not running; the DHT is only reachable through a running daemon")
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to fetch value: %v\n", err)
+		return 1
+	}
+
+	if item.Mutable {
+		fmt.Fprintf(os.Stderr, "Key %s, sequence %d\n", item.Key, item.Seq)
+	}
+	os.Stdout.Write(item.Value)
+	return 0
+}
+
+// runDHTQueryCommand implements "nerd-daemon dht-query". The node's answer is
+// written to stdout as JSON.
+func runDHTQueryCommand(args []string) int {
+	fs := flag.NewFlagSet("dht-query", flag.ContinueOnError)
+	creator := fs.String("creator", "", "Creator address of the profile to fetch")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: nerd-daemon dht-query [options] <host:port> quality|balance|profile")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	query := url.Values{}
+	query.Set("addr", fs.Arg(0))
+	query.Set("query", fs.Arg(1))
+	if *creator != "" {
+		query.Set("creator", *creator)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	var reply json.RawMessage
+	err = getControlJSON(cfg, "/dht/nerd?"+query.Encode(), &reply)
+	if err == errDaemonNotRunning {
+		fmt.Fprintln(os.Stderr, "Daemon not running; the DHT is only reachable through a running daemon")
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query failed: %v\n", err)
+		return 1
+	}
+
+	out, _ := json.MarshalIndent(reply, "", "  ")
+	fmt.Println(string(out))
+	return 0
+}
+
+// setTorrentLimits applies the upload and download limits in form to one torrent
+func setTorrentLimits(cfg *Config, hash string, form url.Values) int {
+	infoHash, err := parseInfoHash(hash)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid info hash: %v\n", err)
+		return 2
+	}
+	for _, field := range []string{"peer_upload_rate", "peer_download_rate", "schedule"} {
+		if _, present := form[field]; present {
+			fmt.Fprintln(os.Stderr, "Per-peer limits and the schedule apply to the whole daemon, not one torrent")
+			return 2
+		}
+	}
+	form.Set("info_hash", hash)
+
+	var limits RateLimits
+	status, err := postControl(cfg, "/torrents/limits", form)
+	if err == errDaemonNotRunning {
+		limits, err = setOfflineTorrentLimits(cfg, infoHash, form)
+		if err == nil {
+			fmt.Println("Daemon not running; limits will apply on next start")
+		}
+	} else if err == nil {
+		limits = status.RateLimits
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set limits: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Torrent %s: upload %s, download %s\n", hash, FormatRate(limits.Upload), FormatRate(limits.Download))
+	return 0
+}
+
+// setOfflineTorrentLimits records a registered torrent's limits for the next start
+func setOfflineTorrentLimits(cfg *Config, infoHash [20]byte, form url.Values) (RateLimits, error) {
+	session := offlineSession(cfg)
+	limits, registered := session.TorrentRateLimits(infoHash)
+	if !registered {
+		return limits, fmt.Errorf("torrent %x is not in the session", infoHash)
+	}
+
+	// The rates were validated when the form was built
+	if form.Has("upload_rate") {
+		limits.Upload, _ = ParseRate(form.Get("upload_rate"))
+	}
+	if form.Has("download_rate") {
+		limits.Download, _ = ParseRate(form.Get("download_rate"))
+	}
+	return limits, session.SetTorrentRateLimits(infoHash, limits)
+}
+
+// offlineSession opens the data directory's registry without a running daemon
+func offlineSession(config *Config) *Session {
+	session := NewSession(config.DataDir, config.Port, nil, nil)
+	if err := session.KeepRegistry(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	return session
+}
+
+// errDaemonNotRunning is returned by postControl when no daemon answers on the control port
+var errDaemonNotRunning = fmt.Errorf("daemon not running")
+
+// postControl sends a form to the running daemon's control API and decodes the torrent status reply
+func postControl(config *Config, path string, form url.Values) (*TorrentStatus, error) {
+	var status TorrentStatus
+	if err := postControlJSON(config, path, form, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// postControlJSON sends a form to the running daemon's control API and decodes the reply into v
+func postControlJSON(config *Config, path string, form url.Values, v interface{}) error {
+	if config.ControlPort == 0 {
+		return errDaemonNotRunning
+	}
+
+	req, err := newControlRequest(config, "POST", path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{Timeout: 10 * time.Minute} // Hashing large content can take a while
+	resp, err := client.Do(req)
+	return decodeControlReply(resp, err, v)
+}
+
+// getControlJSON queries the running daemon's control API and decodes the reply into v
+func getControlJSON(config *Config, path string, v interface{}) error {
+	if config.ControlPort == 0 {
+		return errDaemonNotRunning
+	}
+
+	req, err := newControlRequest(config, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: DHTItemTimeout + 10*time.Second} // DHT lookups take a while
+	resp, err := client.Do(req)
+	return decodeControlReply(resp, err, v)
+}
+
+// newControlRequest builds a control API request carrying the token from the data directory
+func newControlRequest(config *Config, method, path string, body io.Reader) (*http.Request, error) {
+	token, err := LoadControlToken(filepath.Join(config.DataDir, ControlTokenFile))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, controlURL(config, path), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(ControlTokenHeader, token)
+	return req, nil
+}
+
+// controlURL returns the address of a control API path on the loopback interface
+func controlURL(config *Config, path string) string {
+	return fmt.Sprintf("http://127.0.0.1:%d%s", config.ControlPort, path)
+}
+
+// decodeControlReply turns a control API response into v, or an error
+func decodeControlReply(resp *http.Response, err error, v interface{}) error {
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return errDaemonNotRunning
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s", string(body))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response from daemon: %v", err)
+	}
+	return nil
+}
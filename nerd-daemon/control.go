@@ -0,0 +1,595 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Control API authentication
+const (
+	ControlTokenFile   = "control.token" // Under the data directory; readable only by the daemon's user
+	ControlTokenHeader = "X-NERD-Token"  // Every control API request carries the token in this header
+)
+
+// ControlServer exposes the daemon's local HTTP control API (used by the
+// desktop app and the command line)
+type ControlServer struct {
+	config     *Config
+	session    *Session
+	httpServer *http.Server
+	token      string // Shared secret from ControlTokenFile
+}
+
+// LoadControlToken reads the control API token from path, creating a random
+// one if the file does not exist yet
+func LoadControlToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(data))
+		if len(token) != 64 {
+			return "", fmt.Errorf("invalid control API token in %s", path)
+		}
+		return token, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate control API token: %v", err)
+	}
+	token := hex.EncodeToString(secret)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to save control API token: %v", err)
+	}
+	return token, nil
+}
+
+// NewControlServer creates a control API server for a session
+func NewControlServer(config *Config, session *Session) *ControlServer {
+	return &ControlServer{
+		config:  config,
+		session: session,
+	}
+}
+
+// Start begins serving the control API on the loopback interface
+func (cs *ControlServer) Start() error {
+	token, err := LoadControlToken(filepath.Join(cs.config.DataDir, ControlTokenFile))
+	if err != nil {
+		return err
+	}
+	cs.token = token
+
+	mux := http.NewServeMux()
+
+	// Torrent management
+	mux.HandleFunc("/torrents", cs.handleListTorrents)
+	mux.HandleFunc("/torrents/add", cs.handleAddTorrent)
+	mux.HandleFunc("/torrents/magnet", cs.handleAddMagnet)
+	mux.HandleFunc("/torrents/create", cs.handleCreateTorrent)
+	mux.HandleFunc("/torrents/remove", cs.handleRemoveTorrent)
+	mux.HandleFunc("/torrents/mode", cs.handleSetPickMode)
+	mux.HandleFunc("/torrents/limits", cs.handleSetTorrentLimits)
+
+	// Connections
+	mux.HandleFunc("/peers", cs.handleListPeers)
+
+	// Bandwidth
+	mux.HandleFunc("/limits", cs.handleLimits)
+
+	// DHT storage
+	mux.HandleFunc("/dht/items", cs.handleDHTItems)
+	mux.HandleFunc("/dht/nerd", cs.handleNERDQuery)
+
+	cs.httpServer = &http.Server{
+		Addr:    fmt.Sprintf("127.0.0.1:%d", cs.config.ControlPort),
+		Handler: cs.authorize(mux),
+	}
+
+	listener, err := net.Listen("tcp", cs.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := cs.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("[Control] HTTP server error: %v", err)
+		}
+	}()
+
+	log.Printf("[Control] Control API listening on http://%s", cs.httpServer.Addr)
+	return nil
+}
+
+// authorize rejects requests that do not carry the control token, and requests
+// addressed to a host name other than the loopback interface, which a web page
+// could send through DNS rebinding
+func (cs *ControlServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopbackHost(r.Host) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		token := r.Header.Get(ControlTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cs.token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackHost reports whether a request's Host header names the loopback interface
+func isLoopbackHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// Stop shuts down the control API
+func (cs *ControlServer) Stop() {
+	if cs.httpServer != nil {
+		cs.httpServer.Close()
+	}
+}
+
+// handleListTorrents returns the status of every torrent in the session
+func (cs *ControlServer) handleListTorrents(w http.ResponseWriter, r *http.Request) {
+	var statuses []TorrentStatus
+	for _, torrent := range cs.session.Torrents() {
+		statuses = append(statuses, torrent.Status())
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// handleAddTorrent adds a .torrent file to the session
+func (cs *ControlServer) handleAddTorrent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	torrentFile := r.FormValue("torrent_file")
+	if torrentFile == "" {
+		http.Error(w, "Missing torrent_file", http.StatusBadRequest)
+		return
+	}
+
+	torrent, err := cs.session.AddTorrentFile(torrentFile, r.FormValue("save_path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, torrent.Status())
+}
+
+// handleAddMagnet adds a torrent from a magnet link and connects to any peers it lists
+func (cs *ControlServer) handleAddMagnet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	uri := r.FormValue("magnet")
+	if uri == "" {
+		http.Error(w, "Missing magnet", http.StatusBadRequest)
+		return
+	}
+
+	torrent, err := cs.session.AddMagnet(uri, r.FormValue("save_path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Peer addresses in the link ("x.pe") let us start before the DHT finds anyone
+	if magnet, err := metainfo.ParseMagnetV2Uri(uri); err == nil {
+		for _, addr := range magnet.Params["x.pe"] {
+			go dialPeer(addr, cs.session, torrent, PeerSourceMagnet)
+		}
+	}
+	writeJSON(w, http.StatusOK, torrent.Status())
+}
+
+// handleCreateTorrent hashes local files into a .torrent and starts seeding them
+func (cs *ControlServer) handleCreateTorrent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sourcePath := r.FormValue("source_path")
+	if sourcePath == "" {
+		http.Error(w, "Missing source_path", http.StatusBadRequest)
+		return
+	}
+
+	opts := NewCreateTorrentOptions(cs.config, sourcePath)
+	opts.Comment = r.FormValue("comment")
+	if pieceLength := r.FormValue("piece_length"); pieceLength != "" {
+		length, err := strconv.ParseInt(pieceLength, 10, 64)
+		if err != nil || length <= 0 {
+			http.Error(w, "Invalid piece_length", http.StatusBadRequest)
+			return
+		}
+		opts.PieceLength = length
+	}
+
+	torrent, err := cs.session.CreateAndSeed(opts, r.FormValue("output_path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, torrent.Status())
+}
+
+// handleRemoveTorrent removes a torrent from the session (data is kept on disk)
+func (cs *ControlServer) handleRemoveTorrent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	infoHash, err := parseInfoHash(r.FormValue("info_hash"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := cs.session.RemoveTorrent(infoHash); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Torrent removed"))
+}
+
+// handleSetPickMode switches a torrent between rarest-first and sequential
+// (streaming) piece picking
+func (cs *ControlServer) handleSetPickMode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	infoHash, err := parseInfoHash(r.FormValue("info_hash"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := ParsePickMode(r.FormValue("mode")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	torrent, exists := cs.session.GetTorrent(infoHash)
+	if !exists {
+		http.Error(w, fmt.Sprintf("torrent %x is not in the session", infoHash), http.StatusNotFound)
+		return
+	}
+	if err := cs.session.SetPickMode(infoHash, r.FormValue("mode")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, torrent.Status())
+}
+
+// handleSetTorrentLimits changes a torrent's upload and download limits.
+// Rates missing from the form keep their current value.
+func (cs *ControlServer) handleSetTorrentLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	infoHash, err := parseInfoHash(r.FormValue("info_hash"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	torrent, exists := cs.session.GetTorrent(infoHash)
+	if !exists {
+		http.Error(w, fmt.Sprintf("torrent %x is not in the session", infoHash), http.StatusNotFound)
+		return
+	}
+
+	limits, _ := cs.session.TorrentRateLimits(infoHash)
+	if err := parseRateForm(r, "upload_rate", &limits.Upload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := parseRateForm(r, "download_rate", &limits.Download); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := cs.session.SetTorrentRateLimits(infoHash, limits); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, torrent.Status())
+}
+
+// handleLimits returns the session's rate limits, or on POST changes the
+// global and per-connection limits and the schedule. Values missing from the
+// form are kept; an empty schedule value clears the schedule.
+func (cs *ControlServer) handleLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		writeJSON(w, http.StatusOK, cs.session.RateLimitStatus())
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	current := cs.session.RateLimitStatus()
+	global, peer := current.Global, current.Peer
+	for field, rate := range map[string]*int64{
+		"upload_rate":        &global.Upload,
+		"download_rate":      &global.Download,
+		"peer_upload_rate":   &peer.Upload,
+		"peer_download_rate": &peer.Download,
+	} {
+		if err := parseRateForm(r, field, rate); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	limitLocal := current.Local
+	if value := r.Form.Get("limit_local_peers"); value != "" {
+		var err error
+		if limitLocal, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "limit_local_peers must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if windows, present := r.Form["schedule"]; present {
+		var schedule []RateSchedule
+		for _, window := range windows {
+			if window == "" {
+				continue
+			}
+			parsed, err := ParseRateSchedule(window)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			schedule = append(schedule, parsed)
+		}
+		cs.session.SetRateSchedule(schedule)
+	}
+	cs.session.SetLimitLocalPeers(limitLocal)
+	cs.session.SetRateLimits(global, peer)
+	writeJSON(w, http.StatusOK, cs.session.RateLimitStatus())
+}
+
+// handleDHTItems reads (GET) or stores (POST) a BEP 44 item. A GET with
+// key fetches an immutable item; with public_key and an optional salt it
+// fetches the latest mutable item. A POST stores value as an immutable item,
+// or with mutable=true signs it with the daemon's item key under salt; cas
+// makes the store conditional on the current sequence number. Items live in
+// the NERD overlay DHT when it runs.
+func (cs *ControlServer) handleDHTItems(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dhtServer := cs.session.nerdDHT()
+	if dhtServer == nil {
+		http.Error(w, "DHT is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), DHTItemTimeout)
+	defer cancel()
+	salt := []byte(r.FormValue("salt"))
+
+	if r.Method == "GET" {
+		if value := r.FormValue("public_key"); value != "" {
+			var publicKey [32]byte
+			decoded, err := hex.DecodeString(value)
+			if err != nil || len(decoded) != len(publicKey) {
+				http.Error(w, "invalid public_key", http.StatusBadRequest)
+				return
+			}
+			copy(publicKey[:], decoded)
+
+			item, err := dhtServer.RetrieveMutableNERDData(ctx, publicKey, salt)
+			if err != nil {
+				writeDHTItemError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, item.Status())
+			return
+		}
+
+		key, err := parseInfoHash(r.FormValue("key"))
+		if err != nil {
+			http.Error(w, "key or public_key is required", http.StatusBadRequest)
+			return
+		}
+		value, err := dhtServer.RetrieveNERDData(ctx, key)
+		if err != nil {
+			writeDHTItemError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, itemStatus(key, value))
+		return
+	}
+
+	value := []byte(r.FormValue("value"))
+	mutable := false
+	if field := r.FormValue("mutable"); field != "" {
+		var err error
+		if mutable, err = strconv.ParseBool(field); err != nil {
+			http.Error(w, "mutable must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	if !mutable {
+		if len(salt) > 0 || r.FormValue("cas") != "" {
+			http.Error(w, "salt and cas need mutable=true", http.StatusBadRequest)
+			return
+		}
+		key, err := dhtServer.StoreNERDData(ctx, value)
+		if err != nil {
+			writeDHTItemError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, itemStatus(key, value))
+		return
+	}
+
+	var cas *int64
+	if field := r.FormValue("cas"); field != "" {
+		seq, err := strconv.ParseInt(field, 10, 64)
+		if err != nil || seq < 0 {
+			http.Error(w, "cas must be a sequence number", http.StatusBadRequest)
+			return
+		}
+		cas = &seq
+	}
+	item, err := dhtServer.StoreMutableNERDData(ctx, salt, value, cas)
+	if err != nil {
+		writeDHTItemError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, item.Status())
+}
+
+// writeDHTItemError maps a BEP 44 store or lookup failure to a status code
+func writeDHTItemError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrDHTItemNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrDHTItemChanged):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// handleNERDQuery sends a NERD extension query (quality, balance or profile,
+// the last with a creator address) to the overlay node at addr
+func (cs *ControlServer) handleNERDQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cs.session.mu.RLock()
+	overlay := cs.session.overlay
+	cs.session.mu.RUnlock()
+	if overlay == nil {
+		http.Error(w, ErrNERDOverlayDisabled.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	addr := r.FormValue("addr")
+	if addr == "" {
+		http.Error(w, "addr is required", http.StatusBadRequest)
+		return
+	}
+	query := "nerd_" + r.FormValue("query")
+	switch query {
+	case NERDQueryQuality, NERDQueryBalance, NERDQueryProfile:
+	default:
+		http.Error(w, "query must be quality, balance or profile", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), NERDQueryTimeout)
+	defer cancel()
+	reply, err := overlay.QueryNERDNode(ctx, addr, query, r.FormValue("creator"))
+	switch {
+	case errors.Is(err, ErrNERDNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		writeJSON(w, http.StatusOK, reply.Status(query))
+	}
+}
+
+// parseRateForm sets rate from a form field if the request has it
+func parseRateForm(r *http.Request, field string, rate *int64) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	if _, present := r.Form[field]; !present {
+		return nil
+	}
+	parsed, err := ParseRate(r.Form.Get(field))
+	if err != nil {
+		return fmt.Errorf("%s: %v", field, err)
+	}
+	*rate = parsed
+	return nil
+}
+
+// handleListPeers returns the protocol state of every connection, optionally
+// filtered to one torrent with ?info_hash=
+func (cs *ControlServer) handleListPeers(w http.ResponseWriter, r *http.Request) {
+	filter := r.URL.Query().Get("info_hash")
+
+	var peers []PeerStats
+	for _, stats := range cs.session.PeerStats() {
+		if filter == "" || stats.InfoHash == filter {
+			peers = append(peers, stats)
+		}
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+// parseInfoHash decodes a 40-character hex infohash
+func parseInfoHash(value string) ([20]byte, error) {
+	var infoHash [20]byte
+
+	decoded, err := hex.DecodeString(value)
+	if err != nil || len(decoded) != 20 {
+		return infoHash, fmt.Errorf("invalid info_hash")
+	}
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[Control] Failed to write response: %v", err)
+	}
+}
@@ -2,55 +2,193 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"fmt"
 	"log"
+	"math"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/bep44"
 	"github.com/anacrolix/dht/v2/krpc"
+	peer_store "github.com/anacrolix/dht/v2/peer-store"
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/nerd-daemon/messages"
 	"google.golang.org/protobuf/proto"
 )
 
+// DHTPeerSearchTimeout bounds the daemon's periodic peer searches
+const DHTPeerSearchTimeout = time.Minute
+
 // DHTConfig holds configuration for DHT operations
 type DHTConfig struct {
 	Port           int
 	BootstrapNodes []string
 	NodeID         [20]byte
-	SecretSalt     uint16
+	ExternalIP     net.IP             // Our address as other nodes see it, which NodeID is bound to (BEP 42); nil if unknown
+	IdentityFile   string             // Where NodeID and ExternalIP are saved when they change; empty disables it
+	NodesFile      string             // Where routing table nodes are saved and reloaded from; empty disables it
+	NetworkID      string             // Joins the private NERD overlay with this ID instead of mainline
+	ItemKey        ed25519.PrivateKey // Signs the mutable BEP 44 items we publish; nil disables publishing them
 }
 
 // DHTServer wraps the DHT functionality with NERD-specific features
 type DHTServer struct {
-	server       *dht.Server
+	server       *dht.Server    // IPv4 routing table
+	server6      *dht.Server    // IPv6 routing table (BEP 32); nil when the host has no IPv6
+	items        *bep44.Wrapper // BEP 44 items stored on this node, shared by both routing tables
+	store        bep44.Store    // Holds items; the library answers get and put queries from it
+	announced    *announceStore // Peers that announced to this node, returned by our get_peers replies
+	guard        *nodeGuard     // Node IDs each address sent from, held to the Sybil limits
+	conns        []net.PacketConn
 	config       *DHTConfig
 	peerStore    *PeerStore
 	qualityCache *QualityMetricsCache
+	nerdInfo     NERDInfo               // Answers the NERD extension queries on the overlay
+	tokenSecret  []byte                 // Keys the profile tokens we issue; new each run, like the DHT library's own
+	surveys      map[string]*nodeSurvey // Overlay nodes by address, with how often they answered
+	surveyMu     sync.Mutex
 	mu           sync.RWMutex
 	isRunning    bool
 }
 
 // PeerStore manages discovered peers with quality metrics
 type PeerStore struct {
-	peers map[string]*PeerInfo
-	mu    sync.RWMutex
+	peers     map[string]*PeerInfo
+	penalties map[string]float64 // Quality deducted from hosts that sent corrupt data
+	limits    *peerLimiter       // Peers by address and subnet, held to the Sybil limits
+	mu        sync.RWMutex
 }
 
 // PeerInfo represents a peer with quality metrics
 type PeerInfo struct {
-	Address      string
+	Address      string // IPv4 or IPv6 address, without brackets
 	Port         int
 	QualityScore float64
 	LastSeen     time.Time
+	Source       string // PeerSource* the peer was first found through
 	Uptime       time.Duration
 	Location     *messages.GeographicHintMsg
 	TokenBalance uint64
 }
 
+// Addr returns the peer's "host:port", with IPv6 hosts in brackets
+func (p *PeerInfo) Addr() string {
+	return net.JoinHostPort(p.Address, strconv.Itoa(p.Port))
+}
+
+// IsIPv6 reports whether the peer was found at an IPv6 address
+func (p *PeerInfo) IsIPv6() bool {
+	ip := net.ParseIP(p.Address)
+	return ip != nil && ip.To4() == nil
+}
+
+// normalizeHost writes IP addresses in their canonical form, so that an
+// IPv4-mapped IPv6 address and the IPv4 address share one peer store entry
+func normalizeHost(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// Limits of the peers other nodes announce to us
+const (
+	announceExpiry        = 30 * time.Minute // Peers re-announce every 15-30 minutes
+	maxAnnouncedPeers     = 500              // Kept per infohash
+	maxAnnouncedPeerReply = 50               // Returned in one get_peers reply
+)
+
+// announceStore keeps the peers that send us announce_peer, per infohash and
+// address, so that our get_peers replies carry values
+type announceStore struct {
+	swarms map[peer_store.InfoHash]map[string]announcedPeer
+	guard  *nodeGuard // Tells which announcers sent BEP 42 compliant node IDs
+	mu     sync.Mutex
+}
+
+// announcedPeer is a peer address with the time it last announced
+type announcedPeer struct {
+	addr krpc.NodeAddr
+	seen time.Time
+}
+
+// newAnnounceStore creates an empty announce store
+func newAnnounceStore(guard *nodeGuard) *announceStore {
+	return &announceStore{
+		swarms: make(map[peer_store.InfoHash]map[string]announcedPeer),
+		guard:  guard,
+	}
+}
+
+// AddPeer records an announce, ignoring new peers of a full swarm and those
+// over the Sybil limits of its address or subnet
+func (as *announceStore) AddPeer(infoHash peer_store.InfoHash, addr krpc.NodeAddr) {
+	trusted := as.guard.trusted(addr.IP)
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	swarm := as.swarms[infoHash]
+	if swarm == nil {
+		swarm = make(map[string]announcedPeer)
+		as.swarms[infoHash] = swarm
+	}
+	key := addr.String()
+	if _, known := swarm[key]; !known {
+		if len(swarm) >= maxAnnouncedPeers {
+			return
+		}
+		limits := newPeerLimiter()
+		for _, peer := range swarm {
+			limits.add(peer.addr.IP.String())
+		}
+		if !limits.allow(addr.IP.String(), trusted) {
+			return
+		}
+	}
+	swarm[key] = announcedPeer{addr: addr, seen: time.Now()}
+}
+
+// GetPeers returns up to maxAnnouncedPeerReply peers that announced infoHash
+// recently, in no particular order
+func (as *announceStore) GetPeers(infoHash peer_store.InfoHash) []krpc.NodeAddr {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	var peers []krpc.NodeAddr
+	for _, peer := range as.swarms[infoHash] {
+		if time.Since(peer.seen) < announceExpiry {
+			peers = append(peers, peer.addr)
+		}
+		if len(peers) == maxAnnouncedPeerReply {
+			break
+		}
+	}
+	return peers
+}
+
+// prune forgets expired announces and empty swarms
+func (as *announceStore) prune() {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	for infoHash, swarm := range as.swarms {
+		for key, peer := range swarm {
+			if time.Since(peer.seen) >= announceExpiry {
+				delete(swarm, key)
+			}
+		}
+		if len(swarm) == 0 {
+			delete(as.swarms, infoHash)
+		}
+	}
+}
+
 // QualityMetricsCache manages peer quality data
 type QualityMetricsCache struct {
 	metrics map[string]*QualityMetrics
@@ -66,57 +204,177 @@ type QualityMetrics struct {
 	LastUpdated      time.Time
 }
 
-// NewDHTServer creates a new DHT server instance
+// NewDHTServer creates a new DHT server instance. IPv4 and IPv6 nodes are
+// kept in separate routing tables on their own sockets, as BEP 32 requires;
+// IPv6 is skipped with a warning when the host cannot listen on it.
 func NewDHTServer(config *DHTConfig) (*DHTServer, error) {
+	store := bep44.NewMemory()
+	guard := newNodeGuard()
+	dhtServer := &DHTServer{
+		items:        bep44.NewWrapper(store, dht.NewDefaultServerConfig().Exp),
+		store:        store,
+		announced:    newAnnounceStore(guard),
+		guard:        guard,
+		config:       config,
+		peerStore:    NewPeerStore(),
+		qualityCache: NewQualityMetricsCache(),
+		surveys:      make(map[string]*nodeSurvey),
+		isRunning:    false,
+	}
+	dhtServer.tokenSecret = make([]byte, dhtSecretSize)
+	if _, err := rand.Read(dhtServer.tokenSecret); err != nil {
+		return nil, fmt.Errorf("failed to generate DHT token secret: %v", err)
+	}
+
+	if config.NetworkID != "" {
+		log.Printf("[DHT] Joining NERD overlay network %q", config.NetworkID)
+	}
+
+	// Bind the node ID to the external IP the last run learned, unless it is already
+	if ip := config.ExternalIP; ip != nil && !nodeIDSecure(config.NodeID, ip) {
+		config.NodeID = secureNodeID(config.NodeID, ip)
+		log.Printf("[DHT] Binding node ID to external address %s (BEP 42): %x", ip, config.NodeID)
+		dhtServer.saveIdentity(config.NodeID)
+	}
+
+	if err := dhtServer.openServers(); err != nil {
+		return nil, err
+	}
+	return dhtServer, nil
+}
+
+// openServers creates the DHT node of each address family with the configured node ID
+func (ds *DHTServer) openServers() error {
+	server, conn, err := ds.newKRPCServer("udp4")
+	if err != nil {
+		return err
+	}
+	ds.server = server
+	ds.conns = []net.PacketConn{conn}
+
+	server6, conn6, err := ds.newKRPCServer("udp6")
+	if err != nil {
+		log.Printf("[DHT] IPv6 unavailable, running IPv4 only: %v", err)
+		ds.server6 = nil
+	} else {
+		ds.server6 = server6
+		ds.conns = append(ds.conns, conn6)
+	}
+	return nil
+}
+
+// closeServers closes the DHT node of each address family. The library closes
+// sockets in the background, so they are closed here too to free the port at once.
+func (ds *DHTServer) closeServers() {
+	for _, server := range ds.servers() {
+		server.Close()
+	}
+	for _, conn := range ds.conns {
+		conn.Close()
+	}
+}
+
+// newKRPCServer creates a DHT node for one address family ("udp4" or "udp6")
+// on the configured port and returns it with its socket. Nodes of both
+// families share the BEP 44 items, the announced peers and the node guard.
+// With a network ID the node joins that NERD overlay instead of mainline and
+// answers the NERD extension queries.
+func (ds *DHTServer) newKRPCServer(network string) (*dht.Server, net.PacketConn, error) {
+	config := ds.config
+
 	// Create UDP connection for DHT
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", config.Port))
+	addr, err := net.ResolveUDPAddr(network, fmt.Sprintf(":%d", config.Port))
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve DHT address: %v", err)
+		return nil, nil, fmt.Errorf("failed to resolve DHT address: %v", err)
 	}
 
-	conn, err := net.ListenUDP("udp", addr)
+	conn, err := net.ListenUDP(network, addr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to listen on DHT port: %v", err)
+		return nil, nil, fmt.Errorf("failed to listen on DHT port: %v", err)
 	}
 
+	var packetConn net.PacketConn = conn
+	if config.NetworkID != "" {
+		packetConn = newOverlayConn(conn, config.NetworkID)
+	}
+	// Messages from nodes over the Sybil limits are dropped before the library sees them
+	packetConn = &guardConn{PacketConn: packetConn, guard: ds.guard}
+
 	// Create DHT server configuration
 	serverConfig := dht.NewDefaultServerConfig()
-	serverConfig.Conn = conn
+	serverConfig.Conn = packetConn
 	serverConfig.NodeId = krpc.ID(config.NodeID)
-
-	// Set bootstrap nodes
-	if len(config.BootstrapNodes) > 0 {
-		serverConfig.StartingNodes = func() ([]dht.Addr, error) {
-			return dht.ResolveHostPorts(config.BootstrapNodes)
+	serverConfig.Store = ds.store
+	serverConfig.PeerStore = ds.announced
+
+	// Start from the nodes saved by the last run, which need no DNS and keep
+	// us joined when the bootstrap hosts are down, then the bootstrap hosts,
+	// keeping those of this address family
+	ipv6 := network == "udp6"
+	bootstrap := config.BootstrapNodes
+	if len(bootstrap) == 0 && config.NetworkID == "" {
+		bootstrap = dht.DefaultGlobalBootstrapHostPorts
+	}
+	serverConfig.StartingNodes = func() ([]dht.Addr, error) {
+		family := savedNodeAddrs(config.NodesFile, ipv6)
+		saved := len(family)
+		addrs, err := dht.ResolveHostPorts(bootstrap)
+		for _, addr := range addrs {
+			if (addr.IP().To4() == nil) == ipv6 {
+				family = append(family, addr)
+			}
+		}
+		if saved > 0 {
+			return family, nil
+		}
+		if len(family) == 0 && err == nil {
+			err = fmt.Errorf("no %s bootstrap nodes", network)
 		}
+		return family, err
 	}
 
 	// Configure DHT callbacks for NERD integration
+	if config.NetworkID != "" {
+		serverConfig.OnQuery = func(query *krpc.Msg, source net.Addr) bool {
+			return ds.handleNERDQuery(packetConn, query, source)
+		}
+	}
 	serverConfig.OnAnnouncePeer = func(infoHash metainfo.Hash, ip net.IP, port int, portOk bool) {
-		log.Printf("[DHT] Peer announced: %s:%d for infohash %x", ip, port, infoHash)
+		log.Printf("[DHT] Peer announced: %s for infohash %x", net.JoinHostPort(ip.String(), strconv.Itoa(port)), infoHash)
 	}
 
 	// Create DHT server
 	server, err := dht.NewServer(serverConfig)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create DHT server: %v", err)
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to create DHT server: %v", err)
 	}
+	return server, conn, nil
+}
 
-	dhtServer := &DHTServer{
-		server:       server,
-		config:       config,
-		peerStore:    NewPeerStore(),
-		qualityCache: NewQualityMetricsCache(),
-		isRunning:    false,
+// servers returns the DHT node of each address family we run
+func (ds *DHTServer) servers() []*dht.Server {
+	if ds.server6 == nil {
+		return []*dht.Server{ds.server}
 	}
+	return []*dht.Server{ds.server, ds.server6}
+}
 
-	return dhtServer, nil
+// numNodes counts the nodes in every routing table
+func (ds *DHTServer) numNodes() int {
+	n := 0
+	for _, server := range ds.servers() {
+		n += server.NumNodes()
+	}
+	return n
 }
 
 // NewPeerStore creates a new peer store
 func NewPeerStore() *PeerStore {
 	return &PeerStore{
-		peers: make(map[string]*PeerInfo),
+		peers:     make(map[string]*PeerInfo),
+		penalties: make(map[string]float64),
+		limits:    newPeerLimiter(),
 	}
 }
 
@@ -149,29 +407,63 @@ func (ds *DHTServer) Start() error {
 	log.Printf("[DHT] Starting DHT server on port %d", ds.config.Port)
 	log.Printf("[DHT] Node ID: %x", ds.config.NodeID)
 
-	// Start table maintainer (keeps routing table healthy)
-	go ds.server.TableMaintainer()
+	ds.bootstrap()
 
-	// Bootstrap the DHT
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	// Replies carry the address they were sent to; once enough nodes agree on
+	// it, rejoin with a node ID bound to it so that BEP 42 nodes trust us
+	if nodeID, changed := ds.checkExternalIP(); changed {
+		ds.closeServers()
+		ds.config.NodeID = nodeID
+		if err := ds.openServers(); err != nil {
+			return fmt.Errorf("failed to reopen DHT with new node ID: %v", err)
+		}
+		ds.bootstrap()
+	}
 
-	stats, err := ds.server.BootstrapContext(ctx)
-	if err != nil {
-		log.Printf("[DHT] Bootstrap warning: %v", err)
-	} else {
-		log.Printf("[DHT] Bootstrap completed: %d nodes contacted", stats.NumAddrsTried)
+	// Start table maintainers (keep routing tables healthy) only now, as their
+	// own bootstrap would turn ours away
+	for _, server := range ds.servers() {
+		go server.TableMaintainer()
 	}
 
 	ds.isRunning = true
 
 	// Start periodic maintenance
 	go ds.maintenanceLoop()
+	if ds.config.NetworkID != "" {
+		go ds.surveyNERDNodes()
+	}
 
-	log.Printf("[DHT] DHT server started successfully with %d nodes in routing table", ds.server.NumNodes())
+	log.Printf("[DHT] DHT server started successfully with %d nodes in routing table", ds.numNodes())
 	return nil
 }
 
+// bootstrap fills each routing table together and saves the nodes found
+func (ds *DHTServer) bootstrap() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range ds.servers() {
+		wg.Add(1)
+		go func(server *dht.Server) {
+			defer wg.Done()
+			network := "IPv4"
+			if server == ds.server6 {
+				network = "IPv6"
+			}
+			stats, err := server.BootstrapContext(ctx)
+			if err != nil {
+				log.Printf("[DHT] %s bootstrap warning: %v", network, err)
+			} else {
+				log.Printf("[DHT] %s bootstrap completed: %d nodes contacted", network, stats.NumAddrsTried)
+			}
+		}(server)
+	}
+	wg.Wait()
+	ds.saveNodes()
+}
+
 // Stop shuts down the DHT server
 func (ds *DHTServer) Stop() {
 	ds.mu.Lock()
@@ -182,12 +474,14 @@ func (ds *DHTServer) Stop() {
 	}
 
 	log.Printf("[DHT] Stopping DHT server...")
-	ds.server.Close()
+	ds.saveNodes()
+	ds.closeServers()
 	ds.isRunning = false
 	log.Printf("[DHT] DHT server stopped")
 }
 
-// AnnouncePeer announces this node as a peer for a given infohash
+// AnnouncePeer announces this node as a peer for a given infohash in every
+// routing table
 func (ds *DHTServer) AnnouncePeer(infohash [20]byte, port int) error {
 	if !ds.isRunning {
 		return fmt.Errorf("DHT server is not running")
@@ -195,93 +489,171 @@ func (ds *DHTServer) AnnouncePeer(infohash [20]byte, port int) error {
 
 	log.Printf("[DHT] Announcing peer for infohash %x on port %d", infohash, port)
 
-	// Use the new AnnounceTraversal method
-	announce, err := ds.server.AnnounceTraversal(infohash, dht.AnnouncePeer(dht.AnnouncePeerOpts{
-		Port:        port,
-		ImpliedPort: false,
-	}))
-	if err != nil {
-		return fmt.Errorf("failed to start announce traversal: %v", err)
-	}
-
-	// Monitor the announcement in a goroutine
-	go func() {
-		defer announce.Close()
-
-		finished := announce.Finished()
-		for {
-			select {
-			case peers, ok := <-announce.Peers:
-				if !ok {
-					log.Printf("[DHT] Announce completed for infohash %x", infohash)
+	var lastErr error
+	started := 0
+	for _, server := range ds.servers() {
+		// Use the new AnnounceTraversal method
+		announce, err := server.AnnounceTraversal(infohash, dht.AnnouncePeer(dht.AnnouncePeerOpts{
+			Port:        port,
+			ImpliedPort: false,
+		}))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		started++
+
+		// Monitor the announcement in a goroutine
+		go func() {
+			defer announce.Close()
+
+			finished := announce.Finished()
+			for {
+				select {
+				case peers, ok := <-announce.Peers:
+					if !ok {
+						log.Printf("[DHT] Announce completed for infohash %x", infohash)
+						return
+					}
+
+					// Process discovered peers
+					for _, peer := range peers.Peers {
+						ds.addDiscoveredPeer(peer.IP.String(), peer.Port, PeerSourceDHT, &peers.NodeInfo)
+					}
+
+				case <-finished:
+					log.Printf("[DHT] Announce traversal finished for infohash %x", infohash)
 					return
 				}
-
-				// Process discovered peers
-				for _, peer := range peers.Peers {
-					ds.addDiscoveredPeer(peer.IP.String(), peer.Port, &peers.NodeInfo)
-				}
-
-			case <-finished:
-				log.Printf("[DHT] Announce traversal finished for infohash %x", infohash)
-				return
 			}
-		}
-	}()
+		}()
+	}
+	if started == 0 {
+		return fmt.Errorf("failed to start announce traversal: %v", lastErr)
+	}
 
 	return nil
 }
 
-// FindPeers searches for peers sharing a specific infohash
-func (ds *DHTServer) FindPeers(infohash [20]byte) ([]*PeerInfo, error) {
+// PeerSearch streams the peers found by a DHT lookup as nodes report them
+type PeerSearch struct {
+	Peers <-chan *PeerInfo // Each address once; closed when the search ends
+	done  chan struct{}
+	err   error
+}
+
+// Err waits for the search to end and reports why: nil when every traversal
+// completed, otherwise the error of the context that cut it short
+func (ps *PeerSearch) Err() error {
+	<-ps.done
+	return ps.err
+}
+
+// FindPeers looks up peers sharing infohash with get_peers queries in every
+// routing table. Peers are delivered on the returned search's channel as they
+// arrive and recorded in the peer store; the channel is closed once every
+// traversal has completed or ctx is done. Callers must read the channel until
+// it is closed or cancel ctx.
+func (ds *DHTServer) FindPeers(ctx context.Context, infohash [20]byte) (*PeerSearch, error) {
 	if !ds.isRunning {
 		return nil, fmt.Errorf("DHT server is not running")
 	}
 
 	log.Printf("[DHT] Searching for peers with infohash %x", infohash)
 
-	announce, err := ds.server.AnnounceTraversal(infohash, dht.Scrape())
-	if err != nil {
-		return nil, fmt.Errorf("failed to start peer search: %v", err)
-	}
-
-	var discoveredPeers []*PeerInfo
-	timeout := time.After(30 * time.Second)
-
-	go func() {
-		defer announce.Close()
-
-		finished := announce.Finished()
-		for {
-			select {
-			case peers, ok := <-announce.Peers:
+	var announces []*dht.Announce
+	var lastErr error
+	for _, server := range ds.servers() {
+		announce, err := server.AnnounceTraversal(infohash)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		announces = append(announces, announce)
+	}
+	if len(announces) == 0 {
+		return nil, fmt.Errorf("failed to start peer search: %v", lastErr)
+	}
+
+	peers := make(chan *PeerInfo, 64) // Holds a few replies' worth while the reader is busy
+	search := &PeerSearch{Peers: peers, done: make(chan struct{})}
+
+	var (
+		seen        = make(map[string]bool)
+		interrupted bool
+		mu          sync.Mutex
+		wg          sync.WaitGroup
+	)
+	for _, announce := range announces {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer announce.Close()
+
+			for {
+				var values dht.PeersValues
+				var ok bool
+				select {
+				case values, ok = <-announce.Peers:
+				case <-ctx.Done():
+				}
 				if !ok {
+					if ctx.Err() != nil {
+						mu.Lock()
+						interrupted = true
+						mu.Unlock()
+					}
 					return
 				}
 
-				// Add discovered peers to our store
-				for _, peer := range peers.Peers {
-					peerInfo := ds.addDiscoveredPeer(peer.IP.String(), peer.Port, &peers.NodeInfo)
-					discoveredPeers = append(discoveredPeers, peerInfo)
+				for _, peer := range values.Peers {
+					peerInfo := ds.addDiscoveredPeer(peer.IP.String(), peer.Port, PeerSourceDHT, &values.NodeInfo)
+					if peerInfo == nil {
+						continue
+					}
+					mu.Lock()
+					duplicate := seen[peerInfo.Addr()]
+					seen[peerInfo.Addr()] = true
+					mu.Unlock()
+					if duplicate {
+						continue
+					}
+
+					select {
+					case peers <- peerInfo:
+					case <-ctx.Done():
+						mu.Lock()
+						interrupted = true
+						mu.Unlock()
+						return
+					}
 				}
-
-			case <-finished:
-				return
-			case <-timeout:
-				return
 			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		if interrupted {
+			search.err = ctx.Err()
 		}
+		log.Printf("[DHT] Peer search for infohash %x ended with %d peers", infohash, len(seen))
+		close(search.done)
+		close(peers)
 	}()
 
-	// Wait a bit for initial results
-	time.Sleep(5 * time.Second)
-
-	return discoveredPeers, nil
+	return search, nil
 }
 
-// addDiscoveredPeer adds a newly discovered peer to our store
-func (ds *DHTServer) addDiscoveredPeer(address string, port int, nodeInfo *krpc.NodeInfo) *PeerInfo {
-	peerKey := fmt.Sprintf("%s:%d", address, port)
+// addDiscoveredPeer adds a newly discovered peer to our store, recording the
+// source it was first found through. nodeInfo is the DHT node that reported
+// the peer, if any; peers reported by a node whose ID is not bound to its
+// address (BEP 42) start with a lower quality score and tighter Sybil limits.
+// It returns nil for a new peer over those limits.
+func (ds *DHTServer) addDiscoveredPeer(address string, port int, source string, nodeInfo *krpc.NodeInfo) *PeerInfo {
+	address = normalizeHost(address)
+	peerKey := net.JoinHostPort(address, strconv.Itoa(port))
+	trusted := nodeInfo == nil || nodeIDSecure(nodeInfo.ID, nodeInfo.Addr.IP)
 
 	ds.peerStore.mu.Lock()
 	defer ds.peerStore.mu.Unlock()
@@ -290,20 +662,29 @@ func (ds *DHTServer) addDiscoveredPeer(address string, port int, nodeInfo *krpc.
 		existingPeer.LastSeen = time.Now()
 		return existingPeer
 	}
+	if !ds.peerStore.limits.allow(address, trusted) {
+		return nil
+	}
 
+	quality := 0.5 // Default quality score
+	if !trusted {
+		quality = untrustedPeerQuality
+	}
 	peerInfo := &PeerInfo{
 		Address:      address,
 		Port:         port,
-		QualityScore: 0.5, // Default quality score
+		QualityScore: math.Max(quality-ds.peerStore.penalties[address], 0),
 		LastSeen:     time.Now(),
+		Source:       source,
 		Uptime:       0,
 		Location:     nil,
 		TokenBalance: 0,
 	}
 
 	ds.peerStore.peers[peerKey] = peerInfo
+	ds.peerStore.limits.add(address)
 
-	log.Printf("[DHT] Discovered new peer: %s:%d", address, port)
+	log.Printf("[DHT] Discovered new peer: %s (%s)", peerKey, source)
 	return peerInfo
 }
 
@@ -324,7 +705,8 @@ func (ds *DHTServer) GetPeers(minQuality float64) []*PeerInfo {
 
 // UpdatePeerQuality updates quality metrics for a peer
 func (ds *DHTServer) UpdatePeerQuality(address string, port int, metrics *QualityMetrics) {
-	peerKey := fmt.Sprintf("%s:%d", address, port)
+	address = normalizeHost(address)
+	peerKey := net.JoinHostPort(address, strconv.Itoa(port))
 
 	ds.qualityCache.mu.Lock()
 	ds.qualityCache.metrics[peerKey] = metrics
@@ -333,12 +715,28 @@ func (ds *DHTServer) UpdatePeerQuality(address string, port int, metrics *Qualit
 	// Update peer info with new quality score
 	ds.peerStore.mu.Lock()
 	if peer, exists := ds.peerStore.peers[peerKey]; exists {
-		peer.QualityScore = ds.calculateQualityScore(metrics)
+		peer.QualityScore = math.Max(ds.calculateQualityScore(metrics)-ds.peerStore.penalties[address], 0)
 		peer.LastSeen = time.Now()
 	}
 	ds.peerStore.mu.Unlock()
 }
 
+// PenalizePeer lowers the quality score of every peer at host, which sent
+// data that failed verification. The penalty also applies to scores the host
+// reports or is given later.
+func (ds *DHTServer) PenalizePeer(host string, penalty float64) {
+	host = normalizeHost(host)
+	ds.peerStore.mu.Lock()
+	defer ds.peerStore.mu.Unlock()
+
+	ds.peerStore.penalties[host] += penalty
+	for _, peer := range ds.peerStore.peers {
+		if peer.Address == host {
+			peer.QualityScore = math.Max(peer.QualityScore-penalty, 0)
+		}
+	}
+}
+
 // calculateQualityScore computes an overall quality score from metrics
 func (ds *DHTServer) calculateQualityScore(metrics *QualityMetrics) float64 {
 	// Weight different factors
@@ -373,46 +771,38 @@ func (ds *DHTServer) calculateQualityScore(metrics *QualityMetrics) float64 {
 	return qualityScore
 }
 
-// StoreNERDData stores NERD-specific data in the DHT
-func (ds *DHTServer) StoreNERDData(key [20]byte, data []byte) error {
-	if !ds.isRunning {
-		return fmt.Errorf("DHT server is not running")
-	}
-
-	// In a real implementation, you would use BEP44 mutable/immutable storage
-	// For now, we'll log the storage request
-	log.Printf("[DHT] Storing NERD data: key=%x, size=%d bytes", key, len(data))
-
-	// TODO: Implement actual DHT storage using BEP44
-	// This would involve using ds.server.Put() with appropriate parameters
-
-	return nil
-}
-
-// RetrieveNERDData retrieves NERD-specific data from the DHT
-func (ds *DHTServer) RetrieveNERDData(key [20]byte) ([]byte, error) {
-	if !ds.isRunning {
-		return nil, fmt.Errorf("DHT server is not running")
-	}
-
-	log.Printf("[DHT] Retrieving NERD data: key=%x", key)
-
-	// TODO: Implement actual DHT retrieval using BEP44
-	// This would involve using ds.server.Get() with appropriate parameters
-
-	return nil, fmt.Errorf("DHT storage not yet implemented")
-}
-
 // GetStats returns DHT statistics
 func (ds *DHTServer) GetStats() map[string]interface{} {
 	stats := make(map[string]interface{})
 
 	if ds.isRunning {
-		serverStats := ds.server.Stats()
-		stats["good_nodes"] = serverStats.GoodNodes
-		stats["total_nodes"] = serverStats.Nodes
-		stats["outstanding_transactions"] = serverStats.OutstandingTransactions
-		stats["successful_announces"] = serverStats.SuccessfulOutboundAnnouncePeerQueries
+		var goodNodes, totalNodes, outstanding int
+		var announces int64
+		for _, server := range ds.servers() {
+			serverStats := server.Stats()
+			goodNodes += serverStats.GoodNodes
+			totalNodes += serverStats.Nodes
+			outstanding += serverStats.OutstandingTransactions
+			announces += serverStats.SuccessfulOutboundAnnouncePeerQueries
+		}
+		stats["good_nodes"] = goodNodes
+		stats["total_nodes"] = totalNodes
+		stats["outstanding_transactions"] = outstanding
+		stats["successful_announces"] = announces
+		if ds.server6 != nil {
+			serverStats := ds.server6.Stats()
+			stats["ipv6_good_nodes"] = serverStats.GoodNodes
+			stats["ipv6_nodes"] = serverStats.Nodes
+		}
+	}
+
+	nodes, insecure, rejected := ds.guard.counts()
+	stats["tracked_node_ids"] = nodes
+	stats["insecure_node_ids"] = insecure
+	stats["rejected_node_ids"] = rejected
+	if ds.config.ExternalIP != nil {
+		stats["external_ip"] = ds.config.ExternalIP.String()
+		stats["node_id_secure"] = nodeIDSecure(ds.config.NodeID, ds.config.ExternalIP)
 	}
 
 	ds.peerStore.mu.RLock()
@@ -440,6 +830,14 @@ func (ds *DHTServer) maintenanceLoop() {
 
 			// Clean up old peers
 			ds.cleanupOldPeers()
+			ds.announced.prune()
+			ds.saveNodes()
+			if _, changed := ds.checkExternalIP(); changed {
+				log.Printf("[DHT] The new node ID is used from the next start")
+			}
+			if ds.config.NetworkID != "" {
+				ds.surveyNERDNodes()
+			}
 
 			// Log stats
 			stats := ds.GetStats()
@@ -460,6 +858,7 @@ func (ds *DHTServer) cleanupOldPeers() {
 	for key, peer := range ds.peerStore.peers {
 		if peer.LastSeen.Before(threshold) {
 			delete(ds.peerStore.peers, key)
+			ds.peerStore.limits.remove(peer.Address)
 			removed++
 		}
 	}
@@ -497,6 +896,34 @@ func (ds *DHTServer) ProcessNERDMessage(msgType string, data []byte) error {
 	return nil
 }
 
+// RegisterHandlers routes quality metrics and geographic hints from peers to the DHT
+func (ds *DHTServer) RegisterHandlers(r *MessageRegistry) error {
+	if err := r.Register(MsgTypeQualityMetrics, "quality metrics",
+		ProtobufDecoder(func() proto.Message { return &messages.QualityMetricsMsg{} }),
+		func(ctx *MessageContext, payload proto.Message) error {
+			qualityMetrics := payload.(*messages.QualityMetricsMsg)
+			log.Printf("Quality metrics from %s: uptime=%d, reliability=%.2f",
+				ctx.Peer.accountKey(), qualityMetrics.UptimeSeconds, qualityMetrics.ReliabilityScore)
+			if err := ds.processQualityMetrics(qualityMetrics); err != nil {
+				log.Printf("[DHT] Failed to process quality metrics from %s: %v", ctx.Peer.accountKey(), err)
+			}
+			return nil
+		}); err != nil {
+		return err
+	}
+
+	return r.Register(MsgTypeGeographicHint, "geographic hint",
+		ProtobufDecoder(func() proto.Message { return &messages.GeographicHintMsg{} }),
+		func(ctx *MessageContext, payload proto.Message) error {
+			geoHint := payload.(*messages.GeographicHintMsg)
+			log.Printf("Geographic hint from %s: %s, %s", ctx.Peer.accountKey(), geoHint.CountryCode, geoHint.City)
+			if err := ds.processGeographicHint(geoHint); err != nil {
+				log.Printf("[DHT] Failed to process geographic hint from %s: %v", ctx.Peer.accountKey(), err)
+			}
+			return nil
+		})
+}
+
 // processQualityMetrics processes received quality metrics
 func (ds *DHTServer) processQualityMetrics(msg *messages.QualityMetricsMsg) error {
 	// Calculate response time from uptime (simplified approach)
@@ -543,7 +970,7 @@ func (ds *DHTServer) findPeerByID(peerID string) *PeerInfo {
 
 	// In a real implementation, you'd have proper peer ID mapping
 	for _, peer := range ds.peerStore.peers {
-		if fmt.Sprintf("%s:%d", peer.Address, peer.Port) == peerID {
+		if peer.Addr() == peerID {
 			return peer
 		}
 	}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// Sybil limits. A host may run a few nodes or peers behind one address, but
+// an attacker holding many addresses in one subnet, or many node IDs on one
+// address, only gets this share of the routing tables and peer stores. Nodes
+// whose ID is not bound to their address (BEP 42) are trusted less. Local
+// network addresses are exempt, as they are from BEP 42 checks. Only nodes
+// that proved their address, by answering one of our queries or by sending
+// back a token we gave that address, are counted; others are answered but
+// kept out of the routing tables, so spoofed sources cannot use up the limits.
+const (
+	maxNodesPerIP              = 4                // Node IDs heard from one address
+	maxNodesPerSubnet          = 16               // Node IDs heard from one /24 (IPv4) or /48 (IPv6)
+	maxInsecureNodesPerIP      = 1                // Node IDs not bound to their address, per address
+	maxInsecureNodesPerSubnet  = 4                // Node IDs not bound to their address, per subnet
+	nodeGuardExpiry            = 15 * time.Minute // Node IDs not heard from for this long stop counting
+	maxPeersPerIP              = 4                // Ports per address in the peer store and in each announced swarm
+	maxPeersPerSubnet          = 16               // Peers per subnet in the peer store and in each announced swarm
+	maxUntrustedPeersPerIP     = 1                // Lower limits for peers only non-compliant nodes vouch for
+	maxUntrustedPeersPerSubnet = 4                // And per subnet, for the same peers
+	untrustedPeerQuality       = 0.25             // Starting quality score of peers only non-compliant nodes told us about
+	minExternalIPVotes         = 3                // Subnets that must report the same external IP before we bind to it
+	maxExternalIPCandidates    = 16               // Reported external IPs counted at once
+	maxGuardSubnets            = 8192             // Subnets with counted node IDs; new ones are turned away beyond this
+	maxGuardChallenges         = 16384            // Queries and tokens awaiting proof of a node's address
+	guardQueryExpiry           = time.Minute      // How long a reply to one of our queries proves the address
+	guardTokenExpiry           = 10 * time.Minute // How long a token we issued proves the address it was sent to
+)
+
+// isLocalAddress reports whether ip is a loopback, link-local or private
+// address, which BEP 42 exempts from node ID checks
+func isLocalAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsPrivate()
+}
+
+// subnetOf returns the /24 of an IPv4 address or the /48 of an IPv6 one, or
+// "" for a host that is not an IP address
+func subnetOf(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	if ip.To16() != nil {
+		return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+	}
+	return ""
+}
+
+// nodeIDSecure reports whether id is bound to ip as BEP 42 requires
+func nodeIDSecure(id [20]byte, ip net.IP) bool {
+	return isLocalAddress(ip) || dht.NodeIdSecure(id, ip)
+}
+
+// secureNodeID returns id bound to ip (BEP 42). The last byte, which picks
+// one of the eight IDs an address may have, and all but the first 21 bits are
+// kept, so rebinding after an address change stays close to the old ID.
+func secureNodeID(id [20]byte, ip net.IP) [20]byte {
+	secure := krpc.ID(id)
+	dht.SecureNodeId(&secure, ip)
+	return secure
+}
+
+// guardedNode is a node ID heard from an address
+type guardedNode struct {
+	secure bool
+	seen   time.Time
+}
+
+// nodeGuard tracks the node IDs each proven address sends from and turns away
+// those over the Sybil limits, so that they never reach the routing tables. It
+// also counts the external IP other nodes see us at.
+type nodeGuard struct {
+	nodes      map[string]map[string]map[krpc.ID]guardedNode // By subnet, then address
+	votes      map[string]map[string]time.Time               // Reported external IP, by reporting subnet
+	challenges map[string]time.Time                          // Expiry of the queries we sent and tokens we issued, by challengeKey
+	rejected   int64
+	lastPrune  time.Time
+	mu         sync.Mutex
+}
+
+// newNodeGuard creates a guard that knows no nodes
+func newNodeGuard() *nodeGuard {
+	return &nodeGuard{
+		nodes:      make(map[string]map[string]map[krpc.ID]guardedNode),
+		votes:      make(map[string]map[string]time.Time),
+		challenges: make(map[string]time.Time),
+		lastPrune:  time.Now(),
+	}
+}
+
+// challengeKey identifies a query transaction ("q") or a token ("t") sent to addr
+func challengeKey(kind string, addr *net.UDPAddr, value string) string {
+	return kind + "|" + addr.String() + "|" + value
+}
+
+// challenge records a query or token sent to a node, whose reply or announce
+// will prove the node's address. Nothing is recorded while the table is full.
+func (g *nodeGuard) challenge(key string, expiry time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.challenges[key]; !ok && len(g.challenges) >= maxGuardChallenges {
+		g.pruneChallenges()
+		if len(g.challenges) >= maxGuardChallenges {
+			return
+		}
+	}
+	g.challenges[key] = time.Now().Add(expiry)
+}
+
+// proven reports whether a recorded challenge was answered. Query
+// transactions are answered once; tokens may be used until they expire.
+func (g *nodeGuard) proven(key string, once bool) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	expiry, ok := g.challenges[key]
+	if !ok || time.Now().After(expiry) {
+		return false
+	}
+	if once {
+		delete(g.challenges, key)
+	}
+	return true
+}
+
+// known refreshes and reports whether node id at ip is counted already. Local
+// addresses are always known.
+func (g *nodeGuard) known(ip net.IP, id krpc.ID) bool {
+	if isLocalAddress(ip) {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ids := g.nodes[subnetOf(ip)][ip.String()]
+	node, ok := ids[id]
+	if ok {
+		node.seen = time.Now()
+		ids[id] = node
+	}
+	return ok
+}
+
+// admit records a message from node id at a proven address ip and reports
+// whether it may be handled. Known nodes always may; a new one only while its
+// address and subnet are under the limits.
+func (g *nodeGuard) admit(ip net.IP, id krpc.ID) bool {
+	if isLocalAddress(ip) {
+		return true
+	}
+	subnet, host := subnetOf(ip), ip.String()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.prune()
+
+	hosts := g.nodes[subnet]
+	if node, known := hosts[host][id]; known {
+		node.seen = time.Now()
+		hosts[host][id] = node
+		return true
+	}
+	if hosts == nil && len(g.nodes) >= maxGuardSubnets {
+		g.rejected++
+		return false
+	}
+
+	var hostNodes, hostInsecure, subnetNodes, subnetInsecure int
+	for h, ids := range hosts {
+		for _, node := range ids {
+			subnetNodes++
+			if !node.secure {
+				subnetInsecure++
+			}
+			if h == host {
+				hostNodes++
+				if !node.secure {
+					hostInsecure++
+				}
+			}
+		}
+	}
+
+	secure := nodeIDSecure(id, ip)
+	if hostNodes >= maxNodesPerIP || subnetNodes >= maxNodesPerSubnet ||
+		!secure && (hostInsecure >= maxInsecureNodesPerIP || subnetInsecure >= maxInsecureNodesPerSubnet) {
+		g.rejected++
+		return false
+	}
+
+	if hosts == nil {
+		hosts = make(map[string]map[krpc.ID]guardedNode)
+		g.nodes[subnet] = hosts
+	}
+	if hosts[host] == nil {
+		hosts[host] = make(map[krpc.ID]guardedNode)
+	}
+	hosts[host][id] = guardedNode{secure: secure, seen: time.Now()}
+	return true
+}
+
+// trusted reports whether ip is a local address or one we have heard a
+// BEP 42 compliant node ID from
+func (g *nodeGuard) trusted(ip net.IP) bool {
+	if isLocalAddress(ip) {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, node := range g.nodes[subnetOf(ip)][ip.String()] {
+		if node.secure {
+			return true
+		}
+	}
+	return false
+}
+
+// vote records that a node at reporter saw us at external
+func (g *nodeGuard) vote(external, reporter net.IP) {
+	if external == nil || external.IsUnspecified() || isLocalAddress(reporter) {
+		return
+	}
+	key := external.String()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	subnets := g.votes[key]
+	if subnets == nil {
+		if len(g.votes) >= maxExternalIPCandidates {
+			return
+		}
+		subnets = make(map[string]time.Time)
+		g.votes[key] = subnets
+	}
+	subnets[subnetOf(reporter)] = time.Now()
+}
+
+// externalIP returns the address most subnets report seeing us at, once at
+// least minExternalIPVotes agree. IPv4 is preferred, as the one node ID is
+// shared by both routing tables.
+func (g *nodeGuard) externalIP() net.IP {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	type candidate struct {
+		ip    net.IP
+		votes int
+	}
+	var candidates []candidate
+	for key, subnets := range g.votes {
+		if len(subnets) >= minExternalIPVotes {
+			candidates = append(candidates, candidate{net.ParseIP(key), len(subnets)})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if ipv4 := candidates[i].ip.To4() != nil; ipv4 != (candidates[j].ip.To4() != nil) {
+			return ipv4
+		}
+		return candidates[i].votes > candidates[j].votes
+	})
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[0].ip
+}
+
+// counts returns how many node IDs are tracked, how many of them are not
+// BEP 42 compliant, and how many new ones were turned away
+func (g *nodeGuard) counts() (nodes, insecure int, rejected int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, hosts := range g.nodes {
+		for _, ids := range hosts {
+			for _, node := range ids {
+				nodes++
+				if !node.secure {
+					insecure++
+				}
+			}
+		}
+	}
+	return nodes, insecure, g.rejected
+}
+
+// prune forgets node IDs and votes older than nodeGuardExpiry, at most once a
+// minute. The caller holds g.mu.
+func (g *nodeGuard) prune() {
+	if time.Since(g.lastPrune) < time.Minute {
+		return
+	}
+	g.lastPrune = time.Now()
+
+	for subnet, hosts := range g.nodes {
+		for host, ids := range hosts {
+			for id, node := range ids {
+				if time.Since(node.seen) >= nodeGuardExpiry {
+					delete(ids, id)
+				}
+			}
+			if len(ids) == 0 {
+				delete(hosts, host)
+			}
+		}
+		if len(hosts) == 0 {
+			delete(g.nodes, subnet)
+		}
+	}
+	for key, subnets := range g.votes {
+		for subnet, seen := range subnets {
+			if time.Since(seen) >= nodeGuardExpiry {
+				delete(subnets, subnet)
+			}
+		}
+		if len(subnets) == 0 {
+			delete(g.votes, key)
+		}
+	}
+	g.pruneChallenges()
+}
+
+// pruneChallenges forgets expired queries and tokens. The caller holds g.mu.
+func (g *nodeGuard) pruneChallenges() {
+	now := time.Now()
+	for key, expiry := range g.challenges {
+		if now.After(expiry) {
+			delete(g.challenges, key)
+		}
+	}
+}
+
+// guardConn passes received KRPC messages through a nodeGuard before the DHT
+// library sees them. Messages the guard turns away are dropped, so their
+// senders never enter the routing table. It also shows the guard the queries
+// and tokens we send, which nodes prove their address with.
+type guardConn struct {
+	net.PacketConn
+	guard *nodeGuard
+}
+
+// ReadFrom returns the next packet the guard admits
+func (c *guardConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		if n, ok := c.admit(p, n, addr); ok {
+			return n, addr, nil
+		}
+	}
+}
+
+// WriteTo records our queries and the tokens in our replies before sending p
+func (c *guardConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		var msg krpc.Msg
+		if err := bencode.Unmarshal(p, &msg); err == nil {
+			switch {
+			case msg.Y == "q":
+				c.guard.challenge(challengeKey("q", udpAddr, msg.T), guardQueryExpiry)
+			case msg.Y == "r" && msg.R != nil && msg.R.Token != nil:
+				c.guard.challenge(challengeKey("t", udpAddr, *msg.R.Token), guardTokenExpiry)
+			}
+		}
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// admit checks the sender of the packet in p[:n] and returns the length of
+// the packet to hand on, which may have been rewritten. Replies count once
+// they answer one of our queries, and queries once they carry a token we gave
+// their address; other queries from unknown nodes are marked read-only (BEP
+// 43), so the library answers them without adding the sender to its routing
+// table. Packets that are not KRPC queries or replies are left to the library.
+func (c *guardConn) admit(p []byte, n int, addr net.Addr) (int, bool) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return n, true
+	}
+	var msg krpc.Msg
+	if err := bencode.Unmarshal(p[:n], &msg); err != nil {
+		return n, true
+	}
+	switch {
+	case msg.Y == "r" && msg.R != nil:
+		if !c.guard.proven(challengeKey("q", udpAddr, msg.T), true) {
+			return n, false // Not an answer to a query of ours; the library would ignore it too
+		}
+		c.guard.vote(msg.IP.IP, udpAddr.IP)
+		return n, c.guard.admit(udpAddr.IP, msg.R.ID)
+	case msg.Y == "q" && msg.A != nil:
+		if msg.ReadOnly || c.guard.known(udpAddr.IP, msg.A.ID) {
+			return n, true
+		}
+		if msg.A.Token != "" && c.guard.proven(challengeKey("t", udpAddr, msg.A.Token), false) {
+			return n, c.guard.admit(udpAddr.IP, msg.A.ID)
+		}
+		msg.ReadOnly = true
+		packet, err := bencode.Marshal(msg)
+		if err != nil || len(packet) > len(p) {
+			return n, false
+		}
+		return copy(p, packet), true
+	default:
+		return n, true
+	}
+}
+
+// peerLimiter counts the peers of a store by address and subnet
+type peerLimiter struct {
+	hosts   map[string]int
+	subnets map[string]int
+}
+
+// newPeerLimiter creates a limiter that counts no peers
+func newPeerLimiter() *peerLimiter {
+	return &peerLimiter{hosts: make(map[string]int), subnets: make(map[string]int)}
+}
+
+// allow reports whether one more peer at host fits under the Sybil limits,
+// the lower ones when host is not trusted. Hostnames and local addresses
+// always fit.
+func (l *peerLimiter) allow(host string, trusted bool) bool {
+	ip := net.ParseIP(host)
+	if ip == nil || isLocalAddress(ip) {
+		return true
+	}
+	perIP, perSubnet := maxPeersPerIP, maxPeersPerSubnet
+	if !trusted {
+		perIP, perSubnet = maxUntrustedPeersPerIP, maxUntrustedPeersPerSubnet
+	}
+	return l.hosts[host] < perIP && l.subnets[subnetOf(ip)] < perSubnet
+}
+
+// add counts a peer at host
+func (l *peerLimiter) add(host string) {
+	l.hosts[host]++
+	if ip := net.ParseIP(host); ip != nil {
+		l.subnets[subnetOf(ip)]++
+	}
+}
+
+// remove stops counting a peer at host
+func (l *peerLimiter) remove(host string) {
+	if l.hosts[host]--; l.hosts[host] <= 0 {
+		delete(l.hosts, host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		subnet := subnetOf(ip)
+		if l.subnets[subnet]--; l.subnets[subnet] <= 0 {
+			delete(l.subnets, subnet)
+		}
+	}
+}
+
+// checkExternalIP compares the external IP other nodes report with the one
+// our node ID is bound to. On a change the identity file is updated with the
+// new IP and, when the node ID is not bound to it, a bound node ID, which is
+// returned with true; the caller decides when the DHT nodes switch to it.
+func (ds *DHTServer) checkExternalIP() ([20]byte, bool) {
+	ip := ds.guard.externalIP()
+	if ip == nil || isLocalAddress(ip) || ip.Equal(ds.config.ExternalIP) {
+		return ds.config.NodeID, false
+	}
+	ds.config.ExternalIP = ip
+	if nodeIDSecure(ds.config.NodeID, ip) {
+		log.Printf("[DHT] External address is %s; node ID is bound to it (BEP 42)", ip)
+		ds.saveIdentity(ds.config.NodeID)
+		return ds.config.NodeID, false
+	}
+
+	nodeID := secureNodeID(ds.config.NodeID, ip)
+	log.Printf("[DHT] External address is %s; binding node ID to it (BEP 42): %x", ip, nodeID)
+	ds.saveIdentity(nodeID)
+	return nodeID, true
+}
+
+// saveIdentity writes nodeID to the identity file with the current external IP
+func (ds *DHTServer) saveIdentity(nodeID [20]byte) {
+	if ds.config.IdentityFile == "" {
+		return
+	}
+	identity := &DHTIdentity{NodeID: nodeID, ExternalIP: ds.config.ExternalIP}
+	if err := identity.Save(ds.config.IdentityFile); err != nil {
+		log.Printf("[DHT] Warning: %v", err)
+	}
+}
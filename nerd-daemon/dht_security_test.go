@@ -0,0 +1,251 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// discardConn swallows everything written to it
+type discardConn struct {
+	net.PacketConn
+}
+
+func (discardConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return len(p), nil
+}
+
+// guardStep is a KRPC message sent to or received from a node
+type guardStep struct {
+	send bool // We send msg to addr; otherwise addr sends it to us
+	addr string
+	msg  krpc.Msg
+
+	wantAdmit    bool
+	wantReadOnly bool // The admitted packet was marked read-only
+}
+
+func testNodeID(ip string, n byte) krpc.ID {
+	return krpc.ID(secureNodeID([20]byte{10: n}, net.ParseIP(ip)))
+}
+
+func TestGuardConnAdmit(t *testing.T) {
+	const node = "8.8.8.8:6881"
+	id := testNodeID("8.8.8.8", 1)
+	token := "token"
+	query := func(t string, args krpc.MsgArgs) krpc.Msg {
+		return krpc.Msg{T: t, Y: krpc.YQuery, Q: "ping", A: &args}
+	}
+	reply := func(t string, ret krpc.Return) krpc.Msg {
+		return krpc.Msg{T: t, Y: krpc.YResponse, R: &ret}
+	}
+
+	tests := []struct {
+		name      string
+		steps     []guardStep
+		wantNodes int
+	}{
+		{
+			name: "reply to our query counts the node",
+			steps: []guardStep{
+				{send: true, addr: node, msg: query("aa", krpc.MsgArgs{})},
+				{addr: node, msg: reply("aa", krpc.Return{ID: id}), wantAdmit: true},
+			},
+			wantNodes: 1,
+		},
+		{
+			name: "unsolicited reply is dropped",
+			steps: []guardStep{
+				{addr: node, msg: reply("aa", krpc.Return{ID: id})},
+			},
+		},
+		{
+			name: "a query is answered once",
+			steps: []guardStep{
+				{send: true, addr: node, msg: query("aa", krpc.MsgArgs{})},
+				{addr: node, msg: reply("aa", krpc.Return{ID: id}), wantAdmit: true},
+				{addr: node, msg: reply("aa", krpc.Return{ID: id})},
+			},
+			wantNodes: 1,
+		},
+		{
+			name: "reply from another port is dropped",
+			steps: []guardStep{
+				{send: true, addr: node, msg: query("aa", krpc.MsgArgs{})},
+				{addr: "8.8.8.8:6882", msg: reply("aa", krpc.Return{ID: id})},
+			},
+		},
+		{
+			name: "query from an unknown node is answered read-only",
+			steps: []guardStep{
+				{addr: node, msg: query("aa", krpc.MsgArgs{ID: id}), wantAdmit: true, wantReadOnly: true},
+			},
+		},
+		{
+			name: "query with a token we issued counts the node",
+			steps: []guardStep{
+				{send: true, addr: node, msg: reply("aa", krpc.Return{ID: id, Token: &token})},
+				{addr: node, msg: query("bb", krpc.MsgArgs{ID: id, Token: token}), wantAdmit: true},
+			},
+			wantNodes: 1,
+		},
+		{
+			name: "token issued to another address proves nothing",
+			steps: []guardStep{
+				{send: true, addr: "8.8.4.4:6881", msg: reply("aa", krpc.Return{ID: id, Token: &token})},
+				{addr: node, msg: query("bb", krpc.MsgArgs{ID: id, Token: token}), wantAdmit: true, wantReadOnly: true},
+			},
+		},
+		{
+			name: "queries from a counted node pass unchanged",
+			steps: []guardStep{
+				{send: true, addr: node, msg: query("aa", krpc.MsgArgs{})},
+				{addr: node, msg: reply("aa", krpc.Return{ID: id}), wantAdmit: true},
+				{addr: node, msg: query("bb", krpc.MsgArgs{ID: id}), wantAdmit: true},
+			},
+			wantNodes: 1,
+		},
+		{
+			name: "local addresses need no proof",
+			steps: []guardStep{
+				{addr: "192.168.1.2:6881", msg: query("aa", krpc.MsgArgs{ID: id}), wantAdmit: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard := newNodeGuard()
+			conn := &guardConn{PacketConn: discardConn{}, guard: guard}
+
+			for i, step := range tt.steps {
+				addr, err := net.ResolveUDPAddr("udp", step.addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				packet, err := bencode.Marshal(step.msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if step.send {
+					conn.WriteTo(packet, addr)
+					continue
+				}
+
+				p := make([]byte, 1500)
+				n, admitted := conn.admit(p, copy(p, packet), addr)
+				if admitted != step.wantAdmit {
+					t.Fatalf("step %d: admitted = %v, want %v", i, admitted, step.wantAdmit)
+				}
+				if !admitted {
+					continue
+				}
+				var got krpc.Msg
+				if err := bencode.Unmarshal(p[:n], &got); err != nil {
+					t.Fatalf("step %d: admitted packet does not decode: %v", i, err)
+				}
+				if got.ReadOnly != step.wantReadOnly {
+					t.Errorf("step %d: read-only = %v, want %v", i, got.ReadOnly, step.wantReadOnly)
+				}
+				if got.T != step.msg.T || got.Y != step.msg.Y {
+					t.Errorf("step %d: rewritten message lost its transaction", i)
+				}
+			}
+			if nodes, _, _ := guard.counts(); nodes != tt.wantNodes {
+				t.Errorf("counted nodes = %d, want %d", nodes, tt.wantNodes)
+			}
+		})
+	}
+}
+
+func TestNodeGuardLimits(t *testing.T) {
+	type admission struct {
+		ip     string
+		n      byte
+		secure bool
+		want   bool
+	}
+
+	tests := []struct {
+		name       string
+		admissions []admission
+	}{
+		{
+			name: "node IDs per address",
+			admissions: []admission{
+				{"8.8.8.8", 1, true, true},
+				{"8.8.8.8", 2, true, true},
+				{"8.8.8.8", 3, true, true},
+				{"8.8.8.8", 4, true, true},
+				{"8.8.8.8", 5, true, false},
+				{"8.8.8.8", 1, true, true}, // Known nodes are always admitted
+			},
+		},
+		{
+			name: "insecure node IDs per address",
+			admissions: []admission{
+				{"8.8.8.8", 1, false, true},
+				{"8.8.8.8", 2, false, false},
+				{"8.8.8.8", 3, true, true},
+			},
+		},
+		{
+			name: "local addresses are exempt",
+			admissions: []admission{
+				{"10.0.0.1", 1, false, true},
+				{"10.0.0.1", 2, false, true},
+				{"10.0.0.1", 3, false, true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard := newNodeGuard()
+			for i, a := range tt.admissions {
+				ip := net.ParseIP(a.ip)
+				id := krpc.ID{10: a.n}
+				if a.secure {
+					id = testNodeID(a.ip, a.n)
+				}
+				if got := guard.admit(ip, id); got != a.want {
+					t.Errorf("admission %d (%s, node %d): got %v, want %v", i, a.ip, a.n, got, a.want)
+				}
+			}
+		})
+	}
+
+	t.Run("node IDs per subnet", func(t *testing.T) {
+		guard := newNodeGuard()
+		for i := 0; i < maxNodesPerSubnet; i++ {
+			ip := net.IPv4(8, 8, 8, byte(i+1))
+			if !guard.admit(ip, testNodeID(ip.String(), 1)) {
+				t.Fatalf("node %d of the subnet was turned away", i)
+			}
+		}
+		ip := net.IPv4(8, 8, 8, 200)
+		if guard.admit(ip, testNodeID(ip.String(), 1)) {
+			t.Error("node past the subnet limit was admitted")
+		}
+	})
+
+	t.Run("subnets tracked", func(t *testing.T) {
+		guard := newNodeGuard()
+		for i := 0; i < maxGuardSubnets; i++ {
+			ip := net.IPv4(11, byte(i>>8), byte(i), 1)
+			if !guard.admit(ip, testNodeID(ip.String(), 1)) {
+				t.Fatalf("subnet %d was turned away", i)
+			}
+		}
+		ip := net.IPv4(12, 0, 0, 1)
+		if guard.admit(ip, testNodeID(ip.String(), 1)) {
+			t.Error("node in a subnet past the limit was admitted")
+		}
+		known := net.IPv4(11, 0, 0, 2)
+		if !guard.admit(known, testNodeID(known.String(), 1)) {
+			t.Error("node in a tracked subnet was turned away")
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/krpc"
+)
+
+// DHT state kept under the data directory, so a restarted daemon keeps its
+// place in the DHT
+const (
+	DHTIdentityFile = "dht_identity.json" // Node ID and external IP, created on first start
+	DHTNodesFile    = "dht_nodes.dat"     // Routing table nodes of both address families, in compact form
+	dhtSecretSize   = 20
+)
+
+// DHTIdentity is the node ID kept across restarts, with the external address
+// it is bound to (BEP 42)
+type DHTIdentity struct {
+	NodeID     [20]byte
+	ExternalIP net.IP // nil until other nodes have agreed on our address
+}
+
+// dhtIdentity is the saved form of a DHTIdentity. Files written before the
+// token secret was dropped still hold one; it is ignored.
+type dhtIdentity struct {
+	NodeID     string `json:"node_id"`
+	ExternalIP string `json:"external_ip,omitempty"`
+}
+
+// LoadDHTIdentity reads the node ID from path, creating it the first time. Keeping the node ID means the nodes that hold us in their
+// routing tables still find us where they expect after a restart.
+func LoadDHTIdentity(path string) (*DHTIdentity, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var saved dhtIdentity
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return nil, fmt.Errorf("invalid DHT identity in %s: %v", path, err)
+		}
+		identity := &DHTIdentity{}
+		id, err := hex.DecodeString(saved.NodeID)
+		if err != nil || len(id) != len(identity.NodeID) {
+			return nil, fmt.Errorf("invalid DHT node ID in %s", path)
+		}
+		copy(identity.NodeID[:], id)
+		if saved.ExternalIP != "" {
+			if identity.ExternalIP = net.ParseIP(saved.ExternalIP); identity.ExternalIP == nil {
+				return nil, fmt.Errorf("invalid DHT external IP in %s", path)
+			}
+		}
+		return identity, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	nodeID, err := GenerateRandomNodeID()
+	if err != nil {
+		return nil, err
+	}
+	identity := &DHTIdentity{NodeID: nodeID}
+	if err := identity.Save(path); err != nil {
+		return nil, err
+	}
+	log.Printf("[DHT] Created node identity in %s", path)
+	return identity, nil
+}
+
+// Save writes the identity to path, readable only by us
+func (identity *DHTIdentity) Save(path string) error {
+	saved := dhtIdentity{
+		NodeID: hex.EncodeToString(identity.NodeID[:]),
+	}
+	if identity.ExternalIP != nil {
+		saved.ExternalIP = identity.ExternalIP.String()
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save DHT identity: %v", err)
+	}
+	return nil
+}
+
+// savedNodeAddrs returns the addresses of the saved nodes of one address
+// family. A missing or unreadable file gives none.
+func savedNodeAddrs(path string, ipv6 bool) []dht.Addr {
+	if path == "" {
+		return nil
+	}
+	nodes, err := dht.ReadNodesFromFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[DHT] Ignoring saved nodes in %s: %v", path, err)
+		}
+		return nil
+	}
+
+	var addrs []dht.Addr
+	for _, node := range nodes {
+		ip := node.Addr.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if (ip.To4() == nil) != ipv6 || node.Addr.Port == 0 {
+			continue
+		}
+		addrs = append(addrs, dht.NewAddr(&net.UDPAddr{IP: ip, Port: node.Addr.Port}))
+	}
+	return addrs
+}
+
+// saveNodes writes the nodes of every routing table to the nodes file. An
+// empty table, as after losing the network, leaves the last good file alone.
+func (ds *DHTServer) saveNodes() {
+	if ds.config.NodesFile == "" {
+		return
+	}
+	var nodes []krpc.NodeInfo
+	for _, server := range ds.servers() {
+		nodes = append(nodes, server.Nodes()...)
+	}
+	if len(nodes) == 0 {
+		return
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated node list
+	path := ds.config.NodesFile
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("[DHT] Warning: failed to save nodes: %v", err)
+		return
+	}
+	if err := dht.WriteNodesToFile(nodes, path+".tmp"); err != nil {
+		log.Printf("[DHT] Warning: failed to save nodes: %v", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Printf("[DHT] Warning: failed to save nodes: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDHTIdentityRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", DHTIdentityFile)
+
+	created, err := LoadDHTIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("identity file: %v, %v; want mode 0600", info, err)
+	}
+	loaded, err := LoadDHTIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.NodeID != created.NodeID || loaded.ExternalIP != nil {
+		t.Errorf("loaded %x %v, want %x and no external IP", loaded.NodeID, loaded.ExternalIP, created.NodeID)
+	}
+
+	// The external IP learned later is saved with the node ID
+	for _, ip := range []net.IP{net.ParseIP("203.0.113.7"), net.ParseIP("2001:db8::7")} {
+		saved := &DHTIdentity{NodeID: secureNodeID(created.NodeID, ip), ExternalIP: ip}
+		if err := saved.Save(path); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadDHTIdentity(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.NodeID != saved.NodeID || !loaded.ExternalIP.Equal(ip) {
+			t.Errorf("loaded %x %v, want %x %v", loaded.NodeID, loaded.ExternalIP, saved.NodeID, ip)
+		}
+	}
+}
+
+func TestLoadDHTIdentityFile(t *testing.T) {
+	const nodeID = "0102030405060708090a0b0c0d0e0f1011121314"
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{name: "node ID only", data: `{"node_id": "` + nodeID + `"}`},
+		{name: "token secret from an older version", data: `{"node_id": "` + nodeID + `", "token_secret": "00"}`},
+		{name: "short node ID", data: `{"node_id": "0102"}`, wantErr: true},
+		{name: "node ID not hex", data: `{"node_id": "zz"}`, wantErr: true},
+		{name: "bad external IP", data: `{"node_id": "` + nodeID + `", "external_ip": "nowhere"}`, wantErr: true},
+		{name: "not JSON", data: "node_id", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), DHTIdentityFile)
+		if err := os.WriteFile(path, []byte(tt.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		identity, err := LoadDHTIdentity(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: LoadDHTIdentity error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && identity.NodeID != [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20} {
+			t.Errorf("%s: node ID %x, want %s", tt.name, identity.NodeID, nodeID)
+		}
+	}
+}
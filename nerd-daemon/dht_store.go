@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/bep44"
+	"github.com/anacrolix/dht/v2/exts/getput"
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// DHT item storage parameters (BEP 44)
+const (
+	MaxDHTItemSize = 1000 // Bytes of the bencoded value
+	MaxDHTSaltSize = 64
+	DHTItemKeyFile = "dht_item.key"   // Under the data directory; signs the mutable items we publish
+	DHTItemTimeout = 30 * time.Second // Control API stores and lookups give up after this
+)
+
+var (
+	// ErrDHTItemNotFound is returned when no node in the DHT holds the item
+	ErrDHTItemNotFound = errors.New("item not found in the DHT")
+
+	// ErrDHTItemChanged is returned when a compare-and-swap store finds a
+	// sequence number other than the expected one
+	ErrDHTItemChanged = errors.New("item changed since it was read")
+)
+
+// MutableItem is a BEP 44 item signed with an ed25519 key. Its key in the DHT
+// is the SHA-1 of the public key and salt, so the owner can replace the value
+// by storing it again with a higher sequence number.
+type MutableItem struct {
+	PublicKey [32]byte
+	Salt      []byte
+	Seq       int64
+	Value     []byte
+	Signature [64]byte
+}
+
+// Target returns the key the item is stored under
+func (m *MutableItem) Target() [20]byte {
+	return bep44.MakeMutableTarget(m.PublicKey, m.Salt)
+}
+
+// DHTItemStatus describes a BEP 44 item for the control API
+type DHTItemStatus struct {
+	Key       string `json:"key"`
+	Mutable   bool   `json:"mutable"`
+	PublicKey string `json:"public_key,omitempty"`
+	Salt      string `json:"salt,omitempty"`
+	Seq       int64  `json:"seq"`
+	Value     []byte `json:"value"`
+}
+
+// LoadItemKey reads the ed25519 key that signs our mutable items from path,
+// creating one the first time
+func LoadItemKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid DHT item key in %s", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DHT item key: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("failed to save DHT item key: %v", err)
+	}
+	return key, nil
+}
+
+// ItemPublicKey returns the public key of our mutable items
+func (ds *DHTServer) ItemPublicKey() ([32]byte, bool) {
+	var pub [32]byte
+	if ds.config.ItemKey == nil {
+		return pub, false
+	}
+	copy(pub[:], ds.config.ItemKey.Public().(ed25519.PublicKey))
+	return pub, true
+}
+
+// StoreNERDData stores data in the DHT as an immutable item and returns its
+// key, the SHA-1 of the bencoded value
+func (ds *DHTServer) StoreNERDData(ctx context.Context, data []byte) ([20]byte, error) {
+	if !ds.isRunning {
+		return [20]byte{}, fmt.Errorf("DHT server is not running")
+	}
+	encoded, err := encodeItemValue(data)
+	if err != nil {
+		return [20]byte{}, err
+	}
+
+	key := sha1.Sum(encoded)
+	put := bep44.Put{V: data}
+	log.Printf("[DHT] Storing NERD data: key=%x, size=%d bytes", key, len(data))
+	return key, ds.putItem(ctx, key, nil, put)
+}
+
+// RetrieveNERDData fetches the immutable item stored under key. Items held by
+// this node are returned without a lookup.
+func (ds *DHTServer) RetrieveNERDData(ctx context.Context, key [20]byte) ([]byte, error) {
+	if !ds.isRunning {
+		return nil, fmt.Errorf("DHT server is not running")
+	}
+
+	log.Printf("[DHT] Retrieving NERD data: key=%x", key)
+
+	if item, err := ds.items.Get(key); err == nil && !item.IsMutable() {
+		if value, ok := storedItemValue(item); ok {
+			return value, nil
+		}
+	}
+
+	result, err := ds.getItem(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if result.Mutable {
+		return nil, fmt.Errorf("%x is a mutable item", key)
+	}
+	return decodeItemValue(result.V)
+}
+
+// StoreMutableNERDData signs data with our item key and stores it under the
+// key's public key and salt, replacing any earlier value. The new sequence
+// number is one above the highest found in the DHT. If cas is given the store
+// only goes ahead while the current sequence number is *cas, so concurrent
+// writers do not overwrite each other; a cas of 0 also matches an item that
+// does not exist yet.
+func (ds *DHTServer) StoreMutableNERDData(ctx context.Context, salt, data []byte, cas *int64) (*MutableItem, error) {
+	if !ds.isRunning {
+		return nil, fmt.Errorf("DHT server is not running")
+	}
+	if ds.config.ItemKey == nil {
+		return nil, fmt.Errorf("no DHT item key configured")
+	}
+	if len(salt) > MaxDHTSaltSize {
+		return nil, fmt.Errorf("salt is %d bytes, more than %d", len(salt), MaxDHTSaltSize)
+	}
+	if _, err := encodeItemValue(data); err != nil {
+		return nil, err
+	}
+
+	item := &MutableItem{Salt: salt, Value: data}
+	item.PublicKey, _ = ds.ItemPublicKey()
+	target := item.Target()
+
+	// Learn the current sequence number first, so both routing tables get the same put
+	var current int64
+	found := false
+	result, err := ds.getItem(ctx, target, salt)
+	switch {
+	case err == nil && result.Mutable:
+		current, found = result.Seq, true
+	case err != nil && !errors.Is(err, ErrDHTItemNotFound):
+		return nil, err
+	}
+	if local, err := ds.items.Get(target); err == nil && local.IsMutable() && (!found || local.Seq > current) {
+		current, found = local.Seq, true
+	}
+
+	put := bep44.Put{V: data, K: &item.PublicKey, Salt: salt}
+	switch {
+	case cas != nil && (found && current != *cas || !found && *cas != 0):
+		return nil, fmt.Errorf("%w: sequence number is %d, expected %d", ErrDHTItemChanged, current, *cas)
+	case cas != nil:
+		put.Cas = *cas
+		put.Seq = *cas + 1
+	case found:
+		put.Seq = current + 1
+	}
+	put.Sign(ds.config.ItemKey)
+	item.Seq = put.Seq
+	item.Signature = put.Sig
+
+	log.Printf("[DHT] Storing mutable NERD data: key=%x, seq=%d, size=%d bytes", target, item.Seq, len(data))
+	if err := ds.putItem(ctx, target, salt, put); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// RetrieveMutableNERDData fetches the mutable item with the highest sequence
+// number stored under publicKey and salt. Signatures are verified.
+func (ds *DHTServer) RetrieveMutableNERDData(ctx context.Context, publicKey [32]byte, salt []byte) (*MutableItem, error) {
+	if !ds.isRunning {
+		return nil, fmt.Errorf("DHT server is not running")
+	}
+
+	target := bep44.MakeMutableTarget(publicKey, salt)
+	log.Printf("[DHT] Retrieving mutable NERD data: key=%x", target)
+
+	result, err := ds.getItem(ctx, target, salt)
+	var item *MutableItem
+	if err == nil && result.Mutable {
+		value, err := decodeItemValue(result.V)
+		if err != nil {
+			return nil, err
+		}
+		item = &MutableItem{PublicKey: publicKey, Salt: salt, Seq: result.Seq, Value: value, Signature: result.Sig}
+	} else if err != nil && !errors.Is(err, ErrDHTItemNotFound) {
+		return nil, err
+	}
+
+	// A newer value we hold ourselves, such as one we just published, wins
+	if local, err := ds.items.Get(target); err == nil && local.IsMutable() && (item == nil || local.Seq > item.Seq) {
+		if value, ok := storedItemValue(local); ok {
+			item = &MutableItem{PublicKey: publicKey, Salt: salt, Seq: local.Seq, Value: value, Signature: local.Sig}
+		}
+	}
+	if item == nil {
+		return nil, ErrDHTItemNotFound
+	}
+	return item, nil
+}
+
+// getItem looks target up in every routing table. Immutable results are
+// checked against the key and mutable ones against their signature; of
+// several mutable results the one with the highest sequence number wins.
+func (ds *DHTServer) getItem(ctx context.Context, target bep44.Target, salt []byte) (getput.GetResult, error) {
+	servers := ds.servers()
+	results := make(chan getput.GetResult, len(servers))
+	for _, server := range servers {
+		go func(server *dht.Server) {
+			// A value found before ctx ends is returned along with ctx's error
+			result, _, _ := getput.Get(ctx, target, server, nil, salt)
+			results <- result
+		}(server)
+	}
+
+	var best getput.GetResult
+	for range servers {
+		result := <-results
+		if result.V == nil {
+			continue
+		}
+		if best.V == nil || result.Mutable && result.Seq > best.Seq {
+			best = result
+		}
+	}
+	if best.V == nil {
+		if err := ctx.Err(); err != nil {
+			return best, fmt.Errorf("%w: %v", ErrDHTItemNotFound, err)
+		}
+		return best, ErrDHTItemNotFound
+	}
+	return best, nil
+}
+
+// putItem stores an item on the nodes closest to target in every routing table
+func (ds *DHTServer) putItem(ctx context.Context, target bep44.Target, salt []byte, put bep44.Put) error {
+	servers := ds.servers()
+	responses := make(chan uint32, len(servers))
+	for _, server := range servers {
+		go func(server *dht.Server) {
+			stats, err := getput.Put(ctx, target, server, salt, func(int64) bep44.Put { return put })
+			if err != nil || stats == nil {
+				responses <- 0
+				return
+			}
+			responses <- stats.NumResponses
+		}(server)
+	}
+
+	var total uint32
+	for range servers {
+		total += <-responses
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if total == 0 {
+		return fmt.Errorf("no DHT nodes answered")
+	}
+	return nil
+}
+
+// encodeItemValue bencodes data as an item value, which BEP 44 limits to 1000 bytes
+func encodeItemValue(data []byte) ([]byte, error) {
+	encoded, err := bencode.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) > MaxDHTItemSize {
+		return nil, fmt.Errorf("value is %d bytes bencoded, more than %d", len(encoded), MaxDHTItemSize)
+	}
+	return encoded, nil
+}
+
+// decodeItemValue reads a bencoded item value, which must be a byte string
+func decodeItemValue(encoded bencode.Bytes) ([]byte, error) {
+	var value []byte
+	if err := bencode.Unmarshal(encoded, &value); err != nil {
+		return nil, fmt.Errorf("item value is not a byte string: %v", err)
+	}
+	return value, nil
+}
+
+// storedItemValue returns the value of an item held by this node: our own
+// puts keep the []byte we stored, while puts from other nodes decode to a string
+func storedItemValue(item *bep44.Item) ([]byte, bool) {
+	switch value := item.V.(type) {
+	case []byte:
+		return value, true
+	case string:
+		return []byte(value), true
+	default:
+		return nil, false
+	}
+}
+
+// itemStatus describes an item for the control API
+func itemStatus(key [20]byte, value []byte) DHTItemStatus {
+	return DHTItemStatus{Key: hex.EncodeToString(key[:]), Value: value}
+}
+
+// Status describes a mutable item for the control API
+func (m *MutableItem) Status() DHTItemStatus {
+	target := m.Target()
+	return DHTItemStatus{
+		Key:       hex.EncodeToString(target[:]),
+		Mutable:   true,
+		PublicKey: hex.EncodeToString(m.PublicKey[:]),
+		Salt:      string(m.Salt),
+		Seq:       m.Seq,
+		Value:     m.Value,
+	}
+}
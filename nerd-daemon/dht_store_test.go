@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+)
+
+// newTestDHTPair starts two DHT nodes on loopback that know each other. The
+// first holds an item key and publishes; the second only reads.
+func newTestDHTPair(t *testing.T) (*DHTServer, *DHTServer) {
+	t.Helper()
+	// Loopback nodes exchange far more queries than the default send rate allows
+	limit := dht.DefaultSendLimiter.Limit()
+	dht.DefaultSendLimiter.SetLimit(1e9)
+	t.Cleanup(func() { dht.DefaultSendLimiter.SetLimit(limit) })
+
+	key, err := LoadItemKey(filepath.Join(t.TempDir(), DHTItemKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newNode := func(config *DHTConfig) *DHTServer {
+		nodeID, err := GenerateRandomNodeID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.NodeID = nodeID
+		ds, err := NewDHTServer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds.isRunning = true
+		t.Cleanup(ds.closeServers)
+		return ds
+	}
+
+	publisher := newNode(&DHTConfig{ItemKey: key})
+	port := publisher.server.Addr().(*net.UDPAddr).Port
+	reader := newNode(&DHTConfig{BootstrapNodes: []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	reader.server.BootstrapContext(ctx)
+	publisher.server.BootstrapContext(ctx)
+	if publisher.server.NumNodes() == 0 || reader.server.NumNodes() == 0 {
+		t.Fatal("DHT nodes did not find each other")
+	}
+	return publisher, reader
+}
+
+func TestStoreMutableNERDDataCAS(t *testing.T) {
+	publisher, reader := newTestDHTPair(t)
+	cas := func(seq int64) *int64 { return &seq }
+
+	tests := []struct {
+		name    string
+		stores  int // Unconditional stores before the tested one
+		cas     *int64
+		wantSeq int64
+		wantErr error
+	}{
+		{name: "first store", wantSeq: 0},
+		{name: "store replaces", stores: 2, wantSeq: 2},
+		{name: "cas 0 creates an item", cas: cas(0), wantSeq: 1},
+		{name: "cas matches", stores: 2, cas: cas(1), wantSeq: 2},
+		{name: "cas 0 on a replaced item", stores: 2, cas: cas(0), wantErr: ErrDHTItemChanged},
+		{name: "stale cas", stores: 3, cas: cas(1), wantErr: ErrDHTItemChanged},
+		{name: "cas ahead of the item", stores: 1, cas: cas(5), wantErr: ErrDHTItemChanged},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			salt := []byte(strings.ReplaceAll(tt.name, " ", "-"))
+
+			var previous *MutableItem
+			for i := 0; i < tt.stores; i++ {
+				item, err := publisher.StoreMutableNERDData(ctx, salt, []byte("earlier"), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				previous = item
+			}
+
+			item, err := publisher.StoreMutableNERDData(ctx, salt, []byte("value"), tt.cas)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("StoreMutableNERDData error = %v, want %v", err, tt.wantErr)
+			}
+			want := previous
+			if err == nil {
+				if item.Seq != tt.wantSeq {
+					t.Errorf("stored seq %d, want %d", item.Seq, tt.wantSeq)
+				}
+				want = item
+			}
+
+			// Another node sees the newest successful store
+			got, err := reader.RetrieveMutableNERDData(ctx, want.PublicKey, salt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Seq != want.Seq || !bytes.Equal(got.Value, want.Value) {
+				t.Errorf("retrieved seq %d value %q, want seq %d value %q", got.Seq, got.Value, want.Seq, want.Value)
+			}
+		})
+	}
+}
+
+func TestStoreMutableNERDDataInvalid(t *testing.T) {
+	publisher, reader := newTestDHTPair(t)
+
+	tests := []struct {
+		name   string
+		server *DHTServer
+		salt   []byte
+		data   []byte
+	}{
+		{name: "no item key", server: reader, data: []byte("value")},
+		{name: "salt too long", server: publisher, salt: make([]byte, MaxDHTSaltSize+1), data: []byte("value")},
+		{name: "value too large", server: publisher, data: make([]byte, MaxDHTItemSize)},
+	}
+
+	for _, tt := range tests {
+		if _, err := tt.server.StoreMutableNERDData(context.Background(), tt.salt, tt.data, nil); err == nil {
+			t.Errorf("%s: stored without error", tt.name)
+		}
+	}
+}
+
+func TestItemValue(t *testing.T) {
+	for _, size := range []int{0, 1, MaxDHTItemSize - 4} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		encoded, err := encodeItemValue(data)
+		if err != nil {
+			t.Errorf("encodeItemValue(%d bytes): %v", size, err)
+			continue
+		}
+		decoded, err := decodeItemValue(encoded)
+		if err != nil || !bytes.Equal(decoded, data) {
+			t.Errorf("decodeItemValue(%d bytes) = %d bytes, %v", size, len(decoded), err)
+		}
+	}
+	if _, err := decodeItemValue([]byte("i42e")); err == nil {
+		t.Error("decodeItemValue accepted an integer")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/anacrolix/torrent/mse"
+)
+
+// Encryption policies for peer connections
+const (
+	EncryptionDisabled  = "disabled"  // Plaintext only
+	EncryptionPreferred = "preferred" // Encrypt when the peer supports it, fall back to plaintext
+	EncryptionRequired  = "required"  // Refuse connections that end up unencrypted
+)
+
+// Transports a connection can use, shown in peer stats
+const (
+	TransportPlaintext = "plaintext"
+	TransportMSE       = "mse"       // BitTorrent Message Stream Encryption (BEP 8 style MSE/PE, RC4)
+	TransportNoise     = "noise"     // Authenticated X25519 + AES-GCM handshake between NERD daemons
+	TransportMSENoise  = "mse+noise" // Noise running inside an MSE stream
+)
+
+// ParseEncryptionPolicy checks a configured encryption policy; "" means preferred
+func ParseEncryptionPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return EncryptionPreferred, nil
+	case EncryptionDisabled, EncryptionPreferred, EncryptionRequired:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown encryption policy %q (want %s, %s or %s)",
+			policy, EncryptionDisabled, EncryptionPreferred, EncryptionRequired)
+	}
+}
+
+// streamConn is a net.Conn whose reads and writes go through another stream
+// (a peek buffer or an MSE cipher) while deadlines and addresses stay on the socket
+type streamConn struct {
+	net.Conn
+	rw io.ReadWriter
+}
+
+func (c *streamConn) Read(b []byte) (int, error)  { return c.rw.Read(b) }
+func (c *streamConn) Write(b []byte) (int, error) { return c.rw.Write(b) }
+
+// acceptEncryption looks at the first bytes of an incoming connection: a
+// BitTorrent handshake is plaintext, anything else must be an MSE handshake for
+// one of our torrents
+func (s *Session) acceptEncryption(conn net.Conn) (net.Conn, string, error) {
+	reader := bufio.NewReader(conn)
+	peeked := &streamConn{Conn: conn, rw: struct {
+		io.Reader
+		io.Writer
+	}{reader, conn}}
+
+	header, err := reader.Peek(1 + ProtocolStringLen)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read handshake: %w", err)
+	}
+	if header[0] == ProtocolStringLen && bytes.Equal(header[1:], []byte(ProtocolString)) {
+		return peeked, TransportPlaintext, nil
+	}
+
+	policy := s.Encryption()
+	if policy == EncryptionDisabled {
+		return nil, "", fmt.Errorf("encrypted connection refused: encryption is disabled")
+	}
+
+	skeys := func(callback func(skey []byte) bool) {
+		for _, torrent := range s.Torrents() {
+			if !callback(torrent.InfoHash[:]) {
+				return
+			}
+		}
+	}
+	selectCrypto := func(provided mse.CryptoMethod) mse.CryptoMethod {
+		if provided&mse.CryptoMethodRC4 != 0 {
+			return mse.CryptoMethodRC4
+		}
+		if policy == EncryptionRequired {
+			return 0 // Fails the handshake
+		}
+		return mse.CryptoMethodPlaintext
+	}
+
+	rw, method, err := mse.ReceiveHandshake(context.Background(), peeked, skeys, selectCrypto)
+	if err != nil {
+		return nil, "", fmt.Errorf("MSE handshake failed: %w", err)
+	}
+	return &streamConn{Conn: conn, rw: rw}, mseTransport(method), nil
+}
+
+// dialEncrypted connects to a peer following the encryption policy. With the
+// preferred policy a peer that fails the MSE handshake is redialled in plaintext.
+func (s *Session) dialEncrypted(addr string, infoHash [20]byte) (net.Conn, string, error) {
+	timeout := s.WireLimits().HandshakeTimeout
+	policy := s.Encryption()
+
+	conn, err := s.dial(addr, timeout)
+	if err != nil || policy == EncryptionDisabled {
+		return conn, TransportPlaintext, err
+	}
+
+	provides := mse.CryptoMethodRC4
+	if policy == EncryptionPreferred {
+		provides |= mse.CryptoMethodPlaintext
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	rw, method, err := mse.InitiateHandshake(conn, infoHash[:], nil, provides)
+	if err == nil {
+		return &streamConn{Conn: conn, rw: rw}, mseTransport(method), nil
+	}
+	conn.Close()
+
+	if policy == EncryptionRequired {
+		return nil, "", fmt.Errorf("MSE handshake failed: %w", err)
+	}
+	log.Printf("MSE handshake with %s failed (%v), retrying in plaintext", addr, err)
+	if conn.RemoteAddr().Network() == "utp" {
+		conn, err = s.UTP().DialTimeout(addr, utpDialTimeout(timeout))
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+	}
+	return conn, TransportPlaintext, err
+}
+
+// dial connects to a peer over uTP when it is enabled, falling back to TCP
+// for peers that do not answer on UDP
+func (s *Session) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if sock := s.UTP(); sock != nil {
+		conn, err := sock.DialTimeout(addr, utpDialTimeout(timeout))
+		if err == nil {
+			return conn, nil
+		}
+		log.Printf("No uTP answer from %s (%v), trying TCP", addr, err)
+	}
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// utpDialTimeout limits how long a uTP dial may take, leaving time for TCP
+func utpDialTimeout(timeout time.Duration) time.Duration {
+	if timeout > UTPConnectTimeout {
+		return UTPConnectTimeout
+	}
+	return timeout
+}
+
+// mseTransport names the transport an MSE handshake settled on
+func mseTransport(method mse.CryptoMethod) string {
+	if method == mse.CryptoMethodRC4 {
+		return TransportMSE
+	}
+	return TransportPlaintext // Only the handshake was obfuscated
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// encryptionPairings are the outcomes for each client and server policy when
+// both ends are NERD daemons; want is "" where the connection is refused
+var encryptionPairings = []struct {
+	client, server string
+	want           string // Transport over TCP, where the client dials with MSE unless disabled
+	wantNoMSE      string // Transport when the BitTorrent handshake is sent in plaintext
+}{
+	{EncryptionDisabled, EncryptionDisabled, TransportPlaintext, TransportPlaintext},
+	{EncryptionDisabled, EncryptionPreferred, TransportPlaintext, TransportPlaintext},
+	{EncryptionDisabled, EncryptionRequired, "", ""},
+	{EncryptionPreferred, EncryptionDisabled, TransportPlaintext, TransportPlaintext}, // The MSE dial is refused and redialled in plaintext
+	{EncryptionPreferred, EncryptionPreferred, TransportMSENoise, TransportNoise},
+	{EncryptionPreferred, EncryptionRequired, TransportMSENoise, TransportNoise},
+	{EncryptionRequired, EncryptionDisabled, "", ""},
+	{EncryptionRequired, EncryptionPreferred, TransportMSENoise, TransportNoise},
+	{EncryptionRequired, EncryptionRequired, TransportMSENoise, TransportNoise},
+}
+
+func TestParseEncryptionPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    string
+		wantErr bool
+	}{
+		{policy: "", want: EncryptionPreferred},
+		{policy: EncryptionDisabled, want: EncryptionDisabled},
+		{policy: EncryptionRequired, want: EncryptionRequired},
+		{policy: "rc4", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseEncryptionPolicy(tt.policy)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseEncryptionPolicy(%q) = %q, %v; want %q, error %v", tt.policy, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// TestNoiseNegotiation checks the reserved bit each policy sets and which
+// pairings run the Noise handshake after a plaintext BitTorrent handshake
+func TestNoiseNegotiation(t *testing.T) {
+	for _, tt := range encryptionPairings {
+		t.Run(tt.client+"/"+tt.server, func(t *testing.T) {
+			client := &wireSide{identity: testIdentity(t), policy: tt.client}
+			server := &wireSide{identity: testIdentity(t), policy: tt.server}
+			handshakePair(t, client, server)
+
+			for _, side := range []struct{ wire, peer *wireSide }{{client, server}, {server, client}} {
+				offered := side.wire.wire.peerReserved[NERDProtocolByte]&NERDEncryptionBit != 0
+				if want := side.peer.policy != EncryptionDisabled; offered != want {
+					t.Errorf("%s peer set the encryption bit: %v, want %v", side.peer.policy, offered, want)
+				}
+			}
+			if tt.wantNoMSE == "" {
+				if client.err == nil && server.err == nil {
+					t.Error("connection accepted")
+				}
+				return
+			}
+			if client.err != nil || server.err != nil {
+				t.Fatalf("negotiation failed: client %v, server %v", client.err, server.err)
+			}
+			if client.wire.Transport() != tt.wantNoMSE || server.wire.Transport() != tt.wantNoMSE {
+				t.Errorf("transports %s and %s, want %s", client.wire.Transport(), server.wire.Transport(), tt.wantNoMSE)
+			}
+		})
+	}
+}
+
+// TestConnectionEncryption connects dialPeer to handleConnection over
+// loopback TCP for each pairing of policies
+func TestConnectionEncryption(t *testing.T) {
+	seed := newTestTorrent(t, 4*BlockSize, BlockSize)
+
+	for _, tt := range encryptionPairings {
+		t.Run(tt.client+"/"+tt.server, func(t *testing.T) {
+			newSession := func(policy string) (*Session, *Torrent) {
+				session := NewSession(t.TempDir(), 0, nil, nil)
+				session.SetEncryption(policy)
+				torrent, err := NewTorrent(seed.InfoHash, seed.InfoBytes(), seed.dataDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := torrent.Recheck(); err != nil {
+					t.Fatal(err)
+				}
+				if err := session.AddTorrent(torrent); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { session.RemoveTorrent(torrent.InfoHash) })
+				return session, torrent
+			}
+			clientSession, clientTorrent := newSession(tt.client)
+			serverSession, serverTorrent := newSession(tt.server)
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { ln.Close() })
+			handled := make(chan struct{}, 4) // One per connection handleConnection is done with
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						handleConnection(conn, serverSession)
+						handled <- struct{}{}
+					}()
+				}
+			}()
+
+			dialPeer(ln.Addr().String(), clientSession, clientTorrent, PeerSourceConfig)
+
+			if tt.want == "" {
+				// The server gives up on the connection and neither side keeps a peer
+				select {
+				case <-handled:
+				case <-time.After(10 * time.Second):
+					t.Fatal("server kept the connection")
+				}
+				waitFor(t, "the client to drop the peer", func() bool { return len(clientTorrent.connectedPeers()) == 0 })
+				if peers := serverTorrent.connectedPeers(); len(peers) != 0 {
+					t.Errorf("server holds %d peers", len(peers))
+				}
+				return
+			}
+
+			waitFor(t, "both sides to add the peer", func() bool {
+				return len(clientTorrent.connectedPeers()) == 1 && len(serverTorrent.connectedPeers()) == 1
+			})
+			for name, torrent := range map[string]*Torrent{"client": clientTorrent, "server": serverTorrent} {
+				if got := torrent.connectedPeers()[0].wire.Transport(); got != tt.want {
+					t.Errorf("%s transport %s, want %s", name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
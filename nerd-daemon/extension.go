@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// BEP 10 extension protocol
+const (
+	ExtendedHandshakeID = 0 // Extended message ID of the extension handshake
+	ExtensionMetadata   = "ut_metadata"
+	ExtensionNERD       = "nerd_protocol" // NERD messages (100+) for peers using standard framing
+	ExtensionPEX        = "ut_pex"        // BEP 11 peer exchange
+
+	// Extended message IDs we accept our extensions on (advertised in "m")
+	extendedIDMetadata = 1
+	extendedIDNERD     = 2
+	extendedIDAuth     = 3
+	extendedIDPEX      = 4
+)
+
+// localExtensions maps the extensions we support to our extended message IDs
+var localExtensions = map[string]int{
+	ExtensionMetadata: extendedIDMetadata,
+	ExtensionNERD:     extendedIDNERD,
+	ExtensionAuth:     extendedIDAuth,
+	ExtensionPEX:      extendedIDPEX,
+}
+
+// extendedHandshake is the bencoded dictionary exchanged after the BitTorrent handshake
+type extendedHandshake struct {
+	M            map[string]int `bencode:"m"`                        // Extension name -> extended message ID (0 disables)
+	V            string         `bencode:"v,omitempty"`              // Client name and version
+	MetadataSize int            `bencode:"metadata_size,omitempty"`  // ut_metadata: size of the info dictionary
+	Port         int            `bencode:"p,omitempty"`              // Port the sender accepts connections on
+	Challenge    []byte         `bencode:"nerd_challenge,omitempty"` // nerd_auth: nonce the peer signs to prove its identity
+}
+
+// sendExtendedHandshake advertises our extensions to a peer that supports BEP 10
+func (pc *PeerConn) sendExtendedHandshake() error {
+	challenge := newAuthChallenge()
+	pc.mu.Lock()
+	pc.authChallenge = challenge
+	pc.mu.Unlock()
+
+	handshake := extendedHandshake{
+		M:            localExtensions,
+		V:            CreatedBy,
+		MetadataSize: len(pc.torrent.InfoBytes()),
+		Port:         pc.session.port,
+		Challenge:    challenge,
+	}
+	if pc.torrent.IsPrivate() {
+		// Private torrents only learn peers from their trackers (BEP 27)
+		handshake.M = make(map[string]int)
+		for name, id := range localExtensions {
+			if name != ExtensionPEX {
+				handshake.M[name] = id
+			}
+		}
+	}
+
+	payload, err := bencode.Marshal(handshake)
+	if err != nil {
+		return fmt.Errorf("failed to encode extended handshake: %v", err)
+	}
+	return pc.wire.SendExtended(ExtendedHandshakeID, payload)
+}
+
+// handleExtended dispatches a BEP 10 message on its extended message ID
+func (pc *PeerConn) handleExtended(payload []byte) error {
+	if len(payload) == 0 {
+		return fmt.Errorf("empty extended message")
+	}
+
+	switch payload[0] {
+	case ExtendedHandshakeID:
+		return pc.handleExtendedHandshake(payload[1:])
+	case extendedIDMetadata:
+		return pc.handleMetadataMessage(payload[1:])
+	case extendedIDAuth:
+		return pc.handleAuthResponse(payload[1:])
+	case extendedIDPEX:
+		return pc.handlePEX(payload[1:])
+	default:
+		log.Printf("Ignoring extended message %d from %s", payload[0], pc.addr)
+		return nil
+	}
+}
+
+// handleExtendedHandshake records the peer's extensions and starts fetching
+// metadata if we only have the infohash
+func (pc *PeerConn) handleExtendedHandshake(payload []byte) error {
+	var handshake extendedHandshake
+	if err := bencode.Unmarshal(payload, &handshake); err != nil {
+		return fmt.Errorf("invalid extended handshake: %v", err)
+	}
+
+	extensions := make(map[string]int)
+	for name, id := range handshake.M {
+		if id > 0 && id <= 255 {
+			extensions[name] = id
+		}
+	}
+
+	pc.mu.Lock()
+	pc.peerExtensions = extensions
+	if handshake.Port > 0 && handshake.Port <= 65535 {
+		pc.listenPort = handshake.Port
+	}
+	if len(handshake.Challenge) == AuthChallengeSize {
+		pc.peerChallenge = handshake.Challenge
+	}
+	pc.mu.Unlock()
+
+	log.Printf("Peer %s extensions: %v (client %q)", pc.addr, extensions, handshake.V)
+
+	if id, ok := extensions[ExtensionNERD]; ok {
+		pc.wire.SetNERDExtensionID(byte(id))
+	}
+	if err := pc.answerAuthChallenge(handshake.Challenge); err != nil {
+		return err
+	}
+	pc.startPEX()
+
+	if _, ok := extensions[ExtensionMetadata]; !ok || pc.torrent.HasInfo() {
+		return nil
+	}
+	if err := pc.torrent.startMetadata(handshake.MetadataSize); err != nil {
+		log.Printf("Not fetching metadata from %s: %v", pc.addr, err)
+		return nil
+	}
+	return pc.requestMetadata()
+}
+
+// peerExtensionID returns the extended message ID the peer accepts an extension on
+func (pc *PeerConn) peerExtensionID(name string) (byte, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	id, ok := pc.peerExtensions[name]
+	return byte(id), ok
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/nerd-daemon/messages"
+)
+
+// Fast Extension parameters (BEP 6)
+const (
+	AllowedFastCount   = 10 // Pieces a peer may request from us while choked
+	SuggestPieces      = 3  // Rare pieces suggested to a peer when it is unchoked
+	MaxPeerSuggestions = 16 // Suggestions remembered per peer; older ones are dropped
+)
+
+// allowedFastSet generates the canonical allowed-fast set of a peer (BEP 6):
+// repeated SHA-1 over the peer's /24 network and the infohash. The set only
+// depends on the address, so a peer cannot get more pieces by reconnecting.
+// Addresses other than IPv4 get no set.
+func allowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) []uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	k = min(k, numPieces)
+
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+
+	var set []uint32
+	seen := make(map[uint32]bool)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces)
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// sendHaveState announces our pieces after the handshake: HaveAll or HaveNone
+// when both sides support the Fast Extension, otherwise a bitfield if we have
+// anything
+func (pc *PeerConn) sendHaveState() error {
+	bitfield := pc.torrent.Bitfield()
+
+	var err error
+	switch {
+	case pc.wire.SupportsFast() && pc.torrent.IsComplete():
+		err = pc.wire.SendHaveAll()
+	case pc.wire.SupportsFast() && bitfield.Count() == 0:
+		err = pc.wire.SendHaveNone()
+	case bitfield.Count() > 0:
+		err = pc.wire.SendBitfield(bitfield)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send bitfield: %v", err)
+	}
+	return nil
+}
+
+// sendAllowedFast sends the peer its allowed-fast set, so it can fetch its
+// first pieces before the choker gets to it
+func (pc *PeerConn) sendAllowedFast() error {
+	if !pc.wire.SupportsFast() {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(pc.addr)
+	if err != nil {
+		return nil
+	}
+
+	for _, piece := range allowedFastSet(net.ParseIP(host), pc.torrent.InfoHash, pc.torrent.NumPieces(), AllowedFastCount) {
+		if !pc.state.AllowFast(piece) {
+			continue
+		}
+		if err := pc.wire.SendAllowedFast(piece); err != nil {
+			return fmt.Errorf("failed to send allowed fast: %v", err)
+		}
+	}
+	return nil
+}
+
+// allowFast lets the peer fetch a piece we have while it is choked. Peers
+// whose payment for a piece is verified get it this way without waiting for a
+// paid upload slot.
+func (pc *PeerConn) allowFast(piece uint32) error {
+	if !pc.wire.SupportsFast() || !pc.torrent.HavePiece(int(piece)) || !pc.state.AllowFast(piece) {
+		return nil
+	}
+	return pc.wire.SendAllowedFast(piece)
+}
+
+// sendSuggestions suggests the rarest pieces the peer lacks, so newly
+// unchoked peers help spread them
+func (pc *PeerConn) sendSuggestions() error {
+	if !pc.wire.SupportsFast() {
+		return nil
+	}
+
+	pc.mu.Lock()
+	bitfield := pc.bitfield
+	pc.mu.Unlock()
+
+	for _, piece := range pc.torrent.suggestionsFor(bitfield, SuggestPieces) {
+		if err := pc.wire.SendSuggest(uint32(piece)); err != nil {
+			return fmt.Errorf("failed to send suggest: %v", err)
+		}
+	}
+	return nil
+}
+
+// rejectRequests tells a Fast Extension peer that requests will not be served;
+// other peers learn it from the choke alone
+func (pc *PeerConn) rejectRequests(reqs []blockRequest) error {
+	if !pc.wire.SupportsFast() {
+		return nil
+	}
+	for _, req := range reqs {
+		if err := pc.wire.SendReject(req); err != nil {
+			return fmt.Errorf("failed to send reject: %v", err)
+		}
+	}
+	return nil
+}
+
+// requireFast rejects Fast Extension messages from peers that did not negotiate it
+func (pc *PeerConn) requireFast(name string) error {
+	if !pc.wire.SupportsFast() {
+		return fmt.Errorf("%s from a peer without the Fast Extension", name)
+	}
+	return nil
+}
+
+// decodePieceIndex parses the 4-byte payload of Suggest and AllowedFast
+func (pc *PeerConn) decodePieceIndex(name string, payload []byte) (uint32, error) {
+	if err := pc.requireFast(name); err != nil {
+		return 0, err
+	}
+	if len(payload) != 4 {
+		return 0, fmt.Errorf("%s has %d byte payload, want 4", name, len(payload))
+	}
+	index := binary.BigEndian.Uint32(payload)
+	if numPieces := pc.torrent.NumPieces(); numPieces > 0 && int(index) >= numPieces {
+		return 0, fmt.Errorf("%s for out-of-range piece %d", name, index)
+	}
+	return index, nil
+}
+
+// handleHaveAll records that the peer has every piece. Before the info is
+// known the piece count is not, so the bitfield is filled in once it is.
+func (pc *PeerConn) handleHaveAll(payload []byte) error {
+	if err := pc.requireFast("have all"); err != nil {
+		return err
+	}
+	log.Printf("Peer %s has all pieces", pc.addr)
+
+	numPieces := pc.torrent.NumPieces()
+	if numPieces == 0 {
+		pc.mu.Lock()
+		pc.haveAll = true
+		pc.mu.Unlock()
+		return nil
+	}
+	return pc.handleBitfield(&messages.BitfieldMsg{Bitfield: fullBitfield(numPieces)})
+}
+
+// handleHaveNone records that the peer has no pieces
+func (pc *PeerConn) handleHaveNone(payload []byte) error {
+	if err := pc.requireFast("have none"); err != nil {
+		return err
+	}
+	pc.mu.Lock()
+	pc.haveAll = false
+	pc.mu.Unlock()
+	return pc.handleBitfield(&messages.BitfieldMsg{Bitfield: NewBitfield(pc.torrent.NumPieces())})
+}
+
+// handleSuggest remembers a piece the peer would like us to download; the
+// picker prefers it over other pieces of equal standing
+func (pc *PeerConn) handleSuggest(payload []byte) error {
+	index, err := pc.decodePieceIndex("suggest", payload)
+	if err != nil {
+		return err
+	}
+
+	pc.mu.Lock()
+	for i, piece := range pc.suggested {
+		if piece == int(index) {
+			pc.suggested = append(pc.suggested[:i], pc.suggested[i+1:]...)
+			break
+		}
+	}
+	pc.suggested = append(pc.suggested, int(index))
+	if len(pc.suggested) > MaxPeerSuggestions {
+		pc.suggested = pc.suggested[len(pc.suggested)-MaxPeerSuggestions:]
+	}
+	pc.mu.Unlock()
+
+	return pc.fillRequests()
+}
+
+// handleAllowedFast records a piece we may request while the peer chokes us
+func (pc *PeerConn) handleAllowedFast(payload []byte) error {
+	index, err := pc.decodePieceIndex("allowed fast", payload)
+	if err != nil {
+		return err
+	}
+	pc.state.SetPeerAllowedFast(index, true)
+	return pc.fillRequests()
+}
+
+// handleReject releases a request the peer will not serve, so another peer
+// can be asked. A rejected allowed-fast piece is not requested again while
+// the peer chokes us.
+func (pc *PeerConn) handleReject(payload []byte) error {
+	if err := pc.requireFast("reject"); err != nil {
+		return err
+	}
+	if len(payload) != 12 {
+		return fmt.Errorf("reject has %d byte payload, want 12", len(payload))
+	}
+	req := blockRequest{
+		Piece:  binary.BigEndian.Uint32(payload[0:4]),
+		Offset: binary.BigEndian.Uint32(payload[4:8]),
+		Length: binary.BigEndian.Uint32(payload[8:12]),
+	}
+
+	if !pc.state.CancelRequest(req) {
+		return nil // Already released by a choke or cancelled in endgame
+	}
+	pc.torrent.releaseRequests([]blockRequest{req})
+	if pc.state.PeerChoking() {
+		pc.state.SetPeerAllowedFast(req.Piece, false)
+	}
+	return nil
+}
+
+// fullBitfield returns a bitfield with every piece set
+func fullBitfield(numPieces int) Bitfield {
+	bitfield := NewBitfield(numPieces)
+	for i := 0; i < numPieces; i++ {
+		bitfield.Set(i)
+	}
+	return bitfield
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/nerd-daemon/messages"
+	"google.golang.org/protobuf/proto"
+)
+
+// MessageDecoder parses a message payload. Routes registered without one get a
+// nil payload and read the raw bytes from the context instead.
+type MessageDecoder func(payload []byte) (proto.Message, error)
+
+// MessageContext is a received message together with the connection it arrived on
+type MessageContext struct {
+	Session *Session
+	Peer    *PeerConn
+	Message *messages.Message // As received; Payload holds the undecoded bytes
+}
+
+// MessageHandler processes a decoded message. Returning an error closes the connection.
+type MessageHandler func(ctx *MessageContext, payload proto.Message) error
+
+// messageRoute is a registered message type
+type messageRoute struct {
+	name    string
+	decode  MessageDecoder
+	handler MessageHandler
+}
+
+// MessageRegistry maps message IDs to the decoder and handler of the subsystem
+// that owns them, so new message families can be added without touching the
+// connection loop.
+type MessageRegistry struct {
+	routes map[uint32]messageRoute
+	mu     sync.RWMutex
+}
+
+// NewMessageRegistry creates an empty registry
+func NewMessageRegistry() *MessageRegistry {
+	return &MessageRegistry{
+		routes: make(map[uint32]messageRoute),
+	}
+}
+
+// Register routes a message ID to a decoder and handler. Each ID can only be registered once.
+func (r *MessageRegistry) Register(messageID uint32, name string, decode MessageDecoder, handler MessageHandler) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.routes[messageID]; ok {
+		return fmt.Errorf("message type %d already registered as %s", messageID, existing.name)
+	}
+	r.routes[messageID] = messageRoute{name: name, decode: decode, handler: handler}
+	return nil
+}
+
+// Registered returns the registered message IDs in order
+func (r *MessageRegistry) Registered() []uint32 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]uint32, 0, len(r.routes))
+	for id := range r.routes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Dispatch decodes a message and runs its handler. Unknown message types and
+// payloads that fail to decode are logged and skipped.
+func (r *MessageRegistry) Dispatch(ctx *MessageContext) error {
+	msg := ctx.Message
+
+	r.mu.RLock()
+	route, ok := r.routes[msg.MessageId]
+	r.mu.RUnlock()
+	if !ok {
+		log.Printf("Received message type %d from %s", msg.MessageId, ctx.Peer.addr)
+		return nil
+	}
+
+	payload, err := ctx.Peer.wire.DecodePayload(msg, route.decode)
+	if err != nil {
+		log.Printf("Failed to parse message payload from %s (type %d): %v", ctx.Peer.addr, msg.MessageId, err)
+		return nil
+	}
+	return route.handler(ctx, payload)
+}
+
+// ProtobufDecoder returns a decoder that unmarshals payloads into messages made by newMsg
+func ProtobufDecoder(newMsg func() proto.Message) MessageDecoder {
+	return func(payload []byte) (proto.Message, error) {
+		msg := newMsg()
+		if err := proto.Unmarshal(payload, msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+}
+
+// registerPeerHandlers registers the standard BitTorrent messages, keep-alives
+// and extension messages, which drive piece exchange on every connection
+func registerPeerHandlers(r *MessageRegistry) error {
+	routes := []struct {
+		id      uint32
+		name    string
+		newMsg  func() proto.Message
+		handler MessageHandler
+	}{
+		{999, "keep-alive", func() proto.Message { return &messages.KeepAliveMsg{} }, handleKeepAlive},
+		{MsgTypeChoke, "choke", func() proto.Message { return &messages.ChokeMsg{} }, handleChokeMessage},
+		{MsgTypeUnchoke, "unchoke", func() proto.Message { return &messages.UnchokeMsg{} }, handleUnchokeMessage},
+		{MsgTypeInterested, "interested", func() proto.Message { return &messages.InterestedMsg{} }, handleInterestedMessage},
+		{MsgTypeNotInterested, "not interested", func() proto.Message { return &messages.NotInterestedMsg{} }, handleNotInterestedMessage},
+		{MsgTypeHave, "have", func() proto.Message { return &messages.HaveMsg{} }, handleHaveMessage},
+		{MsgTypeBitfield, "bitfield", func() proto.Message { return &messages.BitfieldMsg{} }, handleBitfieldMessage},
+		{MsgTypeRequest, "request", func() proto.Message { return &messages.RequestMsg{} }, handleRequestMessage},
+		{MsgTypePiece, "piece", func() proto.Message { return &messages.PieceMsg{} }, handlePieceMessage},
+		{MsgTypeCancel, "cancel", func() proto.Message { return &messages.CancelMsg{} }, handleCancelMessage},
+		{MsgTypePort, "port", func() proto.Message { return &messages.PortMsg{} }, handlePortMessage},
+	}
+	for _, route := range routes {
+		if err := r.Register(route.id, route.name, ProtobufDecoder(route.newMsg), route.handler); err != nil {
+			return err
+		}
+	}
+
+	// Fast Extension, extension and BEP 52 hash messages keep their BitTorrent payloads rather than protobuf
+	rawRoutes := []struct {
+		id      uint32
+		name    string
+		handler func(pc *PeerConn, payload []byte) error
+	}{
+		{MsgTypeSuggest, "suggest", (*PeerConn).handleSuggest},
+		{MsgTypeHaveAll, "have all", (*PeerConn).handleHaveAll},
+		{MsgTypeHaveNone, "have none", (*PeerConn).handleHaveNone},
+		{MsgTypeReject, "reject", (*PeerConn).handleReject},
+		{MsgTypeAllowedFast, "allowed fast", (*PeerConn).handleAllowedFast},
+		{MsgTypeExtended, "extended", (*PeerConn).handleExtended},
+		{MsgTypeHashRequest, "hash request", (*PeerConn).handleHashRequest},
+		{MsgTypeHashes, "hashes", (*PeerConn).handleHashes},
+		{MsgTypeHashReject, "hash reject", (*PeerConn).handleHashReject},
+	}
+	for _, route := range rawRoutes {
+		handler := route.handler
+		err := r.Register(route.id, route.name, nil, func(ctx *MessageContext, _ proto.Message) error {
+			return handler(ctx.Peer, ctx.Message.Payload)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func handleKeepAlive(ctx *MessageContext, _ proto.Message) error {
+	log.Printf("Received keep-alive from %s", ctx.Peer.addr)
+	return nil
+}
+
+func handleChokeMessage(ctx *MessageContext, _ proto.Message) error {
+	log.Printf("Peer %s choked us", ctx.Peer.addr)
+	ctx.Peer.handleChoke()
+	return nil
+}
+
+func handleUnchokeMessage(ctx *MessageContext, _ proto.Message) error {
+	log.Printf("Peer %s unchoked us", ctx.Peer.addr)
+	return ctx.Peer.handleUnchoke()
+}
+
+func handleInterestedMessage(ctx *MessageContext, _ proto.Message) error {
+	log.Printf("Peer %s is interested", ctx.Peer.addr)
+	ctx.Peer.handleInterested()
+	ctx.Session.choker.Trigger()
+	return nil
+}
+
+func handleNotInterestedMessage(ctx *MessageContext, _ proto.Message) error {
+	log.Printf("Peer %s is not interested", ctx.Peer.addr)
+	ctx.Peer.handleNotInterested()
+	ctx.Session.choker.Trigger()
+	return nil
+}
+
+func handleHaveMessage(ctx *MessageContext, payload proto.Message) error {
+	haveMsg := payload.(*messages.HaveMsg)
+	log.Printf("Peer %s has piece %d", ctx.Peer.addr, haveMsg.PieceIndex)
+	return ctx.Peer.handleHave(haveMsg)
+}
+
+func handleBitfieldMessage(ctx *MessageContext, payload proto.Message) error {
+	bitfieldMsg := payload.(*messages.BitfieldMsg)
+	log.Printf("Peer %s sent bitfield (%d pieces)", ctx.Peer.addr, Bitfield(bitfieldMsg.Bitfield).Count())
+	return ctx.Peer.handleBitfield(bitfieldMsg)
+}
+
+func handleRequestMessage(ctx *MessageContext, payload proto.Message) error {
+	return ctx.Peer.handleRequest(payload.(*messages.RequestMsg))
+}
+
+func handlePieceMessage(ctx *MessageContext, payload proto.Message) error {
+	return ctx.Peer.handlePiece(payload.(*messages.PieceMsg))
+}
+
+func handleCancelMessage(ctx *MessageContext, payload proto.Message) error {
+	ctx.Peer.handleCancel(payload.(*messages.CancelMsg))
+	return nil
+}
+
+func handlePortMessage(ctx *MessageContext, payload proto.Message) error {
+	log.Printf("Peer %s runs a DHT node on port %d", ctx.Peer.addr, payload.(*messages.PortMsg).Port)
+	return nil
+}
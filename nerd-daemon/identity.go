@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"log"
+
+	"github.com/anacrolix/torrent/bencode"
+	primitives "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	"github.com/bsv-blockchain/go-sdk/script"
+)
+
+// PeerIDPrefix starts every NERD daemon peer ID (Azureus-style client and version)
+const PeerIDPrefix = "-ND0100-"
+
+// Peer authentication (nerd_auth extension)
+const (
+	ExtensionAuth      = "nerd_auth"
+	AuthChallengeSize  = 32
+	authSignatureLabel = "NERD peer auth v2"
+)
+
+// Identity is the local peer ID and, when a BSV key is configured, the key it
+// is derived from. Peers prove their identity by signing a challenge.
+type Identity struct {
+	privateKey *primitives.PrivateKey // nil for anonymous identities
+	peerID     [20]byte
+	address    string
+}
+
+// NewIdentity derives a stable peer ID from a BSV key
+func NewIdentity(privateKey *primitives.PrivateKey) (*Identity, error) {
+	pubKey := privateKey.PubKey()
+	address, err := script.NewAddressFromPublicKey(pubKey, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive address: %v", err)
+	}
+	return &Identity{
+		privateKey: privateKey,
+		peerID:     DerivePeerID(pubKey),
+		address:    address.AddressString,
+	}, nil
+}
+
+// NewAnonymousIdentity creates a random peer ID for daemons without a BSV key
+func NewAnonymousIdentity() *Identity {
+	id := &Identity{}
+	copy(id.peerID[:], PeerIDPrefix)
+	rand.Read(id.peerID[len(PeerIDPrefix):])
+	return id
+}
+
+// DerivePeerID returns the peer ID belonging to a public key: the client prefix
+// followed by the start of the SHA-256 of the compressed key
+func DerivePeerID(pubKey *primitives.PublicKey) [20]byte {
+	var peerID [20]byte
+	hash := sha256.Sum256(pubKey.Compressed())
+	copy(peerID[:], PeerIDPrefix)
+	copy(peerID[len(PeerIDPrefix):], hash[:])
+	return peerID
+}
+
+// PeerID returns the peer ID sent in our handshakes
+func (id *Identity) PeerID() [20]byte {
+	return id.peerID
+}
+
+// Address returns the BSV address of the identity, or "" if anonymous
+func (id *Identity) Address() string {
+	return id.address
+}
+
+// CanSign reports whether the identity can answer authentication challenges
+func (id *Identity) CanSign() bool {
+	return id.privateKey != nil
+}
+
+// authResponse is the nerd_auth message proving ownership of a peer ID
+type authResponse struct {
+	PubKey    []byte `bencode:"pubkey"` // Compressed public key the peer ID is derived from
+	Signature []byte `bencode:"sig"`    // DER signature over authSignedData
+}
+
+// authSignedData is what a peer signs to answer a challenge. It covers both
+// sides' challenges, both peer IDs and the infohash, and on encrypted
+// connections the Noise handshake hash, which a relay between two peers cannot
+// make match on both of its connections.
+func authSignedData(verifierChallenge, signerChallenge []byte, infoHash, signerID, verifierID [20]byte, handshakeHash []byte) []byte {
+	var data bytes.Buffer
+	data.WriteString(authSignatureLabel)
+	data.Write(verifierChallenge)
+	data.Write(signerChallenge)
+	data.Write(infoHash[:])
+	data.Write(signerID[:])
+	data.Write(verifierID[:])
+	data.Write(handshakeHash)
+	return data.Bytes()
+}
+
+// newAuthChallenge creates the challenge sent in our extended handshake
+func newAuthChallenge() []byte {
+	challenge := make([]byte, AuthChallengeSize)
+	rand.Read(challenge)
+	return challenge
+}
+
+// answerAuthChallenge signs the peer's challenge if we have a key to sign with
+func (pc *PeerConn) answerAuthChallenge(challenge []byte) error {
+	identity := pc.wire.identity
+	if !identity.CanSign() {
+		return nil
+	}
+	id, ok := pc.peerExtensionID(ExtensionAuth)
+	if !ok || len(challenge) != AuthChallengeSize {
+		return nil
+	}
+
+	pc.mu.Lock()
+	ownChallenge := pc.authChallenge
+	pc.mu.Unlock()
+	if ownChallenge == nil {
+		return nil // The peer would have no challenge of ours to check the answer against
+	}
+
+	data := authSignedData(challenge, ownChallenge, pc.torrent.InfoHash, identity.PeerID(), pc.wire.RemotePeerID(), pc.wire.HandshakeHash())
+	hash := sha256.Sum256(data)
+	sig, err := identity.privateKey.Sign(hash[:])
+	if err != nil {
+		return fmt.Errorf("failed to sign auth challenge: %v", err)
+	}
+	der, err := sig.ToDER()
+	if err != nil {
+		return fmt.Errorf("failed to encode auth signature: %v", err)
+	}
+
+	payload, err := bencode.Marshal(authResponse{
+		PubKey:    identity.privateKey.PubKey().Compressed(),
+		Signature: der,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode auth response: %v", err)
+	}
+	return pc.wire.SendExtended(id, payload)
+}
+
+// handleAuthResponse checks that the peer owns the key its peer ID is derived
+// from. A response that does not verify closes the connection.
+func (pc *PeerConn) handleAuthResponse(payload []byte) error {
+	var resp authResponse
+	if err := bencode.Unmarshal(payload, &resp); err != nil {
+		return fmt.Errorf("invalid %s message: %v", ExtensionAuth, err)
+	}
+
+	pc.mu.Lock()
+	challenge, peerChallenge := pc.authChallenge, pc.peerChallenge
+	pc.mu.Unlock()
+	if challenge == nil || peerChallenge == nil {
+		return fmt.Errorf("unsolicited %s response", ExtensionAuth)
+	}
+
+	pubKey, err := primitives.ParsePubKey(resp.PubKey)
+	if err != nil {
+		return fmt.Errorf("invalid %s public key: %v", ExtensionAuth, err)
+	}
+	remoteID := pc.wire.RemotePeerID()
+	if DerivePeerID(pubKey) != remoteID {
+		return fmt.Errorf("peer ID %x does not belong to the presented key", remoteID)
+	}
+	sig, err := primitives.ParseDERSignature(resp.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid %s signature: %v", ExtensionAuth, err)
+	}
+	data := authSignedData(challenge, peerChallenge, pc.torrent.InfoHash, remoteID, pc.wire.identity.PeerID(), pc.wire.HandshakeHash())
+	if !pubKey.Verify(data, sig) {
+		return fmt.Errorf("%s signature does not verify", ExtensionAuth)
+	}
+
+	address, err := script.NewAddressFromPublicKey(pubKey, true)
+	if err != nil {
+		return fmt.Errorf("failed to derive peer address: %v", err)
+	}
+
+	pc.mu.Lock()
+	pc.identity = address.AddressString
+	pc.authChallenge = nil // Each challenge is answered once
+	pc.mu.Unlock()
+
+	log.Printf("Peer %s authenticated as %s", pc.addr, address.AddressString)
+	return nil
+}
+
+// Identity returns the BSV address the peer proved it owns, or "" if it has not authenticated
+func (pc *PeerConn) Identity() string {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.identity
+}
+
+// accountKey identifies the peer for payments and reputation: its proven
+// identity, or its address until it authenticates
+func (pc *PeerConn) accountKey() string {
+	if identity := pc.Identity(); identity != "" {
+		return identity
+	}
+	return pc.addr
+}
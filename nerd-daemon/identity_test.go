@@ -0,0 +1,160 @@
+package main
+
+import "testing"
+
+// authPeers connects client and server in plaintext, so only nerd_auth can
+// prove an identity, and wraps each end in a PeerConn for its torrent. A nil
+// torrent means one without metadata for testInfoHash.
+func authPeers(t *testing.T, client, server *Identity, clientTorrent, serverTorrent *Torrent) (*PeerConn, *PeerConn) {
+	t.Helper()
+	clientSide := &wireSide{identity: client, policy: EncryptionDisabled}
+	serverSide := &wireSide{identity: server, policy: EncryptionDisabled}
+	handshakePair(t, clientSide, serverSide)
+	if clientSide.err != nil || serverSide.err != nil {
+		t.Fatalf("handshake failed: client %v, server %v", clientSide.err, serverSide.err)
+	}
+
+	newPeer := func(side *wireSide, torrent *Torrent) *PeerConn {
+		if torrent == nil {
+			var err error
+			if torrent, err = NewTorrent(testInfoHash, nil, t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pc := NewPeerConn(side.wire, "127.0.0.1:6881", torrent, NewSession(t.TempDir(), 0, nil, nil), PeerSourceIncoming)
+		t.Cleanup(pc.close)
+		return pc
+	}
+	return newPeer(clientSide, clientTorrent), newPeer(serverSide, serverTorrent)
+}
+
+// receiveExtended reads the next message on pc's connection, which must be
+// an extended one, and returns its payload
+func receiveExtended(t *testing.T, pc *PeerConn) []byte {
+	t.Helper()
+	msg, err := pc.wire.ReceiveMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MessageId != MsgTypeExtended {
+		t.Fatalf("received message %d, want an extended message", msg.MessageId)
+	}
+	return msg.Payload
+}
+
+// exchangeExtendedHandshakes sends both extended handshakes with their
+// challenges and hands each to the other side, which answers the challenge
+func exchangeExtendedHandshakes(t *testing.T, client, server *PeerConn) {
+	t.Helper()
+	for _, pc := range []*PeerConn{client, server} {
+		if err := pc.sendExtendedHandshake(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, pc := range []*PeerConn{server, client} {
+		if err := pc.handleExtended(receiveExtended(t, pc)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuthExchange(t *testing.T) {
+	alice, bob := testIdentity(t), testIdentity(t)
+
+	tests := []struct {
+		name           string
+		client, server *Identity
+	}{
+		{name: "both sign", client: alice, server: bob},
+		{name: "anonymous server", client: alice, server: NewAnonymousIdentity()},
+		{name: "anonymous client", client: NewAnonymousIdentity(), server: bob},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := authPeers(t, tt.client, tt.server, nil, nil)
+			exchangeExtendedHandshakes(t, client, server)
+
+			// Only a side with a key answers; the other sends nothing more
+			for _, side := range []struct {
+				verifier *PeerConn
+				signer   *Identity
+			}{{server, tt.client}, {client, tt.server}} {
+				if side.signer.CanSign() {
+					if err := side.verifier.handleExtended(receiveExtended(t, side.verifier)); err != nil {
+						t.Fatalf("auth response rejected: %v", err)
+					}
+				}
+				if got := side.verifier.Identity(); got != side.signer.Address() {
+					t.Errorf("peer proved as %q, want %q", got, side.signer.Address())
+				}
+			}
+		})
+	}
+}
+
+func TestAuthReplay(t *testing.T) {
+	alice, bob := testIdentity(t), testIdentity(t)
+	client, server := authPeers(t, alice, bob, nil, nil)
+	exchangeExtendedHandshakes(t, client, server)
+	response := receiveExtended(t, server)
+	if err := server.handleExtended(response); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each challenge is answered once
+	if err := server.handleExtended(response); err == nil {
+		t.Error("replayed response accepted on the same connection")
+	}
+
+	// A new connection has new challenges, so the old answer does not verify
+	client2, server2 := authPeers(t, alice, bob, nil, nil)
+	exchangeExtendedHandshakes(t, client2, server2)
+	if err := server2.handleExtended(response); err == nil {
+		t.Error("response from an earlier connection accepted")
+	}
+	if got := server2.Identity(); got != "" {
+		t.Errorf("replay proved the peer as %s", got)
+	}
+}
+
+func TestAuthRejected(t *testing.T) {
+	alice, bob, carol := testIdentity(t), testIdentity(t), testIdentity(t)
+	mallory := testIdentity(t)
+	// Claims Alice's peer ID while holding Mallory's key
+	impostor := &Identity{privateKey: mallory.privateKey, peerID: alice.PeerID()}
+
+	otherTorrent, err := NewTorrent([20]byte{1}, nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		client        *Identity
+		clientTorrent *Torrent
+		verifier      *Identity // Who the server turns out to be, when not the peer the client signed for
+	}{
+		{name: "signed for another infohash", client: alice, clientTorrent: otherTorrent},
+		{name: "peer ID of another key", client: impostor},
+		{name: "signed for another verifier", client: alice, verifier: carol},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := authPeers(t, tt.client, bob, tt.clientTorrent, nil)
+			exchangeExtendedHandshakes(t, client, server)
+			if tt.verifier != nil {
+				// As if the response was relayed to another peer
+				server.wire.identity = tt.verifier
+			}
+
+			if err := server.handleExtended(receiveExtended(t, server)); err == nil {
+				t.Error("auth response accepted")
+			}
+			if got := server.Identity(); got != "" {
+				t.Errorf("peer proved as %s", got)
+			}
+		})
+	}
+}
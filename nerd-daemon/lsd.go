@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local Service Discovery parameters (BEP 14)
+const (
+	LSDMulticastAddr  = "239.192.152.143:6771"
+	LSDMulticastAddr6 = "[ff15::efc0:988f]:6771"
+	LSDInterval       = 5 * time.Minute // How often every torrent is announced on the LAN
+	LSDMinInterval    = time.Minute     // Announces of a torrent from one host closer together than this are ignored
+	LSDHostExpiry     = 3 * LSDInterval // How long a host that announced counts as a LAN peer
+	lsdMaxInfoHashes  = 20              // Infohashes in one announce, keeping it within a single packet
+	lsdMaxPacket      = 1400
+	lsdMaxHosts       = 256  // LAN hosts remembered at once
+	lsdMaxHeard       = 4096 // Recent announces remembered at once
+)
+
+// LocalDiscovery announces the session's torrents by multicast on the local
+// network and connects to other daemons announcing the same torrents. Hosts
+// heard this way are treated as LAN peers.
+type LocalDiscovery struct {
+	groups   []*lsdGroup // IPv4 and, where available, IPv6
+	session  *Session
+	port     int
+	cookie   string // Identifies our own announces when they loop back
+	heard    map[string]time.Time
+	hosts    map[string]time.Time // LAN hosts by IP, with the time they last announced
+	stop     chan struct{}
+	stopOnce sync.Once
+	mu       sync.Mutex
+}
+
+// lsdGroup is one address family's multicast group
+type lsdGroup struct {
+	addr     string
+	listener *net.UDPConn // Joined to the multicast group
+	sender   *net.UDPConn // Multicast loopback stays on, so daemons on one host find each other
+}
+
+// ListenLSD joins the BEP 14 multicast groups and announces port as the
+// session's P2P port. A group that cannot be joined is skipped, so hosts
+// without IPv6 or without IPv4 multicast still take part.
+func ListenLSD(session *Session, port int) (*LocalDiscovery, error) {
+	var groups []*lsdGroup
+	var errs []string
+	for _, family := range []struct{ network, addr string }{
+		{"udp4", LSDMulticastAddr},
+		{"udp6", LSDMulticastAddr6},
+	} {
+		group, err := joinLSDGroup(family.network, family.addr)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		groups = append(groups, group)
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	for _, err := range errs {
+		log.Printf("[LSD] %s", err)
+	}
+
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+
+	return &LocalDiscovery{
+		groups:  groups,
+		session: session,
+		port:    port,
+		cookie:  hex.EncodeToString(cookie),
+		heard:   make(map[string]time.Time),
+		hosts:   make(map[string]time.Time),
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+// joinLSDGroup listens on and opens a sender to one multicast group
+func joinLSDGroup(network, addr string) (*lsdGroup, error) {
+	group, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenMulticastUDP(network, nil, group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join %s: %v", addr, err)
+	}
+	sender, err := net.DialUDP(network, nil, group)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to open multicast sender for %s: %v", addr, err)
+	}
+	return &lsdGroup{addr: addr, listener: listener, sender: sender}, nil
+}
+
+// Start begins receiving announces and announcing every torrent every LSDInterval
+func (ld *LocalDiscovery) Start() {
+	for _, group := range ld.groups {
+		go ld.readLoop(group)
+	}
+	go func() {
+		ticker := time.NewTicker(LSDInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ld.stop:
+				return
+			case <-ticker.C:
+			}
+
+			ld.prune()
+			var infoHashes [][20]byte
+			for _, torrent := range ld.session.Torrents() {
+				if !torrent.IsPrivate() {
+					infoHashes = append(infoHashes, torrent.InfoHash)
+				}
+			}
+			ld.Announce(infoHashes...)
+		}
+	}()
+}
+
+// Close leaves the multicast groups
+func (ld *LocalDiscovery) Close() {
+	ld.stopOnce.Do(func() {
+		close(ld.stop)
+		for _, group := range ld.groups {
+			group.listener.Close()
+			group.sender.Close()
+		}
+	})
+}
+
+// Announce tells the LAN we take part in the given torrents
+func (ld *LocalDiscovery) Announce(infoHashes ...[20]byte) {
+	for len(infoHashes) > 0 {
+		batch := infoHashes[:min(len(infoHashes), lsdMaxInfoHashes)]
+		infoHashes = infoHashes[len(batch):]
+
+		for _, group := range ld.groups {
+			var msg bytes.Buffer
+			fmt.Fprintf(&msg, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", group.addr, ld.port)
+			for _, infoHash := range batch {
+				fmt.Fprintf(&msg, "Infohash: %x\r\n", infoHash)
+			}
+			fmt.Fprintf(&msg, "cookie: %s\r\n\r\n\r\n", ld.cookie)
+
+			if _, err := group.sender.Write(msg.Bytes()); err != nil {
+				log.Printf("[LSD] Failed to announce %d torrents to %s: %v", len(batch), group.addr, err)
+			}
+		}
+	}
+}
+
+// readLoop handles announces to a group until its socket is closed
+func (ld *LocalDiscovery) readLoop(group *lsdGroup) {
+	buf := make([]byte, lsdMaxPacket)
+	for {
+		n, from, err := group.listener.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-ld.stop:
+			default:
+				log.Printf("[LSD] Receive error: %v", err)
+			}
+			return
+		}
+		ld.receive(buf[:n], from)
+	}
+}
+
+// receive connects to the sender of an announce for each torrent we share with it
+func (ld *LocalDiscovery) receive(packet []byte, from *net.UDPAddr) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil || req.Method != "BT-SEARCH" {
+		return
+	}
+	if req.Header.Get("Cookie") == ld.cookie {
+		return // Our own announce
+	}
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return
+	}
+	if !isLANSender(from.IP) {
+		return // Unicast from beyond the LAN reaches the group's port too
+	}
+
+	host := from.IP.String()
+	if from.Zone != "" {
+		host += "%" + from.Zone // Link-local IPv6 senders are only reachable through the interface they used
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	now := time.Now()
+
+	ld.mu.Lock()
+	known := rememberLocked(ld.hosts, host, now, lsdMaxHosts, LSDHostExpiry)
+	ld.mu.Unlock()
+	if !known {
+		return
+	}
+
+	for _, value := range req.Header.Values("Infohash") {
+		infoHash, err := parseInfoHash(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		torrent, exists := ld.session.GetTorrent(infoHash)
+		if !exists || torrent.IsPrivate() {
+			continue
+		}
+
+		key := addr + "/" + value
+		ld.mu.Lock()
+		recent := now.Sub(ld.heard[key]) < LSDMinInterval
+		remembered := rememberLocked(ld.heard, key, now, lsdMaxHeard, LSDMinInterval)
+		ld.mu.Unlock()
+		if recent || !remembered {
+			continue
+		}
+
+		log.Printf("[LSD] %s announced %s", addr, torrent.Name())
+		if ld.session.dhtServer != nil {
+			ld.session.dhtServer.addDiscoveredPeer(host, port, PeerSourceLSD, nil)
+		}
+		ld.session.dialDiscovered(torrent, addr, PeerSourceLSD)
+	}
+}
+
+// rememberLocked records key as seen at now. A full map first drops entries
+// older than expiry; if it is still full a new key is not recorded and false
+// is returned. ld.mu must be held.
+func rememberLocked(seen map[string]time.Time, key string, now time.Time, max int, expiry time.Duration) bool {
+	if _, ok := seen[key]; !ok && len(seen) >= max {
+		for k, t := range seen {
+			if now.Sub(t) >= expiry {
+				delete(seen, k)
+			}
+		}
+		if len(seen) >= max {
+			return false
+		}
+	}
+	seen[key] = now
+	return true
+}
+
+// isLANSender reports whether ip is loopback, private or link-local, or on
+// the subnet of one of our interfaces
+func isLANSender(ip net.IP) bool {
+	if isLocalAddress(ip) {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// prune forgets announces too old to matter
+func (ld *LocalDiscovery) prune() {
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+
+	for key, heard := range ld.heard {
+		if time.Since(heard) >= LSDMinInterval {
+			delete(ld.heard, key)
+		}
+	}
+	for host, heard := range ld.hosts {
+		if time.Since(heard) > LSDHostExpiry {
+			delete(ld.hosts, host)
+		}
+	}
+}
+
+// IsLocalHost reports whether host announced itself on the LAN recently
+func (ld *LocalDiscovery) IsLocalHost(host string) bool {
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+
+	heard, ok := ld.hosts[host]
+	return ok && time.Since(heard) <= LSDHostExpiry
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestLSD(t *testing.T) *LocalDiscovery {
+	t.Helper()
+	return &LocalDiscovery{
+		session: NewSession(t.TempDir(), 0, nil, nil),
+		cookie:  "ourcookie",
+		heard:   make(map[string]time.Time),
+		hosts:   make(map[string]time.Time),
+		stop:    make(chan struct{}),
+	}
+}
+
+func lsdAnnounce(port, cookie string) []byte {
+	return []byte(fmt.Sprintf("BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %s\r\nInfohash: %x\r\ncookie: %s\r\n\r\n\r\n",
+		LSDMulticastAddr, port, testInfoHash, cookie))
+}
+
+func TestLSDReceive(t *testing.T) {
+	tests := []struct {
+		name     string
+		packet   []byte
+		from     *net.UDPAddr
+		host     string
+		wantHost bool
+	}{
+		{name: "private sender", packet: lsdAnnounce("6881", "theirs"), from: &net.UDPAddr{IP: net.ParseIP("192.168.1.5")}, host: "192.168.1.5", wantHost: true},
+		{name: "loopback sender", packet: lsdAnnounce("6881", "theirs"), from: &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, host: "127.0.0.1", wantHost: true},
+		{name: "link-local sender", packet: lsdAnnounce("6881", "theirs"), from: &net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}, host: "fe80::1%eth0", wantHost: true},
+		{name: "non-local sender", packet: lsdAnnounce("6881", "theirs"), from: &net.UDPAddr{IP: net.ParseIP("203.0.113.7")}, host: "203.0.113.7"},
+		{name: "our own announce", packet: lsdAnnounce("6881", "ourcookie"), from: &net.UDPAddr{IP: net.ParseIP("192.168.1.5")}, host: "192.168.1.5"},
+		{name: "bad port", packet: lsdAnnounce("70000", "theirs"), from: &net.UDPAddr{IP: net.ParseIP("192.168.1.5")}, host: "192.168.1.5"},
+		{name: "not BT-SEARCH", packet: []byte("GET / HTTP/1.1\r\nPort: 6881\r\n\r\n"), from: &net.UDPAddr{IP: net.ParseIP("192.168.1.5")}, host: "192.168.1.5"},
+	}
+
+	for _, tt := range tests {
+		ld := newTestLSD(t)
+		ld.receive(tt.packet, tt.from)
+		if got := ld.IsLocalHost(tt.host); got != tt.wantHost {
+			t.Errorf("%s: IsLocalHost(%s) = %v, want %v", tt.name, tt.host, got, tt.wantHost)
+		}
+	}
+}
+
+func TestLSDHostLimit(t *testing.T) {
+	ld := newTestLSD(t)
+	for i := 0; i < lsdMaxHosts; i++ {
+		ld.receive(lsdAnnounce("6881", "theirs"), &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i))})
+	}
+	if len(ld.hosts) != lsdMaxHosts {
+		t.Fatalf("remembered %d hosts, want %d", len(ld.hosts), lsdMaxHosts)
+	}
+
+	// A full map takes no new hosts until old ones expire
+	ld.receive(lsdAnnounce("6881", "theirs"), &net.UDPAddr{IP: net.ParseIP("10.1.0.1")})
+	if ld.IsLocalHost("10.1.0.1") || len(ld.hosts) != lsdMaxHosts {
+		t.Errorf("full map took a new host; %d hosts", len(ld.hosts))
+	}
+	ld.hosts["10.0.0.0"] = time.Now().Add(-LSDHostExpiry - time.Second)
+	ld.receive(lsdAnnounce("6881", "theirs"), &net.UDPAddr{IP: net.ParseIP("10.1.0.1")})
+	if !ld.IsLocalHost("10.1.0.1") || ld.IsLocalHost("10.0.0.0") {
+		t.Error("expired host was not replaced")
+	}
+}
+
+func TestRememberLocked(t *testing.T) {
+	now := time.Now()
+	seen := map[string]time.Time{"old": now.Add(-time.Hour), "new": now}
+	if !rememberLocked(seen, "third", now, 2, time.Minute) || len(seen) != 2 {
+		t.Errorf("expired entry not dropped: %v", seen)
+	}
+	if rememberLocked(seen, "fourth", now, 2, time.Minute) {
+		t.Error("full map took a new key")
+	}
+	if !rememberLocked(seen, "new", now, 2, time.Minute) {
+		t.Error("known key refused in a full map")
+	}
+}
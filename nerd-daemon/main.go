@@ -1,16 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
-
-	"github.com/nerd-daemon/messages" // Import the generated Protocol Buffer messages
 )
 
 // Global map to store active connections and a mutex for thread safety
@@ -28,23 +32,45 @@ type Config struct {
 	ConnectPeers    []string         // List of peer addresses to try connecting to (for now)
 	BootstrapNodes  []string         // DHT bootstrap nodes
 	EnableDHT       bool             // Enable DHT functionality
+	EnableNERDDHT   bool             // Join the private NERD overlay DHT; daemons then find each other there instead of on mainline
+	NERDDHTPort     int              // UDP port of the overlay DHT
+	NERDNetworkID   string           // Overlay network to join; nodes of other networks are ignored
+	NERDBootstrap   []string         // Overlay bootstrap nodes
 	EnableTracker   bool             // Enable tracker functionality
 	EnableBSV       bool             // Enable BSV payment functionality
+	EnableUTP       bool             // Accept and dial uTP connections on the P2P port over UDP
+	EnableLSD       bool             // Announce torrents and find peers by multicast on the LAN
 	DataDir         string           // Data directory for storage
+	ControlPort     int              // Local HTTP control API port (0 disables it)
+	AnnounceURLs    []string         // Tracker URLs written into torrents we create
+	Wire            WireLimits       // Message size caps and connection timeouts
+	Encryption      string           // Peer encryption policy: disabled, preferred or required
+	RateLimits      RateConfig       // Upload and download caps and their schedule
 	BSVPayment      BSVPaymentConfig // BSV payment configuration
 }
 
 // JSONConfig represents the JSON structure for configuration file
 type JSONConfig struct {
-	Port            int      `json:"port"`
-	DHTPort         int      `json:"dht_port"`
-	TrackerHTTPPort int      `json:"tracker_http_port"`
-	TrackerUDPPort  int      `json:"tracker_udp_port"`
-	EnableDHT       bool     `json:"enable_dht"`
-	EnableTracker   bool     `json:"enable_tracker"`
-	EnableBSV       bool     `json:"enable_bsv"`
-	BootstrapNodes  []string `json:"bootstrap_nodes"`
-	ConnectPeers    []string `json:"connect_peers"`
+	Port            int            `json:"port"`
+	DHTPort         int            `json:"dht_port"`
+	TrackerHTTPPort int            `json:"tracker_http_port"`
+	TrackerUDPPort  int            `json:"tracker_udp_port"`
+	EnableDHT       bool           `json:"enable_dht"`
+	EnableNERDDHT   bool           `json:"enable_nerd_dht"`
+	NERDDHTPort     int            `json:"nerd_dht_port"`
+	NERDNetworkID   string         `json:"nerd_network_id"`
+	NERDBootstrap   []string       `json:"nerd_bootstrap_nodes"`
+	EnableTracker   bool           `json:"enable_tracker"`
+	EnableBSV       bool           `json:"enable_bsv"`
+	EnableUTP       bool           `json:"enable_utp"`
+	EnableLSD       bool           `json:"enable_lsd"`
+	ControlPort     int            `json:"control_port"`
+	AnnounceURLs    []string       `json:"announce_urls"`
+	BootstrapNodes  []string       `json:"bootstrap_nodes"`
+	ConnectPeers    []string       `json:"connect_peers"`
+	Wire            JSONWireConfig `json:"wire"`
+	Encryption      string         `json:"encryption"`
+	RateLimits      RateConfig     `json:"rate_limits"`
 	BSVPayment      struct {
 		PrivateKeyWIF        string  `json:"private_key_wif"`
 		MinPaymentSatoshis   int64   `json:"min_payment_satoshis"`
@@ -54,9 +80,56 @@ type JSONConfig struct {
 		NetworkType          string  `json:"network_type"`
 		BroadcastURL         string  `json:"broadcast_url"`
 		UTXOFetchURLFormat   string  `json:"utxo_fetch_url_format"`
+		TxFetchURLFormat     string  `json:"tx_fetch_url_format"`
 	} `json:"bsv_payment"`
 }
 
+// JSONWireConfig is the "wire" section of the configuration file; zero values keep the defaults
+type JSONWireConfig struct {
+	MaxMessageSize          uint32            `json:"max_message_size"`
+	MaxPayloadSizes         map[uint32]uint32 `json:"max_payload_sizes"` // Keyed by message type ID
+	HandshakeTimeoutSeconds int               `json:"handshake_timeout_seconds"`
+	IdleTimeoutSeconds      int               `json:"idle_timeout_seconds"`
+	KeepAliveSeconds        int               `json:"keep_alive_seconds"`
+	WriteTimeoutSeconds     int               `json:"write_timeout_seconds"`
+}
+
+// RateConfig is the "rate_limits" section of the configuration file. Rates are
+// in bytes per second with zero meaning unlimited; schedule windows are parsed
+// by ParseRateSchedule.
+type RateConfig struct {
+	UploadRate       int64    `json:"upload_rate"`
+	DownloadRate     int64    `json:"download_rate"`
+	PeerUploadRate   int64    `json:"peer_upload_rate"`
+	PeerDownloadRate int64    `json:"peer_download_rate"`
+	Schedule         []string `json:"schedule"`
+	LimitLocalPeers  bool     `json:"limit_local_peers"` // Also limit LAN peers found by Local Service Discovery
+}
+
+// toWireLimits applies the configured values over the default wire limits
+func (jw JSONWireConfig) toWireLimits() WireLimits {
+	limits := DefaultWireLimits()
+	if jw.MaxMessageSize > 0 {
+		limits.MaxMessageSize = jw.MaxMessageSize
+	}
+	for messageType, size := range jw.MaxPayloadSizes {
+		limits.MaxPayloadSizes[messageType] = size
+	}
+	if jw.HandshakeTimeoutSeconds > 0 {
+		limits.HandshakeTimeout = time.Duration(jw.HandshakeTimeoutSeconds) * time.Second
+	}
+	if jw.IdleTimeoutSeconds > 0 {
+		limits.IdleTimeout = time.Duration(jw.IdleTimeoutSeconds) * time.Second
+	}
+	if jw.KeepAliveSeconds > 0 {
+		limits.KeepAliveInterval = time.Duration(jw.KeepAliveSeconds) * time.Second
+	}
+	if jw.WriteTimeoutSeconds > 0 {
+		limits.WriteTimeout = time.Duration(jw.WriteTimeoutSeconds) * time.Second
+	}
+	return limits
+}
+
 // Load configuration with support for JSON file loading and fallback to defaults
 func loadConfig() (*Config, error) {
 	log.Println("Loading configuration...")
@@ -77,9 +150,20 @@ func loadConfig() (*Config, error) {
 				TrackerHTTPPort: jsonConfig.TrackerHTTPPort,
 				TrackerUDPPort:  jsonConfig.TrackerUDPPort,
 				EnableDHT:       jsonConfig.EnableDHT,
+				EnableNERDDHT:   jsonConfig.EnableNERDDHT,
+				NERDDHTPort:     jsonConfig.NERDDHTPort,
+				NERDNetworkID:   jsonConfig.NERDNetworkID,
+				NERDBootstrap:   jsonConfig.NERDBootstrap,
 				EnableTracker:   jsonConfig.EnableTracker,
 				EnableBSV:       jsonConfig.EnableBSV,
+				EnableUTP:       jsonConfig.EnableUTP,
+				EnableLSD:       jsonConfig.EnableLSD,
 				DataDir:         "./nerd-data", // Default data directory
+				ControlPort:     jsonConfig.ControlPort,
+				AnnounceURLs:    jsonConfig.AnnounceURLs,
+				Wire:            jsonConfig.Wire.toWireLimits(),
+				Encryption:      jsonConfig.Encryption,
+				RateLimits:      jsonConfig.RateLimits,
 				BootstrapNodes:  jsonConfig.BootstrapNodes,
 				ConnectPeers:    jsonConfig.ConnectPeers,
 				BSVPayment: BSVPaymentConfig{
@@ -91,6 +175,7 @@ func loadConfig() (*Config, error) {
 					NetworkType:          jsonConfig.BSVPayment.NetworkType,
 					BroadcastURL:         jsonConfig.BSVPayment.BroadcastURL,
 					UTXOFetchURLFormat:   jsonConfig.BSVPayment.UTXOFetchURLFormat,
+					TxFetchURLFormat:     jsonConfig.BSVPayment.TxFetchURLFormat,
 				},
 			}
 			log.Printf("Configuration loaded from file successfully")
@@ -115,9 +200,16 @@ func loadConfig() (*Config, error) {
 		TrackerHTTPPort: 8080, // Tracker HTTP port
 		TrackerUDPPort:  8081, // Tracker UDP port
 		EnableDHT:       true,
+		NERDDHTPort:     6884, // Overlay DHT, off by default
+		NERDNetworkID:   DefaultNERDNetworkID,
 		EnableTracker:   true,
-		EnableBSV:       true,          // Enable BSV payments by default
+		EnableBSV:       true, // Enable BSV payments by default
+		EnableUTP:       true,
+		EnableLSD:       true,
 		DataDir:         "./nerd-data", // Default data directory
+		ControlPort:     8090,          // Local control API port
+		Wire:            DefaultWireLimits(),
+		Encryption:      EncryptionPreferred,
 		BootstrapNodes:  defaultBootstrapNodes,
 		ConnectPeers:    []string{"localhost:6883"}, // Example peer for testing
 		BSVPayment: BSVPaymentConfig{
@@ -129,6 +221,7 @@ func loadConfig() (*Config, error) {
 			NetworkType:          "testnet",
 			BroadcastURL:         "https://api.whatsonchain.com/v1/bsv/test/tx/raw",
 			UTXOFetchURLFormat:   "https://api.whatsonchain.com/v1/bsv/%s/address/%s/unspent",
+			TxFetchURLFormat:     "https://api.whatsonchain.com/v1/bsv/%s/tx/%s/hex",
 		},
 	}
 	log.Printf("Using default configuration")
@@ -140,60 +233,100 @@ func loadConfig() (*Config, error) {
 // Note: Message structures are now imported from "github.com/nerd-daemon/messages" package
 // Available types: messages.HandshakeMsg, messages.InterestedMsg, messages.HaveMsg
 
-// TODO: Define other message types (KeepAlive, Choke, Unchoke, Request, Piece, Cancel)
 // TODO: Define NERD-specific message types (PaymentRequest, PaymentProof, TokenBalance, etc.)
 
-// Placeholder function to handle incoming connections
-func handleConnection(conn net.Conn, dhtServer *DHTServer) {
+// handleConnection accepts an incoming connection and routes it to the torrent
+// named by the peer's handshake
+func handleConnection(conn net.Conn, session *Session) {
 	log.Printf("Accepted connection from %s", conn.RemoteAddr())
 
-	// Add the connection to the pool
-	connectionsMutex.Lock()
-	activeConnections[conn.RemoteAddr().String()] = conn
-	connectionsMutex.Unlock()
+	// The peer gets a fixed time to complete the handshake
+	conn.SetDeadline(time.Now().Add(session.WireLimits().HandshakeTimeout))
 
-	// Ensure the connection is closed and removed from the pool when the function exits
-	defer func() {
+	// Encrypted connections start with an MSE handshake instead of the BitTorrent one
+	secured, transport, err := session.acceptEncryption(conn)
+	if err != nil {
+		log.Printf("Rejecting %s: %v", conn.RemoteAddr(), err)
 		conn.Close()
-		connectionsMutex.Lock()
-		delete(activeConnections, conn.RemoteAddr().String())
-		log.Printf("Connection closed and removed from pool: %s", conn.RemoteAddr())
-		connectionsMutex.Unlock()
-	}()
-
-	log.Printf("Handling connection from %s. Currently %d active connections.", conn.RemoteAddr(), len(activeConnections))
+		return
+	}
+	conn = secured
 
 	// Create wire protocol handler
-	wireProtocol := NewWireProtocol(conn)
+	wireProtocol := session.newWire(conn, transport)
 
 	// Try to receive handshake (for incoming connections)
 	handshake, err := wireProtocol.ReceiveHandshake()
 	if err != nil {
 		log.Printf("Failed to receive handshake from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
 		return
 	}
 
-	log.Printf("Received handshake from %s: protocol=%s, peer_id=%x",
-		conn.RemoteAddr(), string(handshake.ProtocolString), handshake.PeerId)
+	log.Printf("Received handshake from %s: protocol=%s, peer_id=%x, info_hash=%x",
+		conn.RemoteAddr(), string(handshake.ProtocolString), handshake.PeerId, handshake.InfoHash)
 
-	// Send our handshake response
-	var infoHash [20]byte                     // Placeholder - in real implementation this would be content-specific
-	copy(infoHash[:], "NERD_DAEMON_HASH____") // 20 byte placeholder
+	// Route the connection to the torrent it asked for
+	var infoHash [20]byte
+	copy(infoHash[:], handshake.InfoHash)
+	torrent, exists := session.GetTorrent(infoHash)
+	if !exists {
+		log.Printf("Rejecting %s: not serving infohash %x", conn.RemoteAddr(), infoHash)
+		conn.Close()
+		return
+	}
 
-	err = wireProtocol.SendHandshake(infoHash)
+	// Send our handshake response
+	err = wireProtocol.SendHandshake(torrent.InfoHash)
 	if err != nil {
 		log.Printf("Failed to send handshake to %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if err := wireProtocol.negotiateEncryption(false, torrent.InfoHash); err != nil {
+		log.Printf("Rejecting %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
 		return
 	}
 
-	// Send interested message to indicate we want to participate
-	err = wireProtocol.SendInterested()
-	if err != nil {
-		log.Printf("Failed to send interested message to %s: %v", conn.RemoteAddr(), err)
+	conn.SetDeadline(time.Time{}) // The message loop sets its own deadlines
+	log.Printf("Handshake completed with %s for %s (%s framing, %s)",
+		conn.RemoteAddr(), torrent.Name(), wireProtocol.Framing(), wireProtocol.Transport())
+	servePeer(conn, wireProtocol, session, torrent, PeerSourceIncoming)
+}
+
+// servePeer runs piece exchange and message handling for a connection that has
+// completed its handshake. It closes the connection when done.
+func servePeer(conn net.Conn, wireProtocol *WireProtocol, session *Session, torrent *Torrent, source string) {
+	// Add the connection to the pool
+	connectionsMutex.Lock()
+	activeConnections[conn.RemoteAddr().String()] = conn
+	active := len(activeConnections)
+	connectionsMutex.Unlock()
+
+	// Ensure the connection is closed and removed from the pool when the function exits
+	defer func() {
+		conn.Close()
+		connectionsMutex.Lock()
+		delete(activeConnections, conn.RemoteAddr().String())
+		log.Printf("Connection closed and removed from pool: %s", conn.RemoteAddr())
+		connectionsMutex.Unlock()
+	}()
+
+	log.Printf("Handling connection from %s. Currently %d active connections.", conn.RemoteAddr(), active)
+
+	// Set up piece exchange: our bitfield goes out first, interest follows the peer's pieces
+	peer := NewPeerConn(wireProtocol, conn.RemoteAddr().String(), torrent, session, source)
+	if err := peer.start(); err != nil {
+		log.Printf("Failed to start piece exchange with %s: %v", conn.RemoteAddr(), err)
 		return
 	}
+	defer func() {
+		peer.close()
+		session.choker.Trigger() // Hand the slot to someone else
+	}()
 
-	log.Printf("Handshake completed with %s", conn.RemoteAddr())
+	dhtServer := session.dhtServer
 
 	// If DHT is enabled, add this peer to our DHT peer store
 	if dhtServer != nil {
@@ -201,7 +334,7 @@ func handleConnection(conn net.Conn, dhtServer *DHTServer) {
 		if err == nil {
 			if port := parsePort(portStr); port > 0 {
 				// Add discovered peer to DHT
-				dhtServer.addDiscoveredPeer(host, port, nil)
+				dhtServer.addDiscoveredPeer(host, port, source, nil)
 			}
 		}
 	}
@@ -210,82 +343,38 @@ func handleConnection(conn net.Conn, dhtServer *DHTServer) {
 	for {
 		msg, err := wireProtocol.ReceiveMessage()
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error receiving message from %s: %v", conn.RemoteAddr(), err)
-			}
+			log.Printf("Disconnecting %s: %s", conn.RemoteAddr(), disconnectReason(err))
 			return
 		}
 
-		// Parse the message payload
-		payload, err := ParseMessagePayload(msg.MessageId, msg.Payload)
+		// Hand the message to the subsystem registered for its type
+		err = session.Handlers().Dispatch(&MessageContext{Session: session, Peer: peer, Message: msg})
 		if err != nil {
-			log.Printf("Failed to parse message payload from %s (type %d): %v",
-				conn.RemoteAddr(), msg.MessageId, err)
-			continue
-		}
-
-		// Handle different message types
-		switch msg.MessageId {
-		case 999: // Keep-alive (defined in protocol.go)
-			log.Printf("Received keep-alive from %s", conn.RemoteAddr())
-		case 2: // MsgTypeInterested
-			log.Printf("Peer %s is interested", conn.RemoteAddr())
-			// Send unchoke message
-			unchoke := &messages.UnchokeMsg{}
-			wireProtocol.SendMessage(1, unchoke) // MsgTypeUnchoke = 1
-		case 4: // MsgTypeHave
-			haveMsg := payload.(*messages.HaveMsg)
-			log.Printf("Peer %s has piece %d", conn.RemoteAddr(), haveMsg.PieceIndex)
-		case 100: // MsgTypePaymentRequest
-			paymentReq := payload.(*messages.PaymentRequestMsg)
-			log.Printf("Payment request from %s: %d satoshis for piece %d",
-				conn.RemoteAddr(), paymentReq.AmountSatoshis, paymentReq.PieceIndex)
-		case 102: // MsgTypeTokenBalance
-			tokenBalance := payload.(*messages.TokenBalanceMsg)
-			log.Printf("Token balance from %s: %d $NERD tokens, quality score: %d",
-				conn.RemoteAddr(), tokenBalance.NerdBalance, tokenBalance.QualityScore)
-		case 103: // MsgTypeQualityMetrics
-			qualityMetrics := payload.(*messages.QualityMetricsMsg)
-			log.Printf("Quality metrics from %s: uptime=%d, reliability=%.2f",
-				conn.RemoteAddr(), qualityMetrics.UptimeSeconds, qualityMetrics.ReliabilityScore)
-			// Process quality metrics through DHT if available
-			if dhtServer != nil {
-				dhtServer.ProcessNERDMessage("quality_metrics", msg.Payload)
-			}
-		case 104: // MsgTypeGeographicHint
-			geoHint := payload.(*messages.GeographicHintMsg)
-			log.Printf("Geographic hint from %s: %s, %s",
-				conn.RemoteAddr(), geoHint.CountryCode, geoHint.City)
-			// Process geographic hint through DHT if available
-			if dhtServer != nil {
-				dhtServer.ProcessNERDMessage("geographic_hint", msg.Payload)
-			}
-		default:
-			log.Printf("Received message type %d from %s", msg.MessageId, conn.RemoteAddr())
+			log.Printf("Closing connection to %s: %v", conn.RemoteAddr(), err)
+			return
 		}
 	}
 }
 
-// Function to dial and establish an outgoing connection to a peer
-func dialPeer(addr string, dhtServer *DHTServer) {
-	log.Printf("Attempting to connect to peer %s...", addr)
+// Function to dial and establish an outgoing connection to a peer for a torrent,
+// found through source
+func dialPeer(addr string, session *Session, torrent *Torrent, source string) {
+	log.Printf("Attempting to connect to peer %s for %s...", addr, torrent.Name())
 
-	conn, err := net.Dial("tcp", addr)
+	conn, transport, err := session.dialEncrypted(addr, torrent.InfoHash)
 	if err != nil {
 		log.Printf("Failed to connect to peer %s: %v", addr, err)
 		return // Exit if connection fails
 	}
 
-	log.Printf("Successfully connected to peer %s", addr)
+	log.Printf("Successfully connected to peer %s (%s)", addr, transport)
 
 	// Create wire protocol handler for outgoing connection
-	wireProtocol := NewWireProtocol(conn)
+	wireProtocol := session.newWire(conn, transport)
+	conn.SetDeadline(time.Now().Add(session.WireLimits().HandshakeTimeout))
 
 	// Send handshake first (for outgoing connections)
-	var infoHash [20]byte
-	copy(infoHash[:], "NERD_DAEMON_HASH____") // 20 byte placeholder
-
-	err = wireProtocol.SendHandshake(infoHash)
+	err = wireProtocol.SendHandshake(torrent.InfoHash)
 	if err != nil {
 		log.Printf("Failed to send handshake to %s: %v", addr, err)
 		conn.Close()
@@ -294,8 +383,65 @@ func dialPeer(addr string, dhtServer *DHTServer) {
 
 	log.Printf("Sent handshake to %s", addr)
 
-	// Hand off the established connection to the handler
-	go handleConnection(conn, dhtServer) // handleConnection will add to pool and manage lifecycle
+	// The peer must answer for the same torrent
+	handshake, err := wireProtocol.ReceiveHandshake()
+	if err != nil {
+		log.Printf("Failed to receive handshake from %s: %v", addr, err)
+		conn.Close()
+		return
+	}
+	if !bytes.Equal(handshake.InfoHash, torrent.InfoHash[:]) {
+		log.Printf("Peer %s answered with infohash %x, expected %x", addr, handshake.InfoHash, torrent.InfoHash)
+		conn.Close()
+		return
+	}
+	if err := wireProtocol.negotiateEncryption(true, torrent.InfoHash); err != nil {
+		log.Printf("Disconnecting %s: %v", addr, err)
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{}) // The message loop sets its own deadlines
+	log.Printf("Handshake completed with %s for %s (%s framing, %s)",
+		addr, torrent.Name(), wireProtocol.Framing(), wireProtocol.Transport())
+
+	// Hand off the established connection to the message loop
+	go servePeer(conn, wireProtocol, session, torrent, source) // servePeer will add to pool and manage lifecycle
+}
+
+// registerSubsystemHandlers lets the enabled subsystems claim their message types
+func registerSubsystemHandlers(session *Session, dhtServer *DHTServer, bsvSystem *BSVPaymentSystem, socialSystem *BSVSocialSystem) error {
+	if dhtServer != nil {
+		if err := dhtServer.RegisterHandlers(session.Handlers()); err != nil {
+			return err
+		}
+	}
+	if bsvSystem != nil {
+		if err := bsvSystem.RegisterHandlers(session.Handlers()); err != nil {
+			return err
+		}
+	}
+	if socialSystem != nil {
+		if err := socialSystem.RegisterHandlers(session.Handlers()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// disconnectReason describes why reading from a peer failed
+func disconnectReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "peer closed the connection"
+	case errors.Is(err, net.ErrClosed):
+		return "connection closed locally"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "idle timeout"
+	default:
+		return err.Error()
+	}
 }
 
 // Helper function to parse port from string
@@ -314,18 +460,28 @@ func initializeDHT(config *Config) (*DHTServer, error) {
 
 	log.Printf("Initializing DHT on port %d...", config.DHTPort)
 
-	// Generate a random node ID for this daemon instance
-	nodeID, err := GenerateRandomNodeID()
+	// The node ID is created once and kept in the data directory
+	identityFile := filepath.Join(config.DataDir, DHTIdentityFile)
+	identity, err := LoadDHTIdentity(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load DHT identity: %v", err)
+	}
+
+	// Mutable items we publish are signed with a key kept in the data directory
+	itemKey, err := LoadItemKey(filepath.Join(config.DataDir, DHTItemKeyFile))
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate node ID: %v", err)
+		return nil, fmt.Errorf("failed to load DHT item key: %v", err)
 	}
 
 	// Create DHT configuration
 	dhtConfig := &DHTConfig{
 		Port:           config.DHTPort,
 		BootstrapNodes: config.BootstrapNodes,
-		NodeID:         nodeID,
-		SecretSalt:     12345, // TODO: Make this configurable or random
+		NodeID:         identity.NodeID,
+		ExternalIP:     identity.ExternalIP,
+		IdentityFile:   identityFile,
+		NodesFile:      filepath.Join(config.DataDir, DHTNodesFile),
+		ItemKey:        itemKey,
 	}
 
 	// Create DHT server
@@ -344,6 +500,51 @@ func initializeDHT(config *Config) (*DHTServer, error) {
 	return dhtServer, nil
 }
 
+// initializeNERDDHT sets up and starts the private NERD overlay DHT. It shares
+// the mainline node's identity but keeps its own port, bootstrap nodes and
+// routing table.
+func initializeNERDDHT(config *Config) (*DHTServer, error) {
+	if !config.EnableNERDDHT {
+		return nil, nil
+	}
+	networkID := config.NERDNetworkID
+	if networkID == "" {
+		networkID = DefaultNERDNetworkID
+	}
+
+	log.Printf("Initializing NERD overlay DHT %q on port %d...", networkID, config.NERDDHTPort)
+
+	identityFile := filepath.Join(config.DataDir, DHTIdentityFile)
+	identity, err := LoadDHTIdentity(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load DHT identity: %v", err)
+	}
+	itemKey, err := LoadItemKey(filepath.Join(config.DataDir, DHTItemKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load DHT item key: %v", err)
+	}
+
+	overlay, err := NewDHTServer(&DHTConfig{
+		Port:           config.NERDDHTPort,
+		BootstrapNodes: config.NERDBootstrap,
+		NodeID:         identity.NodeID,
+		ExternalIP:     identity.ExternalIP,
+		IdentityFile:   identityFile,
+		NodesFile:      filepath.Join(config.DataDir, NERDDHTNodesFile),
+		NetworkID:      networkID,
+		ItemKey:        itemKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create NERD overlay DHT: %v", err)
+	}
+	if err := overlay.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start NERD overlay DHT: %v", err)
+	}
+
+	log.Printf("NERD overlay DHT initialized successfully on port %d", config.NERDDHTPort)
+	return overlay, nil
+}
+
 // announceDaemonToNetwork announces this daemon to the DHT network
 func announceDaemonToNetwork(dhtServer *DHTServer, tcpPort int) {
 	if dhtServer == nil {
@@ -381,7 +582,7 @@ func announceDaemonToNetwork(dhtServer *DHTServer, tcpPort int) {
 }
 
 // discoverPeersViaDHT discovers other NERD daemons via DHT
-func discoverPeersViaDHT(dhtServer *DHTServer) {
+func discoverPeersViaDHT(dhtServer *DHTServer, session *Session) {
 	if dhtServer == nil {
 		return
 	}
@@ -400,30 +601,41 @@ func discoverPeersViaDHT(dhtServer *DHTServer) {
 			select {
 			case <-ticker.C:
 				log.Printf("Discovering NERD daemons via DHT...")
-				peers, err := dhtServer.FindPeers(nerdInfoHash)
+				ctx, cancel := context.WithTimeout(context.Background(), DHTPeerSearchTimeout)
+				search, err := dhtServer.FindPeers(ctx, nerdInfoHash)
 				if err != nil {
+					cancel()
 					log.Printf("DHT peer discovery failed: %v", err)
 					continue
 				}
 
-				log.Printf("Discovered %d peers via DHT", len(peers))
-				for _, peer := range peers {
-					log.Printf("Found peer: %s:%d (quality: %.2f)",
-						peer.Address, peer.Port, peer.QualityScore)
+				// Connect to peers as they are found rather than after the search
+				found := 0
+				for peer := range search.Peers {
+					found++
+					log.Printf("Found peer: %s (quality: %.2f)",
+						peer.Addr(), peer.QualityScore)
 
-					// Attempt to connect to high-quality peers
+					// Attempt to connect to high-quality peers for every torrent we serve
 					if peer.QualityScore > 0.7 {
-						peerAddr := fmt.Sprintf("%s:%d", peer.Address, peer.Port)
-						go dialPeer(peerAddr, dhtServer)
+						peerAddr := peer.Addr()
+						for _, torrent := range session.Torrents() {
+							go dialPeer(peerAddr, session, torrent, PeerSourceDHT)
+						}
 					}
 				}
+				if err := search.Err(); err != nil {
+					log.Printf("DHT peer discovery stopped early: %v", err)
+				}
+				cancel()
+				log.Printf("Discovered %d peers via DHT", found)
 			}
 		}
 	}()
 }
 
-// logDHTStats periodically logs DHT statistics
-func logDHTStats(dhtServer *DHTServer) {
+// logDHTStats periodically logs the statistics of a DHT, labelled name
+func logDHTStats(name string, dhtServer *DHTServer) {
 	if dhtServer == nil {
 		return
 	}
@@ -434,8 +646,11 @@ func logDHTStats(dhtServer *DHTServer) {
 
 		for range ticker.C {
 			stats := dhtServer.GetStats()
-			log.Printf("[DHT Stats] Nodes: %v, Peers: %v, Quality Metrics: %v",
-				stats["total_nodes"], stats["known_peers"], stats["quality_metrics_cached"])
+			log.Printf("[%s Stats] Nodes: %v, Peers: %v, Quality Metrics: %v",
+				name, stats["total_nodes"], stats["known_peers"], stats["quality_metrics_cached"])
+			if ipv6Nodes, ok := stats["ipv6_nodes"]; ok {
+				log.Printf("[%s Stats] IPv6 nodes: %v (%v good)", name, ipv6Nodes, stats["ipv6_good_nodes"])
+			}
 		}
 	}()
 }
@@ -495,6 +710,21 @@ func logTrackerStats(tracker *TrackerServer) {
 	}()
 }
 
+// initializeControl sets up and starts the local control API
+func initializeControl(config *Config, session *Session) (*ControlServer, error) {
+	if config.ControlPort == 0 {
+		log.Println("Control API is disabled in configuration")
+		return nil, nil
+	}
+
+	controlServer := NewControlServer(config, session)
+	if err := controlServer.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start control API: %v", err)
+	}
+
+	return controlServer, nil
+}
+
 // initializeBSVPayments sets up and starts the BSV payment system
 func initializeBSVPayments(config *Config) (*BSVPaymentSystem, error) {
 	if !config.EnableBSV {
@@ -549,6 +779,21 @@ func logBSVStats(bsvSystem *BSVPaymentSystem) {
 	}()
 }
 
+// logSessionStats periodically logs torrent session statistics
+func logSessionStats(session *Session) {
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			stats := session.GetStats()
+			log.Printf("[Session Stats] Torrents: %v (complete: %v), Peers: %v (interested: %v, unchoked: %v)",
+				stats["torrents"], stats["complete_torrents"], stats["connected_peers"],
+				stats["interested_peers"], stats["unchoked_peers"])
+		}
+	}()
+}
+
 // logSocialStats periodically logs BSV Social Protocol statistics
 func logSocialStats(socialSystem *BSVSocialSystem) {
 	if socialSystem == nil {
@@ -569,6 +814,11 @@ func logSocialStats(socialSystem *BSVSocialSystem) {
 }
 
 func main() {
+	// Subcommands (create, add) run instead of the daemon
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	log.Println("NERD daemon starting...")
 
 	// Load configuration
@@ -591,6 +841,17 @@ func main() {
 		}
 	}()
 
+	// Initialize the NERD overlay DHT if enabled
+	overlay, err := initializeNERDDHT(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize NERD overlay DHT: %v", err)
+	}
+	defer func() {
+		if overlay != nil {
+			overlay.Stop()
+		}
+	}()
+
 	// Initialize Tracker if enabled
 	tracker, err := initializeTracker(cfg)
 	if err != nil {
@@ -638,11 +899,99 @@ func main() {
 
 	log.Printf("NERD daemon listening on %s", listenAddr)
 
-	// Start DHT-related background tasks
+	// uTP shares the port number over UDP
+	var utpSocket *UTPSocket
+	if cfg.EnableUTP {
+		utpSocket, err = ListenUTP(listenAddr)
+		if err != nil {
+			log.Fatalf("Failed to start uTP on %s: %v", listenAddr, err)
+		}
+		defer utpSocket.Close()
+	}
+
+	// Create the session that owns every torrent we take part in
+	session := NewSession(cfg.DataDir, cfg.Port, dhtServer, bsvSystem)
+	session.SetWireLimits(cfg.Wire)
+	encryption, err := ParseEncryptionPolicy(cfg.Encryption)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	session.SetEncryption(encryption)
+	var schedule []RateSchedule
+	for _, window := range cfg.RateLimits.Schedule {
+		parsed, err := ParseRateSchedule(window)
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		schedule = append(schedule, parsed)
+	}
+	session.SetRateSchedule(schedule)
+	session.SetLimitLocalPeers(cfg.RateLimits.LimitLocalPeers)
+	session.SetRateLimits(
+		RateLimits{Upload: cfg.RateLimits.UploadRate, Download: cfg.RateLimits.DownloadRate},
+		RateLimits{Upload: cfg.RateLimits.PeerUploadRate, Download: cfg.RateLimits.PeerDownloadRate})
+	if utpSocket != nil {
+		session.SetUTP(utpSocket)
+		go acceptConnections(utpSocket, session)
+	}
+	var lsd *LocalDiscovery
+	if cfg.EnableLSD {
+		// Not every network allows multicast; the daemon works without it
+		lsd, err = ListenLSD(session, cfg.Port)
+		if err != nil {
+			log.Printf("Warning: Local Service Discovery disabled: %v", err)
+		} else {
+			defer lsd.Close()
+			session.SetLSD(lsd)
+			lsd.Start()
+		}
+	}
+	if overlay != nil {
+		overlay.SetNERDInfo(NewSessionInfo(session, bsvSystem, socialSystem))
+		session.SetOverlay(overlay)
+	}
+	if bsvSystem != nil {
+		identity, err := bsvSystem.Identity()
+		if err != nil {
+			log.Fatalf("Failed to derive peer identity: %v", err)
+		}
+		session.SetIdentity(identity)
+	}
+	log.Printf("Peer ID: %x", session.Identity().PeerID())
+	if err := registerSubsystemHandlers(session, dhtServer, bsvSystem, socialSystem); err != nil {
+		log.Fatalf("Failed to register message handlers: %v", err)
+	}
+	if err := session.LoadRegistry(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	session.Start()
+	defer session.Stop()
+
+	// Start the local control API
+	controlServer, err := initializeControl(cfg, session)
+	if err != nil {
+		log.Fatalf("Failed to initialize control API: %v", err)
+	}
+	defer func() {
+		if controlServer != nil {
+			controlServer.Stop()
+		}
+	}()
+
+	// Start session-related background tasks
+	logSessionStats(session)
+
+	// Start DHT-related background tasks. Daemons find each other on the
+	// overlay when it runs, leaving mainline to public torrents.
+	if daemonDHT := session.nerdDHT(); daemonDHT != nil {
+		announceDaemonToNetwork(daemonDHT, cfg.Port)
+		discoverPeersViaDHT(daemonDHT, session)
+	}
 	if dhtServer != nil {
-		announceDaemonToNetwork(dhtServer, cfg.Port)
-		discoverPeersViaDHT(dhtServer)
-		logDHTStats(dhtServer)
+		logDHTStats("DHT", dhtServer)
+	}
+	if overlay != nil {
+		logDHTStats("NERD DHT", overlay)
 	}
 
 	// Start tracker-related background tasks
@@ -662,12 +1011,30 @@ func main() {
 
 	// Log service status
 	log.Printf("=== NERD Daemon Services ===")
-	log.Printf("P2P Network: listening on port %d", cfg.Port)
+	if utpSocket != nil {
+		log.Printf("P2P Network: listening on port %d (TCP and uTP)", cfg.Port)
+	} else {
+		log.Printf("P2P Network: listening on port %d (TCP)", cfg.Port)
+	}
+	log.Printf("Torrents: %d in session", len(session.Torrents()))
+	if lsd != nil {
+		log.Printf("Local Service Discovery: %s", LSDMulticastAddr)
+	} else {
+		log.Printf("Local Service Discovery: disabled")
+	}
+	if controlServer != nil {
+		log.Printf("Control API: http://127.0.0.1:%d", cfg.ControlPort)
+	} else {
+		log.Printf("Control API: disabled")
+	}
 	if dhtServer != nil {
 		log.Printf("DHT: enabled on port %d", cfg.DHTPort)
 	} else {
 		log.Printf("DHT: disabled")
 	}
+	if overlay != nil {
+		log.Printf("NERD overlay DHT: enabled on port %d", cfg.NERDDHTPort)
+	}
 	if tracker != nil {
 		log.Printf("Tracker: HTTP port %d, UDP port %d", cfg.TrackerHTTPPort, cfg.TrackerUDPPort)
 	} else {
@@ -685,18 +1052,37 @@ func main() {
 	}
 	log.Printf("============================")
 
-	// Attempt to connect to configured peers (for testing)
+	// Attempt to connect to configured peers (for testing) for each torrent
 	for _, peerAddr := range cfg.ConnectPeers {
-		go dialPeer(peerAddr, dhtServer)
+		for _, torrent := range session.Torrents() {
+			go dialPeer(peerAddr, session, torrent, PeerSourceConfig)
+		}
 	}
 
-	// Accept incoming connections
+	// Shut down on Ctrl-C or SIGTERM by closing the listener, so the deferred
+	// cleanup runs and resume data is saved
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-shutdown
+		log.Printf("Received %s, shutting down", sig)
+		listener.Close()
+	}()
+
+	acceptConnections(listener, session)
+}
+
+// acceptConnections hands incoming connections to the session until the listener is closed
+func acceptConnections(listener net.Listener, session *Session) {
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Printf("Failed to accept connection: %v", err)
 			continue
 		}
-		go handleConnection(conn, dhtServer)
+		go handleConnection(conn, session)
 	}
 }
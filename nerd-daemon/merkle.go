@@ -0,0 +1,626 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/bits"
+
+	"github.com/anacrolix/torrent/merkle"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// BitTorrent v2 (BEP 52) gives every file a SHA-256 merkle tree over 16 KiB
+// blocks. The info dictionary holds each file's root and the .torrent's piece
+// layers hold the tree layer with one hash per piece. Peers exchange ranges of
+// the trees with hash request/hashes/reject messages: we use them to fetch the
+// piece layers a magnet link does not carry and, when a piece fails, the block
+// hashes that show which of its blocks are corrupt.
+const (
+	MaxHashesPerRequest    = 512 // Largest range we request or serve
+	MaxHashRequestsPerPeer = 4   // Hash requests outstanding to one peer
+	hashRequestSize        = 48  // Pieces root, base layer, index, length, proof layers
+)
+
+// hashRequest identifies a range of a file's merkle tree: Length hashes from
+// Index in the base layer (0 is the block layer), proven with uncle hashes up
+// to ProofLayers layers above the base layer
+type hashRequest struct {
+	Root        [32]byte
+	BaseLayer   uint32
+	Index       uint32
+	Length      uint32
+	ProofLayers uint32
+}
+
+// encode returns the header shared by the three hash messages
+func (req hashRequest) encode() []byte {
+	payload := make([]byte, hashRequestSize)
+	copy(payload, req.Root[:])
+	binary.BigEndian.PutUint32(payload[32:], req.BaseLayer)
+	binary.BigEndian.PutUint32(payload[36:], req.Index)
+	binary.BigEndian.PutUint32(payload[40:], req.Length)
+	binary.BigEndian.PutUint32(payload[44:], req.ProofLayers)
+	return payload
+}
+
+// uncleCount is the number of proof hashes that answer the request; the
+// layers spanned by the requested range need none
+func (req hashRequest) uncleCount() int {
+	return max(int(req.ProofLayers)-log2(int(req.Length)), 0)
+}
+
+// decodeHashMessage parses the header of a hash message and the hashes that
+// follow it in a hashes message
+func decodeHashMessage(payload []byte) (hashRequest, [][32]byte, error) {
+	var req hashRequest
+	if len(payload) < hashRequestSize || (len(payload)-hashRequestSize)%32 != 0 {
+		return req, nil, fmt.Errorf("invalid hash message of %d bytes", len(payload))
+	}
+	copy(req.Root[:], payload)
+	req.BaseLayer = binary.BigEndian.Uint32(payload[32:])
+	req.Index = binary.BigEndian.Uint32(payload[36:])
+	req.Length = binary.BigEndian.Uint32(payload[40:])
+	req.ProofLayers = binary.BigEndian.Uint32(payload[44:])
+	if !isPowerOfTwo(int(req.Length)) || req.Length > MaxHashesPerRequest || req.Index%req.Length != 0 {
+		return req, nil, fmt.Errorf("invalid hash range %d+%d", req.Index, req.Length)
+	}
+
+	hashes := make([][32]byte, (len(payload)-hashRequestSize)/32)
+	for i := range hashes {
+		copy(hashes[i][:], payload[hashRequestSize+32*i:])
+	}
+	return req, hashes, nil
+}
+
+// v2File is a file's place in a v2 torrent
+type v2File struct {
+	root       [32]byte // Pieces root from the file tree
+	length     int64
+	firstPiece int
+	numPieces  int
+}
+
+// layerDownload assembles a piece layer fetched from peers one request-sized chunk at a time
+type layerDownload struct {
+	hashes    [][32]byte // Padded to a power of two
+	chunk     int        // Hashes per request
+	have      []bool
+	requested []bool
+}
+
+// indexV2Files records which file each piece belongs to (assumes lock is held)
+func (t *Torrent) indexV2Files() {
+	t.v2Files = make(map[[32]byte]*v2File)
+	t.v2PieceFiles = make([]*v2File, 0, t.Info.NumPieces())
+	t.pieceLayers = make(map[[32]byte][][32]byte)
+	t.layerDownloads = make(map[[32]byte]*layerDownload)
+
+	for _, fi := range t.Info.UpvertedFiles() {
+		if !fi.PiecesRoot.Ok || fi.Length == 0 {
+			continue
+		}
+		file := &v2File{
+			root:       fi.PiecesRoot.Value,
+			length:     fi.Length,
+			firstPiece: len(t.v2PieceFiles),
+			numPieces:  int((fi.Length + t.Info.PieceLength - 1) / t.Info.PieceLength),
+		}
+		if _, exists := t.v2Files[file.root]; !exists {
+			t.v2Files[file.root] = file // Files with identical content share a tree
+		}
+		for i := 0; i < file.numPieces; i++ {
+			t.v2PieceFiles = append(t.v2PieceFiles, file)
+		}
+	}
+}
+
+// SetPieceLayers attaches piece layers from a .torrent, keeping each one that
+// matches its file root. Missing layers are fetched from peers.
+func (t *Torrent) SetPieceLayers(layers map[string]string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.Info == nil || !t.Info.HasV2() {
+		return nil
+	}
+	pad := metainfo.HashForPiecePad(t.Info.PieceLength)
+	for root, compact := range layers {
+		if len(root) != 32 {
+			continue
+		}
+		file, exists := t.v2Files[[32]byte([]byte(root))]
+		if !exists {
+			continue
+		}
+		hashes, err := merkle.CompactLayerToSliceHashes(compact)
+		if err != nil || len(hashes) != file.numPieces {
+			return fmt.Errorf("invalid piece layer for file root %x", root)
+		}
+		if merkle.RootWithPadHash(hashes, pad) != file.root {
+			return fmt.Errorf("piece layer does not match file root %x", root)
+		}
+		t.pieceLayers[file.root] = hashes
+	}
+	return nil
+}
+
+// PieceLayers returns the piece layers we know, in .torrent form
+func (t *Torrent) PieceLayers() map[string]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if len(t.pieceLayers) == 0 {
+		return nil
+	}
+	layers := make(map[string]string, len(t.pieceLayers))
+	for root, hashes := range t.pieceLayers {
+		compact := make([]byte, 0, 32*len(hashes))
+		for _, hash := range hashes {
+			compact = append(compact, hash[:]...)
+		}
+		layers[string(root[:])] = string(compact)
+	}
+	return layers
+}
+
+// pieceHashV2 returns the merkle hash a piece must match: the file root for a
+// file of a single piece, otherwise the piece's entry in the file's piece
+// layer once that is known (assumes lock is held)
+func (t *Torrent) pieceHashV2(index int) ([32]byte, bool) {
+	file := t.v2PieceFiles[index]
+	if file.numPieces == 1 {
+		return file.root, true
+	}
+	layer, known := t.pieceLayers[file.root]
+	if !known {
+		return [32]byte{}, false
+	}
+	return layer[index-file.firstPiece], true
+}
+
+// canVerify reports whether a downloaded piece could be checked. Pieces of a
+// v2-only torrent wait for their file's piece layer (assumes lock is held).
+func (t *Torrent) canVerify(index int) bool {
+	if !t.Info.HasV2() || t.Info.HasV1() {
+		return true
+	}
+	_, known := t.pieceHashV2(index)
+	return known
+}
+
+// blockTreeWidth is the number of block hashes under one piece hash: a piece's
+// worth of blocks, or for a single-piece file its blocks rounded up to a power
+// of two
+func (t *Torrent) blockTreeWidth(file *v2File) int {
+	if file.numPieces == 1 {
+		return int(merkle.RoundUpToPowerOfTwo(uint((file.length + merkle.BlockSize - 1) / merkle.BlockSize)))
+	}
+	return int(t.Info.PieceLength / merkle.BlockSize)
+}
+
+// pieceLayerNumber is the tree layer holding one hash per piece, counted up from the block layer
+func (t *Torrent) pieceLayerNumber() uint32 {
+	return uint32(log2(int(t.Info.PieceLength / merkle.BlockSize)))
+}
+
+// pieceMerkleHash computes a piece's hash in its file's tree; blocks past the
+// end of the file count as zero hashes
+func (t *Torrent) pieceMerkleHash(file *v2File, data []byte) [32]byte {
+	h := merkle.NewHash()
+	h.Write(data)
+	var sum [32]byte
+	if file.numPieces == 1 {
+		h.Sum(sum[:0])
+	} else {
+		h.SumMinLength(sum[:0], int(t.Info.PieceLength))
+	}
+	return sum
+}
+
+// blockHashes returns the SHA-256 of each 16 KiB block of data
+func blockHashes(data []byte) [][32]byte {
+	hashes := make([][32]byte, 0, (len(data)+merkle.BlockSize-1)/merkle.BlockSize)
+	for offset := 0; offset < len(data); offset += merkle.BlockSize {
+		hashes = append(hashes, sha256.Sum256(data[offset:min(offset+merkle.BlockSize, len(data))]))
+	}
+	return hashes
+}
+
+// nextHashRequests picks requests for piece layers we still need from a peer
+// that has pieces of the file (assumes no lock is held)
+func (t *Torrent) nextHashRequests(peerBitfield Bitfield, refused map[[32]byte]bool, max int) []hashRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var reqs []hashRequest
+	if t.Info == nil || !t.Info.HasV2() {
+		return reqs
+	}
+
+	for index := 0; index < len(t.v2PieceFiles) && len(reqs) < max; {
+		file := t.v2PieceFiles[index]
+		index = file.firstPiece + file.numPieces
+		if _, known := t.pieceLayers[file.root]; known || file.numPieces == 1 || refused[file.root] {
+			continue
+		}
+		if !peerHasAny(peerBitfield, file.firstPiece, file.numPieces) {
+			continue
+		}
+
+		download := t.layerDownloadFor(file)
+		for chunk := range download.have {
+			if len(reqs) >= max {
+				break
+			}
+			if download.have[chunk] || download.requested[chunk] {
+				continue
+			}
+			download.requested[chunk] = true
+			reqs = append(reqs, hashRequest{
+				Root:        file.root,
+				BaseLayer:   t.pieceLayerNumber(),
+				Index:       uint32(chunk * download.chunk),
+				Length:      uint32(download.chunk),
+				ProofLayers: uint32(log2(len(download.hashes))),
+			})
+		}
+	}
+	return reqs
+}
+
+// layerDownloadFor returns the download of a file's piece layer, starting it if
+// needed; chunks that are all padding are filled in at once (assumes lock is held)
+func (t *Torrent) layerDownloadFor(file *v2File) *layerDownload {
+	if download, exists := t.layerDownloads[file.root]; exists {
+		return download
+	}
+
+	width := int(merkle.RoundUpToPowerOfTwo(uint(file.numPieces)))
+	chunk := max(min(width, MaxHashesPerRequest), 2)
+	download := &layerDownload{
+		hashes:    padLayer(nil, width, metainfo.HashForPiecePad(t.Info.PieceLength)),
+		chunk:     chunk,
+		have:      make([]bool, max(width/chunk, 1)),
+		requested: make([]bool, max(width/chunk, 1)),
+	}
+	for c := range download.have {
+		download.have[c] = c*chunk >= file.numPieces
+	}
+	t.layerDownloads[file.root] = download
+	return download
+}
+
+// receiveLayerHashes stores a chunk of a piece layer once its proof leads to
+// the file root. It reports whether the layer is now complete.
+func (t *Torrent) receiveLayerHashes(req hashRequest, hashes [][32]byte) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	file, exists := t.v2Files[req.Root]
+	download := t.layerDownloads[req.Root]
+	if !exists || download == nil {
+		return false, nil // The layer was completed by another peer
+	}
+
+	length := int(req.Length)
+	if length != download.chunk || len(hashes) != length+req.uncleCount() {
+		return false, fmt.Errorf("hashes for %d+%d have the wrong length", req.Index, req.Length)
+	}
+	if proveRange(hashes[:length], int(req.Index), hashes[length:]) != file.root {
+		return false, fmt.Errorf("hashes for %d+%d do not lead to file root %x", req.Index, req.Length, file.root)
+	}
+
+	chunk := int(req.Index) / download.chunk
+	copy(download.hashes[req.Index:], hashes[:length])
+	download.have[chunk] = true
+	download.requested[chunk] = false
+	for _, have := range download.have {
+		if !have {
+			return false, nil
+		}
+	}
+
+	t.pieceLayers[file.root] = download.hashes[:file.numPieces]
+	delete(t.layerDownloads, file.root)
+	return true, nil
+}
+
+// pieceLayerComplete starts requesting the pieces of a file whose piece layer
+// has arrived, and reports the metadata complete once every layer is known
+func (t *Torrent) pieceLayerComplete(root [32]byte) {
+	log.Printf("[Torrent] %s: piece layer of file %x verified", t.Name(), root[:8])
+
+	t.mu.RLock()
+	allKnown := true
+	for root, file := range t.v2Files {
+		if _, known := t.pieceLayers[root]; !known && file.numPieces > 1 {
+			allKnown = false
+		}
+	}
+	layersReady := t.layersReady
+	t.mu.RUnlock()
+
+	if allKnown && layersReady != nil {
+		layersReady(t)
+	}
+	t.refillPeers()
+}
+
+// releaseHashRequest makes an unanswered request available to other peers, or
+// gives up on finding the corrupt blocks of a failed piece
+func (t *Torrent) releaseHashRequest(req hashRequest) {
+	if req.BaseLayer == 0 {
+		t.blockHashesUnavailable(req)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if download, exists := t.layerDownloads[req.Root]; exists {
+		download.requested[int(req.Index)/download.chunk] = false
+	}
+}
+
+// hashesFor answers a hash request from the piece layers we know and the
+// pieces we have
+func (t *Torrent) hashesFor(req hashRequest) ([][32]byte, error) {
+	if !t.HasInfo() || !t.Info.HasV2() {
+		return nil, fmt.Errorf("not a v2 torrent")
+	}
+
+	t.mu.RLock()
+	file := t.v2Files[req.Root]
+	layer := t.pieceLayers[req.Root]
+	t.mu.RUnlock()
+	if file == nil {
+		return nil, fmt.Errorf("unknown file root %x", req.Root)
+	}
+
+	index, length := int(req.Index), int(req.Length)
+	pad := metainfo.HashForPiecePad(t.Info.PieceLength)
+
+	switch req.BaseLayer {
+	case t.pieceLayerNumber():
+		if layer == nil {
+			return nil, fmt.Errorf("piece layer of %x not known", req.Root)
+		}
+		layers := merkleLayers(padLayer(layer, int(merkle.RoundUpToPowerOfTwo(uint(file.numPieces))), pad))
+		if index+length > len(layers[0]) {
+			return nil, fmt.Errorf("range %d+%d outside the piece layer", index, length)
+		}
+		return appendRange(layers[0], index, length, uncles(layers, index, length, req.uncleCount())), nil
+
+	case 0:
+		width := t.blockTreeWidth(file)
+		piece := file.firstPiece + index/width
+		if length > width || piece >= file.firstPiece+file.numPieces {
+			return nil, fmt.Errorf("range %d+%d outside a single piece", index, length)
+		}
+		if !t.HavePiece(piece) {
+			return nil, fmt.Errorf("piece %d not available", piece)
+		}
+		data, err := t.readPiece(piece)
+		if err != nil {
+			return nil, err
+		}
+
+		layers := merkleLayers(padLayer(blockHashes(data), width, [32]byte{}))
+		proof := uncles(layers, index%width, length, req.uncleCount())
+		if extra := req.uncleCount() - len(proof); extra > 0 && layer != nil {
+			// The proof continues through the piece layer towards the file root
+			pieceLayers := merkleLayers(padLayer(layer, int(merkle.RoundUpToPowerOfTwo(uint(file.numPieces))), pad))
+			proof = append(proof, uncles(pieceLayers, piece-file.firstPiece, 1, extra)...)
+		}
+		return appendRange(layers[0], index%width, length, proof), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported base layer %d", req.BaseLayer)
+	}
+}
+
+// appendRange returns length hashes from index followed by their proof
+func appendRange(layer [][32]byte, index, length int, proof [][32]byte) [][32]byte {
+	hashes := append([][32]byte(nil), layer[index:index+length]...)
+	return append(hashes, proof...)
+}
+
+// merkleLayers returns every layer of a tree from its base (a power of two
+// hashes) up to the root
+func merkleLayers(base [][32]byte) [][][32]byte {
+	layers := [][][32]byte{base}
+	for layer := base; len(layer) > 1; {
+		next := make([][32]byte, len(layer)/2)
+		for i := range next {
+			next[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+		layers = append(layers, next)
+		layer = next
+	}
+	return layers
+}
+
+// uncles returns up to count proof hashes for length hashes at index: the
+// sibling of each ancestor of the range, lowest first
+func uncles(layers [][][32]byte, index, length, count int) [][32]byte {
+	var proof [][32]byte
+	height := log2(length)
+	position := index >> height
+	for h := height; h < len(layers)-1 && len(proof) < count; h++ {
+		proof = append(proof, layers[h][position^1])
+		position >>= 1
+	}
+	return proof
+}
+
+// proveRange hashes a range of a layer up the tree with its proof
+func proveRange(hashes [][32]byte, index int, proof [][32]byte) [32]byte {
+	node := merkle.Root(hashes)
+	position := index / len(hashes)
+	for _, uncle := range proof {
+		if position%2 == 0 {
+			node = hashPair(node, uncle)
+		} else {
+			node = hashPair(uncle, node)
+		}
+		position /= 2
+	}
+	return node
+}
+
+func hashPair(left, right [32]byte) [32]byte {
+	return sha256.Sum256(append(left[:], right[:]...))
+}
+
+// padLayer extends a layer to width hashes with pad
+func padLayer(layer [][32]byte, width int, pad [32]byte) [][32]byte {
+	padded := make([][32]byte, width)
+	copy(padded, layer)
+	for i := len(layer); i < width; i++ {
+		padded[i] = pad
+	}
+	return padded
+}
+
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+// log2 of a power of two
+func log2(n int) int {
+	return bits.Len(uint(n)) - 1
+}
+
+// peerHasAny reports whether the bitfield has any of count pieces from first
+func peerHasAny(bitfield Bitfield, first, count int) bool {
+	for i := first; i < first+count; i++ {
+		if bitfield.Has(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHashes asks the peer for piece layers we still need
+func (pc *PeerConn) requestHashes() error {
+	pc.mu.Lock()
+	bitfield := pc.bitfield
+	refused := make(map[[32]byte]bool, len(pc.hashRefused))
+	for root := range pc.hashRefused {
+		refused[root] = true
+	}
+	room := MaxHashRequestsPerPeer - len(pc.hashRequests)
+	pc.mu.Unlock()
+
+	if room <= 0 {
+		return nil
+	}
+	for _, req := range pc.torrent.nextHashRequests(bitfield, refused, room) {
+		if err := pc.sendHashRequest(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendHashRequest records and sends a hash request
+func (pc *PeerConn) sendHashRequest(req hashRequest) error {
+	pc.mu.Lock()
+	pc.hashRequests = append(pc.hashRequests, req)
+	pc.mu.Unlock()
+
+	if err := pc.wire.SendHashRequest(req); err != nil {
+		return fmt.Errorf("failed to send hash request: %v", err)
+	}
+	return nil
+}
+
+// takeHashRequest removes the outstanding request an answer refers to
+func (pc *PeerConn) takeHashRequest(req hashRequest) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	for i, outstanding := range pc.hashRequests {
+		if outstanding == req {
+			pc.hashRequests = append(pc.hashRequests[:i], pc.hashRequests[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// takeHashRequests clears and returns the outstanding hash requests
+func (pc *PeerConn) takeHashRequests() []hashRequest {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	reqs := pc.hashRequests
+	pc.hashRequests = nil
+	return reqs
+}
+
+// handleHashRequest serves hashes from our trees, or rejects the request
+func (pc *PeerConn) handleHashRequest(payload []byte) error {
+	req, _, err := decodeHashMessage(payload)
+	if err != nil {
+		return err
+	}
+
+	hashes, err := pc.torrent.hashesFor(req)
+	if err != nil {
+		log.Printf("Rejecting hash request from %s: %v", pc.addr, err)
+		return pc.wire.SendHashReject(req)
+	}
+	return pc.wire.SendHashes(req, hashes)
+}
+
+// handleHashes checks and stores hashes we requested. Hashes that do not
+// verify count against the peer like corrupt piece data.
+func (pc *PeerConn) handleHashes(payload []byte) error {
+	req, hashes, err := decodeHashMessage(payload)
+	if err != nil {
+		return err
+	}
+	if !pc.takeHashRequest(req) {
+		log.Printf("Ignoring unrequested hashes from %s", pc.addr)
+		return nil
+	}
+
+	if req.BaseLayer == 0 {
+		err = pc.torrent.receiveBlockHashes(req, hashes)
+	} else {
+		var complete bool
+		complete, err = pc.torrent.receiveLayerHashes(req, hashes)
+		if complete {
+			pc.torrent.pieceLayerComplete(req.Root)
+		}
+	}
+	if err != nil {
+		log.Printf("Bad hashes from %s: %v", pc.addr, err)
+		pc.torrent.releaseHashRequest(req)
+		pc.torrent.penalize(pc)
+	}
+	return pc.fillRequests()
+}
+
+// handleHashReject stops asking the peer for a tree it does not have
+func (pc *PeerConn) handleHashReject(payload []byte) error {
+	req, _, err := decodeHashMessage(payload)
+	if err != nil {
+		return err
+	}
+	if !pc.takeHashRequest(req) {
+		return nil
+	}
+
+	pc.mu.Lock()
+	if pc.hashRefused == nil {
+		pc.hashRefused = make(map[[32]byte]bool)
+	}
+	pc.hashRefused[req.Root] = true
+	pc.mu.Unlock()
+
+	pc.torrent.releaseHashRequest(req)
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"testing"
+
+	"github.com/anacrolix/torrent/merkle"
+)
+
+func testLayer(width int) [][32]byte {
+	layer := make([][32]byte, width)
+	for i := range layer {
+		layer[i] = sha256.Sum256([]byte(strconv.Itoa(i)))
+	}
+	return layer
+}
+
+func TestMerkleProof(t *testing.T) {
+	tests := []struct {
+		width  int
+		index  int
+		length int
+	}{
+		{width: 1, index: 0, length: 1},
+		{width: 2, index: 1, length: 1},
+		{width: 8, index: 0, length: 1},
+		{width: 8, index: 5, length: 1},
+		{width: 8, index: 4, length: 2},
+		{width: 8, index: 4, length: 4},
+		{width: 8, index: 0, length: 8},
+		{width: 64, index: 48, length: 16},
+	}
+
+	for _, tt := range tests {
+		base := testLayer(tt.width)
+		layers := merkleLayers(base)
+		root := layers[len(layers)-1][0]
+		if want := merkle.Root(base); root != want {
+			t.Fatalf("merkleLayers(%d hashes) root = %x, want %x", tt.width, root, want)
+		}
+
+		hashes := base[tt.index : tt.index+tt.length]
+		proof := uncles(layers, tt.index, tt.length, len(layers))
+		if want := log2(tt.width) - log2(tt.length); len(proof) != want {
+			t.Errorf("width %d, range %d+%d: %d uncles, want %d", tt.width, tt.index, tt.length, len(proof), want)
+		}
+		if got := proveRange(hashes, tt.index, proof); got != root {
+			t.Errorf("width %d, range %d+%d: proof does not reach the root", tt.width, tt.index, tt.length)
+		}
+
+		// A tampered hash or uncle must not prove the range
+		tampered := append([][32]byte(nil), hashes...)
+		tampered[0][0] ^= 1
+		if proveRange(tampered, tt.index, proof) == root {
+			t.Errorf("width %d, range %d+%d: tampered hash reached the root", tt.width, tt.index, tt.length)
+		}
+		if len(proof) > 0 {
+			badProof := append([][32]byte(nil), proof...)
+			badProof[len(badProof)-1][0] ^= 1
+			if proveRange(hashes, tt.index, badProof) == root {
+				t.Errorf("width %d, range %d+%d: tampered uncle reached the root", tt.width, tt.index, tt.length)
+			}
+		}
+	}
+}
+
+func TestUnclesCount(t *testing.T) {
+	layers := merkleLayers(testLayer(16))
+
+	// Asking for fewer uncles returns the lowest ones, which prove the range
+	// up to an intermediate layer
+	proof := uncles(layers, 6, 2, 2)
+	if len(proof) != 2 {
+		t.Fatalf("got %d uncles, want 2", len(proof))
+	}
+	if got := proveRange(layers[0][6:8], 6, proof); got != layers[3][0] {
+		t.Errorf("partial proof = %x, want %x", got, layers[3][0])
+	}
+}
+
+func TestDecodeHashMessage(t *testing.T) {
+	req := hashRequest{Root: sha256.Sum256([]byte("root")), BaseLayer: 2, Index: 8, Length: 4, ProofLayers: 5}
+	hashes := testLayer(3)
+	payload := req.encode()
+	for _, hash := range hashes {
+		payload = append(payload, hash[:]...)
+	}
+
+	got, gotHashes, err := decodeHashMessage(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != req {
+		t.Errorf("decoded request %+v, want %+v", got, req)
+	}
+	if len(gotHashes) != len(hashes) {
+		t.Fatalf("decoded %d hashes, want %d", len(gotHashes), len(hashes))
+	}
+	for i := range hashes {
+		if gotHashes[i] != hashes[i] {
+			t.Errorf("hash %d = %x, want %x", i, gotHashes[i], hashes[i])
+		}
+	}
+	if got.uncleCount() != 3 {
+		t.Errorf("uncleCount = %d, want 3", got.uncleCount())
+	}
+
+	invalid := []struct {
+		name    string
+		payload []byte
+	}{
+		{"short header", payload[:hashRequestSize-1]},
+		{"partial hash", payload[:hashRequestSize+31]},
+		{"zero length", hashRequest{Length: 0}.encode()},
+		{"length not a power of two", hashRequest{Length: 3}.encode()},
+		{"length too large", hashRequest{Length: 2 * MaxHashesPerRequest}.encode()},
+		{"unaligned index", hashRequest{Index: 2, Length: 4}.encode()},
+	}
+	for _, tt := range invalid {
+		if _, _, err := decodeHashMessage(tt.payload); err == nil {
+			t.Errorf("%s: decoded without error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// BEP 9 metadata exchange (ut_metadata)
+const (
+	MetadataPieceSize   = 16 * 1024        // Size of each metadata piece
+	MaxMetadataSize     = 16 * 1024 * 1024 // Largest info dictionary we will fetch
+	MaxMetadataRequests = 4                // Metadata requests kept in flight per peer
+)
+
+// ut_metadata message types
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// metadataMessage is the bencoded header of a ut_metadata message; data
+// messages carry the piece bytes after it
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// metadataDownload assembles an info dictionary fetched from peers
+type metadataDownload struct {
+	data      []byte
+	received  []bool
+	requested []bool
+	remaining int
+}
+
+// startMetadata prepares to fetch an info dictionary of size bytes. Peers that
+// report a different size while a download is running are not used.
+func (t *Torrent) startMetadata(size int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if size <= 0 || size > MaxMetadataSize {
+		return fmt.Errorf("invalid metadata size %d", size)
+	}
+	if t.metadata != nil {
+		if len(t.metadata.data) != size {
+			return fmt.Errorf("metadata size %d does not match %d", size, len(t.metadata.data))
+		}
+		return nil
+	}
+
+	numPieces := (size + MetadataPieceSize - 1) / MetadataPieceSize
+	t.metadata = &metadataDownload{
+		data:      make([]byte, size),
+		received:  make([]bool, numPieces),
+		requested: make([]bool, numPieces),
+		remaining: numPieces,
+	}
+	log.Printf("[Torrent] %s: fetching %d bytes of metadata from peers", t.displayNameLocked(), size)
+	return nil
+}
+
+// displayNameLocked returns the name used before the info is known (assumes lock is held)
+func (t *Torrent) displayNameLocked() string {
+	if t.displayName != "" {
+		return t.displayName
+	}
+	return fmt.Sprintf("%x", t.InfoHash)
+}
+
+// nextMetadataPieces picks up to max metadata pieces that nobody has been asked for
+func (t *Torrent) nextMetadataPieces(max int) []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var pieces []int
+	if t.metadata == nil {
+		return pieces
+	}
+	for i := range t.metadata.requested {
+		if len(pieces) >= max {
+			break
+		}
+		if t.metadata.requested[i] || t.metadata.received[i] {
+			continue
+		}
+		t.metadata.requested[i] = true
+		pieces = append(pieces, i)
+	}
+	return pieces
+}
+
+// releaseMetadataPieces makes metadata pieces available to other peers again
+func (t *Torrent) releaseMetadataPieces(pieces []int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.metadata == nil {
+		return
+	}
+	for _, piece := range pieces {
+		if piece < len(t.metadata.requested) && !t.metadata.received[piece] {
+			t.metadata.requested[piece] = false
+		}
+	}
+}
+
+// receiveMetadataPiece stores a metadata piece. Once every piece has arrived the
+// info dictionary is checked against the infohash and attached; completed
+// reports whether that happened.
+func (t *Torrent) receiveMetadataPiece(piece int, data []byte) (completed bool, err error) {
+	t.mu.Lock()
+
+	md := t.metadata
+	if md == nil {
+		t.mu.Unlock()
+		return false, nil // Already complete or not being fetched
+	}
+	if piece < 0 || piece >= len(md.received) {
+		t.mu.Unlock()
+		return false, fmt.Errorf("metadata piece %d out of range", piece)
+	}
+	offset := piece * MetadataPieceSize
+	if len(data) != min(MetadataPieceSize, len(md.data)-offset) {
+		t.mu.Unlock()
+		return false, fmt.Errorf("metadata piece %d has wrong length %d", piece, len(data))
+	}
+	if md.received[piece] {
+		t.mu.Unlock()
+		return false, nil // Duplicate
+	}
+
+	copy(md.data[offset:], data)
+	md.received[piece] = true
+	md.remaining--
+	if md.remaining > 0 {
+		t.mu.Unlock()
+		return false, nil
+	}
+	t.metadata = nil
+	t.mu.Unlock()
+
+	if err := t.SetInfoBytes(md.data); err != nil {
+		// Start over with every peer that offers metadata
+		if restartErr := t.startMetadata(len(md.data)); restartErr == nil {
+			for _, pc := range t.connectedPeers() {
+				if reqErr := pc.requestMetadata(); reqErr != nil {
+					log.Printf("Failed to request metadata from %s: %v", pc.addr, reqErr)
+				}
+			}
+		}
+		return false, err
+	}
+
+	log.Printf("[Torrent] %s: metadata received (%d pieces)", t.Name(), t.NumPieces())
+	t.metadataComplete()
+	return true, nil
+}
+
+// metadataComplete checks existing data and brings connected peers up to date
+// once the info dictionary is known
+func (t *Torrent) metadataComplete() {
+	if _, err := t.Recheck(); err != nil {
+		log.Printf("[Torrent] %s: recheck failed: %v", t.Name(), err)
+	}
+	if t.infoReady != nil {
+		t.infoReady(t)
+	}
+	for _, pc := range t.connectedPeers() {
+		if err := pc.handleInfoReady(); err != nil {
+			log.Printf("Failed to start piece exchange with %s: %v", pc.addr, err)
+		}
+	}
+}
+
+// metadataPiece returns a piece of our info dictionary and its total size
+func (t *Torrent) metadataPiece(piece int) ([]byte, int, bool) {
+	infoBytes := t.InfoBytes()
+	offset := piece * MetadataPieceSize
+	if infoBytes == nil || piece < 0 || offset >= len(infoBytes) {
+		return nil, 0, false
+	}
+	end := min(offset+MetadataPieceSize, len(infoBytes))
+	return infoBytes[offset:end], len(infoBytes), true
+}
+
+// requestMetadata keeps metadata requests to the peer in flight
+func (pc *PeerConn) requestMetadata() error {
+	if _, ok := pc.peerExtensionID(ExtensionMetadata); !ok {
+		return nil
+	}
+
+	pc.mu.Lock()
+	wanted := MaxMetadataRequests - len(pc.metadataRequests)
+	pc.mu.Unlock()
+	if wanted <= 0 {
+		return nil
+	}
+
+	pieces := pc.torrent.nextMetadataPieces(wanted)
+	pc.mu.Lock()
+	pc.metadataRequests = append(pc.metadataRequests, pieces...)
+	pc.mu.Unlock()
+
+	for _, piece := range pieces {
+		if err := pc.sendMetadataMessage(metadataMessage{MsgType: metadataRequest, Piece: piece}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// takeMetadataRequests clears and returns the metadata pieces requested from this peer
+func (pc *PeerConn) takeMetadataRequests() []int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pieces := pc.metadataRequests
+	pc.metadataRequests = nil
+	return pieces
+}
+
+// completeMetadataRequest removes a piece from the outstanding requests,
+// reporting whether we had asked for it
+func (pc *PeerConn) completeMetadataRequest(piece int) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	for i, outstanding := range pc.metadataRequests {
+		if outstanding == piece {
+			pc.metadataRequests = append(pc.metadataRequests[:i], pc.metadataRequests[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// sendMetadataMessage sends a ut_metadata message on the ID the peer chose
+func (pc *PeerConn) sendMetadataMessage(msg metadataMessage, data []byte) error {
+	id, ok := pc.peerExtensionID(ExtensionMetadata)
+	if !ok {
+		return fmt.Errorf("peer does not support %s", ExtensionMetadata)
+	}
+
+	header, err := bencode.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata message: %v", err)
+	}
+	if err := pc.wire.SendExtended(id, append(header, data...)); err != nil {
+		return fmt.Errorf("failed to send metadata message: %v", err)
+	}
+	return nil
+}
+
+// handleMetadataMessage serves metadata requests and collects metadata pieces
+func (pc *PeerConn) handleMetadataMessage(payload []byte) error {
+	var msg metadataMessage
+	var data []byte
+
+	err := bencode.Unmarshal(payload, &msg)
+	var trailing bencode.ErrUnusedTrailingBytes
+	if errors.As(err, &trailing) {
+		data = payload[len(payload)-trailing.NumUnusedBytes:]
+	} else if err != nil {
+		return fmt.Errorf("invalid %s message: %v", ExtensionMetadata, err)
+	}
+
+	switch msg.MsgType {
+	case metadataRequest:
+		if _, ok := pc.peerExtensionID(ExtensionMetadata); !ok {
+			return nil // No ID to answer on
+		}
+		piece, totalSize, ok := pc.torrent.metadataPiece(msg.Piece)
+		if !ok {
+			return pc.sendMetadataMessage(metadataMessage{MsgType: metadataReject, Piece: msg.Piece}, nil)
+		}
+		return pc.sendMetadataMessage(metadataMessage{MsgType: metadataData, Piece: msg.Piece, TotalSize: totalSize}, piece)
+
+	case metadataData:
+		if !pc.completeMetadataRequest(msg.Piece) {
+			log.Printf("Ignoring unrequested metadata piece %d from %s", msg.Piece, pc.addr)
+			return nil
+		}
+		completed, err := pc.torrent.receiveMetadataPiece(msg.Piece, data)
+		if err != nil {
+			log.Printf("Metadata from %s rejected: %v", pc.addr, err)
+			return nil
+		}
+		if completed {
+			return nil
+		}
+		return pc.requestMetadata()
+
+	case metadataReject:
+		// The peer does not have (or will not share) this piece; let another peer fetch it
+		if pc.completeMetadataRequest(msg.Piece) {
+			pc.torrent.releaseMetadataPieces([]int{msg.Piece})
+		}
+		return nil
+
+	default:
+		return nil // Unknown message types are ignored (BEP 9)
+	}
+}
+
+// handleInfoReady starts piece exchange on a connection that was opened before
+// the torrent's info was known
+func (pc *PeerConn) handleInfoReady() error {
+	numPieces := pc.torrent.NumPieces()
+
+	pc.mu.Lock()
+	pc.metadataRequests = nil
+	if pc.haveAll {
+		pc.bitfield = fullBitfield(numPieces)
+	} else if !pc.bitfield.validFor(numPieces) {
+		// Haves received before the info could not be recorded; start from the bitfield size we now know
+		pc.bitfield = NewBitfield(numPieces)
+	}
+	pc.countAvailability()
+	pc.mu.Unlock()
+
+	// A bitfield may only follow the handshake, so pieces found on disk are announced individually
+	bitfield := pc.torrent.Bitfield()
+	for i := 0; i < numPieces; i++ {
+		if bitfield.Has(i) {
+			if err := pc.wire.SendHave(uint32(i)); err != nil {
+				return fmt.Errorf("failed to send have: %v", err)
+			}
+		}
+	}
+
+	if err := pc.sendAllowedFast(); err != nil {
+		return err
+	}
+
+	pc.updateInterest()
+	return pc.fillRequests()
+}
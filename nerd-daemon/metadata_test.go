@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// testInfoBytes bencodes a single-file info dictionary with numPieces pieces;
+// a few thousand pieces make the dictionary span several metadata pieces
+func testInfoBytes(t *testing.T, name string, numPieces int) []byte {
+	t.Helper()
+	info := metainfo.Info{
+		Name:        name,
+		PieceLength: BlockSize,
+		Length:      int64(numPieces) * BlockSize,
+		Pieces:      bytes.Repeat([]byte{0xAB}, numPieces*20),
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return infoBytes
+}
+
+func TestMetadataPiece(t *testing.T) {
+	infoBytes := testInfoBytes(t, "data.bin", 2000)
+	seed, err := NewTorrent(sha1.Sum(infoBytes), infoBytes, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := (len(infoBytes) - 1) / MetadataPieceSize
+
+	tests := []struct {
+		piece  int
+		want   []byte
+		wantOk bool
+	}{
+		{piece: 0, want: infoBytes[:MetadataPieceSize], wantOk: true},
+		{piece: last, want: infoBytes[last*MetadataPieceSize:], wantOk: true},
+		{piece: last + 1},
+		{piece: -1},
+	}
+
+	for _, tt := range tests {
+		got, size, ok := seed.metadataPiece(tt.piece)
+		if ok != tt.wantOk || !bytes.Equal(got, tt.want) {
+			t.Errorf("metadataPiece(%d) = %d bytes, %v; want %d bytes, %v", tt.piece, len(got), ok, len(tt.want), tt.wantOk)
+		}
+		if ok && size != len(infoBytes) {
+			t.Errorf("metadataPiece(%d) total size = %d, want %d", tt.piece, size, len(infoBytes))
+		}
+	}
+}
+
+func TestStartMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		sizes   []int
+		wantErr bool
+	}{
+		{name: "valid", sizes: []int{40000}},
+		{name: "same size from a second peer", sizes: []int{40000, 40000}},
+		{name: "different size from a second peer", sizes: []int{40000, 40001}, wantErr: true},
+		{name: "empty", sizes: []int{0}, wantErr: true},
+		{name: "too large", sizes: []int{MaxMetadataSize + 1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		torrent, err := NewTorrent([20]byte{1}, nil, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range tt.sizes {
+			err = torrent.startMetadata(size)
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: startMetadata error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMetadataDownload(t *testing.T) {
+	infoBytes := testInfoBytes(t, "data.bin", 2000)
+	numPieces := (len(infoBytes) + MetadataPieceSize - 1) / MetadataPieceSize
+	if numPieces < 3 {
+		t.Fatalf("info dictionary spans %d metadata pieces, want at least 3", numPieces)
+	}
+	piece := func(i int) []byte {
+		return infoBytes[i*MetadataPieceSize : min((i+1)*MetadataPieceSize, len(infoBytes))]
+	}
+
+	torrent, err := NewTorrent(sha1.Sum(infoBytes), nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := torrent.startMetadata(len(infoBytes)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pieces are handed out once; released pieces can be requested again
+	first := torrent.nextMetadataPieces(2)
+	if len(first) != 2 || first[0] != 0 || first[1] != 1 {
+		t.Fatalf("first peer asked for %v, want [0 1]", first)
+	}
+	if rest := torrent.nextMetadataPieces(MaxMetadataRequests); len(rest) != numPieces-2 {
+		t.Fatalf("second peer asked for %v, want the other %d pieces", rest, numPieces-2)
+	}
+	torrent.releaseMetadataPieces(first[1:])
+	if again := torrent.nextMetadataPieces(MaxMetadataRequests); len(again) != 1 || again[0] != 1 {
+		t.Fatalf("after release asked for %v, want [1]", again)
+	}
+
+	invalid := []struct {
+		name  string
+		piece int
+		data  []byte
+	}{
+		{"out of range", numPieces, piece(0)},
+		{"negative", -1, piece(0)},
+		{"short piece", 0, piece(0)[1:]},
+		{"long last piece", numPieces - 1, append(append([]byte(nil), piece(numPieces-1)...), 0)},
+	}
+	for _, tt := range invalid {
+		if completed, err := torrent.receiveMetadataPiece(tt.piece, tt.data); err == nil || completed {
+			t.Errorf("%s: receiveMetadataPiece = %v, %v; want an error", tt.name, completed, err)
+		}
+	}
+
+	for i := numPieces - 1; i >= 0; i-- {
+		completed, err := torrent.receiveMetadataPiece(i, piece(i))
+		if err != nil {
+			t.Fatalf("piece %d: %v", i, err)
+		}
+		if completed != (i == 0) {
+			t.Fatalf("piece %d: completed = %v", i, completed)
+		}
+		if i == numPieces-1 {
+			// A duplicate is ignored
+			if completed, err := torrent.receiveMetadataPiece(i, piece(i)); err != nil || completed {
+				t.Fatalf("duplicate piece %d: %v, %v", i, completed, err)
+			}
+		}
+	}
+	if !torrent.HasInfo() || !bytes.Equal(torrent.InfoBytes(), infoBytes) {
+		t.Fatal("info dictionary not attached after the last piece")
+	}
+}
+
+func TestMetadataDownloadRejected(t *testing.T) {
+	tests := []struct {
+		name      string
+		infoBytes []byte
+		received  func(infoBytes []byte) []byte
+	}{
+		{
+			name:      "does not match the infohash",
+			infoBytes: testInfoBytes(t, "data.bin", 10),
+			received: func(infoBytes []byte) []byte {
+				corrupt := append([]byte(nil), infoBytes...)
+				corrupt[len(corrupt)-2] ^= 1
+				return corrupt
+			},
+		},
+		{
+			name:      "name escapes the download directory",
+			infoBytes: testInfoBytes(t, "..", 10),
+		},
+		{
+			name:      "name is a path",
+			infoBytes: testInfoBytes(t, "../../etc/passwd", 10),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := tt.infoBytes
+			if tt.received != nil {
+				received = tt.received(tt.infoBytes)
+			}
+			torrent, err := NewTorrent(sha1.Sum(tt.infoBytes), nil, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := torrent.startMetadata(len(received)); err != nil {
+				t.Fatal(err)
+			}
+			torrent.nextMetadataPieces(MaxMetadataRequests)
+
+			completed, err := torrent.receiveMetadataPiece(0, received)
+			if err == nil || completed {
+				t.Fatalf("receiveMetadataPiece = %v, %v; want an error", completed, err)
+			}
+			if torrent.HasInfo() {
+				t.Fatal("rejected info dictionary was attached")
+			}
+
+			// The download starts over with every piece available again
+			if pieces := torrent.nextMetadataPieces(MaxMetadataRequests); len(pieces) != 1 {
+				t.Errorf("after rejection asked for %v, want [0]", pieces)
+			}
+		})
+	}
+}
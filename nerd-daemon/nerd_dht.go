@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/nerd-daemon/messages"
+	"google.golang.org/protobuf/proto"
+)
+
+// NERD overlay DHT parameters
+const (
+	DefaultNERDNetworkID = "nerd-mainnet"
+	NERDDHTNodesFile     = "nerd_dht_nodes.dat" // Overlay routing table nodes, kept apart from mainline's
+	NERDQueryTimeout     = 10 * time.Second     // One extension query, with its retries
+	nerdPacketTagLen     = 8                    // Bytes of HMAC-SHA256 after the magic
+	nerdTokenInterval    = 5 * time.Minute      // Profile tokens stay valid for one to two intervals
+	nerdSurveyNodes      = 32                   // Overlay nodes asked for their quality and balance per round
+	nerdSurveyConcurrent = 8
+)
+
+// Extension queries answered by overlay nodes. Replies carry the responder's
+// P2P port and a protobuf message in the "v" key of the return.
+const (
+	NERDQueryQuality = "nerd_quality" // QualityMetricsMsg
+	NERDQueryBalance = "nerd_balance" // TokenBalanceMsg
+	NERDQueryProfile = "nerd_profile" // SocialProfileMsg of the creator address in "v"; needs a token
+)
+
+// nerdPacketMagic starts every overlay packet. KRPC messages start with 'd',
+// so mainline nodes drop our packets and we drop theirs.
+var nerdPacketMagic = []byte("NERD")
+
+var (
+	// ErrNERDOverlayDisabled is returned by extension queries on a mainline DHT server
+	ErrNERDOverlayDisabled = errors.New("NERD overlay DHT is not enabled")
+
+	// ErrNERDNotFound is returned when a node has no answer to a query, such
+	// as a profile it does not hold
+	ErrNERDNotFound = errors.New("node has no answer")
+)
+
+// NERDInfo supplies this daemon's own state to the extension queries
+type NERDInfo interface {
+	Port() int // P2P port
+	QualityMetrics() *messages.QualityMetricsMsg
+	TokenBalance() *messages.TokenBalanceMsg
+	Profile(creatorAddress string) *messages.SocialProfileMsg // nil if unknown
+}
+
+// NERDNodeReply is a node's answer to an extension query
+type NERDNodeReply struct {
+	Addr    string // The node's DHT address
+	Port    int    // The node's P2P port
+	RTT     time.Duration
+	Message proto.Message
+}
+
+// NERDNodeStatus describes a node's answer for the control API
+type NERDNodeStatus struct {
+	Addr    string        `json:"addr"`
+	Port    int           `json:"port"`
+	RTTMs   float64       `json:"rtt_ms"`
+	Query   string        `json:"query"`
+	Message proto.Message `json:"message"`
+}
+
+// Status describes the reply to query for the control API
+func (r *NERDNodeReply) Status(query string) NERDNodeStatus {
+	return NERDNodeStatus{
+		Addr:    r.Addr,
+		Port:    r.Port,
+		RTTMs:   float64(r.RTT) / float64(time.Millisecond),
+		Query:   query,
+		Message: r.Message,
+	}
+}
+
+// nerdReply is the bencoded "v" of an extension reply
+type nerdReply struct {
+	Port    int    `bencode:"port"`
+	Message []byte `bencode:"msg,omitempty"` // Empty when the node has no answer
+}
+
+// nodeSurvey counts the survey queries a node was sent and answered
+type nodeSurvey struct {
+	asked    int
+	answered int
+}
+
+// overlayConn separates the overlay from mainline and from other overlays. It
+// prefixes every packet with nerdPacketMagic and an HMAC keyed by the network
+// ID, and drops received packets that do not carry both.
+type overlayConn struct {
+	net.PacketConn
+	key     [32]byte
+	readBuf []byte // ReadFrom is only called from the DHT server's read loop
+}
+
+// newOverlayConn wraps conn for the overlay network networkID
+func newOverlayConn(conn net.PacketConn, networkID string) *overlayConn {
+	return &overlayConn{
+		PacketConn: conn,
+		key:        sha256.Sum256([]byte("nerd-dht-network:" + networkID)),
+	}
+}
+
+// tag authenticates payload for the network
+func (c *overlayConn) tag(payload []byte) []byte {
+	mac := hmac.New(sha256.New, c.key[:])
+	mac.Write(payload)
+	return mac.Sum(nil)[:nerdPacketTagLen]
+}
+
+// WriteTo sends p to addr with the overlay header
+func (c *overlayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	packet := make([]byte, 0, len(nerdPacketMagic)+nerdPacketTagLen+len(p))
+	packet = append(packet, nerdPacketMagic...)
+	packet = append(packet, c.tag(p)...)
+	packet = append(packet, p...)
+	if _, err := c.PacketConn.WriteTo(packet, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadFrom returns the next packet of our network, without its header
+func (c *overlayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	header := len(nerdPacketMagic) + nerdPacketTagLen
+	if len(c.readBuf) < len(p)+header {
+		c.readBuf = make([]byte, len(p)+header)
+	}
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(c.readBuf)
+		if err != nil {
+			return 0, addr, err
+		}
+		packet := c.readBuf[:n]
+		if n < header || string(packet[:len(nerdPacketMagic)]) != string(nerdPacketMagic) {
+			continue // Mainline traffic
+		}
+		payload := packet[header:]
+		if !hmac.Equal(packet[len(nerdPacketMagic):header], c.tag(payload)) {
+			continue // Another network, or forged
+		}
+		return copy(p, payload), addr, nil
+	}
+}
+
+// SetNERDInfo sets the source of our answers to extension queries. Until it
+// is set the overlay answers them with errors.
+func (ds *DHTServer) SetNERDInfo(info NERDInfo) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.nerdInfo = info
+}
+
+// handleNERDQuery answers the extension queries, replying through conn, and
+// leaves every other query to the DHT server
+func (ds *DHTServer) handleNERDQuery(conn net.PacketConn, query *krpc.Msg, source net.Addr) bool {
+	switch query.Q {
+	case NERDQueryQuality, NERDQueryBalance, NERDQueryProfile:
+	default:
+		return true
+	}
+
+	ds.mu.RLock()
+	info := ds.nerdInfo
+	ds.mu.RUnlock()
+	if info == nil {
+		ds.sendNERDError(conn, source, query.T, krpc.ErrorCodeServerError, "not available")
+		return false
+	}
+
+	reply := krpc.Return{ID: krpc.ID(ds.config.NodeID)}
+	var message proto.Message
+	switch query.Q {
+	case NERDQueryQuality:
+		message = info.QualityMetrics()
+	case NERDQueryBalance:
+		message = info.TokenBalance()
+	case NERDQueryProfile:
+		var creator string
+		if query.A != nil {
+			creator, _ = query.A.V.(string)
+		}
+		if creator == "" {
+			ds.sendNERDError(conn, source, query.T, krpc.ErrorCodeProtocolError, "creator address required")
+			return false
+		}
+		// Profiles are far larger than the query, so a spoofed source only
+		// gets a token back
+		token := ds.nerdToken(source, time.Now())
+		if !ds.validNERDToken(query.A.Token, source) {
+			reply.Token = &token
+			ds.sendNERDReply(conn, source, query.T, reply)
+			return false
+		}
+		reply.Token = &token
+		message = info.Profile(creator)
+	}
+
+	value := nerdReply{Port: info.Port()}
+	if message != nil && !isNilMessage(message) {
+		data, err := proto.Marshal(message)
+		if err != nil {
+			ds.sendNERDError(conn, source, query.T, krpc.ErrorCodeServerError, err.Error())
+			return false
+		}
+		value.Message = data
+	}
+	encoded, err := bencode.Marshal(value)
+	if err != nil {
+		ds.sendNERDError(conn, source, query.T, krpc.ErrorCodeServerError, err.Error())
+		return false
+	}
+	reply.V = encoded
+	ds.sendNERDReply(conn, source, query.T, reply)
+	return false
+}
+
+// isNilMessage reports whether message is a typed nil, as returned for an unknown profile
+func isNilMessage(message proto.Message) bool {
+	return !message.ProtoReflect().IsValid()
+}
+
+// sendNERDReply answers query t from source
+func (ds *DHTServer) sendNERDReply(conn net.PacketConn, source net.Addr, t string, reply krpc.Return) {
+	ds.sendKRPC(conn, source, krpc.Msg{T: t, Y: krpc.YResponse, R: &reply})
+}
+
+// sendNERDError fails query t from source
+func (ds *DHTServer) sendNERDError(conn net.PacketConn, source net.Addr, t string, code int, msg string) {
+	ds.sendKRPC(conn, source, krpc.Msg{T: t, Y: krpc.YError, E: &krpc.Error{Code: code, Msg: msg}})
+}
+
+// sendKRPC writes a message to addr
+func (ds *DHTServer) sendKRPC(conn net.PacketConn, addr net.Addr, msg krpc.Msg) {
+	data, err := bencode.Marshal(msg)
+	if err != nil {
+		log.Printf("[DHT] Failed to encode reply to %s: %v", addr, err)
+		return
+	}
+	if _, err := conn.WriteTo(data, addr); err != nil {
+		log.Printf("[DHT] Failed to reply to %s: %v", addr, err)
+	}
+}
+
+// nerdToken returns the profile token for the host of addr in the interval containing t
+func (ds *DHTServer) nerdToken(addr net.Addr, t time.Time) string {
+	host := addr.String()
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		host = udpAddr.IP.String()
+	}
+	mac := hmac.New(sha1.New, ds.tokenSecret)
+	fmt.Fprintf(mac, "%s/%d", host, t.UnixNano()/int64(nerdTokenInterval))
+	return string(mac.Sum(nil)[:8])
+}
+
+// validNERDToken accepts tokens of the current and the previous interval
+func (ds *DHTServer) validNERDToken(token string, addr net.Addr) bool {
+	now := time.Now()
+	for _, t := range []time.Time{now, now.Add(-nerdTokenInterval)} {
+		if hmac.Equal([]byte(token), []byte(ds.nerdToken(addr, t))) {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryNERDNode sends an extension query to the overlay node at addr
+// ("host:port" of its DHT socket). Profile queries take the creator address
+// and fetch a token first.
+func (ds *DHTServer) QueryNERDNode(ctx context.Context, addr, query, creator string) (*NERDNodeReply, error) {
+	if !ds.isRunning {
+		return nil, fmt.Errorf("DHT server is not running")
+	}
+	if ds.config.NetworkID == "" {
+		return nil, ErrNERDOverlayDisabled
+	}
+	var message proto.Message
+	args := krpc.MsgArgs{}
+	switch query {
+	case NERDQueryQuality:
+		message = &messages.QualityMetricsMsg{}
+	case NERDQueryBalance:
+		message = &messages.TokenBalanceMsg{}
+	case NERDQueryProfile:
+		if creator == "" {
+			return nil, fmt.Errorf("a creator address is required")
+		}
+		message = &messages.SocialProfileMsg{}
+		args.V = creator
+	default:
+		return nil, fmt.Errorf("unknown query %q", query)
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := ds.server
+	if udpAddr.IP.To4() == nil {
+		if server = ds.server6; server == nil {
+			return nil, fmt.Errorf("no IPv6 DHT to reach %s", addr)
+		}
+	}
+
+	started := time.Now()
+	result := server.Query(ctx, dht.NewAddr(udpAddr), query, dht.QueryInput{MsgArgs: args})
+	if err := result.ToError(); err != nil {
+		return nil, err
+	}
+	if query == NERDQueryProfile && result.Reply.R != nil && result.Reply.R.V == nil && result.Reply.R.Token != nil {
+		args.Token = *result.Reply.R.Token
+		result = server.Query(ctx, dht.NewAddr(udpAddr), query, dht.QueryInput{MsgArgs: args})
+		if err := result.ToError(); err != nil {
+			return nil, err
+		}
+	}
+	rtt := time.Since(started)
+	if result.Reply.R == nil || result.Reply.R.V == nil {
+		return nil, fmt.Errorf("%s sent no value", addr)
+	}
+
+	var value nerdReply
+	if err := bencode.Unmarshal(result.Reply.R.V, &value); err != nil {
+		return nil, fmt.Errorf("invalid reply from %s: %v", addr, err)
+	}
+	if len(value.Message) == 0 {
+		return nil, ErrNERDNotFound
+	}
+	if err := proto.Unmarshal(value.Message, message); err != nil {
+		return nil, fmt.Errorf("invalid reply from %s: %v", addr, err)
+	}
+	return &NERDNodeReply{Addr: udpAddr.String(), Port: value.Port, RTT: rtt, Message: message}, nil
+}
+
+// surveyNERDNodes asks overlay nodes in our routing tables for their quality
+// metrics and token balance. Every overlay node is a NERD daemon, so an answer
+// also adds a peer at the node's host and P2P port, scored by how quickly and
+// how often the node answers and by the bandwidth and uptime it reports.
+func (ds *DHTServer) surveyNERDNodes() {
+	var nodes []krpc.NodeInfo
+	for _, server := range ds.servers() {
+		nodes = append(nodes, server.Nodes()...)
+	}
+	if len(nodes) > nerdSurveyNodes {
+		nodes = nodes[:nerdSurveyNodes]
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, nerdSurveyConcurrent)
+	for _, node := range nodes {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(node krpc.NodeInfo) {
+			defer func() { <-slots; wg.Done() }()
+			ds.surveyNode(node)
+		}(node)
+	}
+	wg.Wait()
+
+	// Forget nodes that left the routing tables
+	known := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		known[node.Addr.String()] = true
+	}
+	ds.surveyMu.Lock()
+	for addr := range ds.surveys {
+		if !known[addr] {
+			delete(ds.surveys, addr)
+		}
+	}
+	ds.surveyMu.Unlock()
+}
+
+// surveyNode asks one overlay node for its quality and balance
+func (ds *DHTServer) surveyNode(node krpc.NodeInfo) {
+	addr := node.Addr.String()
+	ctx, cancel := context.WithTimeout(context.Background(), NERDQueryTimeout)
+	defer cancel()
+	reply, err := ds.QueryNERDNode(ctx, addr, NERDQueryQuality, "")
+
+	ds.surveyMu.Lock()
+	survey := ds.surveys[addr]
+	if survey == nil {
+		survey = &nodeSurvey{}
+		ds.surveys[addr] = survey
+	}
+	survey.asked++
+	if err == nil {
+		survey.answered++
+	}
+	reliability := float64(survey.answered) / float64(survey.asked)
+	ds.surveyMu.Unlock()
+
+	if err != nil || reply.Port <= 0 || reply.Port > 65535 {
+		return
+	}
+	quality := reply.Message.(*messages.QualityMetricsMsg)
+	host := node.Addr.IP.String()
+	ds.addDiscoveredPeer(host, reply.Port, PeerSourceDHT, &node)
+	ds.UpdatePeerQuality(host, reply.Port, &QualityMetrics{
+		ResponseTime:     reply.RTT,
+		Reliability:      reliability, // Measured by us; self-reported scores are not trusted
+		BandwidthScore:   math.Min(float64(quality.UploadSpeedMbps)/100.0, 1),
+		UptimePercentage: math.Min(float64(quality.UptimeSeconds)/(24*3600), 1),
+		LastUpdated:      time.Now(),
+	})
+
+	var balance uint64
+	if reply, err := ds.QueryNERDNode(ctx, addr, NERDQueryBalance, ""); err == nil {
+		balance = reply.Message.(*messages.TokenBalanceMsg).NerdBalance
+	}
+	ds.peerStore.mu.Lock()
+	if peer, exists := ds.peerStore.peers[net.JoinHostPort(normalizeHost(host), strconv.Itoa(reply.Port))]; exists {
+		peer.Uptime = time.Duration(quality.UptimeSeconds) * time.Second
+		peer.TokenBalance = balance
+	}
+	ds.peerStore.mu.Unlock()
+}
+
+// sessionInfo answers the extension queries from the session and, when BSV is
+// enabled, the payment and social systems
+type sessionInfo struct {
+	session  *Session
+	payments *BSVPaymentSystem // nil when BSV is disabled
+	social   *BSVSocialSystem  // nil when BSV is disabled
+	started  time.Time
+}
+
+// NewSessionInfo creates the extension query source for a session
+func NewSessionInfo(session *Session, payments *BSVPaymentSystem, social *BSVSocialSystem) NERDInfo {
+	return &sessionInfo{session: session, payments: payments, social: social, started: time.Now()}
+}
+
+// Port returns the session's P2P port
+func (si *sessionInfo) Port() int {
+	return si.session.port
+}
+
+// QualityMetrics reports uptime and transfer totals. Reliability is left out:
+// nodes measure it themselves from how often we answer.
+func (si *sessionInfo) QualityMetrics() *messages.QualityMetricsMsg {
+	uptime := time.Since(si.started)
+	msg := &messages.QualityMetricsMsg{UptimeSeconds: uint64(uptime.Seconds())}
+	for _, torrent := range si.session.Torrents() {
+		status := torrent.Status()
+		msg.BytesUploaded += uint64(status.Uploaded)
+		msg.BytesDownloaded += uint64(status.Downloaded)
+	}
+	if seconds := uptime.Seconds(); seconds > 0 {
+		msg.UploadSpeedMbps = float32(float64(msg.BytesUploaded) * 8 / seconds / 1e6)
+	}
+	return msg
+}
+
+// TokenBalance reports our token address. There is no $NERD ledger yet, so
+// the balances are zero.
+func (si *sessionInfo) TokenBalance() *messages.TokenBalanceMsg {
+	msg := &messages.TokenBalanceMsg{}
+	if si.payments != nil {
+		msg.TokenAddress = []byte(si.payments.GetAddress())
+	}
+	return msg
+}
+
+// Profile returns the signed profile we hold for a creator
+func (si *sessionInfo) Profile(creatorAddress string) *messages.SocialProfileMsg {
+	if si.social == nil {
+		return nil
+	}
+	profile := si.social.GetCreatorProfile(creatorAddress)
+	if profile == nil {
+		return nil
+	}
+	return &messages.SocialProfileMsg{
+		CreatorAddress: []byte(profile.CreatorAddress),
+		DisplayName:    profile.DisplayName,
+		Bio:            profile.Bio,
+		AvatarHash:     profile.AvatarHash,
+		BannerHash:     profile.BannerHash,
+		SocialLinks:    profile.SocialLinks,
+		BsvSignature:   profile.Signature,
+		Timestamp:      uint64(profile.LastUpdated.Unix()),
+		ContentCount:   profile.ContentCount,
+		TotalEarnings:  profile.TotalEarnings,
+		FollowerCount:  profile.FollowerCount,
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/anacrolix/torrent/bencode"
+	primitives "github.com/bsv-blockchain/go-sdk/primitives/ec"
+	"github.com/bsv-blockchain/go-sdk/script"
+)
+
+// NERD daemons that both set NERDEncryptionBit run a Noise-style handshake
+// right after the BitTorrent handshake: each side sends an ephemeral X25519
+// key, both derive AES-GCM keys from the shared secret and a hash of the
+// handshakes, and each side with a BSV key signs that hash inside the
+// encrypted stream so the peer learns who it is talking to.
+const (
+	noiseLabel     = "NERD noise v2"
+	noiseMaxRecord = 16 * 1024 // Plaintext bytes per encrypted record
+	noiseKeySize   = 32
+)
+
+// Each side signs the handshake hash under its own role, so a peer cannot
+// send our signature back to us as its own
+const (
+	noiseRoleInitiator = "initiator"
+	noiseRoleResponder = "responder"
+)
+
+// noiseAuth proves the identity behind an encrypted connection; both fields
+// are empty for daemons without a key
+type noiseAuth struct {
+	PubKey    []byte `bencode:"pubkey,omitempty"`
+	Signature []byte `bencode:"sig,omitempty"`
+}
+
+// negotiateEncryption runs the Noise handshake if both sides offered it and
+// enforces the required policy. It must run after the BitTorrent handshake and
+// before any other message.
+func (wp *WireProtocol) negotiateEncryption(initiator bool, infoHash [20]byte) error {
+	if wp.offersNoise() && wp.peerReserved[NERDProtocolByte]&NERDEncryptionBit != 0 {
+		if err := wp.noiseHandshake(initiator, infoHash); err != nil {
+			return fmt.Errorf("encrypted handshake failed: %w", err)
+		}
+	}
+	if wp.encryption == EncryptionRequired && wp.transport == TransportPlaintext {
+		return fmt.Errorf("peer does not support encryption, which is required")
+	}
+	return nil
+}
+
+// noiseHandshake replaces the connection with an encrypted one
+func (wp *WireProtocol) noiseHandshake(initiator bool, infoHash [20]byte) error {
+	if wp.remotePeerID == wp.identity.PeerID() {
+		return fmt.Errorf("peer uses our own peer ID")
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if _, err := wp.conn.Write(ephemeral.PublicKey().Bytes()); err != nil {
+		return err
+	}
+	peerKeyBytes := make([]byte, 32)
+	if _, err := io.ReadFull(wp.conn, peerKeyBytes); err != nil {
+		return err
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(peerKeyBytes)
+	if err != nil {
+		return err
+	}
+	shared, err := ephemeral.ECDH(peerKey)
+	if err != nil {
+		return err
+	}
+
+	// Both sides hash the same transcript, ordered initiator first
+	initiatorID, responderID := wp.identity.PeerID(), wp.remotePeerID
+	initiatorKey, responderKey := ephemeral.PublicKey().Bytes(), peerKeyBytes
+	if !initiator {
+		initiatorID, responderID = responderID, initiatorID
+		initiatorKey, responderKey = responderKey, initiatorKey
+	}
+	transcript := sha256.New()
+	transcript.Write([]byte(noiseLabel))
+	transcript.Write(infoHash[:])
+	transcript.Write(initiatorID[:])
+	transcript.Write(responderID[:])
+	transcript.Write(initiatorKey)
+	transcript.Write(responderKey)
+	handshakeHash := transcript.Sum(nil)
+
+	keys, err := hkdf.Key(sha256.New, shared, handshakeHash, noiseLabel, 2*noiseKeySize)
+	if err != nil {
+		return err
+	}
+	sendKey, recvKey := keys[:noiseKeySize], keys[noiseKeySize:]
+	if !initiator {
+		sendKey, recvKey = recvKey, sendKey
+	}
+	conn, err := newNoiseConn(wp.conn, sendKey, recvKey)
+	if err != nil {
+		return err
+	}
+
+	// Prove our identity inside the encrypted stream and check the peer's
+	var auth noiseAuth
+	if wp.identity.CanSign() {
+		sig, err := wp.identity.privateKey.Sign(sha256Sum(noiseAuthData(handshakeHash, initiator)))
+		if err != nil {
+			return err
+		}
+		if auth.Signature, err = sig.ToDER(); err != nil {
+			return err
+		}
+		auth.PubKey = wp.identity.privateKey.PubKey().Compressed()
+	}
+	authBytes, err := bencode.Marshal(auth)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(authBytes); err != nil {
+		return err
+	}
+	if err := conn.readRecord(); err != nil {
+		return err
+	}
+	var peerAuth noiseAuth
+	if err := bencode.Unmarshal(conn.takeBuffered(), &peerAuth); err != nil {
+		return fmt.Errorf("invalid identity proof: %v", err)
+	}
+	if len(peerAuth.PubKey) > 0 {
+		address, err := verifyNoiseAuth(peerAuth, noiseAuthData(handshakeHash, !initiator), wp.remotePeerID)
+		if err != nil {
+			return err
+		}
+		wp.provenIdentity = address
+	}
+
+	wp.conn = conn
+	wp.handshakeHash = handshakeHash
+	if wp.transport == TransportMSE {
+		wp.transport = TransportMSENoise
+	} else {
+		wp.transport = TransportNoise
+	}
+	return nil
+}
+
+// noiseAuthData is what the initiator or the responder signs to prove its identity
+func noiseAuthData(handshakeHash []byte, initiator bool) []byte {
+	role := noiseRoleResponder
+	if initiator {
+		role = noiseRoleInitiator
+	}
+	return append([]byte(role), handshakeHash...)
+}
+
+// verifyNoiseAuth checks that the key signed data and matches the peer ID
+func verifyNoiseAuth(auth noiseAuth, data []byte, peerID [20]byte) (string, error) {
+	pubKey, err := primitives.ParsePubKey(auth.PubKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid public key: %v", err)
+	}
+	if DerivePeerID(pubKey) != peerID {
+		return "", fmt.Errorf("peer ID %x does not belong to the presented key", peerID)
+	}
+	sig, err := primitives.ParseDERSignature(auth.Signature)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature: %v", err)
+	}
+	if !pubKey.Verify(data, sig) {
+		return "", fmt.Errorf("handshake signature does not verify")
+	}
+	address, err := script.NewAddressFromPublicKey(pubKey, true)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive peer address: %v", err)
+	}
+	return address.AddressString, nil
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// noiseConn frames the stream into [2-byte length][AES-GCM sealed record]
+// records, each with its own counter nonce
+type noiseConn struct {
+	net.Conn
+	send, recv           cipher.AEAD
+	sendNonce, recvNonce uint64
+	buffered             []byte // Decrypted bytes not yet read
+	writeMu              sync.Mutex
+}
+
+func newNoiseConn(conn net.Conn, sendKey, recvKey []byte) (*noiseConn, error) {
+	send, err := newGCM(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newGCM(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &noiseConn{Conn: conn, send: send, recv: recv}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func noiseNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// Write seals b into one or more records
+func (c *noiseConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var out bytes.Buffer
+	for offset := 0; offset < len(b); offset += noiseMaxRecord {
+		chunk := b[offset:min(offset+noiseMaxRecord, len(b))]
+		sealed := c.send.Seal(nil, noiseNonce(c.sendNonce), chunk, nil)
+		c.sendNonce++
+		binary.Write(&out, binary.BigEndian, uint16(len(sealed)))
+		out.Write(sealed)
+	}
+	if _, err := c.Conn.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read returns decrypted bytes, reading another record when none are buffered
+func (c *noiseConn) Read(b []byte) (int, error) {
+	if len(c.buffered) == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.buffered)
+	c.buffered = c.buffered[n:]
+	return n, nil
+}
+
+// readRecord reads and decrypts the next record into the buffer
+func (c *noiseConn) readRecord() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+		return err
+	}
+	sealed := make([]byte, binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		return err
+	}
+	plain, err := c.recv.Open(sealed[:0], noiseNonce(c.recvNonce), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt record: %v", err)
+	}
+	c.recvNonce++
+	c.buffered = plain
+	return nil
+}
+
+// takeBuffered returns and clears the decrypted bytes of the last record
+func (c *noiseConn) takeBuffered() []byte {
+	b := c.buffered
+	c.buffered = nil
+	return b
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"net"
+	"testing"
+
+	primitives "github.com/bsv-blockchain/go-sdk/primitives/ec"
+)
+
+var testInfoHash = [20]byte{0: 0x4e, 19: 0x44}
+
+// tcpPair returns both ends of a loopback TCP connection. Unlike net.Pipe,
+// writes are buffered, so both sides can send their handshake first.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func testIdentity(t *testing.T) *Identity {
+	t.Helper()
+	key, err := primitives.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := NewIdentity(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+// wireSide is one end of a connection set up by handshakePair
+type wireSide struct {
+	identity *Identity
+	policy   string
+	wire     *WireProtocol
+	err      error
+}
+
+// handshakePair runs the BitTorrent handshake and encryption negotiation
+// between client and server over loopback TCP, as dialPeer and
+// handleConnection do once any MSE handshake is done
+func handshakePair(t *testing.T, client, server *wireSide) {
+	t.Helper()
+	clientConn, serverConn := tcpPair(t)
+	run := func(side *wireSide, conn net.Conn, initiator bool, done chan<- struct{}) {
+		defer close(done)
+		side.wire = NewWireProtocol(conn, DefaultWireLimits(), side.identity)
+		side.wire.SetEncryption(side.policy, TransportPlaintext)
+		if side.err = side.wire.SendHandshake(testInfoHash); side.err != nil {
+			return
+		}
+		if _, side.err = side.wire.ReceiveHandshake(); side.err != nil {
+			return
+		}
+		if side.err = side.wire.negotiateEncryption(initiator, testInfoHash); side.err != nil {
+			conn.Close() // As the daemon does, so the other side is not left waiting
+		}
+	}
+
+	clientDone, serverDone := make(chan struct{}), make(chan struct{})
+	go run(client, clientConn, true, clientDone)
+	go run(server, serverConn, false, serverDone)
+	<-clientDone
+	<-serverDone
+}
+
+func TestNoiseHandshake(t *testing.T) {
+	alice, bob := testIdentity(t), testIdentity(t)
+	mallory := testIdentity(t)
+	// Claims Alice's peer ID while holding Mallory's key
+	impostor := &Identity{privateKey: mallory.privateKey, peerID: alice.PeerID()}
+
+	tests := []struct {
+		name           string
+		client, server *Identity
+		wantErr        bool
+		wantClientSees string // Identity the client proves to the server
+		wantServerSees string
+	}{
+		{name: "both sign", client: alice, server: bob, wantClientSees: alice.Address(), wantServerSees: bob.Address()},
+		{name: "anonymous server", client: alice, server: NewAnonymousIdentity(), wantClientSees: alice.Address()},
+		{name: "anonymous client", client: NewAnonymousIdentity(), server: bob, wantServerSees: bob.Address()},
+		{name: "wrong key", client: impostor, server: bob, wantErr: true},
+		{name: "own peer ID", client: alice, server: alice, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &wireSide{identity: tt.client, policy: EncryptionPreferred}
+			server := &wireSide{identity: tt.server, policy: EncryptionPreferred}
+			handshakePair(t, client, server)
+
+			if tt.wantErr {
+				if server.err == nil {
+					t.Error("server accepted the handshake")
+				}
+				if server.wire.provenIdentity != "" {
+					t.Errorf("server holds proven identity %s", server.wire.provenIdentity)
+				}
+				return
+			}
+			if client.err != nil || server.err != nil {
+				t.Fatalf("handshake failed: client %v, server %v", client.err, server.err)
+			}
+			if server.wire.provenIdentity != tt.wantClientSees {
+				t.Errorf("server proved client as %q, want %q", server.wire.provenIdentity, tt.wantClientSees)
+			}
+			if client.wire.provenIdentity != tt.wantServerSees {
+				t.Errorf("client proved server as %q, want %q", client.wire.provenIdentity, tt.wantServerSees)
+			}
+			if client.wire.Transport() != TransportNoise {
+				t.Errorf("transport %s, want %s", client.wire.Transport(), TransportNoise)
+			}
+			if !bytes.Equal(client.wire.HandshakeHash(), server.wire.HandshakeHash()) {
+				t.Error("the two sides derived different handshake hashes")
+			}
+
+			// Messages pass through the encrypted stream
+			msg, err := receiveWire(t, server.wire, func() error { return client.wire.SendHave(42) })
+			if err != nil || msg.MessageId != MsgTypeHave {
+				t.Errorf("received %v, %v; want a have message", msg, err)
+			}
+		})
+	}
+}
+
+// TestNoiseReflectedSignature has a peer claim the victim's own peer ID and
+// send the victim's identity proof back to it
+func TestNoiseReflectedSignature(t *testing.T) {
+	victim := &wireSide{identity: testIdentity(t), policy: EncryptionPreferred}
+	victimConn, attackerConn := tcpPair(t)
+
+	go func() {
+		// BitTorrent handshake with the victim's peer ID and the NERD bits set
+		handshake := make([]byte, HandshakeLen)
+		if _, err := io.ReadFull(attackerConn, handshake); err != nil {
+			return
+		}
+		handshake[20+NERDProtocolByte] |= NERDProtocolBit | NERDEncryptionBit
+		attackerConn.Write(handshake)
+
+		ephemeral, _ := ecdh.X25519().GenerateKey(rand.Reader)
+		attackerConn.Write(ephemeral.PublicKey().Bytes())
+		victimKey := make([]byte, 32)
+		if _, err := io.ReadFull(attackerConn, victimKey); err != nil {
+			return
+		}
+		peerKey, _ := ecdh.X25519().NewPublicKey(victimKey)
+		shared, _ := ephemeral.ECDH(peerKey)
+		victimID := victim.identity.PeerID()
+		transcript := sha256.New()
+		transcript.Write([]byte(noiseLabel))
+		transcript.Write(testInfoHash[:])
+		transcript.Write(victimID[:])
+		transcript.Write(victimID[:])
+		transcript.Write(victimKey)
+		transcript.Write(ephemeral.PublicKey().Bytes())
+		keys, _ := hkdf.Key(sha256.New, shared, transcript.Sum(nil), noiseLabel, 2*noiseKeySize)
+		conn, _ := newNoiseConn(attackerConn, keys[noiseKeySize:], keys[:noiseKeySize])
+		if err := conn.readRecord(); err != nil {
+			return
+		}
+		conn.Write(conn.takeBuffered())
+	}()
+
+	victim.wire = NewWireProtocol(victimConn, DefaultWireLimits(), victim.identity)
+	victim.wire.SetEncryption(victim.policy, TransportPlaintext)
+	if err := victim.wire.SendHandshake(testInfoHash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := victim.wire.ReceiveHandshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := victim.wire.negotiateEncryption(true, testInfoHash); err == nil {
+		t.Error("handshake with a reflected identity proof succeeded")
+	}
+	if victim.wire.provenIdentity != "" {
+		t.Errorf("victim proved the peer as %s", victim.wire.provenIdentity)
+	}
+}
+
+func TestVerifyNoiseAuth(t *testing.T) {
+	alice, bob := testIdentity(t), testIdentity(t)
+	handshakeHash := sha256Sum([]byte("handshake"))
+	sign := func(identity *Identity, data []byte) noiseAuth {
+		sig, err := identity.privateKey.Sign(sha256Sum(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := sig.ToDER()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return noiseAuth{PubKey: identity.privateKey.PubKey().Compressed(), Signature: der}
+	}
+	initiatorAuth := sign(alice, noiseAuthData(handshakeHash, true))
+
+	tests := []struct {
+		name    string
+		auth    noiseAuth
+		data    []byte
+		peerID  [20]byte
+		wantErr bool
+	}{
+		{name: "initiator proof", auth: initiatorAuth, data: noiseAuthData(handshakeHash, true), peerID: alice.PeerID()},
+		{name: "checked as the responder's", auth: initiatorAuth, data: noiseAuthData(handshakeHash, false), peerID: alice.PeerID(), wantErr: true},
+		{name: "other handshake", auth: initiatorAuth, data: noiseAuthData(sha256Sum([]byte("other")), true), peerID: alice.PeerID(), wantErr: true},
+		{name: "other peer ID", auth: initiatorAuth, data: noiseAuthData(handshakeHash, true), peerID: bob.PeerID(), wantErr: true},
+		{name: "bad signature", auth: noiseAuth{PubKey: initiatorAuth.PubKey, Signature: []byte{0x30, 0}}, data: noiseAuthData(handshakeHash, true), peerID: alice.PeerID(), wantErr: true},
+		{name: "bad key", auth: noiseAuth{PubKey: []byte{2, 1}, Signature: initiatorAuth.Signature}, data: noiseAuthData(handshakeHash, true), peerID: alice.PeerID(), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		address, err := verifyNoiseAuth(tt.auth, tt.data, tt.peerID)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: verifyNoiseAuth error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && address != alice.Address() {
+			t.Errorf("%s: address %s, want %s", tt.name, address, alice.Address())
+		}
+	}
+}
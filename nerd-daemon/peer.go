@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nerd-daemon/messages"
+)
+
+// Where a connection came from, reported in PeerStats
+const (
+	PeerSourceIncoming = "incoming" // The peer connected to us
+	PeerSourceConfig   = "config"   // ConnectPeers in the configuration
+	PeerSourceMagnet   = "magnet"   // Peer address in a magnet link
+	PeerSourceDHT      = "dht"
+	PeerSourcePEX      = "pex" // Peer exchange with another connected peer
+	PeerSourceLSD      = "lsd" // Local Service Discovery on the LAN
+)
+
+// PeerConn drives piece exchange with a single connected peer
+type PeerConn struct {
+	wire    *WireProtocol
+	addr    string
+	torrent *Torrent
+	session *Session
+	source  string // PeerSource* the connection came from
+	local   bool   // The peer is on our LAN, found by Local Service Discovery
+
+	state    *PeerState // Owned by the connection's wire protocol
+	bitfield Bitfield   // Pieces the peer has announced
+
+	peerExtensions   map[string]int    // BEP 10 extensions the peer supports, by name
+	metadataRequests []int             // Metadata pieces we have requested from the peer
+	hashRequests     []hashRequest     // Merkle tree hashes we have requested from the peer
+	hashRefused      map[[32]byte]bool // File roots the peer rejected hash requests for
+	corruptPieces    int               // Pieces or hashes from the peer that failed verification
+	authChallenge    []byte            // Challenge we sent; cleared once answered
+	peerChallenge    []byte            // Challenge the peer sent in its extended handshake
+	identity         string            // BSV address the peer proved it owns
+	suggested        []int             // Pieces the peer suggested, oldest first (BEP 6)
+	haveAll          bool              // Peer sent HaveAll before the info was known
+	listenPort       int               // Port the peer accepts connections on, from its extended handshake
+	pexSent          map[string]byte   // Peers (and their PEX flags) we have told this peer about
+	pexStarted       bool
+
+	availabilityCounted bool // bitfield is included in the torrent's piece availability
+
+	rates *RateLimiter // Limits of this connection alone
+
+	uploadReady chan struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+	mu          sync.Mutex
+}
+
+// NewPeerConn creates the piece-exchange state for a connection to a torrent
+// in session, made through source
+func NewPeerConn(wire *WireProtocol, addr string, torrent *Torrent, session *Session, source string) *PeerConn {
+	return &PeerConn{
+		wire:        wire,
+		addr:        addr,
+		torrent:     torrent,
+		session:     session,
+		source:      source,
+		local:       source == PeerSourceLSD || session.isLANPeer(addr),
+		state:       wire.State(),
+		identity:    wire.provenIdentity,
+		bitfield:    NewBitfield(torrent.NumPieces()),
+		rates:       NewRateLimiter(session.PeerRateLimits()),
+		uploadReady: make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+}
+
+// start registers the peer with its torrent, sends our bitfield and starts serving uploads
+func (pc *PeerConn) start() error {
+	pc.torrent.addPeer(pc)
+
+	if err := pc.sendHaveState(); err != nil {
+		return err
+	}
+	if pc.torrent.HasInfo() {
+		if err := pc.sendAllowedFast(); err != nil {
+			return err
+		}
+	}
+
+	if pc.wire.SupportsExtensions() {
+		if err := pc.sendExtendedHandshake(); err != nil {
+			return err
+		}
+	}
+
+	go pc.uploadLoop()
+	go pc.keepAliveLoop()
+	return nil
+}
+
+// close stops the upload loop and releases outstanding requests
+func (pc *PeerConn) close() {
+	pc.closeOnce.Do(func() {
+		close(pc.closed)
+
+		pc.mu.Lock()
+		pc.uncountAvailability()
+		pc.mu.Unlock()
+
+		pc.torrent.removePeer(pc)
+	})
+}
+
+// handleChoke processes a choke from the peer; pending requests are dropped
+// except for allowed-fast pieces, which the peer may still serve
+func (pc *PeerConn) handleChoke() {
+	pc.state.SetPeerChoking(true)
+	pc.torrent.releaseRequests(pc.state.TakeChokedRequests())
+}
+
+// handleUnchoke processes an unchoke from the peer and starts requesting blocks
+func (pc *PeerConn) handleUnchoke() error {
+	pc.state.SetPeerChoking(false)
+	return pc.fillRequests()
+}
+
+// handleInterested records that the peer wants to download; the choker decides
+// whether to unchoke it
+func (pc *PeerConn) handleInterested() {
+	pc.state.SetPeerInterested(true)
+}
+
+// handleNotInterested records that the peer no longer wants to download
+func (pc *PeerConn) handleNotInterested() {
+	pc.state.SetPeerInterested(false)
+}
+
+// setChoking chokes or unchokes the peer, sending a message only when the
+// state changes. Requests discarded by a choke are rejected and a newly
+// unchoked peer is sent suggestions, if it supports the Fast Extension.
+func (pc *PeerConn) setChoking(choke bool) (changed bool, err error) {
+	changed, discarded := pc.state.SetAmChoking(choke)
+	if !changed {
+		return false, nil
+	}
+	if choke {
+		if err := pc.wire.SendChoke(); err != nil {
+			return true, err
+		}
+		return true, pc.rejectRequests(discarded)
+	}
+	if err := pc.wire.SendUnchoke(); err != nil {
+		return true, err
+	}
+	return true, pc.sendSuggestions()
+}
+
+// Stats returns a snapshot of the connection for the control API
+func (pc *PeerConn) Stats() PeerStats {
+	stats := PeerStats{
+		Addr:       pc.addr,
+		InfoHash:   fmt.Sprintf("%x", pc.torrent.InfoHash),
+		PeerID:     fmt.Sprintf("%x", pc.wire.RemotePeerID()),
+		Identity:   pc.Identity(),
+		Framing:    pc.wire.Framing(),
+		Transport:  pc.wire.Network(),
+		Encryption: pc.wire.Transport(),
+		NERD:       pc.wire.SupportsNERD(),
+		Fast:       pc.wire.SupportsFast(),
+		Source:     pc.source,
+		Local:      pc.local,
+	}
+	pc.state.fillStats(&stats)
+
+	pc.mu.Lock()
+	stats.PeerPieces = pc.bitfield.Count()
+	stats.CorruptPieces = pc.corruptPieces
+	pc.mu.Unlock()
+
+	return stats
+}
+
+// listenAddr returns the address other peers can reach this peer on: the one
+// we dialled, or for incoming connections the port from its extended handshake
+func (pc *PeerConn) listenAddr() (string, bool) {
+	if pc.source != PeerSourceIncoming {
+		return pc.addr, true
+	}
+
+	pc.mu.Lock()
+	port := pc.listenPort
+	pc.mu.Unlock()
+	if port == 0 {
+		return "", false
+	}
+
+	host, _, err := net.SplitHostPort(pc.addr)
+	if err != nil {
+		return "", false
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), true
+}
+
+// handleHave records a piece the peer has completed
+func (pc *PeerConn) handleHave(msg *messages.HaveMsg) error {
+	numPieces := pc.torrent.NumPieces()
+	if numPieces > 0 && int(msg.PieceIndex) >= numPieces {
+		return fmt.Errorf("have for out-of-range piece %d", msg.PieceIndex)
+	}
+
+	// Without the info we only track haves that fit the peer's bitfield
+	pc.mu.Lock()
+	if !pc.bitfield.Has(int(msg.PieceIndex)) {
+		pc.bitfield.Set(int(msg.PieceIndex))
+		if pc.availabilityCounted {
+			pc.torrent.addPieceAvailability(int(msg.PieceIndex))
+		}
+	}
+	pc.mu.Unlock()
+
+	pc.updateInterest()
+	return pc.fillRequests()
+}
+
+// handleBitfield records the peer's full set of pieces. Before the info is
+// known the bitfield is kept as sent and checked once the piece count is known.
+func (pc *PeerConn) handleBitfield(msg *messages.BitfieldMsg) error {
+	bitfield := Bitfield(msg.Bitfield)
+	if numPieces := pc.torrent.NumPieces(); numPieces > 0 && !bitfield.validFor(numPieces) {
+		return fmt.Errorf("invalid bitfield of %d bytes for %d pieces", len(bitfield), numPieces)
+	}
+
+	pc.mu.Lock()
+	pc.uncountAvailability()
+	pc.bitfield = append(Bitfield(nil), bitfield...)
+	pc.countAvailability()
+	pc.mu.Unlock()
+
+	pc.updateInterest()
+	return pc.fillRequests()
+}
+
+// handleRequest queues a block for upload if we are not choking the peer
+func (pc *PeerConn) handleRequest(msg *messages.RequestMsg) error {
+	req := blockRequest{Piece: msg.PieceIndex, Offset: msg.BlockOffset, Length: msg.BlockLength}
+	if err := pc.torrent.validateRequest(req); err != nil {
+		return fmt.Errorf("invalid request: %v", err)
+	}
+
+	if !pc.state.QueueUpload(req) {
+		return pc.rejectRequests([]blockRequest{req}) // Requests from choked peers are discarded
+	}
+
+	select {
+	case pc.uploadReady <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// handleCancel removes a queued upload that has not been sent yet
+func (pc *PeerConn) handleCancel(msg *messages.CancelMsg) {
+	pc.state.CancelUpload(blockRequest{Piece: msg.PieceIndex, Offset: msg.BlockOffset, Length: msg.BlockLength})
+}
+
+// handlePiece stores a received block and keeps the request pipeline full
+func (pc *PeerConn) handlePiece(msg *messages.PieceMsg) error {
+	req := blockRequest{Piece: msg.PieceIndex, Offset: msg.BlockOffset, Length: uint32(len(msg.BlockData))}
+	if !pc.waitDownload(len(msg.BlockData)) {
+		return nil
+	}
+
+	if !pc.state.CompleteRequest(req) {
+		// Blocks we cancelled in endgame may still arrive and are dropped quietly
+		if !pc.torrent.InEndgame() && !pc.torrent.HavePiece(int(msg.PieceIndex)) {
+			log.Printf("Ignoring unrequested block %d+%d of piece %d from %s",
+				msg.BlockOffset, len(msg.BlockData), msg.PieceIndex, pc.addr)
+		}
+		return nil
+	}
+
+	completed, err := pc.torrent.ReceiveBlock(pc, msg.PieceIndex, msg.BlockOffset, msg.BlockData)
+	if err != nil {
+		log.Printf("Block from %s rejected: %v", pc.addr, err)
+	} else {
+		if pc.torrent.InEndgame() {
+			pc.torrent.cancelDuplicates(req, pc)
+		}
+		if completed {
+			pc.torrent.broadcastHave(msg.PieceIndex)
+		}
+	}
+
+	return pc.fillRequests()
+}
+
+// updateInterest sends Interested/NotInterested when our interest in the peer changes
+func (pc *PeerConn) updateInterest() {
+	pc.mu.Lock()
+	bitfield := pc.bitfield
+	pc.mu.Unlock()
+
+	interested := pc.torrent.wants(bitfield)
+	if !pc.state.SetAmInterested(interested) {
+		return
+	}
+
+	var err error
+	if interested {
+		err = pc.wire.SendInterested()
+	} else {
+		err = pc.wire.SendNotInterested()
+	}
+	if err != nil {
+		log.Printf("Failed to update interest with %s: %v", pc.addr, err)
+	}
+}
+
+// fillRequests tops up our outstanding block and hash requests to the peer
+func (pc *PeerConn) fillRequests() error {
+	if err := pc.requestHashes(); err != nil {
+		return err
+	}
+
+	// LAN peers get a deeper pipeline, so they serve most of the blocks
+	maxRequests := MaxOutstandingRequests
+	if pc.local {
+		maxRequests = MaxLocalOutstandingRequests
+	}
+	wanted := pc.state.CanRequest(maxRequests)
+	if wanted == 0 {
+		return nil
+	}
+
+	pc.mu.Lock()
+	bitfield := pc.bitfield
+	suggested := append([]int(nil), pc.suggested...)
+	pc.mu.Unlock()
+
+	// While the peer chokes us only its allowed-fast pieces may be requested
+	if allowed := pc.state.PeerAllowedFast(); allowed != nil {
+		restricted := make(Bitfield, len(bitfield))
+		for piece := range allowed {
+			if bitfield.Has(int(piece)) {
+				restricted.Set(int(piece))
+			}
+		}
+		bitfield = restricted
+	}
+
+	// Record requests before sending so a fast reply is never seen as unrequested
+	reqs := pc.torrent.nextRequests(bitfield, suggested, pc.state.Requests(), wanted)
+	pc.state.AddRequests(reqs)
+
+	for _, req := range reqs {
+		if err := pc.wire.SendRequest(req); err != nil {
+			return fmt.Errorf("failed to send request: %v", err)
+		}
+	}
+	return nil
+}
+
+// uploadLoop serves queued block requests until the connection closes
+func (pc *PeerConn) uploadLoop() {
+	for {
+		select {
+		case <-pc.closed:
+			return
+		case <-pc.uploadReady:
+		}
+
+		for {
+			req, ok := pc.state.NextUpload()
+			if !ok {
+				break
+			}
+
+			if !pc.waitUpload(int(req.Length)) {
+				return
+			}
+			data, err := pc.torrent.ReadBlock(req)
+			if err != nil {
+				log.Printf("Cannot serve block %d+%d of piece %d to %s: %v",
+					req.Offset, req.Length, req.Piece, pc.addr, err)
+				if err := pc.rejectRequests([]blockRequest{req}); err != nil {
+					log.Printf("Failed to reject request from %s: %v", pc.addr, err)
+					return
+				}
+				continue
+			}
+			if err := pc.wire.SendPiece(req.Piece, req.Offset, data); err != nil {
+				log.Printf("Failed to send piece %d to %s: %v", req.Piece, pc.addr, err)
+				return
+			}
+			pc.state.AddUploaded(len(data))
+		}
+	}
+}
+
+// keepAliveLoop sends a keep-alive whenever nothing else has been sent for a
+// keep-alive interval, so the peer does not time us out while we are idle
+func (pc *PeerConn) keepAliveLoop() {
+	interval := pc.wire.limits.KeepAliveInterval
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pc.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(pc.state.LastSent()) < interval {
+			continue
+		}
+		if err := pc.wire.SendKeepAlive(); err != nil {
+			log.Printf("Failed to send keep-alive to %s: %v", pc.addr, err)
+			pc.wire.conn.Close() // Ends the message loop, which logs the disconnect
+			return
+		}
+	}
+}
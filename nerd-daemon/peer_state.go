@@ -0,0 +1,399 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// PeerState is the protocol state of one connection: the four BEP 3 choke and
+// interest flags, the request queues in both directions, activity timestamps
+// and transfer counters. The wire protocol records traffic in it and the piece
+// exchange, choker and stats read from it.
+type PeerState struct {
+	amChoking      bool // We are choking the peer
+	amInterested   bool // We told the peer we are interested
+	peerChoking    bool // The peer is choking us
+	peerInterested bool // The peer wants pieces from us
+
+	requests []blockRequest // Blocks we have requested from the peer
+	uploads  []blockRequest // Blocks the peer has requested from us, not yet sent
+
+	allowedFast     map[uint32]bool // Pieces the peer may request while we choke it (BEP 6)
+	peerAllowedFast map[uint32]bool // Pieces we may request while the peer chokes us
+
+	connectedAt  time.Time
+	lastReceived time.Time // Any message, including keep-alives
+	lastSent     time.Time
+
+	uploaded         int64 // Piece data sent to the peer
+	downloaded       int64 // Piece data accepted from the peer
+	messagesReceived int64
+	messagesSent     int64
+
+	mu sync.Mutex
+}
+
+// NewPeerState creates the state of a new connection: both sides start choked and not interested
+func NewPeerState() *PeerState {
+	now := time.Now()
+	return &PeerState{
+		amChoking:    true,
+		peerChoking:  true,
+		connectedAt:  now,
+		lastReceived: now,
+		lastSent:     now,
+	}
+}
+
+// AmChoking reports whether we are choking the peer
+func (ps *PeerState) AmChoking() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.amChoking
+}
+
+// SetAmChoking updates our choke flag and reports whether it changed. Choking
+// discards the peer's queued requests (BEP 3) except those for allowed-fast
+// pieces; the discarded requests are returned so they can be rejected (BEP 6).
+func (ps *PeerState) SetAmChoking(choking bool) (changed bool, discarded []blockRequest) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.amChoking == choking {
+		return false, nil
+	}
+	ps.amChoking = choking
+	if choking {
+		var kept []blockRequest
+		for _, req := range ps.uploads {
+			if ps.allowedFast[req.Piece] {
+				kept = append(kept, req)
+			} else {
+				discarded = append(discarded, req)
+			}
+		}
+		ps.uploads = kept
+	}
+	return true, discarded
+}
+
+// AmInterested reports whether we told the peer we are interested
+func (ps *PeerState) AmInterested() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.amInterested
+}
+
+// SetAmInterested updates our interest flag and reports whether it changed
+func (ps *PeerState) SetAmInterested(interested bool) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	changed := ps.amInterested != interested
+	ps.amInterested = interested
+	return changed
+}
+
+// PeerChoking reports whether the peer is choking us
+func (ps *PeerState) PeerChoking() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.peerChoking
+}
+
+// SetPeerChoking records a Choke or Unchoke from the peer
+func (ps *PeerState) SetPeerChoking(choking bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.peerChoking = choking
+}
+
+// PeerInterested reports whether the peer wants pieces from us
+func (ps *PeerState) PeerInterested() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.peerInterested
+}
+
+// SetPeerInterested records an Interested or NotInterested from the peer
+func (ps *PeerState) SetPeerInterested(interested bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.peerInterested = interested
+}
+
+// CanRequest reports how many more blocks we may request from the peer: none
+// while we are not interested, or while it chokes us and allows no fast pieces
+func (ps *PeerState) CanRequest(maxOutstanding int) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if (ps.peerChoking && len(ps.peerAllowedFast) == 0) || !ps.amInterested {
+		return 0
+	}
+	return max(maxOutstanding-len(ps.requests), 0)
+}
+
+// AddRequests records blocks we are about to request
+func (ps *PeerState) AddRequests(reqs []blockRequest) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.requests = append(ps.requests, reqs...)
+}
+
+// CompleteRequest removes an outstanding request that the peer answered and
+// counts the data; it reports false for blocks we did not request
+func (ps *PeerState) CompleteRequest(req blockRequest) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for i, outstanding := range ps.requests {
+		if outstanding == req {
+			ps.requests = append(ps.requests[:i], ps.requests[i+1:]...)
+			ps.downloaded += int64(req.Length)
+			return true
+		}
+	}
+	return false
+}
+
+// CancelRequest removes an outstanding request we are cancelling; it reports
+// false if the request was not outstanding
+func (ps *PeerState) CancelRequest(req blockRequest) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for i, outstanding := range ps.requests {
+		if outstanding == req {
+			ps.requests = append(ps.requests[:i], ps.requests[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Requests returns a copy of our outstanding requests
+func (ps *PeerState) Requests() []blockRequest {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return append([]blockRequest(nil), ps.requests...)
+}
+
+// TakeRequests clears and returns our outstanding requests
+func (ps *PeerState) TakeRequests() []blockRequest {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	reqs := ps.requests
+	ps.requests = nil
+	return reqs
+}
+
+// QueueUpload queues a block the peer requested; requests from a choked peer
+// are discarded unless the piece is allowed fast
+func (ps *PeerState) QueueUpload(req blockRequest) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.amChoking && !ps.allowedFast[req.Piece] {
+		return false
+	}
+	ps.uploads = append(ps.uploads, req)
+	return true
+}
+
+// CancelUpload removes a queued block that has not been sent yet
+func (ps *PeerState) CancelUpload(req blockRequest) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for i, queued := range ps.uploads {
+		if queued == req {
+			ps.uploads = append(ps.uploads[:i], ps.uploads[i+1:]...)
+			return
+		}
+	}
+}
+
+// NextUpload takes the next queued block to send; while we choke the peer only
+// allowed-fast pieces are sent
+func (ps *PeerState) NextUpload() (blockRequest, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for len(ps.uploads) > 0 {
+		req := ps.uploads[0]
+		ps.uploads = ps.uploads[1:]
+		if !ps.amChoking || ps.allowedFast[req.Piece] {
+			return req, true
+		}
+	}
+	ps.uploads = nil
+	return blockRequest{}, false
+}
+
+// AllowFast adds a piece to the set the peer may request while choked and
+// reports whether it was new
+func (ps *PeerState) AllowFast(piece uint32) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.allowedFast[piece] {
+		return false
+	}
+	if ps.allowedFast == nil {
+		ps.allowedFast = make(map[uint32]bool)
+	}
+	ps.allowedFast[piece] = true
+	return true
+}
+
+// SetPeerAllowedFast records whether the peer lets us request a piece while it chokes us
+func (ps *PeerState) SetPeerAllowedFast(piece uint32, allowed bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if !allowed {
+		delete(ps.peerAllowedFast, piece)
+		return
+	}
+	if ps.peerAllowedFast == nil {
+		ps.peerAllowedFast = make(map[uint32]bool)
+	}
+	ps.peerAllowedFast[piece] = true
+}
+
+// PeerAllowedFast returns the pieces we may request while the peer chokes us,
+// or nil while it does not choke us
+func (ps *PeerState) PeerAllowedFast() map[uint32]bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if !ps.peerChoking {
+		return nil
+	}
+	allowed := make(map[uint32]bool, len(ps.peerAllowedFast))
+	for piece := range ps.peerAllowedFast {
+		allowed[piece] = true
+	}
+	return allowed
+}
+
+// TakeChokedRequests clears and returns our outstanding requests for pieces
+// the peer has not allowed fast, which a choke cancels
+func (ps *PeerState) TakeChokedRequests() []blockRequest {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	var kept, taken []blockRequest
+	for _, req := range ps.requests {
+		if ps.peerAllowedFast[req.Piece] {
+			kept = append(kept, req)
+		} else {
+			taken = append(taken, req)
+		}
+	}
+	ps.requests = kept
+	return taken
+}
+
+// AddUploaded counts piece data sent to the peer
+func (ps *PeerState) AddUploaded(n int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.uploaded += int64(n)
+}
+
+// TransferTotals returns the piece data sent to and accepted from the peer
+func (ps *PeerState) TransferTotals() (uploaded, downloaded int64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.uploaded, ps.downloaded
+}
+
+// ConnectedAt returns when the connection was established
+func (ps *PeerState) ConnectedAt() time.Time {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.connectedAt
+}
+
+// messageReceived records traffic from the peer
+func (ps *PeerState) messageReceived() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.lastReceived = time.Now()
+	ps.messagesReceived++
+}
+
+// messageSent records traffic to the peer
+func (ps *PeerState) messageSent() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.lastSent = time.Now()
+	ps.messagesSent++
+}
+
+// LastReceived returns when the peer last sent us anything
+func (ps *PeerState) LastReceived() time.Time {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.lastReceived
+}
+
+// LastSent returns when we last sent the peer anything
+func (ps *PeerState) LastSent() time.Time {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.lastSent
+}
+
+// PeerStats is a snapshot of a connection for the control API and stats logs
+type PeerStats struct {
+	Addr             string    `json:"addr"`
+	InfoHash         string    `json:"info_hash"`
+	PeerID           string    `json:"peer_id"`
+	Identity         string    `json:"identity,omitempty"` // Proven BSV address
+	Framing          string    `json:"framing"`
+	Transport        string    `json:"transport"` // tcp or utp
+	Encryption       string    `json:"encryption"`
+	NERD             bool      `json:"nerd"`
+	Fast             bool      `json:"fast"`   // BEP 6 Fast Extension in use
+	Source           string    `json:"source"` // How we found the peer: incoming, config, magnet, dht, pex or lsd
+	Local            bool      `json:"local"`  // LAN peer: preferred for requests and not rate limited by default
+	AmChoking        bool      `json:"am_choking"`
+	AmInterested     bool      `json:"am_interested"`
+	PeerChoking      bool      `json:"peer_choking"`
+	PeerInterested   bool      `json:"peer_interested"`
+	PendingRequests  int       `json:"pending_requests"`
+	QueuedUploads    int       `json:"queued_uploads"`
+	PeerPieces       int       `json:"peer_pieces"`
+	CorruptPieces    int       `json:"corrupt_pieces"` // Pieces or hashes that failed verification
+	Uploaded         int64     `json:"uploaded"`
+	Downloaded       int64     `json:"downloaded"`
+	MessagesReceived int64     `json:"messages_received"`
+	MessagesSent     int64     `json:"messages_sent"`
+	ConnectedAt      time.Time `json:"connected_at"`
+	LastReceived     time.Time `json:"last_received"`
+	LastSent         time.Time `json:"last_sent"`
+}
+
+// fillStats copies the state into a stats snapshot
+func (ps *PeerState) fillStats(stats *PeerStats) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	stats.AmChoking = ps.amChoking
+	stats.AmInterested = ps.amInterested
+	stats.PeerChoking = ps.peerChoking
+	stats.PeerInterested = ps.peerInterested
+	stats.PendingRequests = len(ps.requests)
+	stats.QueuedUploads = len(ps.uploads)
+	stats.Uploaded = ps.uploaded
+	stats.Downloaded = ps.downloaded
+	stats.MessagesReceived = ps.messagesReceived
+	stats.MessagesSent = ps.messagesSent
+	stats.ConnectedAt = ps.connectedAt
+	stats.LastReceived = ps.lastReceived
+	stats.LastSent = ps.lastSent
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// Peer exchange parameters (BEP 11)
+const (
+	PEXInterval     = time.Minute // How often each peer is told about swarm changes
+	MaxPEXPeers     = 50          // Added or dropped peers in one message
+	MaxPEXDialPeers = 30          // Connections to a torrent beyond which exchanged peers are only stored
+)
+
+// Flags describing each added peer in a PEX message
+const (
+	pexEncryption = 0x01 // Prefers encrypted connections
+	pexSeed       = 0x02 // Has every piece
+	pexUTP        = 0x04 // Supports uTP
+	pexReachable  = 0x10 // Accepts incoming connections
+)
+
+// pexMessage is the bencoded payload of a ut_pex message. Peers are compact
+// addresses (4-byte IPv4 or 16-byte IPv6 IP, 2-byte port) with one flag byte
+// each in "added.f" and "added6.f".
+type pexMessage struct {
+	Added    []byte `bencode:"added"`
+	AddedF   []byte `bencode:"added.f"`
+	Dropped  []byte `bencode:"dropped"`
+	Added6   []byte `bencode:"added6,omitempty"`
+	Added6F  []byte `bencode:"added6.f,omitempty"`
+	Dropped6 []byte `bencode:"dropped6,omitempty"`
+}
+
+// exchangedPeer is a peer address learned through PEX
+type exchangedPeer struct {
+	ip    net.IP
+	port  int
+	flags byte
+}
+
+// IsPrivate reports whether the torrent is marked private (BEP 27), which rules out PEX and the DHT
+func (t *Torrent) IsPrivate() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.Info != nil && t.Info.Private != nil && *t.Info.Private
+}
+
+// pexFlags describes the peer to others in the swarm
+func (pc *PeerConn) pexFlags() byte {
+	var flags byte
+	if pc.wire.Transport() != TransportPlaintext {
+		flags |= pexEncryption
+	}
+	if pc.wire.Network() == "utp" {
+		flags |= pexUTP
+	}
+	if pc.source != PeerSourceIncoming {
+		flags |= pexReachable
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if numPieces := pc.torrent.NumPieces(); numPieces > 0 && pc.bitfield.Count() == numPieces {
+		flags |= pexSeed
+	}
+	return flags
+}
+
+// startPEX begins sending swarm changes every PEXInterval to a peer that
+// supports ut_pex, unless the torrent is private
+func (pc *PeerConn) startPEX() {
+	if _, ok := pc.peerExtensionID(ExtensionPEX); !ok || pc.torrent.IsPrivate() {
+		return
+	}
+
+	pc.mu.Lock()
+	started := pc.pexStarted
+	pc.pexStarted = true
+	pc.mu.Unlock()
+
+	if !started {
+		go pc.pexLoop()
+	}
+}
+
+// pexLoop sends PEX messages until the connection closes
+func (pc *PeerConn) pexLoop() {
+	ticker := time.NewTicker(PEXInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pc.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if err := pc.sendPEX(); err != nil {
+			log.Printf("Failed to send peer exchange to %s: %v", pc.addr, err)
+			return
+		}
+	}
+}
+
+// sendPEX tells the peer which of the torrent's connected peers were added or
+// dropped since the last message. The first message lists every peer.
+func (pc *PeerConn) sendPEX() error {
+	id, ok := pc.peerExtensionID(ExtensionPEX)
+	if !ok {
+		return nil
+	}
+
+	current := make(map[string]byte)
+	for _, other := range pc.torrent.connectedPeers() {
+		if other == pc {
+			continue
+		}
+		if addr, ok := other.listenAddr(); ok {
+			current[addr] = other.pexFlags()
+		}
+	}
+
+	var msg pexMessage
+	pc.mu.Lock()
+	if pc.pexSent == nil {
+		pc.pexSent = make(map[string]byte)
+	}
+	added := 0
+	for addr, flags := range current {
+		if _, sent := pc.pexSent[addr]; sent || added == MaxPEXPeers {
+			continue
+		}
+		compact, ok := compactPeer(addr)
+		switch {
+		case !ok:
+			continue
+		case len(compact) == compactPeerLen:
+			msg.Added = append(msg.Added, compact...)
+			msg.AddedF = append(msg.AddedF, flags)
+		default:
+			msg.Added6 = append(msg.Added6, compact...)
+			msg.Added6F = append(msg.Added6F, flags)
+		}
+		pc.pexSent[addr] = flags
+		added++
+	}
+	dropped := 0
+	for addr := range pc.pexSent {
+		if _, connected := current[addr]; connected || dropped == MaxPEXPeers {
+			continue
+		}
+		compact, _ := compactPeer(addr) // Only encodable addresses were sent
+		if len(compact) == compactPeerLen {
+			msg.Dropped = append(msg.Dropped, compact...)
+		} else {
+			msg.Dropped6 = append(msg.Dropped6, compact...)
+		}
+		delete(pc.pexSent, addr)
+		dropped++
+	}
+	pc.mu.Unlock()
+
+	if added == 0 && dropped == 0 {
+		return nil
+	}
+
+	payload, err := bencode.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode pex message: %v", err)
+	}
+	return pc.wire.SendExtended(id, payload)
+}
+
+// handlePEX stores the peers another peer has exchanged with us and connects
+// to those the torrent can use
+func (pc *PeerConn) handlePEX(payload []byte) error {
+	if pc.torrent.IsPrivate() {
+		return nil // We did not offer ut_pex for this torrent
+	}
+
+	var msg pexMessage
+	if err := bencode.Unmarshal(payload, &msg); err != nil {
+		return fmt.Errorf("invalid pex message: %v", err)
+	}
+	if len(msg.Added)%compactPeerLen != 0 || len(msg.Dropped)%compactPeerLen != 0 ||
+		len(msg.Added6)%compactPeer6Len != 0 || len(msg.Dropped6)%compactPeer6Len != 0 {
+		return fmt.Errorf("pex message has truncated compact peers")
+	}
+
+	peers := parseCompactPeers(msg.Added, msg.AddedF, compactPeerLen, MaxPEXPeers)
+	peers = append(peers, parseCompactPeers(msg.Added6, msg.Added6F, compactPeer6Len, MaxPEXPeers-len(peers))...)
+
+	log.Printf("Peer %s exchanged %d added and %d dropped peers for %s", pc.addr,
+		len(msg.Added)/compactPeerLen+len(msg.Added6)/compactPeer6Len,
+		len(msg.Dropped)/compactPeerLen+len(msg.Dropped6)/compactPeer6Len, pc.torrent.Name())
+	pc.session.addExchangedPeers(pc.torrent, peers)
+	return nil
+}
+
+// addExchangedPeers records peers learned through PEX in the DHT peer store
+// and dials those the torrent is not yet connected to, up to MaxPEXDialPeers
+// connections. Seeds are skipped once the torrent is complete.
+func (s *Session) addExchangedPeers(torrent *Torrent, peers []exchangedPeer) {
+	connections := len(torrent.connectedPeers())
+	for _, peer := range peers {
+		if s.dhtServer != nil {
+			s.dhtServer.addDiscoveredPeer(peer.ip.String(), peer.port, PeerSourcePEX, nil)
+		}
+
+		switch {
+		case s.isOwnAddr(peer.ip, peer.port):
+			continue
+		case peer.flags&pexSeed != 0 && torrent.IsComplete():
+			continue
+		case connections+torrent.dialCount() >= MaxPEXDialPeers:
+			continue
+		}
+		s.dialDiscovered(torrent, net.JoinHostPort(peer.ip.String(), strconv.Itoa(peer.port)), PeerSourcePEX)
+	}
+}
+
+// isOwnAddr reports whether ip:port is this daemon's P2P listener
+func (s *Session) isOwnAddr(ip net.IP, port int) bool {
+	if port != s.port {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sizes of a compact peer: the IP followed by a 2-byte port
+const (
+	compactPeerLen  = net.IPv4len + 2
+	compactPeer6Len = net.IPv6len + 2
+)
+
+// compactPeer encodes "ip:port" in the compact peer format: 6 bytes for IPv4,
+// 18 bytes for IPv6
+func compactPeer(addr string) ([]byte, bool) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil || port <= 0 || port > 65535 {
+		return nil, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	compact := make([]byte, len(ip)+2)
+	copy(compact, ip)
+	binary.BigEndian.PutUint16(compact[len(ip):], uint16(port))
+	return compact, true
+}
+
+// parseCompactPeers decodes up to limit compact peers of size bytes each,
+// pairing them with their flags and skipping unusable addresses
+func parseCompactPeers(compact, flags []byte, size, limit int) []exchangedPeer {
+	var peers []exchangedPeer
+	for i := 0; i+size <= len(compact) && len(peers) < limit; i += size {
+		ipLen := size - 2
+		peer := exchangedPeer{
+			ip:   net.IP(compact[i : i+ipLen]),
+			port: int(binary.BigEndian.Uint16(compact[i+ipLen:])),
+		}
+		if n := i / size; n < len(flags) {
+			peer.flags = flags[n]
+		}
+		if peer.port > 0 && !peer.ip.IsUnspecified() {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestCompactPeer(t *testing.T) {
+	tests := []struct {
+		addr   string
+		want   []byte
+		wantOk bool
+	}{
+		{addr: "1.2.3.4:6881", want: []byte{1, 2, 3, 4, 0x1a, 0xe1}, wantOk: true},
+		{addr: "[::ffff:1.2.3.4]:80", want: []byte{1, 2, 3, 4, 0, 80}, wantOk: true},
+		{addr: "[2001:db8::1]:65535", want: append(net.ParseIP("2001:db8::1").To16(), 0xff, 0xff), wantOk: true},
+		{addr: "1.2.3.4:0"},
+		{addr: "1.2.3.4:65536"},
+		{addr: "1.2.3.4"},
+		{addr: "example.com:6881"},
+		{addr: "1.2.3.4:http"},
+	}
+
+	for _, tt := range tests {
+		got, ok := compactPeer(tt.addr)
+		if ok != tt.wantOk || !bytes.Equal(got, tt.want) {
+			t.Errorf("compactPeer(%q) = %x, %v; want %x, %v", tt.addr, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestParseCompactPeers(t *testing.T) {
+	compact := func(addrs ...string) []byte {
+		var b []byte
+		for _, addr := range addrs {
+			c, ok := compactPeer(addr)
+			if !ok {
+				t.Fatalf("compactPeer(%q) failed", addr)
+			}
+			b = append(b, c...)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name      string
+		compact   []byte
+		flags     []byte
+		size      int
+		limit     int
+		want      []string
+		wantFlags []byte
+	}{
+		{
+			name:      "IPv4 with flags",
+			compact:   compact("1.2.3.4:6881", "5.6.7.8:51413"),
+			flags:     []byte{pexSeed, 0},
+			size:      compactPeerLen,
+			limit:     10,
+			want:      []string{"1.2.3.4:6881", "5.6.7.8:51413"},
+			wantFlags: []byte{pexSeed, 0},
+		},
+		{
+			name:      "IPv6",
+			compact:   compact("[2001:db8::1]:6881", "[2001:db8::2]:6882"),
+			size:      compactPeer6Len,
+			limit:     10,
+			want:      []string{"[2001:db8::1]:6881", "[2001:db8::2]:6882"},
+			wantFlags: []byte{0, 0},
+		},
+		{
+			name:      "fewer flags than peers",
+			compact:   compact("1.2.3.4:1", "1.2.3.4:2"),
+			flags:     []byte{pexSeed},
+			size:      compactPeerLen,
+			limit:     10,
+			want:      []string{"1.2.3.4:1", "1.2.3.4:2"},
+			wantFlags: []byte{pexSeed, 0},
+		},
+		{
+			name:      "trailing partial peer ignored",
+			compact:   append(compact("1.2.3.4:6881"), 9, 9, 9),
+			size:      compactPeerLen,
+			limit:     10,
+			want:      []string{"1.2.3.4:6881"},
+			wantFlags: []byte{0},
+		},
+		{
+			name:      "limit",
+			compact:   compact("1.2.3.4:1", "1.2.3.4:2", "1.2.3.4:3"),
+			size:      compactPeerLen,
+			limit:     2,
+			want:      []string{"1.2.3.4:1", "1.2.3.4:2"},
+			wantFlags: []byte{0, 0},
+		},
+		{
+			name:      "unusable addresses skipped",
+			compact:   append(append([]byte{1, 2, 3, 4, 0, 0}, 0, 0, 0, 0, 0x1a, 0xe1), compact("5.6.7.8:6881")...),
+			flags:     []byte{0, 0, pexSeed},
+			size:      compactPeerLen,
+			limit:     10,
+			want:      []string{"5.6.7.8:6881"},
+			wantFlags: []byte{pexSeed},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peers := parseCompactPeers(tt.compact, tt.flags, tt.size, tt.limit)
+			if len(peers) != len(tt.want) {
+				t.Fatalf("got %d peers, want %d", len(peers), len(tt.want))
+			}
+			for i, peer := range peers {
+				if got := net.JoinHostPort(peer.ip.String(), strconv.Itoa(peer.port)); got != tt.want[i] {
+					t.Errorf("peer %d = %s, want %s", i, got, tt.want[i])
+				}
+				if peer.flags != tt.wantFlags[i] {
+					t.Errorf("peer %d flags = %#x, want %#x", i, peer.flags, tt.wantFlags[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// Piece picking modes, selectable per torrent
+const (
+	PickRarestFirst = "rarest-first" // Pieces fewest peers have first, keeping every piece alive in the swarm
+	PickSequential  = "sequential"   // Pieces in order, so comics and video can be viewed while they download
+)
+
+// EndgameDuplicates is how many peers a block may be requested from at once
+// during endgame
+const EndgameDuplicates = 3
+
+// ParsePickMode checks a piece picking mode; "" means rarest-first
+func ParsePickMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return PickRarestFirst, nil
+	case PickRarestFirst, PickSequential:
+		return mode, nil
+	case "streaming":
+		return PickSequential, nil
+	default:
+		return "", fmt.Errorf("unknown piece picking mode %q (want %s or %s)", mode, PickRarestFirst, PickSequential)
+	}
+}
+
+// SetPickMode changes how pieces are picked; requests already sent are kept
+func (t *Torrent) SetPickMode(mode string) error {
+	mode, err := ParsePickMode(mode)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.pickMode = mode
+	t.mu.Unlock()
+	return nil
+}
+
+// PickMode returns the torrent's piece picking mode
+func (t *Torrent) PickMode() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.pickMode
+}
+
+// InEndgame reports whether every missing block has been requested, so blocks
+// are requested from several peers and cancelled once one of them answers
+func (t *Torrent) InEndgame() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.endgame
+}
+
+// nextRequests picks up to max blocks to request from a peer. suggested lists
+// pieces the peer suggested and outstanding the blocks already requested from it.
+func (t *Torrent) nextRequests(peerBitfield Bitfield, suggested []int, outstanding []blockRequest, max int) []blockRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var reqs []blockRequest
+	if t.Info == nil {
+		return reqs
+	}
+
+	for _, i := range t.pickOrder(peerBitfield, suggested) {
+		if len(reqs) >= max {
+			break
+		}
+
+		pp, exists := t.pending[i]
+		if !exists {
+			pp = t.newPendingPiece(i)
+			t.pending[i] = pp
+		}
+
+		for b := range pp.requested {
+			if len(reqs) >= max {
+				break
+			}
+			if pp.requested[b] > 0 || pp.received[b] {
+				continue
+			}
+			pp.requested[b]++
+			reqs = append(reqs, pp.blockRequest(i, b))
+		}
+	}
+
+	// Endgame starts once no block is left unrequested
+	endgame := len(reqs) < max && t.allRequested()
+	if endgame && !t.endgame {
+		log.Printf("[Torrent] %s: entering endgame", t.Info.BestName())
+	}
+	t.endgame = endgame
+	if endgame {
+		reqs = t.endgameRequests(peerBitfield, outstanding, reqs, max)
+	}
+	return reqs
+}
+
+// pickOrder lists the missing pieces the peer has that we can verify, most
+// wanted first (assumes lock is held)
+func (t *Torrent) pickOrder(peerBitfield Bitfield, suggested []int) []int {
+	var order []int
+	for i := 0; i < t.Info.NumPieces(); i++ {
+		if !t.bitfield.Has(i) && peerBitfield.Has(i) && t.canVerify(i) {
+			order = append(order, i)
+		}
+	}
+	if t.pickMode == PickSequential {
+		return order
+	}
+
+	// Finish pieces already started before starting new ones, then take the
+	// peer's suggestions and go rarest first
+	isSuggested := make(map[int]bool, len(suggested))
+	for _, i := range suggested {
+		isSuggested[i] = true
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		_, startedA := t.pending[order[a]]
+		_, startedB := t.pending[order[b]]
+		if startedA != startedB {
+			return startedA
+		}
+		if isSuggested[order[a]] != isSuggested[order[b]] {
+			return isSuggested[order[a]]
+		}
+		return t.availabilityOf(order[a]) < t.availabilityOf(order[b])
+	})
+	return order
+}
+
+// suggestionsFor picks up to max pieces we have and the peer lacks, rarest in
+// the swarm first, to suggest to the peer (BEP 6)
+func (t *Torrent) suggestionsFor(peerBitfield Bitfield, max int) []int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.Info == nil {
+		return nil
+	}
+	var pieces []int
+	for i := 0; i < t.Info.NumPieces(); i++ {
+		if t.bitfield.Has(i) && !peerBitfield.Has(i) {
+			pieces = append(pieces, i)
+		}
+	}
+	sort.SliceStable(pieces, func(a, b int) bool {
+		return t.availabilityOf(pieces[a]) < t.availabilityOf(pieces[b])
+	})
+	return pieces[:min(len(pieces), max)]
+}
+
+// availabilityOf returns how many connected peers have a piece (assumes lock is held)
+func (t *Torrent) availabilityOf(index int) int {
+	if index < len(t.availability) {
+		return t.availability[index]
+	}
+	return 0
+}
+
+// allRequested reports whether every block of every missing piece has been
+// received or requested (assumes lock is held)
+func (t *Torrent) allRequested() bool {
+	for i := 0; i < t.Info.NumPieces(); i++ {
+		if t.bitfield.Has(i) {
+			continue
+		}
+		pp, exists := t.pending[i]
+		if !exists {
+			return false
+		}
+		for b := range pp.requested {
+			if pp.requested[b] == 0 && !pp.received[b] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// endgameRequests adds blocks that are already requested from other peers, so
+// the last pieces do not wait on the slowest peer (assumes lock is held)
+func (t *Torrent) endgameRequests(peerBitfield Bitfield, outstanding, reqs []blockRequest, max int) []blockRequest {
+	asked := make(map[blockRequest]bool, len(outstanding)+len(reqs))
+	for _, req := range outstanding {
+		asked[req] = true
+	}
+	for _, req := range reqs {
+		asked[req] = true
+	}
+
+	pieces := make([]int, 0, len(t.pending))
+	for i := range t.pending {
+		if peerBitfield.Has(i) {
+			pieces = append(pieces, i)
+		}
+	}
+	sort.Ints(pieces)
+
+	for _, i := range pieces {
+		pp := t.pending[i]
+		for b := range pp.requested {
+			if len(reqs) >= max {
+				return reqs
+			}
+			req := pp.blockRequest(i, b)
+			if pp.received[b] || pp.requested[b] >= EndgameDuplicates || asked[req] {
+				continue
+			}
+			pp.requested[b]++
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+// blockRequest returns the request for block b of piece index
+func (pp *pendingPiece) blockRequest(index, b int) blockRequest {
+	offset := b * BlockSize
+	return blockRequest{
+		Piece:  uint32(index),
+		Offset: uint32(offset),
+		Length: uint32(min(BlockSize, len(pp.data)-offset)),
+	}
+}
+
+// cancelDuplicates withdraws a received endgame block from the other peers it
+// was requested from
+func (t *Torrent) cancelDuplicates(req blockRequest, from *PeerConn) {
+	for _, pc := range t.connectedPeers() {
+		if pc == from || !pc.state.CancelRequest(req) {
+			continue
+		}
+		if err := pc.wire.SendCancel(req); err != nil {
+			log.Printf("Failed to cancel block %d+%d of piece %d with %s: %v",
+				req.Offset, req.Length, req.Piece, pc.addr, err)
+		}
+	}
+}
+
+// changeAvailability adds (delta 1) or removes (delta -1) a peer's pieces from
+// the swarm availability. It reports false if the info is not known yet or the
+// bitfield does not fit it.
+func (t *Torrent) changeAvailability(bitfield Bitfield, delta int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.availability == nil || !bitfield.validFor(len(t.availability)) {
+		return false
+	}
+	for i := range t.availability {
+		if bitfield.Has(i) {
+			t.availability[i] += delta
+		}
+	}
+	return true
+}
+
+// addPieceAvailability counts a piece announced by a peer whose bitfield is already counted
+func (t *Torrent) addPieceAvailability(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if index >= 0 && index < len(t.availability) {
+		t.availability[index]++
+	}
+}
+
+// countAvailability adds the peer's bitfield to the torrent's availability
+// once the info is known (assumes pc.mu is held)
+func (pc *PeerConn) countAvailability() {
+	select {
+	case <-pc.closed:
+		return // Already removed from the torrent
+	default:
+	}
+	if !pc.availabilityCounted && pc.torrent.changeAvailability(pc.bitfield, 1) {
+		pc.availabilityCounted = true
+	}
+}
+
+// uncountAvailability removes the peer's bitfield from the torrent's availability (assumes pc.mu is held)
+func (pc *PeerConn) uncountAvailability() {
+	if pc.availabilityCounted {
+		pc.torrent.changeAvailability(pc.bitfield, -1)
+		pc.availabilityCounted = false
+	}
+}
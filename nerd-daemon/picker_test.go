@@ -0,0 +1,200 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// newTestLeech returns a torrent of pieces pieces with nothing downloaded
+func newTestLeech(t *testing.T, pieces int, pieceLength int64) *Torrent {
+	t.Helper()
+	seed := newTestTorrent(t, pieces*int(pieceLength), pieceLength)
+	leech, err := NewTorrent(seed.InfoHash, seed.InfoBytes(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leech
+}
+
+func bitfieldOf(numPieces int, pieces ...int) Bitfield {
+	bf := NewBitfield(numPieces)
+	for _, i := range pieces {
+		bf.Set(i)
+	}
+	return bf
+}
+
+func TestParsePickMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		want    string
+		wantErr bool
+	}{
+		{mode: "", want: PickRarestFirst},
+		{mode: "rarest-first", want: PickRarestFirst},
+		{mode: "sequential", want: PickSequential},
+		{mode: "streaming", want: PickSequential},
+		{mode: "random", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePickMode(tt.mode)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParsePickMode(%q) = %q, %v; want %q, error %v", tt.mode, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestPickOrder(t *testing.T) {
+	const numPieces = 6
+	// Availability per piece: 3, 1, 2, 1, 2, 3
+	swarm := []Bitfield{
+		bitfieldOf(numPieces, 0, 1, 2, 3, 4, 5),
+		bitfieldOf(numPieces, 0, 2, 4, 5),
+		bitfieldOf(numPieces, 0, 5),
+	}
+
+	tests := []struct {
+		name      string
+		mode      string
+		have      []int
+		peer      Bitfield
+		started   []int
+		suggested []int
+		want      []int
+	}{
+		{
+			name: "rarest first",
+			mode: PickRarestFirst,
+			peer: swarm[0],
+			want: []int{1, 3, 2, 4, 0, 5},
+		},
+		{
+			name: "only pieces the peer has and we lack",
+			mode: PickRarestFirst,
+			have: []int{2},
+			peer: swarm[1],
+			want: []int{4, 0, 5},
+		},
+		{
+			name:    "started pieces first",
+			mode:    PickRarestFirst,
+			peer:    swarm[0],
+			started: []int{5},
+			want:    []int{5, 1, 3, 2, 4, 0},
+		},
+		{
+			name:      "suggestions after started pieces",
+			mode:      PickRarestFirst,
+			peer:      swarm[0],
+			started:   []int{5},
+			suggested: []int{4},
+			want:      []int{5, 4, 1, 3, 2, 0},
+		},
+		{
+			name:      "sequential ignores rarity and suggestions",
+			mode:      PickSequential,
+			have:      []int{0},
+			peer:      swarm[0],
+			started:   []int{5},
+			suggested: []int{4},
+			want:      []int{1, 2, 3, 4, 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrent := newTestLeech(t, numPieces, BlockSize)
+			for _, bf := range swarm {
+				if !torrent.changeAvailability(bf, 1) {
+					t.Fatal("changeAvailability rejected the bitfield")
+				}
+			}
+			if err := torrent.SetPickMode(tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			for _, i := range tt.have {
+				torrent.bitfield.Set(i)
+			}
+			for _, i := range tt.started {
+				torrent.pending[i] = torrent.newPendingPiece(i)
+			}
+
+			if got := torrent.pickOrder(tt.peer, tt.suggested); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pickOrder = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextRequests(t *testing.T) {
+	torrent := newTestLeech(t, 2, 2*BlockSize)
+	all := bitfieldOf(2, 0, 1)
+
+	// Blocks are handed out once until every one is requested
+	first := torrent.nextRequests(all, nil, nil, 3)
+	if len(first) != 3 || torrent.InEndgame() {
+		t.Fatalf("first peer got %d requests, endgame %v; want 3, false", len(first), torrent.InEndgame())
+	}
+	second := torrent.nextRequests(bitfieldOf(2, 1), nil, nil, 10)
+	want := []blockRequest{{Piece: 1, Offset: BlockSize, Length: BlockSize}}
+	if !torrent.InEndgame() {
+		t.Error("not in endgame after every block was requested")
+	}
+	if len(second) != 2 || !reflect.DeepEqual(second[:1], want) {
+		t.Fatalf("second peer got %v, want %v and one endgame request", second, want)
+	}
+
+	// In endgame the second peer is also asked for the other block of the
+	// piece it has
+	if second[1].Piece != 1 || second[1].Offset != 0 {
+		t.Errorf("endgame request %+v, want block 0 of piece 1", second[1])
+	}
+}
+
+func TestEndgameRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		peers    int // Peers asking before the last one
+		received []int
+		want     int
+	}{
+		{name: "duplicates the blocks in flight", peers: 1, want: 4},
+		{name: "skips received blocks", peers: 1, received: []int{0, 3}, want: 2},
+		{name: "at most EndgameDuplicates peers per block", peers: EndgameDuplicates, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrent := newTestLeech(t, 2, 2*BlockSize)
+			all := bitfieldOf(2, 0, 1)
+			for i := 0; i < tt.peers; i++ {
+				torrent.nextRequests(all, nil, nil, 10)
+			}
+			for _, b := range tt.received {
+				torrent.pending[b/2].received[b%2] = true
+			}
+
+			reqs := torrent.nextRequests(all, nil, nil, 10)
+			if len(reqs) != tt.want {
+				t.Errorf("got %d requests, want %d", len(reqs), tt.want)
+			}
+			for _, req := range reqs {
+				if torrent.pending[int(req.Piece)].received[req.Offset/BlockSize] {
+					t.Errorf("requested received block %+v", req)
+				}
+			}
+
+			// A peer is never asked twice for a block it has outstanding
+			asked := make(map[blockRequest]bool)
+			for _, req := range reqs {
+				asked[req] = true
+			}
+			for _, req := range torrent.nextRequests(all, nil, reqs, 10) {
+				if asked[req] {
+					t.Errorf("block %+v requested twice from one peer", req)
+				}
+			}
+		})
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/nerd-daemon/messages"
 	"google.golang.org/protobuf/proto"
@@ -23,6 +26,15 @@ const (
 	MsgTypePiece         = 7
 	MsgTypeCancel        = 8
 	MsgTypePort          = 9
+	MsgTypeSuggest       = 13 // BEP 6 hint that a piece is cheap for the sender to upload
+	MsgTypeHaveAll       = 14 // BEP 6 replacement for a full bitfield
+	MsgTypeHaveNone      = 15 // BEP 6 replacement for an empty bitfield
+	MsgTypeReject        = 16 // BEP 6 refusal of a block request
+	MsgTypeAllowedFast   = 17 // BEP 6 piece that may be requested while choked
+	MsgTypeExtended      = 20 // BEP 10 extension protocol (bencoded payload)
+	MsgTypeHashRequest   = 21 // BEP 52 request for merkle tree hashes
+	MsgTypeHashes        = 22 // BEP 52 merkle tree hashes with their proof
+	MsgTypeHashReject    = 23 // BEP 52 refusal of a hash request
 
 	// NERD-specific message types (100+)
 	MsgTypePaymentRequest = 100
@@ -39,28 +51,119 @@ const (
 	HandshakeLen      = 68 // 1 + 19 + 8 + 20 + 20
 )
 
+// Reserved handshake bits
+const (
+	ExtensionProtocolByte = 5    // reserved[5] carries the BEP 10 bit
+	ExtensionProtocolBit  = 0x10 // Peer supports the extension protocol
+	NERDProtocolByte      = 2    // reserved[2] carries the NERD bit
+	NERDProtocolBit       = 0x01 // Peer speaks the NERD protobuf framing
+	NERDEncryptionBit     = 0x02 // Peer can run the Noise-style encrypted handshake (reserved[2])
+	FastExtensionByte     = 7    // reserved[7] carries the BEP 6 bit
+	FastExtensionBit      = 0x04 // Peer supports the Fast Extension
+)
+
+// How messages are framed after the handshake
+const (
+	FramingBitTorrent = "bittorrent" // Standard binary messages (BEP 3), understood by every client
+	FramingNERD       = "nerd"       // Protobuf message wrapper, used when both sides set the NERD bit
+)
+
+// ErrNERDUnsupported is returned when sending a NERD message to a peer that did not advertise NERD support
+var ErrNERDUnsupported = errors.New("peer does not support NERD messages")
+
+// WireLimits bounds what a peer may send us and how long a connection may stay silent
+type WireLimits struct {
+	MaxMessageSize    uint32            // Largest frame accepted, checked before anything is allocated
+	MaxPayloadSizes   map[uint32]uint32 // Per-message-type payload caps; other types use MaxMessageSize
+	HandshakeTimeout  time.Duration     // Time allowed to dial and complete the handshake
+	IdleTimeout       time.Duration     // Disconnect a peer that sends nothing (not even keep-alives) for this long
+	KeepAliveInterval time.Duration     // Send a keep-alive after this long without sending anything
+	WriteTimeout      time.Duration     // Time allowed for a single write
+}
+
+// DefaultWireLimits returns the limits used unless the configuration overrides them
+func DefaultWireLimits() WireLimits {
+	return WireLimits{
+		MaxMessageSize: 1024 * 1024,
+		MaxPayloadSizes: map[uint32]uint32{
+			MsgTypeChoke:         16,
+			MsgTypeUnchoke:       16,
+			MsgTypeInterested:    16,
+			MsgTypeNotInterested: 16,
+			MsgTypeHave:          16,
+			MsgTypeRequest:       32,
+			MsgTypePiece:         MaxBlockLength + 32,
+			MsgTypeCancel:        32,
+			MsgTypePort:          16,
+			MsgTypeSuggest:       16,
+			MsgTypeHaveAll:       16,
+			MsgTypeHaveNone:      16,
+			MsgTypeReject:        32,
+			MsgTypeAllowedFast:   16,
+			MsgTypeExtended:      MetadataPieceSize + 16*1024,
+			MsgTypeHashRequest:   hashRequestSize,
+			MsgTypeHashes:        hashRequestSize + (MaxHashesPerRequest+32)*32,
+			MsgTypeHashReject:    hashRequestSize,
+			999:                  16, // Keep-alive
+		},
+		HandshakeTimeout:  20 * time.Second,
+		IdleTimeout:       3 * time.Minute,
+		KeepAliveInterval: 90 * time.Second,
+		WriteTimeout:      60 * time.Second,
+	}
+}
+
 // WireProtocol handles BitTorrent wire protocol communication
 type WireProtocol struct {
-	conn   net.Conn
-	peerID [20]byte
+	conn           net.Conn
+	limits         WireLimits
+	identity       *Identity  // Our peer ID and the key behind it
+	remotePeerID   [20]byte   // Peer ID from the peer's handshake
+	peerReserved   [8]byte    // Reserved bytes from the peer's handshake
+	framing        string     // Decided by the handshake, fixed afterwards
+	encryption     string     // Our encryption policy
+	transport      string     // Plaintext, MSE or Noise; fixed before the first message
+	provenIdentity string     // BSV address the peer proved during the encrypted handshake
+	handshakeHash  []byte     // Noise handshake transcript hash, nil on unencrypted connections
+	state          *PeerState // Choke/interest flags, queues and traffic counters
+	writeMu        sync.Mutex // Serialises writes from the read loop, upload server and broadcasts
+
+	nerdExtendedID byte // Peer's extended message ID for NERD messages, 0 if not advertised
+	mu             sync.Mutex
 }
 
 // NewWireProtocol creates a new wire protocol handler for a connection
-func NewWireProtocol(conn net.Conn) *WireProtocol {
+func NewWireProtocol(conn net.Conn, limits WireLimits, identity *Identity) *WireProtocol {
 	return &WireProtocol{
-		conn: conn,
-		// TODO: Generate proper peer ID
-		peerID: [20]byte{}, // Placeholder
+		conn:       conn,
+		limits:     limits,
+		identity:   identity,
+		framing:    FramingBitTorrent,
+		encryption: EncryptionDisabled,
+		transport:  TransportPlaintext,
+		state:      NewPeerState(),
 	}
 }
 
+// State returns the protocol state of the connection
+func (wp *WireProtocol) State() *PeerState {
+	return wp.state
+}
+
 // SendHandshake sends a BitTorrent handshake message
 func (wp *WireProtocol) SendHandshake(infoHash [20]byte) error {
+	peerID := wp.identity.PeerID()
 	handshake := &messages.HandshakeMsg{
 		ProtocolString: []byte(ProtocolString),
 		Reserved:       make([]byte, 8), // Reserved bytes for extensions
 		InfoHash:       infoHash[:],
-		PeerId:         wp.peerID[:],
+		PeerId:         peerID[:],
+	}
+	handshake.Reserved[ExtensionProtocolByte] |= ExtensionProtocolBit
+	handshake.Reserved[NERDProtocolByte] |= NERDProtocolBit
+	handshake.Reserved[FastExtensionByte] |= FastExtensionBit
+	if wp.offersNoise() {
+		handshake.Reserved[NERDProtocolByte] |= NERDEncryptionBit
 	}
 
 	// For handshake, we use the traditional BitTorrent format
@@ -72,9 +175,10 @@ func (wp *WireProtocol) SendHandshake(infoHash [20]byte) error {
 	copy(handshakeBytes[28:48], handshake.InfoHash)
 	copy(handshakeBytes[48:68], handshake.PeerId)
 
+	wp.conn.SetWriteDeadline(time.Now().Add(wp.limits.WriteTimeout))
 	_, err := wp.conn.Write(handshakeBytes)
 	if err != nil {
-		return fmt.Errorf("failed to send handshake: %v", err)
+		return fmt.Errorf("failed to send handshake: %w", err)
 	}
 
 	return nil
@@ -85,7 +189,7 @@ func (wp *WireProtocol) ReceiveHandshake() (*messages.HandshakeMsg, error) {
 	handshakeBytes := make([]byte, HandshakeLen)
 	_, err := io.ReadFull(wp.conn, handshakeBytes)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read handshake: %v", err)
+		return nil, fmt.Errorf("failed to read handshake: %w", err)
 	}
 
 	// Parse traditional BitTorrent handshake format
@@ -104,18 +208,156 @@ func (wp *WireProtocol) ReceiveHandshake() (*messages.HandshakeMsg, error) {
 		InfoHash:       handshakeBytes[28:48],
 		PeerId:         handshakeBytes[48:68],
 	}
+	copy(wp.peerReserved[:], handshake.Reserved)
+	copy(wp.remotePeerID[:], handshake.PeerId)
+
+	// We always set the NERD bit, so the peer's bit decides the framing
+	if wp.peerReserved[NERDProtocolByte]&NERDProtocolBit != 0 {
+		wp.framing = FramingNERD
+	}
 
 	return handshake, nil
 }
 
-// SendMessage sends a message using our protobuf wire protocol
+// SupportsExtensions reports whether the peer set the BEP 10 bit in its handshake
+func (wp *WireProtocol) SupportsExtensions() bool {
+	return wp.peerReserved[ExtensionProtocolByte]&ExtensionProtocolBit != 0
+}
+
+// SupportsFast reports whether the peer set the BEP 6 bit in its handshake.
+// We always set it, so the Fast Extension is in use exactly when this is true.
+func (wp *WireProtocol) SupportsFast() bool {
+	return wp.peerReserved[FastExtensionByte]&FastExtensionBit != 0
+}
+
+// RemotePeerID returns the peer ID the peer sent in its handshake. It is only
+// proven for peers that answered our nerd_auth challenge.
+func (wp *WireProtocol) RemotePeerID() [20]byte {
+	return wp.remotePeerID
+}
+
+// HandshakeHash returns the hash of the encrypted handshake, which is unique to
+// the connection, or nil if the connection is not encrypted
+func (wp *WireProtocol) HandshakeHash() []byte {
+	return wp.handshakeHash
+}
+
+// SetEncryption sets our encryption policy and the transport the connection
+// was established with; it must be called before the handshake
+func (wp *WireProtocol) SetEncryption(policy, transport string) {
+	wp.encryption = policy
+	wp.transport = transport
+}
+
+// Transport returns how the connection is protected
+func (wp *WireProtocol) Transport() string {
+	return wp.transport
+}
+
+// offersNoise reports whether we advertise the encrypted handshake
+func (wp *WireProtocol) offersNoise() bool {
+	return wp.encryption != EncryptionDisabled
+}
+
+// Network returns the transport the connection runs over: "tcp" or "utp"
+func (wp *WireProtocol) Network() string {
+	return wp.conn.RemoteAddr().Network()
+}
+
+// Framing returns how messages are framed on this connection
+func (wp *WireProtocol) Framing() string {
+	return wp.framing
+}
+
+// SetNERDExtensionID records the extended message ID the peer advertised for
+// NERD messages, allowing them on a connection with standard framing
+func (wp *WireProtocol) SetNERDExtensionID(id byte) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.nerdExtendedID = id
+}
+
+// SupportsNERD reports whether NERD messages (100+) can be sent to the peer
+func (wp *WireProtocol) SupportsNERD() bool {
+	if wp.framing == FramingNERD {
+		return true
+	}
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.nerdExtendedID != 0
+}
+
+// SendMessage sends a message in the connection's framing. With standard
+// framing, NERD messages travel as extension messages and fail with
+// ErrNERDUnsupported if the peer did not advertise them.
 func (wp *WireProtocol) SendMessage(messageType uint32, payload proto.Message) error {
+	if wp.framing == FramingBitTorrent {
+		return wp.sendBinary(messageType, payload)
+	}
+
 	// Serialize the payload
 	payloadBytes, err := proto.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal payload: %v", err)
 	}
 
+	return wp.sendPayload(messageType, payloadBytes)
+}
+
+// sendBinary sends a message with standard framing
+func (wp *WireProtocol) sendBinary(messageType uint32, payload proto.Message) error {
+	if messageType <= MsgTypePort {
+		payloadBytes, err := encodeBinaryPayload(payload)
+		if err != nil {
+			return err
+		}
+		return wp.writeFrame(binaryFrame(byte(messageType), payloadBytes))
+	}
+	if messageType < MsgTypePaymentRequest {
+		return fmt.Errorf("message type %d has no BitTorrent encoding", messageType)
+	}
+
+	wp.mu.Lock()
+	extendedID := wp.nerdExtendedID
+	wp.mu.Unlock()
+	if extendedID == 0 {
+		return fmt.Errorf("message type %d: %w", messageType, ErrNERDUnsupported)
+	}
+
+	// NERD messages go through the extension protocol as [4-byte type][protobuf]
+	payloadBytes, err := proto.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %v", err)
+	}
+	return wp.SendExtended(extendedID, append(binary.BigEndian.AppendUint32(nil, messageType), payloadBytes...))
+}
+
+// SendExtended sends a BEP 10 extension message. The payload is bencoded, so
+// with NERD framing it is carried in the message wrapper as-is rather than as
+// a protobuf message.
+func (wp *WireProtocol) SendExtended(extendedID byte, payload []byte) error {
+	return wp.sendRaw(MsgTypeExtended, append([]byte{extendedID}, payload...))
+}
+
+// sendRaw sends a message whose payload is already in its BitTorrent encoding;
+// with NERD framing the payload is carried in the message wrapper as-is
+func (wp *WireProtocol) sendRaw(messageID byte, payload []byte) error {
+	if wp.framing == FramingBitTorrent {
+		return wp.writeFrame(binaryFrame(messageID, payload))
+	}
+	return wp.sendPayload(uint32(messageID), payload)
+}
+
+// binaryFrame builds a standard <length><id><payload> message
+func binaryFrame(messageID byte, payload []byte) []byte {
+	frame := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(1+len(payload)))
+	frame[4] = messageID
+	return append(frame, payload...)
+}
+
+// sendPayload wraps an encoded payload in the message wrapper and sends it
+func (wp *WireProtocol) sendPayload(messageType uint32, payloadBytes []byte) error {
 	// Create the message wrapper
 	msg := &messages.Message{
 		Length:    uint32(len(payloadBytes) + 4), // +4 for message_id
@@ -134,26 +376,43 @@ func (wp *WireProtocol) SendMessage(messageType uint32, payload proto.Message) e
 	binary.BigEndian.PutUint32(lengthBytes, uint32(len(msgBytes)))
 
 	// Send length + message
-	_, err = wp.conn.Write(append(lengthBytes, msgBytes...))
+	return wp.writeFrame(append(lengthBytes, msgBytes...))
+}
+
+// writeFrame writes a complete length-prefixed message
+func (wp *WireProtocol) writeFrame(frame []byte) error {
+	wp.writeMu.Lock()
+	wp.conn.SetWriteDeadline(time.Now().Add(wp.limits.WriteTimeout))
+	_, err := wp.conn.Write(frame)
+	wp.writeMu.Unlock()
 	if err != nil {
-		return fmt.Errorf("failed to send message: %v", err)
+		return fmt.Errorf("failed to send message: %w", err)
 	}
+	wp.state.messageSent()
 
 	return nil
 }
 
-// ReceiveMessage receives and parses a message from the wire
+// ReceiveMessage receives and parses a message from the wire. A peer that stays
+// silent for the idle timeout or exceeds a size limit gets an error.
 func (wp *WireProtocol) ReceiveMessage() (*messages.Message, error) {
+	// The whole message must arrive within the idle timeout
+	wp.conn.SetReadDeadline(time.Now().Add(wp.limits.IdleTimeout))
+
 	// Read message length (4 bytes)
 	lengthBytes := make([]byte, 4)
 	_, err := io.ReadFull(wp.conn, lengthBytes)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read message length: %v", err)
+		return nil, fmt.Errorf("failed to read message length: %w", err)
 	}
 
 	msgLength := binary.BigEndian.Uint32(lengthBytes)
+	if msgLength > wp.limits.MaxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds limit of %d", msgLength, wp.limits.MaxMessageSize)
+	}
 	if msgLength == 0 {
 		// Keep-alive message
+		wp.state.messageReceived()
 		return &messages.Message{
 			Length:    0,
 			MessageId: 999, // Special keep-alive ID
@@ -165,31 +424,86 @@ func (wp *WireProtocol) ReceiveMessage() (*messages.Message, error) {
 	msgBytes := make([]byte, msgLength)
 	_, err = io.ReadFull(wp.conn, msgBytes)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read message data: %v", err)
+		return nil, fmt.Errorf("failed to read message data: %w", err)
 	}
 
 	// Parse the message
 	msg := &messages.Message{}
-	err = proto.Unmarshal(msgBytes, msg)
-	if err != nil {
+	if wp.framing == FramingBitTorrent {
+		msg.Length = msgLength
+		msg.MessageId = uint32(msgBytes[0])
+		msg.Payload = msgBytes[1:]
+	} else if err := proto.Unmarshal(msgBytes, msg); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal message: %v", err)
 	}
 
+	// Unwrap NERD messages sent through the extension protocol
+	if msg.MessageId == MsgTypeExtended && len(msg.Payload) > 0 && msg.Payload[0] == extendedIDNERD {
+		if len(msg.Payload) < 5 {
+			return nil, fmt.Errorf("truncated NERD extension message")
+		}
+		msg = &messages.Message{
+			Length:    uint32(len(msg.Payload) - 1),
+			MessageId: binary.BigEndian.Uint32(msg.Payload[1:5]),
+			Payload:   msg.Payload[5:],
+		}
+		if msg.MessageId < MsgTypePaymentRequest {
+			return nil, fmt.Errorf("message type %d is not a NERD message", msg.MessageId)
+		}
+	}
+
+	if limit, ok := wp.limits.MaxPayloadSizes[msg.MessageId]; ok && uint32(len(msg.Payload)) > limit {
+		return nil, fmt.Errorf("message type %d with %d byte payload exceeds limit of %d",
+			msg.MessageId, len(msg.Payload), limit)
+	}
+	wp.state.messageReceived()
+
 	return msg, nil
 }
 
+// DecodePayload parses a received message's payload with the registered decoder.
+// Standard messages are in BEP 3 binary form unless NERD framing is in use, and
+// are decoded here instead; NERD messages are always protobuf.
+func (wp *WireProtocol) DecodePayload(msg *messages.Message, decode MessageDecoder) (proto.Message, error) {
+	if wp.framing == FramingBitTorrent && msg.MessageId <= MsgTypePort {
+		return decodeBinaryPayload(msg.MessageId, msg.Payload)
+	}
+	if decode == nil {
+		return nil, nil
+	}
+	return decode(msg.Payload)
+}
+
 // SendKeepAlive sends a keep-alive message (empty message)
 func (wp *WireProtocol) SendKeepAlive() error {
+	if wp.framing == FramingBitTorrent {
+		return wp.writeFrame(make([]byte, 4)) // Zero length prefix
+	}
 	keepAlive := &messages.KeepAliveMsg{}
 	return wp.SendMessage(999, keepAlive) // Special keep-alive ID
 }
 
+// SendChoke sends a choke message
+func (wp *WireProtocol) SendChoke() error {
+	return wp.SendMessage(MsgTypeChoke, &messages.ChokeMsg{})
+}
+
+// SendUnchoke sends an unchoke message
+func (wp *WireProtocol) SendUnchoke() error {
+	return wp.SendMessage(MsgTypeUnchoke, &messages.UnchokeMsg{})
+}
+
 // SendInterested sends an interested message
 func (wp *WireProtocol) SendInterested() error {
 	interested := &messages.InterestedMsg{}
 	return wp.SendMessage(MsgTypeInterested, interested)
 }
 
+// SendNotInterested sends a not interested message
+func (wp *WireProtocol) SendNotInterested() error {
+	return wp.SendMessage(MsgTypeNotInterested, &messages.NotInterestedMsg{})
+}
+
 // SendHave sends a have message for a specific piece
 func (wp *WireProtocol) SendHave(pieceIndex uint32) error {
 	have := &messages.HaveMsg{
@@ -198,74 +512,78 @@ func (wp *WireProtocol) SendHave(pieceIndex uint32) error {
 	return wp.SendMessage(MsgTypeHave, have)
 }
 
-// ParseMessagePayload parses a message payload based on its type
-func ParseMessagePayload(messageType uint32, payload []byte) (proto.Message, error) {
-	switch messageType {
-	case MsgTypeChoke:
-		msg := &messages.ChokeMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case MsgTypeUnchoke:
-		msg := &messages.UnchokeMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case MsgTypeInterested:
-		msg := &messages.InterestedMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case MsgTypeNotInterested:
-		msg := &messages.NotInterestedMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case MsgTypeHave:
-		msg := &messages.HaveMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case MsgTypeBitfield:
-		msg := &messages.BitfieldMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case MsgTypeRequest:
-		msg := &messages.RequestMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case MsgTypePiece:
-		msg := &messages.PieceMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case MsgTypeCancel:
-		msg := &messages.CancelMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case MsgTypePort:
-		msg := &messages.PortMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case MsgTypePaymentRequest:
-		msg := &messages.PaymentRequestMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case MsgTypePaymentProof:
-		msg := &messages.PaymentProofMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case MsgTypeTokenBalance:
-		msg := &messages.TokenBalanceMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case MsgTypeQualityMetrics:
-		msg := &messages.QualityMetricsMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case MsgTypeGeographicHint:
-		msg := &messages.GeographicHintMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	case 999: // Keep-alive
-		msg := &messages.KeepAliveMsg{}
-		err := proto.Unmarshal(payload, msg)
-		return msg, err
-	default:
-		return nil, fmt.Errorf("unknown message type: %d", messageType)
+// SendBitfield sends the bitfield of pieces we have
+func (wp *WireProtocol) SendBitfield(bitfield Bitfield) error {
+	return wp.SendMessage(MsgTypeBitfield, &messages.BitfieldMsg{Bitfield: bitfield})
+}
+
+// SendRequest requests a block of a piece from the peer
+func (wp *WireProtocol) SendRequest(req blockRequest) error {
+	return wp.SendMessage(MsgTypeRequest, &messages.RequestMsg{
+		PieceIndex:  req.Piece,
+		BlockOffset: req.Offset,
+		BlockLength: req.Length,
+	})
+}
+
+// SendPiece delivers a block of piece data to the peer
+func (wp *WireProtocol) SendPiece(pieceIndex, offset uint32, data []byte) error {
+	return wp.SendMessage(MsgTypePiece, &messages.PieceMsg{
+		PieceIndex:  pieceIndex,
+		BlockOffset: offset,
+		BlockData:   data,
+	})
+}
+
+// SendCancel cancels a previously sent block request
+func (wp *WireProtocol) SendCancel(req blockRequest) error {
+	return wp.SendMessage(MsgTypeCancel, &messages.CancelMsg{
+		PieceIndex:  req.Piece,
+		BlockOffset: req.Offset,
+		BlockLength: req.Length,
+	})
+}
+
+// SendHashRequest asks the peer for a range of a file's merkle tree (BEP 52)
+func (wp *WireProtocol) SendHashRequest(req hashRequest) error {
+	return wp.sendRaw(MsgTypeHashRequest, req.encode())
+}
+
+// SendHashes answers a hash request with the requested hashes followed by the proof
+func (wp *WireProtocol) SendHashes(req hashRequest, hashes [][32]byte) error {
+	payload := req.encode()
+	for _, hash := range hashes {
+		payload = append(payload, hash[:]...)
 	}
+	return wp.sendRaw(MsgTypeHashes, payload)
+}
+
+// SendHashReject refuses a hash request
+func (wp *WireProtocol) SendHashReject(req hashRequest) error {
+	return wp.sendRaw(MsgTypeHashReject, req.encode())
+}
+
+// SendSuggest suggests a piece the peer should download from us (BEP 6)
+func (wp *WireProtocol) SendSuggest(pieceIndex uint32) error {
+	return wp.sendRaw(MsgTypeSuggest, binary.BigEndian.AppendUint32(nil, pieceIndex))
+}
+
+// SendHaveAll tells the peer we have every piece, in place of a bitfield
+func (wp *WireProtocol) SendHaveAll() error {
+	return wp.sendRaw(MsgTypeHaveAll, nil)
+}
+
+// SendHaveNone tells the peer we have no pieces, in place of a bitfield
+func (wp *WireProtocol) SendHaveNone() error {
+	return wp.sendRaw(MsgTypeHaveNone, nil)
+}
+
+// SendReject tells the peer a block request will not be served
+func (wp *WireProtocol) SendReject(req blockRequest) error {
+	return wp.sendRaw(MsgTypeReject, appendUint32s(nil, req.Piece, req.Offset, req.Length))
+}
+
+// SendAllowedFast lets the peer request a piece even while we choke it
+func (wp *WireProtocol) SendAllowedFast(pieceIndex uint32) error {
+	return wp.sendRaw(MsgTypeAllowedFast, binary.BigEndian.AppendUint32(nil, pieceIndex))
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/nerd-daemon/messages"
+	"google.golang.org/protobuf/proto"
+)
+
+// Standard BitTorrent peers exchange messages 0-9 as <length><id><payload> with
+// fixed binary payloads (BEP 3). These helpers convert between that form and the
+// protobuf message types the rest of the daemon works with.
+
+// encodeBinaryPayload returns the BEP 3 payload of a standard message
+func encodeBinaryPayload(payload proto.Message) ([]byte, error) {
+	switch msg := payload.(type) {
+	case *messages.ChokeMsg, *messages.UnchokeMsg, *messages.InterestedMsg, *messages.NotInterestedMsg:
+		return nil, nil
+	case *messages.HaveMsg:
+		return binary.BigEndian.AppendUint32(nil, msg.PieceIndex), nil
+	case *messages.BitfieldMsg:
+		return msg.Bitfield, nil
+	case *messages.RequestMsg:
+		return appendUint32s(nil, msg.PieceIndex, msg.BlockOffset, msg.BlockLength), nil
+	case *messages.CancelMsg:
+		return appendUint32s(nil, msg.PieceIndex, msg.BlockOffset, msg.BlockLength), nil
+	case *messages.PieceMsg:
+		return append(appendUint32s(nil, msg.PieceIndex, msg.BlockOffset), msg.BlockData...), nil
+	case *messages.PortMsg:
+		return binary.BigEndian.AppendUint16(nil, uint16(msg.Port)), nil
+	default:
+		return nil, fmt.Errorf("no BitTorrent encoding for %T", payload)
+	}
+}
+
+// decodeBinaryPayload parses the BEP 3 payload of a standard message
+func decodeBinaryPayload(messageType uint32, payload []byte) (proto.Message, error) {
+	wantLen := map[uint32]int{
+		MsgTypeChoke:         0,
+		MsgTypeUnchoke:       0,
+		MsgTypeInterested:    0,
+		MsgTypeNotInterested: 0,
+		MsgTypeHave:          4,
+		MsgTypeRequest:       12,
+		MsgTypeCancel:        12,
+		MsgTypePort:          2,
+	}
+	if n, ok := wantLen[messageType]; ok && len(payload) != n {
+		return nil, fmt.Errorf("message type %d has %d byte payload, want %d", messageType, len(payload), n)
+	}
+
+	switch messageType {
+	case MsgTypeChoke:
+		return &messages.ChokeMsg{}, nil
+	case MsgTypeUnchoke:
+		return &messages.UnchokeMsg{}, nil
+	case MsgTypeInterested:
+		return &messages.InterestedMsg{}, nil
+	case MsgTypeNotInterested:
+		return &messages.NotInterestedMsg{}, nil
+	case MsgTypeHave:
+		return &messages.HaveMsg{PieceIndex: binary.BigEndian.Uint32(payload)}, nil
+	case MsgTypeBitfield:
+		return &messages.BitfieldMsg{Bitfield: payload}, nil
+	case MsgTypeRequest:
+		return &messages.RequestMsg{
+			PieceIndex:  binary.BigEndian.Uint32(payload[0:4]),
+			BlockOffset: binary.BigEndian.Uint32(payload[4:8]),
+			BlockLength: binary.BigEndian.Uint32(payload[8:12]),
+		}, nil
+	case MsgTypeCancel:
+		return &messages.CancelMsg{
+			PieceIndex:  binary.BigEndian.Uint32(payload[0:4]),
+			BlockOffset: binary.BigEndian.Uint32(payload[4:8]),
+			BlockLength: binary.BigEndian.Uint32(payload[8:12]),
+		}, nil
+	case MsgTypePiece:
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("piece message too short: %d bytes", len(payload))
+		}
+		return &messages.PieceMsg{
+			PieceIndex:  binary.BigEndian.Uint32(payload[0:4]),
+			BlockOffset: binary.BigEndian.Uint32(payload[4:8]),
+			BlockData:   payload[8:],
+		}, nil
+	case MsgTypePort:
+		return &messages.PortMsg{Port: uint32(binary.BigEndian.Uint16(payload))}, nil
+	default:
+		return nil, fmt.Errorf("unknown message type: %d", messageType)
+	}
+}
+
+// appendUint32s appends big-endian uint32 values
+func appendUint32s(b []byte, values ...uint32) []byte {
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
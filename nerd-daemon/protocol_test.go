@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/nerd-daemon/messages"
+	"google.golang.org/protobuf/proto"
+)
+
+// wirePair connects two wire protocols with the given framing over a pipe
+func wirePair(t *testing.T, framing string) (*WireProtocol, *WireProtocol) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	sender := NewWireProtocol(a, DefaultWireLimits(), nil)
+	receiver := NewWireProtocol(b, DefaultWireLimits(), nil)
+	sender.framing = framing
+	receiver.framing = framing
+	return sender, receiver
+}
+
+// receiveWire runs send in the background, as pipe writes block until read, and
+// returns the message it delivered
+func receiveWire(t *testing.T, receiver *WireProtocol, send func() error) (*messages.Message, error) {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() { errc <- send() }()
+	msg, err := receiver.ReceiveMessage()
+	if err != nil {
+		return nil, err
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	return msg, nil
+}
+
+func TestBinaryPayload(t *testing.T) {
+	tests := []struct {
+		messageType uint32
+		msg         proto.Message
+		want        []byte
+	}{
+		{MsgTypeChoke, &messages.ChokeMsg{}, nil},
+		{MsgTypeUnchoke, &messages.UnchokeMsg{}, nil},
+		{MsgTypeInterested, &messages.InterestedMsg{}, nil},
+		{MsgTypeNotInterested, &messages.NotInterestedMsg{}, nil},
+		{MsgTypeHave, &messages.HaveMsg{PieceIndex: 0x01020304}, []byte{1, 2, 3, 4}},
+		{MsgTypeBitfield, &messages.BitfieldMsg{Bitfield: []byte{0xA0, 0x80}}, []byte{0xA0, 0x80}},
+		{
+			MsgTypeRequest,
+			&messages.RequestMsg{PieceIndex: 1, BlockOffset: 16384, BlockLength: 16384},
+			[]byte{0, 0, 0, 1, 0, 0, 0x40, 0, 0, 0, 0x40, 0},
+		},
+		{
+			MsgTypeCancel,
+			&messages.CancelMsg{PieceIndex: 2, BlockOffset: 0, BlockLength: 100},
+			[]byte{0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 100},
+		},
+		{
+			MsgTypePiece,
+			&messages.PieceMsg{PieceIndex: 3, BlockOffset: 8, BlockData: []byte("data")},
+			[]byte{0, 0, 0, 3, 0, 0, 0, 8, 'd', 'a', 't', 'a'},
+		},
+		{MsgTypePort, &messages.PortMsg{Port: 6881}, []byte{0x1a, 0xe1}},
+	}
+
+	for _, tt := range tests {
+		payload, err := encodeBinaryPayload(tt.msg)
+		if err != nil {
+			t.Errorf("encode %T: %v", tt.msg, err)
+			continue
+		}
+		if !bytes.Equal(payload, tt.want) {
+			t.Errorf("encode %T = %x, want %x", tt.msg, payload, tt.want)
+		}
+		got, err := decodeBinaryPayload(tt.messageType, payload)
+		if err != nil {
+			t.Errorf("decode %T: %v", tt.msg, err)
+			continue
+		}
+		if !proto.Equal(got, tt.msg) {
+			t.Errorf("decode %T = %v, want %v", tt.msg, got, tt.msg)
+		}
+	}
+
+	invalid := []struct {
+		messageType uint32
+		payload     []byte
+	}{
+		{MsgTypeChoke, []byte{0}},
+		{MsgTypeHave, []byte{0, 0, 1}},
+		{MsgTypeRequest, make([]byte, 13)},
+		{MsgTypeCancel, make([]byte, 8)},
+		{MsgTypePiece, make([]byte, 7)},
+		{MsgTypePort, []byte{1}},
+		{MsgTypeExtended, nil},
+	}
+	for _, tt := range invalid {
+		if _, err := decodeBinaryPayload(tt.messageType, tt.payload); err == nil {
+			t.Errorf("decode type %d with %d byte payload: no error", tt.messageType, len(tt.payload))
+		}
+	}
+}
+
+func TestWireMessageRoundTrip(t *testing.T) {
+	block := blockRequest{Piece: 4, Offset: 32768, Length: 16384}
+
+	tests := []struct {
+		name        string
+		send        func(wp *WireProtocol) error
+		messageType uint32
+		want        proto.Message
+	}{
+		{
+			name:        "have",
+			send:        func(wp *WireProtocol) error { return wp.SendHave(7) },
+			messageType: MsgTypeHave,
+			want:        &messages.HaveMsg{PieceIndex: 7},
+		},
+		{
+			name:        "bitfield",
+			send:        func(wp *WireProtocol) error { return wp.SendBitfield(Bitfield{0xFF, 0xC0}) },
+			messageType: MsgTypeBitfield,
+			want:        &messages.BitfieldMsg{Bitfield: []byte{0xFF, 0xC0}},
+		},
+		{
+			name:        "request",
+			send:        func(wp *WireProtocol) error { return wp.SendRequest(block) },
+			messageType: MsgTypeRequest,
+			want:        &messages.RequestMsg{PieceIndex: 4, BlockOffset: 32768, BlockLength: 16384},
+		},
+		{
+			name:        "piece",
+			send:        func(wp *WireProtocol) error { return wp.SendPiece(4, 32768, []byte("block")) },
+			messageType: MsgTypePiece,
+			want:        &messages.PieceMsg{PieceIndex: 4, BlockOffset: 32768, BlockData: []byte("block")},
+		},
+		{
+			name:        "cancel",
+			send:        func(wp *WireProtocol) error { return wp.SendCancel(block) },
+			messageType: MsgTypeCancel,
+			want:        &messages.CancelMsg{PieceIndex: 4, BlockOffset: 32768, BlockLength: 16384},
+		},
+		{
+			name:        "unchoke",
+			send:        func(wp *WireProtocol) error { return wp.SendUnchoke() },
+			messageType: MsgTypeUnchoke,
+			want:        &messages.UnchokeMsg{},
+		},
+	}
+
+	for _, framing := range []string{FramingBitTorrent, FramingNERD} {
+		for _, tt := range tests {
+			t.Run(framing+"/"+tt.name, func(t *testing.T) {
+				sender, receiver := wirePair(t, framing)
+				msg, err := receiveWire(t, receiver, func() error { return tt.send(sender) })
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msg.MessageId != tt.messageType {
+					t.Fatalf("message type = %d, want %d", msg.MessageId, tt.messageType)
+				}
+				decode := func(payload []byte) (proto.Message, error) {
+					m := tt.want.ProtoReflect().New().Interface()
+					return m, proto.Unmarshal(payload, m)
+				}
+				got, err := receiver.DecodePayload(msg, decode)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !proto.Equal(got, tt.want) {
+					t.Errorf("decoded %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestWireRawMessages(t *testing.T) {
+	req := hashRequest{Root: [32]byte{1}, Index: 4, Length: 4, ProofLayers: 3}
+
+	tests := []struct {
+		name        string
+		send        func(wp *WireProtocol) error
+		messageType uint32
+		payload     []byte
+	}{
+		{"have all", func(wp *WireProtocol) error { return wp.SendHaveAll() }, MsgTypeHaveAll, nil},
+		{"suggest", func(wp *WireProtocol) error { return wp.SendSuggest(9) }, MsgTypeSuggest, []byte{0, 0, 0, 9}},
+		{
+			"reject",
+			func(wp *WireProtocol) error { return wp.SendReject(blockRequest{Piece: 1, Offset: 2, Length: 3}) },
+			MsgTypeReject,
+			[]byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3},
+		},
+		{"hash request", func(wp *WireProtocol) error { return wp.SendHashRequest(req) }, MsgTypeHashRequest, req.encode()},
+		{
+			"extended",
+			func(wp *WireProtocol) error { return wp.SendExtended(3, []byte("d1:ai1ee")) },
+			MsgTypeExtended,
+			[]byte("\x03d1:ai1ee"),
+		},
+	}
+
+	for _, framing := range []string{FramingBitTorrent, FramingNERD} {
+		for _, tt := range tests {
+			t.Run(framing+"/"+tt.name, func(t *testing.T) {
+				sender, receiver := wirePair(t, framing)
+				msg, err := receiveWire(t, receiver, func() error { return tt.send(sender) })
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msg.MessageId != tt.messageType || !bytes.Equal(msg.Payload, tt.payload) {
+					t.Errorf("got type %d payload %x, want type %d payload %x", msg.MessageId, msg.Payload, tt.messageType, tt.payload)
+				}
+			})
+		}
+	}
+}
+
+func TestWireBitTorrentFrame(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	wp := NewWireProtocol(a, DefaultWireLimits(), nil)
+
+	go wp.SendRequest(blockRequest{Piece: 1, Offset: 16384, Length: 16384})
+	frame := make([]byte, 17)
+	if _, err := io.ReadFull(b, frame); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0, 0, 0, 13, MsgTypeRequest, 0, 0, 0, 1, 0, 0, 0x40, 0, 0, 0, 0x40, 0}
+	if !bytes.Equal(frame, want) {
+		t.Errorf("request frame = %x, want %x", frame, want)
+	}
+
+	go wp.SendKeepAlive()
+	keepAlive := make([]byte, 4)
+	if _, err := io.ReadFull(b, keepAlive); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keepAlive, []byte{0, 0, 0, 0}) {
+		t.Errorf("keep-alive frame = %x, want 00000000", keepAlive)
+	}
+}
+
+func TestWireNERDExtension(t *testing.T) {
+	sender, receiver := wirePair(t, FramingBitTorrent)
+	payment := &messages.PaymentRequestMsg{AmountSatoshis: 500, PieceIndex: 3}
+
+	// Without the peer advertising NERD messages there is nothing to send
+	if err := sender.SendMessage(MsgTypePaymentRequest, payment); !errors.Is(err, ErrNERDUnsupported) {
+		t.Fatalf("SendMessage error = %v, want ErrNERDUnsupported", err)
+	}
+
+	sender.SetNERDExtensionID(extendedIDNERD)
+	msg, err := receiveWire(t, receiver, func() error { return sender.SendMessage(MsgTypePaymentRequest, payment) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MessageId != MsgTypePaymentRequest {
+		t.Fatalf("message type = %d, want %d", msg.MessageId, MsgTypePaymentRequest)
+	}
+	got := &messages.PaymentRequestMsg{}
+	if err := proto.Unmarshal(msg.Payload, got); err != nil || !proto.Equal(got, payment) {
+		t.Errorf("payload = %v, %v; want %v", got, err, payment)
+	}
+}
+
+func TestWireReceiveLimits(t *testing.T) {
+	frame := func(length uint32, body ...byte) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, length), body...)
+	}
+	nerdWrapped := func(messageType uint32) []byte {
+		ext := append([]byte{extendedIDNERD}, binary.BigEndian.AppendUint32(nil, messageType)...)
+		return frame(uint32(1+len(ext)), append([]byte{MsgTypeExtended}, ext...)...)
+	}
+
+	tests := []struct {
+		name    string
+		frame   []byte
+		wantErr bool
+	}{
+		{name: "keep-alive", frame: frame(0)},
+		{name: "choke", frame: frame(1, MsgTypeChoke)},
+		{name: "oversized frame", frame: frame(2 << 20), wantErr: true},
+		{name: "oversized payload", frame: frame(18, append([]byte{MsgTypeHave}, make([]byte, 17)...)...), wantErr: true},
+		{name: "truncated NERD extension", frame: frame(4, MsgTypeExtended, extendedIDNERD, 0, 0), wantErr: true},
+		{name: "standard type in NERD extension", frame: nerdWrapped(MsgTypePiece), wantErr: true},
+		{name: "NERD extension", frame: nerdWrapped(MsgTypeTokenBalance)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			wp := NewWireProtocol(b, DefaultWireLimits(), nil)
+
+			go a.Write(tt.frame)
+			_, err := wp.ReceiveMessage()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ReceiveMessage error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
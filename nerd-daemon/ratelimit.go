@@ -0,0 +1,497 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limiting parameters
+const (
+	RateScheduleInterval = 30 * time.Second       // How often the schedule is checked for a window starting or ending
+	rateRecheckInterval  = 250 * time.Millisecond // Waits longer than this are checked for a limit change
+)
+
+// RateLimits caps transfer rates in bytes per second; zero means unlimited
+type RateLimits struct {
+	Upload   int64 `json:"upload_rate"`
+	Download int64 `json:"download_rate"`
+}
+
+// TokenBucket limits a byte stream to a rate. Transfers reserve their bytes up
+// front and the bucket may go into debt; the caller then waits until the debt
+// is paid off, so concurrent transfers are served in the order they reserved.
+type TokenBucket struct {
+	rate       int64 // Bytes per second, 0 for unlimited
+	tokens     float64
+	last       time.Time
+	generation uint64 // Bumped when the rate changes, releasing pending waits
+	mu         sync.Mutex
+}
+
+// NewTokenBucket creates a bucket for rate bytes per second (0 for unlimited)
+func NewTokenBucket(rate int64) *TokenBucket {
+	b := &TokenBucket{}
+	b.SetRate(rate)
+	return b
+}
+
+// burst is the most the bucket holds. It is at least one block, so a single
+// request never waits longer than it takes to earn its own bytes.
+func (b *TokenBucket) burst() float64 {
+	return float64(max(b.rate, MaxBlockLength))
+}
+
+// SetRate changes the rate. Debt built up under the old rate is forgiven, so
+// raising or lifting a limit takes effect at once.
+func (b *TokenBucket) SetRate(rate int64) {
+	if rate < 0 {
+		rate = 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rate == b.rate && b.generation > 0 {
+		return
+	}
+	b.rate = rate
+	b.tokens = b.burst()
+	b.last = time.Now()
+	b.generation++
+}
+
+// Rate returns the bucket's rate in bytes per second, 0 if unlimited
+func (b *TokenBucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller must
+// wait before sending or accepting them, along with the bucket's generation
+func (b *TokenBucket) reserve(n int) (time.Duration, uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate == 0 {
+		return 0, b.generation
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if burst := b.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0, b.generation
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second)), b.generation
+}
+
+// changedSince reports whether the rate changed after generation was returned by reserve
+func (b *TokenBucket) changedSince(generation uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.generation != generation
+}
+
+// RateLimiter holds the upload and download buckets of one level: the session,
+// a torrent or a peer
+type RateLimiter struct {
+	upload   *TokenBucket
+	download *TokenBucket
+}
+
+// NewRateLimiter creates a limiter with the given limits
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	return &RateLimiter{
+		upload:   NewTokenBucket(limits.Upload),
+		download: NewTokenBucket(limits.Download),
+	}
+}
+
+// Set changes both limits
+func (rl *RateLimiter) Set(limits RateLimits) {
+	rl.upload.SetRate(limits.Upload)
+	rl.download.SetRate(limits.Download)
+}
+
+// Limits returns the current limits
+func (rl *RateLimiter) Limits() RateLimits {
+	return RateLimits{Upload: rl.upload.Rate(), Download: rl.download.Rate()}
+}
+
+// waitBandwidth reserves n bytes in every bucket and waits until all of them
+// allow the transfer. It returns false if stop is closed first. A limit change
+// on any of the buckets ends the wait early.
+func waitBandwidth(stop <-chan struct{}, n int, buckets ...*TokenBucket) bool {
+	var wait time.Duration
+	generations := make([]uint64, len(buckets))
+	for i, b := range buckets {
+		var d time.Duration
+		d, generations[i] = b.reserve(n)
+		if d > wait {
+			wait = d
+		}
+	}
+	if wait == 0 {
+		return true
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return true
+		}
+		if remaining > rateRecheckInterval {
+			remaining = rateRecheckInterval
+		}
+
+		timer := time.NewTimer(remaining)
+		select {
+		case <-stop:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+
+		for i, b := range buckets {
+			if b.changedSince(generations[i]) {
+				return true
+			}
+		}
+	}
+}
+
+// ParseRate parses a rate in bytes per second such as "512K", "2M" or
+// "1.5MB/s" (binary units). "0", "" and "unlimited" mean no limit.
+func ParseRate(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	if s == "" || s == "UNLIMITED" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(s, "/S")
+	s = strings.TrimSuffix(s, "B")
+
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid rate %q", value)
+	}
+	return int64(number * multiplier), nil
+}
+
+// FormatRate renders a rate for display
+func FormatRate(rate int64) string {
+	switch {
+	case rate <= 0:
+		return "unlimited"
+	case rate >= 1<<20:
+		return fmt.Sprintf("%.1f MiB/s", float64(rate)/(1<<20))
+	case rate >= 1<<10:
+		return fmt.Sprintf("%.1f KiB/s", float64(rate)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B/s", rate)
+	}
+}
+
+// RateSchedule replaces the global limits during a daily time window, written
+// as "<limits> HH:MM-HH:MM" where limits is "unlimited", a single rate for
+// both directions or "<upload>/<download>": "unlimited 01:00-07:00",
+// "256K/2M 09:00-17:00". Windows may wrap past midnight.
+type RateSchedule struct {
+	Start  int // Minutes after midnight, local time
+	End    int
+	Limits RateLimits
+}
+
+// ParseRateSchedule parses a schedule window
+func ParseRateSchedule(value string) (RateSchedule, error) {
+	var schedule RateSchedule
+
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return schedule, fmt.Errorf("invalid rate schedule %q, want \"<limits> HH:MM-HH:MM\"", value)
+	}
+
+	up, down, found := strings.Cut(fields[0], "/")
+	if !found {
+		down = up
+	}
+	var err error
+	if schedule.Limits.Upload, err = ParseRate(up); err != nil {
+		return schedule, err
+	}
+	if schedule.Limits.Download, err = ParseRate(down); err != nil {
+		return schedule, err
+	}
+
+	window := strings.ReplaceAll(fields[1], "–", "-") // Accept an en dash
+	start, end, found := strings.Cut(window, "-")
+	if !found {
+		return schedule, fmt.Errorf("invalid rate schedule window %q", fields[1])
+	}
+	if schedule.Start, err = parseClock(start); err != nil {
+		return schedule, err
+	}
+	if schedule.End, err = parseClock(end); err != nil {
+		return schedule, err
+	}
+	if schedule.Start == schedule.End {
+		return schedule, fmt.Errorf("rate schedule window %q is empty", fields[1])
+	}
+	return schedule, nil
+}
+
+// parseClock parses HH:MM into minutes after midnight
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether the window covers the time of day of now
+func (rs RateSchedule) Contains(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	if rs.Start < rs.End {
+		return minute >= rs.Start && minute < rs.End
+	}
+	return minute >= rs.Start || minute < rs.End // Wraps past midnight
+}
+
+// String renders the window in the form ParseRateSchedule accepts
+func (rs RateSchedule) String() string {
+	limits := formatScheduleRate(rs.Limits.Upload)
+	if rs.Limits.Download != rs.Limits.Upload {
+		limits += "/" + formatScheduleRate(rs.Limits.Download)
+	}
+	return fmt.Sprintf("%s %02d:%02d-%02d:%02d", limits, rs.Start/60, rs.Start%60, rs.End/60, rs.End%60)
+}
+
+// formatScheduleRate renders a rate so that ParseRate reads it back exactly
+func formatScheduleRate(rate int64) string {
+	switch {
+	case rate == 0:
+		return "unlimited"
+	case rate%(1<<20) == 0:
+		return fmt.Sprintf("%dM", rate>>20)
+	case rate%(1<<10) == 0:
+		return fmt.Sprintf("%dK", rate>>10)
+	default:
+		return strconv.FormatInt(rate, 10)
+	}
+}
+
+// RateLimitStatus is the session's rate limit configuration for the control API
+type RateLimitStatus struct {
+	Global   RateLimits `json:"global"`   // Configured global limits
+	Peer     RateLimits `json:"peer"`     // Limits applied to each connection
+	Schedule []string   `json:"schedule"` // Windows replacing the global limits
+	Active   string     `json:"active_schedule,omitempty"`
+	Current  RateLimits `json:"current"`           // Global limits in force now, after the schedule
+	Local    bool       `json:"limit_local_peers"` // LAN peers are limited too
+}
+
+// SetRateLimits changes the global limits and the limits applied to each
+// connection, including those already connected. During a schedule window the
+// new global limits take effect once the window ends.
+func (s *Session) SetRateLimits(global, peer RateLimits) {
+	s.mu.Lock()
+	s.rateConfig = global
+	s.peerRates = peer
+	s.mu.Unlock()
+
+	s.applyRateSchedule(time.Now())
+	for _, torrent := range s.Torrents() {
+		for _, pc := range torrent.connectedPeers() {
+			pc.rates.Set(peer)
+		}
+	}
+}
+
+// SetRateSchedule replaces the windows during which other global limits apply
+func (s *Session) SetRateSchedule(schedule []RateSchedule) {
+	s.mu.Lock()
+	s.schedule = schedule
+	s.mu.Unlock()
+
+	s.applyRateSchedule(time.Now())
+}
+
+// RateLimitStatus returns the configured limits and those in force now
+func (s *Session) RateLimitStatus() RateLimitStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status := RateLimitStatus{
+		Global:   s.rateConfig,
+		Peer:     s.peerRates,
+		Schedule: []string{},
+		Current:  s.rates.Limits(),
+		Local:    s.limitLocal,
+	}
+	if window, ok := s.activeSchedule(time.Now()); ok {
+		status.Active = window.String()
+	}
+	for _, window := range s.schedule {
+		status.Schedule = append(status.Schedule, window.String())
+	}
+	return status
+}
+
+// SetLimitLocalPeers decides whether LAN peers found by Local Service
+// Discovery are held to the limits; by default they are not
+func (s *Session) SetLimitLocalPeers(limit bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limitLocal = limit
+}
+
+// limitsPeer reports whether the limits apply to a connection
+func (s *Session) limitsPeer(pc *PeerConn) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !pc.local || s.limitLocal
+}
+
+// PeerRateLimits returns the limits applied to each new connection
+func (s *Session) PeerRateLimits() RateLimits {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.peerRates
+}
+
+// activeSchedule returns the first schedule window covering now. The caller holds s.mu.
+func (s *Session) activeSchedule(now time.Time) (RateSchedule, bool) {
+	for _, window := range s.schedule {
+		if window.Contains(now) {
+			return window, true
+		}
+	}
+	return RateSchedule{}, false
+}
+
+// applyRateSchedule sets the global buckets to the limits in force at now
+func (s *Session) applyRateSchedule(now time.Time) {
+	s.mu.RLock()
+	limits := s.rateConfig
+	window, scheduled := s.activeSchedule(now)
+	s.mu.RUnlock()
+	if scheduled {
+		limits = window.Limits
+	}
+
+	if limits == s.rates.Limits() {
+		return
+	}
+	s.rates.Set(limits)
+	if scheduled {
+		log.Printf("[Session] Rate schedule %s in force: upload %s, download %s",
+			window, FormatRate(limits.Upload), FormatRate(limits.Download))
+	} else {
+		log.Printf("[Session] Global rate limits: upload %s, download %s",
+			FormatRate(limits.Upload), FormatRate(limits.Download))
+	}
+}
+
+// rateScheduleLoop applies the rate schedule every RateScheduleInterval until the session stops
+func (s *Session) rateScheduleLoop() {
+	ticker := time.NewTicker(RateScheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.applyRateSchedule(now)
+		}
+	}
+}
+
+// SetTorrentRateLimits changes a torrent's limits and records them for the
+// next start if the torrent is registered
+func (s *Session) SetTorrentRateLimits(infoHash [20]byte, limits RateLimits) error {
+	s.mu.Lock()
+	torrent, exists := s.torrents[infoHash]
+	record, registered := s.records[infoHash]
+	if registered {
+		record.RateLimits = &limits
+		s.records[infoHash] = record
+	}
+	s.mu.Unlock()
+
+	if !exists && !registered {
+		return fmt.Errorf("torrent %x is not in the session", infoHash)
+	}
+	if exists {
+		torrent.rates.Set(limits)
+		log.Printf("[Session] %s rate limits: upload %s, download %s",
+			torrent.Name(), FormatRate(limits.Upload), FormatRate(limits.Download))
+	}
+	if registered {
+		if err := s.saveRegistry(); err != nil {
+			log.Printf("[Session] Warning: failed to save torrent registry: %v", err)
+		}
+	}
+	return nil
+}
+
+// waitUpload holds back an upload of n bytes until the peer, torrent and
+// global limits allow it. It returns false if the connection closes first.
+func (pc *PeerConn) waitUpload(n int) bool {
+	if !pc.session.limitsPeer(pc) {
+		return true
+	}
+	return waitBandwidth(pc.closed, n, pc.rates.upload, pc.torrent.rates.upload, pc.session.rates.upload)
+}
+
+// waitDownload holds back reading from the peer after n bytes of block data
+// until the peer, torrent and global limits allow it; the peer's sends stall
+// behind the unread data. It returns false if the connection closes first.
+func (pc *PeerConn) waitDownload(n int) bool {
+	if !pc.session.limitsPeer(pc) {
+		return true
+	}
+	return waitBandwidth(pc.closed, n, pc.rates.download, pc.torrent.rates.download, pc.session.rates.download)
+}
+
+// TorrentRateLimits returns a torrent's limits, or those recorded for it when
+// it is registered but not loaded
+func (s *Session) TorrentRateLimits(infoHash [20]byte) (RateLimits, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if torrent, exists := s.torrents[infoHash]; exists {
+		return torrent.rates.Limits(), true
+	}
+	record, registered := s.records[infoHash]
+	if !registered {
+		return RateLimits{}, false
+	}
+	if record.RateLimits == nil {
+		return RateLimits{}, true
+	}
+	return *record.RateLimits, true
+}
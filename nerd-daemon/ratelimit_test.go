@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "unlimited", want: 0},
+		{value: "Unlimited", want: 0},
+		{value: "0", want: 0},
+		{value: "512", want: 512},
+		{value: "512B", want: 512},
+		{value: "100K", want: 100 << 10},
+		{value: "100k", want: 100 << 10},
+		{value: "100KB/s", want: 100 << 10},
+		{value: "1.5M", want: 3 << 19},
+		{value: "2MB/s", want: 2 << 20},
+		{value: "1G", want: 1 << 30},
+		{value: " 64K ", want: 64 << 10},
+		{value: "-1K", wantErr: true},
+		{value: "fast", wantErr: true},
+		{value: "K", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRate(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRate(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseRateSchedule(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    RateSchedule
+		wantErr bool
+	}{
+		{
+			value: "unlimited 01:00-07:00",
+			want:  RateSchedule{Start: 60, End: 420},
+		},
+		{
+			value: "256K/2M 09:00-17:30",
+			want:  RateSchedule{Start: 540, End: 1050, Limits: RateLimits{Upload: 256 << 10, Download: 2 << 20}},
+		},
+		{
+			value: "1M 22:00-06:00",
+			want:  RateSchedule{Start: 1320, End: 360, Limits: RateLimits{Upload: 1 << 20, Download: 1 << 20}},
+		},
+		{
+			value: "100K 08:00–09:00", // En dash
+			want:  RateSchedule{Start: 480, End: 540, Limits: RateLimits{Upload: 100 << 10, Download: 100 << 10}},
+		},
+		{value: "1M", wantErr: true},
+		{value: "1M 08:00", wantErr: true},
+		{value: "1M 08:00-08:00", wantErr: true},
+		{value: "1M 25:00-08:00", wantErr: true},
+		{value: "fast 08:00-09:00", wantErr: true},
+		{value: "1M/slow 08:00-09:00", wantErr: true},
+		{value: "1M 08:00-09:00 extra", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRateSchedule(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRateSchedule(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRateSchedule(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+
+		// String renders a schedule that parses back to the same window
+		again, err := ParseRateSchedule(got.String())
+		if err != nil || again != got {
+			t.Errorf("ParseRateSchedule(%q) = %+v, %v; want %+v", got.String(), again, err, got)
+		}
+	}
+}
+
+func TestRateScheduleContains(t *testing.T) {
+	day := RateSchedule{Start: 9 * 60, End: 17 * 60}
+	night := RateSchedule{Start: 22 * 60, End: 6 * 60}
+
+	tests := []struct {
+		schedule RateSchedule
+		clock    string
+		want     bool
+	}{
+		{day, "08:59", false},
+		{day, "09:00", true},
+		{day, "16:59", true},
+		{day, "17:00", false},
+		{night, "21:59", false},
+		{night, "22:00", true},
+		{night, "00:00", true},
+		{night, "05:59", true},
+		{night, "06:00", false},
+		{night, "12:00", false},
+	}
+
+	for _, tt := range tests {
+		now, err := time.ParseInLocation("15:04", tt.clock, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tt.schedule.Contains(now); got != tt.want {
+			t.Errorf("%s.Contains(%s) = %v, want %v", tt.schedule, tt.clock, got, tt.want)
+		}
+	}
+}
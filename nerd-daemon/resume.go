@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ResumeInterval is how often changed resume data is written while the daemon runs
+const ResumeInterval = time.Minute
+
+// maxTorrentPayments bounds the payment proofs kept per torrent, on top of the
+// per-peer limit and retention period of the payment system
+const maxTorrentPayments = 1000
+
+// resumeData is the saved state of a torrent, so a restart does not need to
+// hash every piece again. The bitfield is trusted for files whose size and
+// modification time still match.
+type resumeData struct {
+	InfoHash   string         `json:"info_hash"`
+	Pieces     int            `json:"pieces"`
+	Bitfield   []byte         `json:"bitfield"` // Verified pieces
+	Files      []resumeFile   `json:"files"`
+	Uploaded   int64          `json:"uploaded"`
+	Downloaded int64          `json:"downloaded"`
+	Payments   []PiecePayment `json:"payments,omitempty"`
+	SavedAt    time.Time      `json:"saved_at"`
+}
+
+// resumeFile records a file as it was on disk when resume data was saved
+type resumeFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"` // -1 if the file did not exist
+	ModTime time.Time `json:"mtime"`
+}
+
+// PiecePayment is a payment proof a peer sent for a piece of the torrent
+type PiecePayment struct {
+	Piece      uint32    `json:"piece"`
+	Peer       string    `json:"peer"` // Proven identity or address of the payer
+	TxID       string    `json:"txid"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// RecordPayment adds a verified payment proof for a piece to the torrent's
+// resume state. Proofs for pieces the torrent does not have are ignored.
+func (t *Torrent) RecordPayment(piece uint32, peer, txID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.Info == nil || int64(piece) >= int64(t.Info.NumPieces()) {
+		return
+	}
+	for _, payment := range t.payments {
+		if payment.TxID == txID && payment.Piece == piece {
+			return
+		}
+	}
+	payments := append(t.payments, PiecePayment{Piece: piece, Peer: peer, TxID: txID, ReceivedAt: time.Now()})
+	t.payments = prunePayments(payments, t.Info.NumPieces())
+	t.resumeDirty = true
+}
+
+// prunePayments drops payment proofs that are expired or name a piece past
+// numPieces, then keeps the newest maxReceivedPaymentsPerPeer of each peer and
+// the newest maxTorrentPayments overall, oldest first
+func prunePayments(payments []PiecePayment, numPieces int) []PiecePayment {
+	var kept []PiecePayment
+	for _, payment := range payments {
+		if int64(payment.Piece) < int64(numPieces) && time.Since(payment.ReceivedAt) < receivedPaymentRetention {
+			kept = append(kept, payment)
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].ReceivedAt.Before(kept[j].ReceivedAt) })
+
+	perPeer := make(map[string]int)
+	var pruned []PiecePayment
+	for i := len(kept) - 1; i >= 0; i-- {
+		if perPeer[kept[i].Peer] < maxReceivedPaymentsPerPeer && len(kept)-i <= maxTorrentPayments {
+			perPeer[kept[i].Peer]++
+			pruned = append(pruned, kept[i])
+		}
+	}
+	// pruned holds the kept proofs newest first; put them back in order
+	for i, j := 0, len(pruned)-1; i < j; i, j = i+1, j-1 {
+		pruned[i], pruned[j] = pruned[j], pruned[i]
+	}
+	return pruned
+}
+
+// Payments returns the payment proofs received for the torrent's pieces
+func (t *Torrent) Payments() []PiecePayment {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]PiecePayment(nil), t.payments...)
+}
+
+// snapshotResume captures the torrent's resume data. The bitfield is taken
+// before the files are examined, so every piece it lists was written before
+// the recorded modification times.
+func (t *Torrent) snapshotResume() (*resumeData, error) {
+	t.mu.Lock()
+	if t.Info == nil {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("torrent %x has no info", t.InfoHash)
+	}
+	rd := &resumeData{
+		InfoHash:   hex.EncodeToString(t.InfoHash[:]),
+		Pieces:     t.Info.NumPieces(),
+		Bitfield:   append([]byte(nil), t.bitfield...),
+		Uploaded:   t.uploaded,
+		Downloaded: t.downloaded,
+		Payments:   append([]PiecePayment(nil), t.payments...),
+		SavedAt:    time.Now(),
+	}
+	t.resumeDirty = false
+	t.mu.Unlock()
+
+	rd.Files = t.storage.fileStates()
+	return rd, nil
+}
+
+// applyResume restores saved state after a quick consistency check. Pieces of
+// files that changed since the state was saved are hashed again. It reports
+// false if the data does not belong to this torrent, leaving it untouched.
+func (t *Torrent) applyResume(rd *resumeData) bool {
+	numPieces := t.NumPieces()
+	if rd.InfoHash != hex.EncodeToString(t.InfoHash[:]) || rd.Pieces != numPieces ||
+		!Bitfield(rd.Bitfield).validFor(numPieces) || len(rd.Files) != len(t.storage.files) {
+		return false
+	}
+
+	var recheck []int
+	current := t.storage.fileStates()
+	for i, fi := range t.storage.files {
+		if current[i].matches(rd.Files[i]) || fi.Length == 0 {
+			continue
+		}
+		first := int(fi.TorrentOffset / t.Info.PieceLength)
+		last := int((fi.TorrentOffset + fi.Length - 1) / t.Info.PieceLength)
+		for piece := first; piece <= last && piece < numPieces; piece++ {
+			recheck = append(recheck, piece)
+		}
+	}
+
+	t.mu.Lock()
+	t.bitfield = append(Bitfield(nil), rd.Bitfield...)
+	for _, piece := range recheck {
+		t.bitfield.Clear(piece)
+	}
+	t.uploaded = rd.Uploaded
+	t.downloaded = rd.Downloaded
+	t.payments = prunePayments(append([]PiecePayment(nil), rd.Payments...), numPieces)
+	t.mu.Unlock()
+
+	verified := 0
+	for _, piece := range recheck {
+		if t.checkPiece(piece) {
+			verified++
+		}
+	}
+	log.Printf("[Torrent] %s: resumed with %d/%d pieces (%d rechecked, %d verified)",
+		t.Name(), t.Bitfield().Count(), numPieces, len(recheck), verified)
+	return true
+}
+
+// matches reports whether a file is unchanged
+func (f resumeFile) matches(saved resumeFile) bool {
+	return f.Path == saved.Path && f.Size == saved.Size && f.ModTime.Equal(saved.ModTime)
+}
+
+// fileStates records the size and modification time of each file on disk
+func (fs *FileStorage) fileStates() []resumeFile {
+	states := make([]resumeFile, len(fs.files))
+	for i, fi := range fs.files {
+		path := fs.filePath(fi)
+		states[i] = resumeFile{Path: path, Size: -1}
+		if stat, err := os.Stat(path); err == nil {
+			states[i].Size = stat.Size()
+			states[i].ModTime = stat.ModTime().UTC()
+		}
+	}
+	return states
+}
+
+// resumeDir is where resume data is kept
+func (s *Session) resumeDir() string {
+	return filepath.Join(s.dataDir, "resume")
+}
+
+// resumePath is the resume file of a torrent
+func (s *Session) resumePath(infoHash [20]byte) string {
+	return filepath.Join(s.resumeDir(), hex.EncodeToString(infoHash[:])+".json")
+}
+
+// restoreTorrent loads a torrent's resume data, or hashes its data on disk
+// when there is none or it does not match
+func (s *Session) restoreTorrent(torrent *Torrent) error {
+	data, err := os.ReadFile(s.resumePath(torrent.InfoHash))
+	if err == nil {
+		var rd resumeData
+		if err := json.Unmarshal(data, &rd); err == nil && torrent.applyResume(&rd) {
+			s.restorePayments(torrent.Payments())
+			return nil
+		}
+		log.Printf("[Session] Ignoring invalid resume data for %s", torrent.Name())
+	}
+
+	if _, err := torrent.Recheck(); err != nil {
+		return err
+	}
+	torrent.mu.Lock()
+	torrent.resumeDirty = true
+	torrent.mu.Unlock()
+	return nil
+}
+
+// restorePayments hands saved payment proofs back to the payment system, so
+// peers that paid recently keep their reserved upload slots
+func (s *Session) restorePayments(payments []PiecePayment) {
+	if s.bsvSystem == nil {
+		return
+	}
+	sort.Slice(payments, func(i, j int) bool { return payments[i].ReceivedAt.Before(payments[j].ReceivedAt) })
+	for _, payment := range payments {
+		s.bsvSystem.RestorePaymentProof(payment.Peer, ReceivedPayment{
+			TxID:       payment.TxID,
+			PieceIndex: payment.Piece,
+			ReceivedAt: payment.ReceivedAt,
+		})
+	}
+}
+
+// saveResume writes a torrent's resume data
+func (s *Session) saveResume(torrent *Torrent) error {
+	rd, err := torrent.snapshotResume()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(rd, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.resumeDir(), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated resume file
+	path := s.resumePath(torrent.InfoHash)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// SaveResumeData writes the resume data of every torrent whose state changed
+// since it was last saved; all forces a write of every torrent with info
+func (s *Session) SaveResumeData(all bool) {
+	for _, torrent := range s.Torrents() {
+		torrent.mu.RLock()
+		due := torrent.Info != nil && (all || torrent.resumeDirty)
+		torrent.mu.RUnlock()
+		if !due {
+			continue
+		}
+		if err := s.saveResume(torrent); err != nil {
+			log.Printf("[Session] Warning: failed to save resume data for %s: %v", torrent.Name(), err)
+		}
+	}
+}
+
+// resumeLoop saves changed resume data every ResumeInterval until the session stops
+func (s *Session) resumeLoop() {
+	ticker := time.NewTicker(ResumeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.SaveResumeData(false)
+		}
+	}
+}
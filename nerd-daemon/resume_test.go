@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestTorrent hashes a single file of size bytes in a temporary directory
+// and returns the seeded torrent
+func newTestTorrent(t *testing.T, size int, pieceLength int64) *Torrent {
+	t.Helper()
+	dir := t.TempDir()
+	data := make([]byte, size)
+	rand.Read(data)
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mi, _, err := CreateTorrent(CreateTorrentOptions{SourcePath: path, PieceLength: pieceLength})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := NewTorrent(sha1.Sum(mi.InfoBytes), mi.InfoBytes, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := torrent.Recheck(); err != nil || n != torrent.NumPieces() {
+		t.Fatalf("Recheck = %d, %v; want %d pieces", n, err, torrent.NumPieces())
+	}
+	return torrent
+}
+
+func TestApplyResume(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(rd *resumeData)
+		want   bool
+	}{
+		{name: "unchanged", modify: func(rd *resumeData) {}, want: true},
+		{name: "other torrent", modify: func(rd *resumeData) { rd.InfoHash = "00" + rd.InfoHash[2:] }},
+		{name: "piece count", modify: func(rd *resumeData) { rd.Pieces++ }},
+		{name: "short bitfield", modify: func(rd *resumeData) { rd.Bitfield = rd.Bitfield[:1] }},
+		{name: "long bitfield", modify: func(rd *resumeData) { rd.Bitfield = append(rd.Bitfield, 0xFF) }},
+		{name: "spare bits set", modify: func(rd *resumeData) { rd.Bitfield[len(rd.Bitfield)-1] |= 1 }},
+		{name: "file count", modify: func(rd *resumeData) { rd.Files = append(rd.Files, rd.Files[0]) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 10 pieces leave spare bits in the last byte of the bitfield
+			seed := newTestTorrent(t, 10*16384, 16384)
+			rd, err := seed.snapshotResume()
+			if err != nil {
+				t.Fatal(err)
+			}
+			rd.Uploaded = 1234
+			tt.modify(rd)
+
+			torrent, err := NewTorrent(seed.InfoHash, seed.InfoBytes(), seed.dataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := torrent.applyResume(rd); got != tt.want {
+				t.Fatalf("applyResume = %v, want %v", got, tt.want)
+			}
+			wantPieces, wantUploaded := 0, int64(0)
+			if tt.want {
+				wantPieces, wantUploaded = torrent.NumPieces(), 1234
+			}
+			if got := torrent.Bitfield().Count(); got != wantPieces {
+				t.Errorf("resumed with %d pieces, want %d", got, wantPieces)
+			}
+			if torrent.uploaded != wantUploaded {
+				t.Errorf("uploaded = %d, want %d", torrent.uploaded, wantUploaded)
+			}
+		})
+	}
+}
+
+func TestApplyResumeChangedFile(t *testing.T) {
+	seed := newTestTorrent(t, 4*16384, 16384)
+	rd, err := seed.snapshotResume()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt piece 2 and move the modification time, so every piece of the
+	// file is hashed again and only the corrupt one is dropped
+	path := seed.storage.filePath(seed.storage.files[0])
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("corrupt"), 2*16384+100)
+	f.Close()
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, err := NewTorrent(seed.InfoHash, seed.InfoBytes(), seed.dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !torrent.applyResume(rd) {
+		t.Fatal("applyResume rejected data for the torrent")
+	}
+	bitfield := torrent.Bitfield()
+	for piece := 0; piece < torrent.NumPieces(); piece++ {
+		if want := piece != 2; bitfield.Has(piece) != want {
+			t.Errorf("piece %d: have = %v, want %v", piece, bitfield.Has(piece), want)
+		}
+	}
+}
+
+func TestPrunePayments(t *testing.T) {
+	now := time.Now()
+	payment := func(piece uint32, peer string, age time.Duration) PiecePayment {
+		return PiecePayment{Piece: piece, Peer: peer, TxID: strconv.Itoa(int(piece)) + peer, ReceivedAt: now.Add(-age)}
+	}
+	manyFrom := func(peer string, n int) []PiecePayment {
+		var payments []PiecePayment
+		for i := 0; i < n; i++ {
+			payments = append(payments, payment(0, peer, time.Duration(n-i)*time.Second))
+		}
+		return payments
+	}
+	var crowd []PiecePayment
+	for i := 0; i < maxTorrentPayments/maxReceivedPaymentsPerPeer+2; i++ {
+		crowd = append(crowd, manyFrom(strconv.Itoa(i), maxReceivedPaymentsPerPeer)...)
+	}
+
+	tests := []struct {
+		name      string
+		payments  []PiecePayment
+		numPieces int
+		want      int
+	}{
+		{name: "none", numPieces: 10},
+		{
+			name:      "expired and out of range dropped",
+			payments:  []PiecePayment{payment(1, "a", time.Minute), payment(10, "a", time.Minute), payment(2, "a", 25*time.Hour)},
+			numPieces: 10,
+			want:      1,
+		},
+		{
+			name:      "per peer limit",
+			payments:  append(manyFrom("a", maxReceivedPaymentsPerPeer+5), manyFrom("b", 3)...),
+			numPieces: 10,
+			want:      maxReceivedPaymentsPerPeer + 3,
+		},
+		{
+			name:      "torrent limit",
+			payments:  crowd,
+			numPieces: 10,
+			want:      maxTorrentPayments,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newest := time.Time{}
+			for _, p := range tt.payments {
+				if p.Piece < uint32(tt.numPieces) && now.Sub(p.ReceivedAt) < receivedPaymentRetention && p.ReceivedAt.After(newest) {
+					newest = p.ReceivedAt
+				}
+			}
+
+			got := prunePayments(tt.payments, tt.numPieces)
+			if len(got) != tt.want {
+				t.Fatalf("kept %d payments, want %d", len(got), tt.want)
+			}
+			perPeer := make(map[string]int)
+			for i, p := range got {
+				perPeer[p.Peer]++
+				if i > 0 && p.ReceivedAt.Before(got[i-1].ReceivedAt) {
+					t.Errorf("payment %d is out of order", i)
+				}
+			}
+			for peer, n := range perPeer {
+				if n > maxReceivedPaymentsPerPeer {
+					t.Errorf("kept %d payments from %q", n, peer)
+				}
+			}
+			if len(got) > 0 && !got[len(got)-1].ReceivedAt.Equal(newest) {
+				t.Error("newest payment was dropped")
+			}
+		})
+	}
+}
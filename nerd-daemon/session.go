@@ -0,0 +1,655 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Session holds every torrent the daemon takes part in, keyed by infohash
+type Session struct {
+	torrents   map[[20]byte]*Torrent
+	records    map[[20]byte]torrentRecord
+	dataDir    string
+	port       int // P2P port announced to the DHT for each torrent
+	dhtServer  *DHTServer
+	overlay    *DHTServer        // Private NERD overlay DHT, nil if disabled
+	bsvSystem  *BSVPaymentSystem // Payment proofs earn peers reserved upload slots
+	choker     *Choker
+	handlers   *MessageRegistry
+	limits     WireLimits      // Applied to every new connection
+	identity   *Identity       // Our peer ID, shared by every connection
+	encryption string          // Encryption policy for new connections
+	utp        *UTPSocket      // uTP transport for outgoing connections, nil if disabled
+	lsd        *LocalDiscovery // LAN announces, nil if disabled
+	rates      *RateLimiter    // Global limits shared by every connection
+	rateConfig RateLimits      // Global limits outside the schedule's windows
+	peerRates  RateLimits      // Limits applied to each connection
+	limitLocal bool            // Apply the limits to LAN peers too
+	schedule   []RateSchedule  // Windows replacing the global limits, first match wins
+	stop       chan struct{}
+	stopOnce   sync.Once
+	mu         sync.RWMutex
+}
+
+// torrentRecord is the persisted registration of a torrent so it is seeded again after a restart
+type torrentRecord struct {
+	InfoHash    string      `json:"info_hash"`
+	TorrentFile string      `json:"torrent_file"`
+	Magnet      string      `json:"magnet,omitempty"` // Set for torrents added by magnet link
+	SavePath    string      `json:"save_path"`
+	PickMode    string      `json:"pick_mode,omitempty"`   // Set when the piece picking mode was changed
+	RateLimits  *RateLimits `json:"rate_limits,omitempty"` // Set when the torrent's rate limits were changed
+}
+
+// NewSession creates an empty session storing torrent data under dataDir.
+// dhtServer and bsvSystem may be nil when those services are disabled.
+func NewSession(dataDir string, port int, dhtServer *DHTServer, bsvSystem *BSVPaymentSystem) *Session {
+	s := &Session{
+		torrents:   make(map[[20]byte]*Torrent),
+		records:    make(map[[20]byte]torrentRecord),
+		dataDir:    dataDir,
+		port:       port,
+		dhtServer:  dhtServer,
+		bsvSystem:  bsvSystem,
+		limits:     DefaultWireLimits(),
+		identity:   NewAnonymousIdentity(),
+		encryption: EncryptionPreferred,
+		rates:      NewRateLimiter(RateLimits{}),
+		stop:       make(chan struct{}),
+	}
+	s.choker = NewChoker(s)
+	s.handlers = NewMessageRegistry()
+	if err := registerPeerHandlers(s.handlers); err != nil {
+		panic(err) // The built-in IDs never conflict in a new registry
+	}
+	return s
+}
+
+// Handlers returns the registry that dispatches messages received from peers
+func (s *Session) Handlers() *MessageRegistry {
+	return s.handlers
+}
+
+// Start begins the session's background work (choking rounds, resume data,
+// the rate limit schedule)
+func (s *Session) Start() {
+	s.choker.Start()
+	go s.resumeLoop()
+	go s.rateScheduleLoop()
+}
+
+// Stop ends the session's background work and saves every torrent's resume data
+func (s *Session) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.choker.Stop()
+		s.SaveResumeData(true)
+	})
+}
+
+// SetWireLimits changes the size caps and timeouts used for new connections
+func (s *Session) SetWireLimits(limits WireLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = limits
+}
+
+// SetEncryption changes the encryption policy for new connections
+func (s *Session) SetEncryption(policy string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.encryption = policy
+}
+
+// Encryption returns the encryption policy for new connections
+func (s *Session) Encryption() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.encryption
+}
+
+// SetUTP makes outgoing connections try uTP on sock before TCP
+func (s *Session) SetUTP(sock *UTPSocket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.utp = sock
+}
+
+// SetLSD announces torrents added from now on through ld, which also decides
+// which peers are on the LAN
+func (s *Session) SetLSD(ld *LocalDiscovery) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lsd = ld
+}
+
+// SetOverlay makes the NERD overlay DHT the place for daemon discovery and
+// NERD data, leaving the mainline DHT to public torrents
+func (s *Session) SetOverlay(overlay *DHTServer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overlay = overlay
+}
+
+// nerdDHT returns the DHT that holds NERD data: the overlay when it runs,
+// otherwise mainline. It is nil when both are disabled.
+func (s *Session) nerdDHT() *DHTServer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.overlay != nil {
+		return s.overlay
+	}
+	return s.dhtServer
+}
+
+// isLANPeer reports whether the host of addr announced itself by Local Service Discovery
+func (s *Session) isLANPeer(addr string) bool {
+	s.mu.RLock()
+	ld := s.lsd
+	s.mu.RUnlock()
+
+	host, _, err := net.SplitHostPort(addr)
+	return ld != nil && err == nil && ld.IsLocalHost(host)
+}
+
+// UTP returns the session's uTP socket, or nil if uTP is disabled
+func (s *Session) UTP() *UTPSocket {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.utp
+}
+
+// newWire creates the wire protocol for a connection established with transport
+func (s *Session) newWire(conn net.Conn, transport string) *WireProtocol {
+	wire := NewWireProtocol(conn, s.WireLimits(), s.Identity())
+	wire.SetEncryption(s.Encryption(), transport)
+	return wire
+}
+
+// SetIdentity replaces the anonymous peer ID with one derived from a key
+func (s *Session) SetIdentity(identity *Identity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.identity = identity
+}
+
+// Identity returns the peer ID and key used in handshakes
+func (s *Session) Identity() *Identity {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.identity
+}
+
+// WireLimits returns the size caps and timeouts for new connections
+func (s *Session) WireLimits() WireLimits {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.limits
+}
+
+// AddTorrent registers a torrent so connections for its infohash are accepted
+func (s *Session) AddTorrent(torrent *Torrent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.torrents[torrent.InfoHash]; exists {
+		return fmt.Errorf("torrent %x is already in the session", torrent.InfoHash)
+	}
+
+	s.torrents[torrent.InfoHash] = torrent
+	torrent.corruptData = s.penalizePeer
+	torrent.layersReady = s.storePieceLayers
+	log.Printf("[Session] Added torrent %s (%x)", torrent.Name(), torrent.InfoHash)
+
+	// Let LAN peers know at once rather than at the next round of announces
+	if s.lsd != nil && !torrent.IsPrivate() {
+		go s.lsd.Announce(torrent.InfoHash)
+	}
+
+	// Let the swarm find us through the DHT
+	if s.dhtServer != nil {
+		go func() {
+			if err := s.dhtServer.AnnouncePeer(torrent.InfoHash, s.port); err != nil {
+				log.Printf("[Session] Failed to announce %x to DHT: %v", torrent.InfoHash, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// GetTorrent looks up a torrent by infohash
+func (s *Session) GetTorrent(infoHash [20]byte) (*Torrent, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	torrent, exists := s.torrents[infoHash]
+	return torrent, exists
+}
+
+// RemoveTorrent drops a torrent from the session and disconnects its peers
+func (s *Session) RemoveTorrent(infoHash [20]byte) error {
+	s.mu.Lock()
+	torrent, exists := s.torrents[infoHash]
+	delete(s.torrents, infoHash)
+	_, registered := s.records[infoHash]
+	delete(s.records, infoHash)
+	s.mu.Unlock()
+
+	if !exists {
+		return fmt.Errorf("torrent %x is not in the session", infoHash)
+	}
+	if err := os.Remove(s.resumePath(infoHash)); err != nil && !os.IsNotExist(err) {
+		log.Printf("[Session] Warning: failed to remove resume data: %v", err)
+	}
+	if registered {
+		if err := s.saveRegistry(); err != nil {
+			log.Printf("[Session] Warning: failed to save torrent registry: %v", err)
+		}
+	}
+
+	for _, pc := range torrent.connectedPeers() {
+		pc.wire.conn.Close()
+	}
+
+	log.Printf("[Session] Removed torrent %s (%x)", torrent.Name(), infoHash)
+	return nil
+}
+
+// Torrents returns a snapshot of all torrents in the session
+func (s *Session) Torrents() []*Torrent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	torrents := make([]*Torrent, 0, len(s.torrents))
+	for _, torrent := range s.torrents {
+		torrents = append(torrents, torrent)
+	}
+	return torrents
+}
+
+// GetStats returns session statistics
+func (s *Session) GetStats() map[string]interface{} {
+	stats := make(map[string]interface{})
+
+	var peers, complete, unchoked, interested int
+	torrents := s.Torrents()
+	for _, torrent := range torrents {
+		for _, pc := range torrent.connectedPeers() {
+			peers++
+			if !pc.state.AmChoking() {
+				unchoked++
+			}
+			if pc.state.PeerInterested() {
+				interested++
+			}
+		}
+		if torrent.IsComplete() {
+			complete++
+		}
+	}
+
+	stats["torrents"] = len(torrents)
+	stats["complete_torrents"] = complete
+	stats["connected_peers"] = peers
+	stats["unchoked_peers"] = unchoked
+	stats["interested_peers"] = interested
+	return stats
+}
+
+// PeerStats returns a snapshot of every connection in the session
+func (s *Session) PeerStats() []PeerStats {
+	var stats []PeerStats
+	for _, torrent := range s.Torrents() {
+		for _, pc := range torrent.connectedPeers() {
+			stats = append(stats, pc.Stats())
+		}
+	}
+	return stats
+}
+
+// AddTorrentFile loads a .torrent, checks the data already at savePath and adds
+// the torrent to the session. An empty savePath stores data in the data directory.
+// The torrent is registered so it is loaded again on the next start.
+func (s *Session) AddTorrentFile(torrentPath, savePath string) (*Torrent, error) {
+	mi, _, infoHash, err := LoadTorrentFile(torrentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if savePath == "" {
+		savePath = s.dataDir
+	}
+
+	torrent, err := NewTorrent(infoHash, mi.InfoBytes, savePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := torrent.SetPieceLayers(mi.PieceLayers); err != nil {
+		return nil, err
+	}
+	if err := s.restoreTorrent(torrent); err != nil {
+		return nil, err
+	}
+	if err := s.AddTorrent(torrent); err != nil {
+		return nil, err
+	}
+
+	// Keep our own copy of the .torrent next to the registry
+	storedPath := filepath.Join(s.torrentsDir(), hex.EncodeToString(infoHash[:])+".torrent")
+	if storedPath != torrentPath {
+		data, err := os.ReadFile(torrentPath)
+		if err == nil {
+			err = os.MkdirAll(s.torrentsDir(), 0755)
+		}
+		if err == nil {
+			err = os.WriteFile(storedPath, data, 0644)
+		}
+		if err != nil {
+			log.Printf("[Session] Warning: failed to store copy of %s: %v", torrentPath, err)
+			storedPath = torrentPath
+		}
+	}
+
+	s.mu.Lock()
+	s.records[infoHash] = torrentRecord{
+		InfoHash:    hex.EncodeToString(infoHash[:]),
+		TorrentFile: storedPath,
+		SavePath:    savePath,
+	}
+	s.mu.Unlock()
+
+	if err := s.saveRegistry(); err != nil {
+		log.Printf("[Session] Warning: failed to save torrent registry: %v", err)
+	}
+	if err := s.saveResume(torrent); err != nil {
+		log.Printf("[Session] Warning: failed to save resume data for %s: %v", torrent.Name(), err)
+	}
+	return torrent, nil
+}
+
+// AddMagnet adds a torrent from a magnet link. The info dictionary is fetched
+// from peers (BEP 9) and saved as a .torrent once it has been verified.
+func (s *Session) AddMagnet(uri, savePath string) (*Torrent, error) {
+	magnet, err := metainfo.ParseMagnetV2Uri(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %v", err)
+	}
+
+	if savePath == "" {
+		savePath = s.dataDir
+	}
+
+	torrent, err := NewTorrent(magnetInfoHash(magnet), nil, savePath)
+	if err != nil {
+		return nil, err
+	}
+	torrent.displayName = magnet.DisplayName
+	torrent.infoReady = func(t *Torrent) {
+		s.storeMetadata(t, magnet.Trackers)
+	}
+	if err := s.AddTorrent(torrent); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.records[torrent.InfoHash] = torrentRecord{
+		InfoHash: hex.EncodeToString(torrent.InfoHash[:]),
+		Magnet:   uri,
+		SavePath: savePath,
+	}
+	s.mu.Unlock()
+
+	if err := s.saveRegistry(); err != nil {
+		log.Printf("[Session] Warning: failed to save torrent registry: %v", err)
+	}
+	return torrent, nil
+}
+
+// magnetInfoHash returns the infohash a magnet link's torrent is known by in
+// the session: the v1 infohash, or the truncated v2 infohash for v2-only links
+func magnetInfoHash(magnet metainfo.MagnetV2) [20]byte {
+	if magnet.InfoHash.Ok {
+		return magnet.InfoHash.Value
+	}
+	return *magnet.V2InfoHash.Value.ToShort()
+}
+
+// storeMetadata writes the info fetched for a magnet link to a .torrent so the
+// next start does not need to fetch it again
+func (s *Session) storeMetadata(torrent *Torrent, trackers []string) {
+	mi := &metainfo.MetaInfo{InfoBytes: torrent.InfoBytes(), PieceLayers: torrent.PieceLayers()}
+	if len(trackers) > 0 {
+		mi.Announce = trackers[0]
+		mi.AnnounceList = metainfo.AnnounceList{trackers}
+	}
+
+	storedPath := filepath.Join(s.torrentsDir(), hex.EncodeToString(torrent.InfoHash[:])+".torrent")
+	if err := WriteTorrentFile(mi, storedPath); err != nil {
+		log.Printf("[Session] Warning: failed to store metadata for %s: %v", torrent.Name(), err)
+		return
+	}
+
+	s.mu.Lock()
+	record, registered := s.records[torrent.InfoHash]
+	if registered {
+		record.TorrentFile = storedPath
+		s.records[torrent.InfoHash] = record
+	}
+	s.mu.Unlock()
+
+	if registered {
+		if err := s.saveRegistry(); err != nil {
+			log.Printf("[Session] Warning: failed to save torrent registry: %v", err)
+		}
+	}
+}
+
+// storePieceLayers adds piece layers fetched from peers to the stored .torrent,
+// so data already downloaded can be verified on the next start
+func (s *Session) storePieceLayers(torrent *Torrent) {
+	s.mu.RLock()
+	storedPath := s.records[torrent.InfoHash].TorrentFile
+	s.mu.RUnlock()
+	if storedPath == "" || filepath.Dir(storedPath) != s.torrentsDir() {
+		return // Metadata not stored yet, or the .torrent is the user's own file
+	}
+
+	mi, err := metainfo.LoadFromFile(storedPath)
+	if err == nil {
+		mi.PieceLayers = torrent.PieceLayers()
+		err = WriteTorrentFile(mi, storedPath)
+	}
+	if err != nil {
+		log.Printf("[Session] Warning: failed to store piece layers for %s: %v", torrent.Name(), err)
+	}
+}
+
+// dialDiscovered connects to a peer found through source, unless the torrent
+// is already connected to it or dialling it
+func (s *Session) dialDiscovered(torrent *Torrent, addr, source string) {
+	if torrent.connectedTo(addr) || !torrent.claimDial(addr) {
+		return
+	}
+	go func() {
+		defer torrent.releaseDial(addr)
+		dialPeer(addr, s, torrent, source)
+	}()
+}
+
+// penalizePeer lowers the quality score of a peer that sent corrupt data or
+// hashes, and disconnects it after MaxCorruptPieces offences
+func (s *Session) penalizePeer(pc *PeerConn) {
+	pc.mu.Lock()
+	pc.corruptPieces++
+	offences := pc.corruptPieces
+	pc.mu.Unlock()
+
+	log.Printf("[Session] Peer %s sent corrupt data (%d times)", pc.addr, offences)
+	if s.dhtServer != nil {
+		if host, _, err := net.SplitHostPort(pc.addr); err == nil {
+			s.dhtServer.PenalizePeer(host, CorruptDataPenalty)
+		}
+	}
+	if offences >= MaxCorruptPieces {
+		log.Printf("[Session] Disconnecting %s after %d corrupt pieces", pc.addr, offences)
+		pc.wire.conn.Close()
+	}
+}
+
+// CreateAndSeed builds a .torrent for local files, writes it to outPath and
+// seeds the files in place. An empty outPath writes into the data directory.
+func (s *Session) CreateAndSeed(opts CreateTorrentOptions, outPath string) (*Torrent, error) {
+	mi, info, err := CreateTorrent(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if outPath == "" {
+		outPath = filepath.Join(s.torrentsDir(), info.BestName()+".torrent")
+	}
+	if err := WriteTorrentFile(mi, outPath); err != nil {
+		return nil, err
+	}
+	log.Printf("[Session] Created %s (%d pieces of %d bytes)", outPath, info.NumPieces(), info.PieceLength)
+
+	sourcePath, err := filepath.Abs(opts.SourcePath)
+	if err != nil {
+		return nil, err
+	}
+	return s.AddTorrentFile(outPath, filepath.Dir(sourcePath))
+}
+
+// SetPickMode changes a torrent's piece picking mode and records it for the
+// next start. Without a running daemon only the registry is updated.
+func (s *Session) SetPickMode(infoHash [20]byte, mode string) error {
+	mode, err := ParsePickMode(mode)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	torrent, exists := s.torrents[infoHash]
+	record, registered := s.records[infoHash]
+	if registered {
+		record.PickMode = mode
+		s.records[infoHash] = record
+	}
+	s.mu.Unlock()
+
+	if !exists && !registered {
+		return fmt.Errorf("torrent %x is not in the session", infoHash)
+	}
+	if exists {
+		torrent.SetPickMode(mode)
+		log.Printf("[Session] %s now picks pieces %s", torrent.Name(), mode)
+	}
+	if registered {
+		if err := s.saveRegistry(); err != nil {
+			log.Printf("[Session] Warning: failed to save torrent registry: %v", err)
+		}
+	}
+	return nil
+}
+
+// LoadRegistry re-adds every torrent registered in a previous run
+func (s *Session) LoadRegistry() error {
+	records, err := s.readRegistry()
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		var torrent *Torrent
+		var err error
+		if record.TorrentFile == "" && record.Magnet != "" {
+			torrent, err = s.AddMagnet(record.Magnet, record.SavePath) // Metadata was never fetched
+		} else {
+			torrent, err = s.AddTorrentFile(record.TorrentFile, record.SavePath)
+		}
+		if err == nil && record.PickMode != "" {
+			err = s.SetPickMode(torrent.InfoHash, record.PickMode)
+		}
+		if err == nil && record.RateLimits != nil {
+			err = s.SetTorrentRateLimits(torrent.InfoHash, *record.RateLimits)
+		}
+		if err != nil {
+			log.Printf("[Session] Warning: failed to load torrent %s: %v", record.InfoHash, err)
+		}
+	}
+	return nil
+}
+
+// KeepRegistry keeps the torrents registered in a previous run without loading
+// them, so a session used offline (by a command) adds to the registry rather
+// than replacing it
+func (s *Session) KeepRegistry() error {
+	records, err := s.readRegistry()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range records {
+		infoHash, err := parseInfoHash(record.InfoHash)
+		if err != nil {
+			continue
+		}
+		s.records[infoHash] = record
+	}
+	return nil
+}
+
+// readRegistry reads the registered torrents from the data directory
+func (s *Session) readRegistry() ([]torrentRecord, error) {
+	data, err := os.ReadFile(s.registryPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read torrent registry: %v", err)
+	}
+
+	var records []torrentRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse torrent registry: %v", err)
+	}
+	return records, nil
+}
+
+// saveRegistry writes the registered torrents to the data directory
+func (s *Session) saveRegistry() error {
+	s.mu.RLock()
+	records := make([]torrentRecord, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+	s.mu.RUnlock()
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dataDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.registryPath(), data, 0644)
+}
+
+// torrentsDir is where .torrent files are kept
+func (s *Session) torrentsDir() string {
+	return filepath.Join(s.dataDir, "torrents")
+}
+
+// registryPath is the file listing the torrents to load at startup
+func (s *Session) registryPath() string {
+	return filepath.Join(s.dataDir, "torrents.json")
+}
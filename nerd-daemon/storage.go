@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// FileStorage maps the contiguous byte space of a torrent onto the files on disk
+type FileStorage struct {
+	root  string // Directory the torrent's name is resolved against
+	name  string // File name (single-file) or directory name (multi-file)
+	files []metainfo.FileInfo
+}
+
+// NewFileStorage creates storage for a torrent's files rooted at dataDir
+func NewFileStorage(dataDir string, info *metainfo.Info) *FileStorage {
+	return &FileStorage{
+		root:  dataDir,
+		name:  info.BestName(),
+		files: info.UpvertedFiles(),
+	}
+}
+
+// validateFilePaths checks that the torrent's name and every file path
+// component stay inside the torrent's directory, so an info dictionary from a
+// peer or a .torrent file cannot write elsewhere on disk
+func validateFilePaths(info *metainfo.Info) error {
+	if err := validatePathComponent(info.BestName()); err != nil {
+		return fmt.Errorf("invalid torrent name: %v", err)
+	}
+	for _, fi := range info.UpvertedFiles() {
+		path := fi.BestPath()
+		if len(path) == 0 && info.IsDir() {
+			return fmt.Errorf("file with an empty path")
+		}
+		for _, component := range path {
+			if err := validatePathComponent(component); err != nil {
+				return fmt.Errorf("invalid file path %q: %v", strings.Join(path, "/"), err)
+			}
+		}
+	}
+	return nil
+}
+
+// validatePathComponent checks a single file or directory name
+func validatePathComponent(name string) error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return fmt.Errorf("name %q is not allowed", name)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("name %q contains a path separator", name)
+	case !filepath.IsLocal(name):
+		return fmt.Errorf("name %q is not a local path", name)
+	}
+	return nil
+}
+
+// filePath returns the on-disk path of a file in the torrent
+func (fs *FileStorage) filePath(fi metainfo.FileInfo) string {
+	if len(fi.BestPath()) == 0 {
+		// Single-file torrents are stored directly under the root
+		return filepath.Join(fs.root, fs.name)
+	}
+	return filepath.Join(append([]string{fs.root, fs.name}, fi.BestPath()...)...)
+}
+
+// ReadAt reads len(p) bytes starting at torrent offset off
+func (fs *FileStorage) ReadAt(p []byte, off int64) (int, error) {
+	return fs.forEachSpan(p, off, func(path string, span []byte, fileOff int64) (int, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		return f.ReadAt(span, fileOff)
+	})
+}
+
+// WriteAt writes p at torrent offset off, creating files and directories as needed
+func (fs *FileStorage) WriteAt(p []byte, off int64) (int, error) {
+	return fs.forEachSpan(p, off, func(path string, span []byte, fileOff int64) (int, error) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return 0, err
+		}
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		return f.WriteAt(span, fileOff)
+	})
+}
+
+// forEachSpan splits a torrent-wide byte range into per-file spans. v2 files
+// start on a piece boundary, so the byte space can have gaps between files.
+func (fs *FileStorage) forEachSpan(p []byte, off int64, op func(path string, span []byte, fileOff int64) (int, error)) (int, error) {
+	var done int
+
+	for _, fi := range fs.files {
+		fileStart := fi.TorrentOffset
+		fileEnd := fileStart + fi.Length
+		if len(p) == done {
+			break
+		}
+
+		pos := off + int64(done)
+		if pos >= fileStart && pos < fileEnd {
+			spanLen := min(len(p)-done, int(fileEnd-pos))
+			n, err := op(fs.filePath(fi), p[done:done+spanLen], pos-fileStart)
+			done += n
+			if err != nil && err != io.EOF {
+				return done, fmt.Errorf("storage I/O on %s failed: %v", fs.filePath(fi), err)
+			}
+			if n < spanLen {
+				return done, io.ErrUnexpectedEOF
+			}
+		}
+	}
+
+	if done < len(p) {
+		return done, io.ErrUnexpectedEOF
+	}
+	return done, nil
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Block and request sizing for piece exchange
+const (
+	BlockSize                   = 16 * 1024  // Standard block size we request
+	MaxBlockLength              = 128 * 1024 // Largest block we will serve to a peer
+	MaxOutstandingRequests      = 16         // Requests kept in flight per peer
+	MaxLocalOutstandingRequests = 64         // Requests kept in flight per LAN peer
+)
+
+// Bitfield records piece ownership, most significant bit first (BEP 3)
+type Bitfield []byte
+
+// NewBitfield creates an empty bitfield for numPieces pieces
+func NewBitfield(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+// Has reports whether the piece at index is set
+func (bf Bitfield) Has(index int) bool {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return false
+	}
+	return bf[byteIndex]&(0x80>>uint(index%8)) != 0
+}
+
+// Set marks the piece at index as owned
+func (bf Bitfield) Set(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] |= 0x80 >> uint(index%8)
+}
+
+// Clear marks the piece at index as not owned
+func (bf Bitfield) Clear(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] &^= 0x80 >> uint(index%8)
+}
+
+// Count returns the number of pieces set
+func (bf Bitfield) Count() int {
+	count := 0
+	for _, b := range bf {
+		for ; b != 0; b &= b - 1 {
+			count++
+		}
+	}
+	return count
+}
+
+// validFor checks the length and spare bits of a bitfield received from a peer
+func (bf Bitfield) validFor(numPieces int) bool {
+	if len(bf) != (numPieces+7)/8 {
+		return false
+	}
+	if spare := numPieces % 8; spare != 0 && len(bf) > 0 {
+		return bf[len(bf)-1]&(0xFF>>uint(spare)) == 0
+	}
+	return true
+}
+
+// blockRequest identifies a block within a piece
+type blockRequest struct {
+	Piece  uint32
+	Offset uint32
+	Length uint32
+}
+
+// pendingPiece assembles the blocks of a piece that is being downloaded
+type pendingPiece struct {
+	data      []byte
+	received  []bool
+	requested []int       // Number of peers each block is requested from
+	senders   []*PeerConn // Peer each received block came from
+	remaining int
+	verifying bool // Complete but failed; waiting for block hashes to find the corrupt blocks
+}
+
+// Torrent holds the local state of a single swarm
+type Torrent struct {
+	InfoHash       [20]byte
+	Info           *metainfo.Info // Nil until the info dictionary is known
+	infoBytes      []byte         // Bencoded info dictionary as hashed, served to magnet peers
+	displayName    string         // Name from a magnet link, used until the info is known
+	metadata       *metadataDownload
+	infoReady      func(*Torrent) // Called once metadata fetched from peers has been verified
+	dataDir        string
+	storage        *FileStorage
+	bitfield       Bitfield
+	pending        map[int]*pendingPiece
+	pickMode       string                      // PickRarestFirst or PickSequential
+	rates          *RateLimiter                // Limits shared by the torrent's connections
+	endgame        bool                        // Every missing block has been requested at least once
+	availability   []int                       // Number of connected peers having each piece
+	corruptData    func(*PeerConn)             // Called for each peer that sent data failing verification
+	layersReady    func(*Torrent)              // Called once piece layers fetched from peers complete the metadata
+	v2Files        map[[32]byte]*v2File        // v2 files by pieces root
+	v2PieceFiles   []*v2File                   // v2 file of each piece
+	pieceLayers    map[[32]byte][][32]byte     // Verified piece layers by pieces root
+	layerDownloads map[[32]byte]*layerDownload // Piece layers being fetched from peers
+	peers          map[*PeerConn]struct{}
+	dialing        map[string]bool // Addresses of exchanged peers being dialled
+	uploaded       int64
+	downloaded     int64
+	payments       []PiecePayment // Payment proofs received for our pieces
+	resumeDirty    bool           // State changed since resume data was last saved
+	mu             sync.RWMutex
+}
+
+// NewTorrent creates a torrent for infoHash from its bencoded info dictionary.
+// infoBytes may be nil when only the infohash is known (a magnet link); piece
+// exchange starts once the info has been fetched from peers.
+func NewTorrent(infoHash [20]byte, infoBytes []byte, dataDir string) (*Torrent, error) {
+	t := &Torrent{
+		InfoHash: infoHash,
+		dataDir:  dataDir,
+		pending:  make(map[int]*pendingPiece),
+		pickMode: PickRarestFirst,
+		rates:    NewRateLimiter(RateLimits{}),
+		peers:    make(map[*PeerConn]struct{}),
+	}
+	if infoBytes != nil {
+		if err := t.SetInfoBytes(infoBytes); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// SetInfoBytes checks a bencoded info dictionary against the infohash and
+// attaches it. v2-only torrents are identified by their SHA-256 infohash
+// truncated to 20 bytes.
+func (t *Torrent) SetInfoBytes(infoBytes []byte) error {
+	v2Hash := sha256.Sum256(infoBytes)
+	if sha1.Sum(infoBytes) != t.InfoHash && [20]byte(v2Hash[:20]) != t.InfoHash {
+		return fmt.Errorf("info dictionary does not match infohash %x", t.InfoHash)
+	}
+
+	var info metainfo.Info
+	if err := bencode.Unmarshal(infoBytes, &info); err != nil {
+		return fmt.Errorf("invalid info dictionary: %v", err)
+	}
+	if info.PieceLength <= 0 || info.NumPieces() == 0 {
+		return fmt.Errorf("info dictionary has no pieces")
+	}
+	if err := validateFilePaths(&info); err != nil {
+		return fmt.Errorf("invalid info dictionary: %v", err)
+	}
+
+	t.setInfo(&info, infoBytes)
+	return nil
+}
+
+// setInfo attaches the info dictionary and prepares storage (assumes no lock is held)
+func (t *Torrent) setInfo(info *metainfo.Info, infoBytes []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.Info = info
+	t.infoBytes = infoBytes
+	t.metadata = nil
+	t.storage = NewFileStorage(t.dataDir, info)
+	t.bitfield = NewBitfield(info.NumPieces())
+	t.availability = make([]int, info.NumPieces())
+	if info.HasV2() {
+		t.indexV2Files()
+	}
+}
+
+// InfoBytes returns the bencoded info dictionary, or nil if it is not known yet
+func (t *Torrent) InfoBytes() []byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.infoBytes
+}
+
+// HasInfo reports whether the info dictionary is known
+func (t *Torrent) HasInfo() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.Info != nil
+}
+
+// NumPieces returns the number of pieces, or 0 if the info is unknown
+func (t *Torrent) NumPieces() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.Info == nil {
+		return 0
+	}
+	return t.Info.NumPieces()
+}
+
+// Bitfield returns a copy of the pieces we have
+func (t *Torrent) Bitfield() Bitfield {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append(Bitfield(nil), t.bitfield...)
+}
+
+// HavePiece reports whether we have verified the piece at index
+func (t *Torrent) HavePiece(index int) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.bitfield.Has(index)
+}
+
+// IsComplete reports whether every piece has been verified
+func (t *Torrent) IsComplete() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.Info != nil && t.bitfield.Count() == t.Info.NumPieces()
+}
+
+// Name returns a display name for logs
+func (t *Torrent) Name() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.Info != nil {
+		return t.Info.BestName()
+	}
+	if t.displayName != "" {
+		return t.displayName
+	}
+	return fmt.Sprintf("%x", t.InfoHash)
+}
+
+// TorrentStatus is a snapshot of a torrent for the control API and stats
+type TorrentStatus struct {
+	InfoHash   string     `json:"info_hash"`
+	Name       string     `json:"name"`
+	SavePath   string     `json:"save_path"`
+	Pieces     int        `json:"pieces"`
+	Have       int        `json:"have"`
+	Complete   bool       `json:"complete"`
+	Peers      int        `json:"peers"`
+	Uploaded   int64      `json:"uploaded"`
+	Downloaded int64      `json:"downloaded"`
+	PickMode   string     `json:"pick_mode"`
+	Endgame    bool       `json:"endgame"`
+	RateLimits RateLimits `json:"rate_limits"`
+}
+
+// Status returns a snapshot of the torrent's progress and transfer totals
+func (t *Torrent) Status() TorrentStatus {
+	status := TorrentStatus{
+		InfoHash:   fmt.Sprintf("%x", t.InfoHash),
+		Name:       t.Name(),
+		SavePath:   t.dataDir,
+		Pieces:     t.NumPieces(),
+		Complete:   t.IsComplete(),
+		Peers:      len(t.connectedPeers()),
+		RateLimits: t.rates.Limits(),
+	}
+
+	t.mu.RLock()
+	status.Have = t.bitfield.Count()
+	status.Uploaded = t.uploaded
+	status.Downloaded = t.downloaded
+	status.PickMode = t.pickMode
+	status.Endgame = t.endgame
+	t.mu.RUnlock()
+
+	return status
+}
+
+// Recheck hashes the data on disk and marks every piece that verifies
+func (t *Torrent) Recheck() (int, error) {
+	if !t.HasInfo() {
+		return 0, fmt.Errorf("torrent %x has no info", t.InfoHash)
+	}
+
+	numPieces := t.NumPieces()
+	verified := 0
+	for i := 0; i < numPieces; i++ {
+		if t.checkPiece(i) {
+			verified++
+		}
+	}
+
+	log.Printf("[Torrent] %s: %d/%d pieces verified on disk", t.Name(), verified, numPieces)
+	return verified, nil
+}
+
+// checkPiece hashes a piece on disk and marks it if it verifies
+func (t *Torrent) checkPiece(index int) bool {
+	data, err := t.readPiece(index)
+	if err != nil {
+		return false // Missing or short files simply mean we don't have the piece
+	}
+	if !t.verifyPiece(index, data) {
+		return false
+	}
+
+	t.mu.Lock()
+	t.bitfield.Set(index)
+	t.resumeDirty = true
+	t.mu.Unlock()
+	return true
+}
+
+// validateRequest checks that a block request lies inside a piece
+func (t *Torrent) validateRequest(req blockRequest) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.Info == nil {
+		return fmt.Errorf("torrent info not available")
+	}
+	if int(req.Piece) >= t.Info.NumPieces() {
+		return fmt.Errorf("piece index %d out of range", req.Piece)
+	}
+	if req.Length == 0 || req.Length > MaxBlockLength {
+		return fmt.Errorf("invalid block length %d", req.Length)
+	}
+	if int64(req.Offset)+int64(req.Length) > t.Info.Piece(int(req.Piece)).Length() {
+		return fmt.Errorf("block %d+%d exceeds piece %d", req.Offset, req.Length, req.Piece)
+	}
+	return nil
+}
+
+// ReadBlock reads a requested block of a verified piece from storage
+func (t *Torrent) ReadBlock(req blockRequest) ([]byte, error) {
+	if err := t.validateRequest(req); err != nil {
+		return nil, err
+	}
+	if !t.HavePiece(int(req.Piece)) {
+		return nil, fmt.Errorf("piece %d not available", req.Piece)
+	}
+
+	data := make([]byte, req.Length)
+	offset := t.Info.Piece(int(req.Piece)).Offset() + int64(req.Offset)
+	if _, err := t.storage.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	t.uploaded += int64(len(data))
+	t.resumeDirty = true
+	t.mu.Unlock()
+
+	return data, nil
+}
+
+// wants reports whether a peer with the given bitfield has a piece we lack
+func (t *Torrent) wants(peerBitfield Bitfield) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.Info == nil {
+		return false
+	}
+	for i := 0; i < t.Info.NumPieces(); i++ {
+		if peerBitfield.Has(i) && !t.bitfield.Has(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// newPendingPiece allocates assembly state for a piece (assumes lock is held)
+func (t *Torrent) newPendingPiece(index int) *pendingPiece {
+	pieceLength := int(t.Info.Piece(index).Length())
+	numBlocks := (pieceLength + BlockSize - 1) / BlockSize
+	return &pendingPiece{
+		data:      make([]byte, pieceLength),
+		received:  make([]bool, numBlocks),
+		requested: make([]int, numBlocks),
+		senders:   make([]*PeerConn, numBlocks),
+		remaining: numBlocks,
+	}
+}
+
+// releaseRequests makes blocks available to other peers again
+func (t *Torrent) releaseRequests(reqs []blockRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, req := range reqs {
+		if pp, exists := t.pending[int(req.Piece)]; exists {
+			block := int(req.Offset) / BlockSize
+			if block < len(pp.requested) && pp.requested[block] > 0 {
+				pp.requested[block]--
+			}
+		}
+	}
+}
+
+// ReceiveBlock stores a block downloaded from a peer. When the last block of a
+// piece arrives the piece is verified and written to storage; completed
+// reports whether that happened.
+func (t *Torrent) ReceiveBlock(from *PeerConn, pieceIndex, offset uint32, data []byte) (completed bool, err error) {
+	t.mu.Lock()
+
+	pp, exists := t.pending[int(pieceIndex)]
+	if !exists && t.bitfield.Has(int(pieceIndex)) {
+		t.mu.Unlock()
+		return false, nil // Duplicate of an endgame block for a piece we have
+	}
+	if !exists {
+		t.mu.Unlock()
+		return false, fmt.Errorf("unexpected block for piece %d", pieceIndex)
+	}
+
+	block := int(offset) / BlockSize
+	if int(offset)%BlockSize != 0 || block >= len(pp.received) ||
+		int(offset)+len(data) > len(pp.data) ||
+		len(data) != min(BlockSize, len(pp.data)-int(offset)) {
+		t.mu.Unlock()
+		return false, fmt.Errorf("block %d+%d does not match a requested block of piece %d",
+			offset, len(data), pieceIndex)
+	}
+
+	if pp.received[block] {
+		t.mu.Unlock()
+		return false, nil // Duplicate
+	}
+
+	copy(pp.data[offset:], data)
+	pp.received[block] = true
+	pp.senders[block] = from
+	pp.remaining--
+	t.downloaded += int64(len(data))
+
+	if pp.remaining > 0 {
+		t.mu.Unlock()
+		return false, nil
+	}
+
+	// Keep the piece pending while it is checked so its blocks are not requested again
+	pp.verifying = true
+	t.mu.Unlock()
+
+	if !t.verifyPiece(int(pieceIndex), pp.data) {
+		t.pieceFailed(int(pieceIndex), pp)
+		return false, fmt.Errorf("piece %d failed hash check", pieceIndex)
+	}
+
+	if _, err := t.storage.WriteAt(pp.data, t.Info.Piece(int(pieceIndex)).Offset()); err != nil {
+		t.mu.Lock()
+		delete(t.pending, int(pieceIndex))
+		t.mu.Unlock()
+		return false, fmt.Errorf("failed to write piece %d: %v", pieceIndex, err)
+	}
+
+	t.mu.Lock()
+	delete(t.pending, int(pieceIndex))
+	t.bitfield.Set(int(pieceIndex))
+	t.resumeDirty = true
+	t.mu.Unlock()
+
+	log.Printf("[Torrent] %s: piece %d verified (%d/%d)",
+		t.Name(), pieceIndex, t.Bitfield().Count(), t.NumPieces())
+	return true, nil
+}
+
+// addPeer registers a connection with this torrent
+func (t *Torrent) addPeer(pc *PeerConn) {
+	t.mu.Lock()
+	t.peers[pc] = struct{}{}
+	t.mu.Unlock()
+}
+
+// removePeer unregisters a connection and releases its outstanding requests
+func (t *Torrent) removePeer(pc *PeerConn) {
+	t.mu.Lock()
+	delete(t.peers, pc)
+	t.mu.Unlock()
+
+	t.releaseRequests(pc.state.TakeRequests())
+	t.releaseMetadataPieces(pc.takeMetadataRequests())
+	for _, req := range pc.takeHashRequests() {
+		t.releaseHashRequest(req)
+	}
+}
+
+// connectedPeers returns a snapshot of the torrent's connections
+func (t *Torrent) connectedPeers() []*PeerConn {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	peers := make([]*PeerConn, 0, len(t.peers))
+	for pc := range t.peers {
+		peers = append(peers, pc)
+	}
+	return peers
+}
+
+// claimDial marks an address as being dialled, returning false if it already is
+func (t *Torrent) claimDial(addr string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.dialing == nil {
+		t.dialing = make(map[string]bool)
+	}
+	if t.dialing[addr] {
+		return false
+	}
+	t.dialing[addr] = true
+	return true
+}
+
+// releaseDial clears an address marked by claimDial
+func (t *Torrent) releaseDial(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.dialing, addr)
+}
+
+// dialCount returns the number of addresses being dialled
+func (t *Torrent) dialCount() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.dialing)
+}
+
+// connectedTo reports whether one of the torrent's connections reaches the peer listening on addr
+func (t *Torrent) connectedTo(addr string) bool {
+	for _, pc := range t.connectedPeers() {
+		if listen, ok := pc.listenAddr(); ok && listen == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcastHave announces a newly verified piece to every connected peer
+func (t *Torrent) broadcastHave(pieceIndex uint32) {
+	for _, pc := range t.connectedPeers() {
+		if err := pc.wire.SendHave(pieceIndex); err != nil {
+			log.Printf("Failed to send have for piece %d to %s: %v", pieceIndex, pc.addr, err)
+			continue
+		}
+		pc.updateInterest()
+	}
+}
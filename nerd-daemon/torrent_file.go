@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	infohash_v2 "github.com/anacrolix/torrent/types/infohash-v2"
+)
+
+// CreatedBy is written into the "created by" field of torrents we create
+const CreatedBy = "NERD daemon"
+
+// CreateTorrentOptions describes a torrent to build from local files
+type CreateTorrentOptions struct {
+	SourcePath   string   // File or directory to hash
+	PieceLength  int64    // Piece length in bytes; 0 picks one from the content size
+	AnnounceURLs []string // Tracker announce URLs, the first is used as the primary
+	DHTNodes     []string // host:port DHT nodes embedded for trackerless start
+	Comment      string   // Optional free-form comment
+}
+
+// NewCreateTorrentOptions fills in tracker URLs and DHT nodes from the daemon
+// configuration. Without announce_urls the torrent has no tracker and peers
+// find each other through the DHT nodes it carries; our own tracker's address
+// is not one other hosts could reach.
+func NewCreateTorrentOptions(config *Config, sourcePath string) CreateTorrentOptions {
+	return CreateTorrentOptions{
+		SourcePath:   sourcePath,
+		AnnounceURLs: config.AnnounceURLs,
+		DHTNodes:     config.BootstrapNodes,
+	}
+}
+
+// CreateTorrent hashes the files at opts.SourcePath into pieces and builds the metainfo
+func CreateTorrent(opts CreateTorrentOptions) (*metainfo.MetaInfo, *metainfo.Info, error) {
+	sourcePath, err := filepath.Abs(opts.SourcePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid source path: %v", err)
+	}
+	if _, err := os.Stat(sourcePath); err != nil {
+		return nil, nil, fmt.Errorf("cannot read source: %v", err)
+	}
+
+	info := &metainfo.Info{PieceLength: opts.PieceLength}
+	if err := info.BuildFromFilePath(sourcePath); err != nil {
+		return nil, nil, fmt.Errorf("failed to hash %s: %v", sourcePath, err)
+	}
+	if info.TotalLength() == 0 {
+		return nil, nil, fmt.Errorf("%s contains no data", sourcePath)
+	}
+
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode info dictionary: %v", err)
+	}
+
+	mi := &metainfo.MetaInfo{
+		InfoBytes:    infoBytes,
+		Comment:      opts.Comment,
+		CreatedBy:    CreatedBy,
+		CreationDate: time.Now().Unix(),
+	}
+	if len(opts.AnnounceURLs) > 0 {
+		mi.Announce = opts.AnnounceURLs[0]
+		mi.AnnounceList = metainfo.AnnounceList{opts.AnnounceURLs}
+	}
+	for _, node := range opts.DHTNodes {
+		mi.Nodes = append(mi.Nodes, metainfo.Node(node))
+	}
+
+	return mi, info, nil
+}
+
+// WriteTorrentFile writes metainfo to path as a bencoded .torrent file
+func WriteTorrentFile(mi *metainfo.MetaInfo, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", path, err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", path, err)
+	}
+
+	if err := mi.Write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// LoadTorrentFile reads a .torrent file and returns its metainfo, info and infohash
+func LoadTorrentFile(path string) (*metainfo.MetaInfo, *metainfo.Info, [20]byte, error) {
+	var infoHash [20]byte
+
+	mi, err := metainfo.LoadFromFile(path)
+	if err != nil {
+		return nil, nil, infoHash, fmt.Errorf("failed to load %s: %v", path, err)
+	}
+
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return nil, nil, infoHash, fmt.Errorf("invalid info dictionary in %s: %v", path, err)
+	}
+	if info.PieceLength <= 0 || info.NumPieces() == 0 {
+		return nil, nil, infoHash, fmt.Errorf("%s has no pieces", path)
+	}
+	if err := validateFilePaths(&info); err != nil {
+		return nil, nil, infoHash, fmt.Errorf("invalid info dictionary in %s: %v", path, err)
+	}
+
+	if info.HasV1() {
+		infoHash = mi.HashInfoBytes()
+	} else {
+		v2Hash := infohash_v2.HashBytes(mi.InfoBytes)
+		infoHash = *v2Hash.ToShort() // v2-only torrents are known by their truncated SHA-256 infohash
+	}
+	return mi, &info, infoHash, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestNewCreateTorrentOptions(t *testing.T) {
+	nodes := []string{"router.bittorrent.com:6881"}
+	tests := []struct {
+		name   string
+		config *Config
+		want   []string
+	}{
+		{
+			name:   "configured trackers",
+			config: &Config{AnnounceURLs: []string{"udp://tracker.example:6969/announce"}, BootstrapNodes: nodes},
+			want:   []string{"udp://tracker.example:6969/announce"},
+		},
+		{
+			name:   "integrated tracker is not published",
+			config: &Config{EnableTracker: true, TrackerHTTPPort: 6969, BootstrapNodes: nodes},
+		},
+	}
+
+	for _, tt := range tests {
+		opts := NewCreateTorrentOptions(tt.config, "data")
+		if !reflect.DeepEqual(opts.AnnounceURLs, tt.want) || !reflect.DeepEqual(opts.DHTNodes, nodes) {
+			t.Errorf("%s: announce %v, nodes %v; want %v, %v", tt.name, opts.AnnounceURLs, opts.DHTNodes, tt.want, nodes)
+		}
+	}
+}
+
+func TestTorrentFileRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	single := filepath.Join(dir, "single.bin")
+	if err := os.WriteFile(single, bytes.Repeat([]byte{1}, 3*BlockSize+100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	multi := filepath.Join(dir, "album")
+	for name, size := range map[string]int{"a.bin": BlockSize, "sub/b.bin": 2*BlockSize + 1} {
+		path := filepath.Join(multi, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, bytes.Repeat([]byte{2}, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		opts      CreateTorrentOptions
+		wantFiles int
+	}{
+		{
+			name:      "single file",
+			opts:      CreateTorrentOptions{SourcePath: single, PieceLength: BlockSize},
+			wantFiles: 1,
+		},
+		{
+			name: "directory with trackers and nodes",
+			opts: CreateTorrentOptions{
+				SourcePath:   multi,
+				PieceLength:  2 * BlockSize,
+				AnnounceURLs: []string{"udp://tracker.example:6969/announce", "http://backup.example/announce"},
+				DHTNodes:     []string{"router.bittorrent.com:6881"},
+				Comment:      "round trip",
+			},
+			wantFiles: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mi, info, err := CreateTorrent(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "torrents", "out.torrent")
+			if err := WriteTorrentFile(mi, path); err != nil {
+				t.Fatal(err)
+			}
+			loaded, loadedInfo, infoHash, err := LoadTorrentFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if infoHash != sha1.Sum(mi.InfoBytes) {
+				t.Errorf("infohash %x, want %x", infoHash, sha1.Sum(mi.InfoBytes))
+			}
+			if !bytes.Equal(loaded.InfoBytes, mi.InfoBytes) {
+				t.Error("info dictionary changed")
+			}
+			if len(loadedInfo.UpvertedFiles()) != tt.wantFiles || loadedInfo.TotalLength() != info.TotalLength() {
+				t.Errorf("loaded %d files of %d bytes, want %d files of %d bytes",
+					len(loadedInfo.UpvertedFiles()), loadedInfo.TotalLength(), tt.wantFiles, info.TotalLength())
+			}
+			if loadedInfo.PieceLength != tt.opts.PieceLength {
+				t.Errorf("piece length %d, want %d", loadedInfo.PieceLength, tt.opts.PieceLength)
+			}
+
+			var wantAnnounce string
+			var wantList metainfo.AnnounceList
+			if len(tt.opts.AnnounceURLs) > 0 {
+				wantAnnounce = tt.opts.AnnounceURLs[0]
+				wantList = metainfo.AnnounceList{tt.opts.AnnounceURLs}
+			}
+			if loaded.Announce != wantAnnounce || !reflect.DeepEqual(loaded.AnnounceList, wantList) {
+				t.Errorf("announce %q %v, want %q %v", loaded.Announce, loaded.AnnounceList, wantAnnounce, wantList)
+			}
+			if len(loaded.Nodes) != len(tt.opts.DHTNodes) {
+				t.Errorf("nodes %v, want %v", loaded.Nodes, tt.opts.DHTNodes)
+			}
+			if loaded.Comment != tt.opts.Comment || loaded.CreatedBy != CreatedBy {
+				t.Errorf("comment %q created by %q, want %q by %q", loaded.Comment, loaded.CreatedBy, tt.opts.Comment, CreatedBy)
+			}
+		})
+	}
+}
+
+func TestTorrentFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.bin")
+	garbage := filepath.Join(dir, "garbage.torrent")
+	for path, data := range map[string]string{empty: "", garbage: "not bencode"} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, source := range []string{empty, filepath.Join(dir, "missing")} {
+		if _, _, err := CreateTorrent(CreateTorrentOptions{SourcePath: source}); err == nil {
+			t.Errorf("CreateTorrent(%s) succeeded", filepath.Base(source))
+		}
+	}
+	for _, path := range []string{garbage, filepath.Join(dir, "missing.torrent")} {
+		if _, _, _, err := LoadTorrentFile(path); err == nil {
+			t.Errorf("LoadTorrentFile(%s) succeeded", filepath.Base(path))
+		}
+	}
+	// The parent of the output is a file
+	if err := WriteTorrentFile(&metainfo.MetaInfo{}, filepath.Join(empty, "out.torrent")); err == nil {
+		t.Error("WriteTorrentFile under a file succeeded")
+	}
+}
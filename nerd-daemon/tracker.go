@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"log"
@@ -54,7 +55,8 @@ type Swarm struct {
 // TrackerPeer represents a peer in the tracker
 type TrackerPeer struct {
 	PeerID       string
-	IP           net.IP
+	IP           net.IP // Address the peer announced from
+	IP6          net.IP // IPv6 address given with the ipv6 parameter when announcing over IPv4 (BEP 7)
 	Port         uint16
 	Uploaded     int64
 	Downloaded   int64
@@ -90,6 +92,7 @@ type AnnounceRequest struct {
 	NoPeerID   bool
 	Event      string
 	IP         net.IP
+	IP6        net.IP
 	NumWant    int
 	Key        string
 	TrackerID  string
@@ -104,6 +107,8 @@ type AnnounceResponse struct {
 	Complete    int32
 	Incomplete  int32
 	Peers       []TrackerPeer
+	Compact     bool // Write peers and peers6 as compact strings (BEP 23, BEP 7)
+	NoPeerID    bool
 	WarningMsg  string
 	FailureMsg  string
 }
@@ -412,12 +417,30 @@ func (ts *TrackerServer) parseAnnounceRequest(r *http.Request) (*AnnounceRequest
 	}
 
 	// Get client IP
-	ip := net.ParseIP(r.RemoteAddr)
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
 	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-		if forwardedIP := net.ParseIP(strings.Split(forwarded, ",")[0]); forwardedIP != nil {
+		if forwardedIP := net.ParseIP(strings.TrimSpace(strings.Split(forwarded, ",")[0])); forwardedIP != nil {
 			ip = forwardedIP
 		}
 	}
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client address")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	// A dual-stack client announcing over IPv4 may give its IPv6 address too (BEP 7)
+	var ip6 net.IP
+	if ip.To4() != nil {
+		if param := parseIPv6Param(query.Get("ipv6")); param != nil {
+			ip6 = param
+		}
+	}
 
 	return &AnnounceRequest{
 		InfoHash:   hex.EncodeToString([]byte(infoHashBytes)),
@@ -430,6 +453,7 @@ func (ts *TrackerServer) parseAnnounceRequest(r *http.Request) (*AnnounceRequest
 		NoPeerID:   query.Get("no_peer_id") == "1",
 		Event:      query.Get("event"),
 		IP:         ip,
+		IP6:        ip6,
 		NumWant:    numWant,
 		Key:        query.Get("key"),
 		TrackerID:  query.Get("trackerid"),
@@ -467,6 +491,7 @@ func (ts *TrackerServer) processAnnounce(req *AnnounceRequest) (*AnnounceRespons
 
 	// Update peer information
 	peer.IP = req.IP
+	peer.IP6 = req.IP6
 	peer.Port = req.Port
 	peer.Uploaded = req.Uploaded
 	peer.Downloaded = req.Downloaded
@@ -509,6 +534,8 @@ func (ts *TrackerServer) processAnnounce(req *AnnounceRequest) (*AnnounceRespons
 		Complete:    int32(swarm.SeedCount),
 		Incomplete:  int32(swarm.LeechCount),
 		Peers:       peers,
+		Compact:     req.Compact,
+		NoPeerID:    req.NoPeerID,
 	}, nil
 }
 
@@ -621,13 +648,22 @@ func (ts *TrackerServer) writeAnnounceResponse(w http.ResponseWriter, resp *Anno
 		fmt.Fprintf(w, "15:warning message%d:%s", len(resp.WarningMsg), resp.WarningMsg)
 	}
 
+	if resp.Compact {
+		peers, peers6 := compactTrackerPeers(resp.Peers)
+		fmt.Fprintf(w, "5:peers%d:%s6:peers6%d:%se", len(peers), peers, len(peers6), peers6)
+		return
+	}
+
 	// Write peers list
 	fmt.Fprintf(w, "5:peersl")
 	for _, peer := range resp.Peers {
 		// Write peer dictionary
-		fmt.Fprintf(w, "d2:ip%d:%s7:peer id20:%s4:porti%de",
-			len(peer.IP.String()), peer.IP.String(),
-			peer.PeerID, peer.Port)
+		ip := peer.IP.String()
+		fmt.Fprintf(w, "d2:ip%d:%s", len(ip), ip)
+		if peerID, err := hex.DecodeString(peer.PeerID); err == nil && !resp.NoPeerID {
+			fmt.Fprintf(w, "7:peer id%d:%s", len(peerID), peerID)
+		}
+		fmt.Fprintf(w, "4:porti%de", peer.Port)
 
 		// Add NERD-specific fields if enabled
 		if ts.config.EnableNERD {
@@ -640,6 +676,42 @@ func (ts *TrackerServer) writeAnnounceResponse(w http.ResponseWriter, resp *Anno
 	fmt.Fprintf(w, "ee") // End peers list and response dict
 }
 
+// compactTrackerPeers encodes peers as compact IPv4 entries (4-byte IP,
+// 2-byte port) and compact IPv6 entries (16-byte IP, 2-byte port). A peer
+// that gave both addresses appears in both lists.
+func compactTrackerPeers(peers []TrackerPeer) (peers4, peers6 []byte) {
+	for _, peer := range peers {
+		for _, ip := range []net.IP{peer.IP, peer.IP6} {
+			switch {
+			case ip == nil:
+			case ip.To4() != nil:
+				peers4 = append(peers4, ip.To4()...)
+				peers4 = binary.BigEndian.AppendUint16(peers4, peer.Port)
+			default:
+				peers6 = append(peers6, ip.To16()...)
+				peers6 = binary.BigEndian.AppendUint16(peers6, peer.Port)
+			}
+		}
+	}
+	return peers4, peers6
+}
+
+// parseIPv6Param reads the BEP 7 ipv6 parameter, which is either a bare
+// address or "[address]:port". Only global IPv6 addresses are accepted.
+func parseIPv6Param(value string) net.IP {
+	if value == "" {
+		return nil
+	}
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	ip := net.ParseIP(value)
+	if ip == nil || ip.To4() != nil || !ip.IsGlobalUnicast() {
+		return nil
+	}
+	return ip
+}
+
 // writeErrorResponse writes an error response
 func (ts *TrackerServer) writeErrorResponse(w http.ResponseWriter, msg string) {
 	w.Header().Set("Content-Type", "text/plain")
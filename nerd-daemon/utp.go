@@ -0,0 +1,957 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// uTP packet types (BEP 29)
+const (
+	utpData  = 0 // Payload data
+	utpFin   = 1 // Last packet of the stream
+	utpState = 2 // Acknowledgement without data
+	utpReset = 3 // Connection refused or torn down
+	utpSyn   = 4 // Connection request
+)
+
+// uTP parameters
+const (
+	UTPPacketSize     = 1400                   // Largest datagram sent, header included, to stay under common MTUs
+	UTPTargetDelay    = 100 * time.Millisecond // LEDBAT target for the queuing delay we add
+	UTPMaxWindow      = 1 << 20                // Upper bound of the congestion window in bytes
+	UTPRecvBuffer     = 1 << 20                // Receive window advertised to the peer
+	UTPSendBuffer     = 1 << 20                // Write blocks once this much data waits to be sent
+	UTPConnectTimeout = 3 * time.Second        // Time a dial waits for the SYN to be answered
+
+	utpVersion         = 1
+	utpHeaderSize      = 20
+	utpExtSelectiveAck = 1
+	utpMaxSackBytes    = 32 // Selective acks cover up to 256 packets past the gap
+	utpDupAckThreshold = 3  // Acks past a packet before it is considered lost
+	utpMaxPayload      = UTPPacketSize - utpHeaderSize
+	utpMinWindow       = UTPPacketSize
+	utpInitialWindow   = 3 * UTPPacketSize
+	utpMaxCwndIncrease = 3000 // Bytes the window grows per RTT with no queuing delay (BEP 29)
+	utpInitialTimeout  = time.Second
+	utpMinTimeout      = 500 * time.Millisecond
+	utpMaxTimeout      = 16 * time.Second
+	utpMaxRetransmits  = 8 // Consecutive timeouts before the connection is given up
+	utpReorderLimit    = 1024
+	utpDelayBucket     = 20 * time.Second // Base delay is the minimum over the last 6 buckets (2 minutes)
+	utpDelayBuckets    = 6
+	utpTickInterval    = 50 * time.Millisecond
+	utpBacklog         = 64
+
+	// Larger payloads do not fit an Ethernet MTU; they are dropped, which also
+	// bounds the memory held by reorder
+	utpMaxRecvPayload = 1500
+)
+
+var (
+	errUTPReset   = errors.New("uTP connection reset by peer")
+	errUTPTimeout = errors.New("uTP connection timed out")
+)
+
+// utpHeader is the fixed 20-byte header of every uTP packet
+type utpHeader struct {
+	typ       byte
+	connID    uint16
+	timestamp uint32 // Sender's clock in microseconds
+	timeDiff  uint32 // Sender's last one-way delay measurement of our packets
+	wndSize   uint32 // Sender's free receive buffer
+	seqNr     uint16
+	ackNr     uint16
+	sack      []byte // Selective ack: bit i acknowledges packet ackNr+2+i
+}
+
+// marshal encodes the header, the selective ack extension if any, and payload
+func (h *utpHeader) marshal(payload []byte) []byte {
+	b := make([]byte, utpHeaderSize, utpHeaderSize+2+len(h.sack)+len(payload))
+	b[0] = h.typ<<4 | utpVersion
+	if len(h.sack) > 0 {
+		b[1] = utpExtSelectiveAck
+	}
+	binary.BigEndian.PutUint16(b[2:], h.connID)
+	binary.BigEndian.PutUint32(b[4:], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:], h.timeDiff)
+	binary.BigEndian.PutUint32(b[12:], h.wndSize)
+	binary.BigEndian.PutUint16(b[16:], h.seqNr)
+	binary.BigEndian.PutUint16(b[18:], h.ackNr)
+	if len(h.sack) > 0 {
+		b = append(b, 0, byte(len(h.sack)))
+		b = append(b, h.sack...)
+	}
+	return append(b, payload...)
+}
+
+// parseUTPPacket decodes a datagram, keeping a selective ack and skipping
+// other extensions
+func parseUTPPacket(b []byte) (utpHeader, []byte, error) {
+	var h utpHeader
+	if len(b) < utpHeaderSize {
+		return h, nil, fmt.Errorf("short packet of %d bytes", len(b))
+	}
+	if b[0]&0x0f != utpVersion || b[0]>>4 > utpSyn {
+		return h, nil, fmt.Errorf("not a uTP packet")
+	}
+	h.typ = b[0] >> 4
+	h.connID = binary.BigEndian.Uint16(b[2:])
+	h.timestamp = binary.BigEndian.Uint32(b[4:])
+	h.timeDiff = binary.BigEndian.Uint32(b[8:])
+	h.wndSize = binary.BigEndian.Uint32(b[12:])
+	h.seqNr = binary.BigEndian.Uint16(b[16:])
+	h.ackNr = binary.BigEndian.Uint16(b[18:])
+
+	payload := b[utpHeaderSize:]
+	for ext := b[1]; ext != 0; {
+		if len(payload) < 2 || len(payload) < 2+int(payload[1]) {
+			return h, nil, fmt.Errorf("truncated extension")
+		}
+		if ext == utpExtSelectiveAck {
+			h.sack = payload[2 : 2+int(payload[1])]
+		}
+		ext = payload[0]
+		payload = payload[2+int(payload[1]):]
+	}
+	return h, payload, nil
+}
+
+// utpAddr is the address of a uTP endpoint; its network is "utp"
+type utpAddr struct {
+	*net.UDPAddr
+}
+
+func (a utpAddr) Network() string { return "utp" }
+
+// utpConnKey identifies a connection by the peer's address and the
+// connection ID the peer puts in its packets
+type utpConnKey struct {
+	addr   string
+	recvID uint16
+}
+
+// UTPSocket runs uTP connections over one UDP socket. It accepts incoming
+// connections like a net.Listener and dials outgoing ones.
+type UTPSocket struct {
+	conn      *net.UDPConn
+	conns     map[utpConnKey]*utpConn
+	backlog   chan *utpConn
+	closed    chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+}
+
+// ListenUTP opens a uTP socket on a UDP address such as ":6881"
+func ListenUTP(addr string) (*UTPSocket, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadBuffer(4 * UTPRecvBuffer) // Best effort; bursts of packets arrive at once
+
+	s := &UTPSocket{
+		conn:    conn,
+		conns:   make(map[utpConnKey]*utpConn),
+		backlog: make(chan *utpConn, utpBacklog),
+		closed:  make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s, nil
+}
+
+// Accept waits for the next incoming connection
+func (s *UTPSocket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr returns the socket's local address
+func (s *UTPSocket) Addr() net.Addr {
+	return utpAddr{s.conn.LocalAddr().(*net.UDPAddr)}
+}
+
+// Close stops the socket and fails every connection on it
+func (s *UTPSocket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+
+		s.mu.Lock()
+		conns := make([]*utpConn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.mu.Lock()
+			c.fail(net.ErrClosed)
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+// DialTimeout opens a uTP connection to addr
+func (s *UTPSocket) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The initiator picks its receive ID and sends with the next one (BEP 29)
+	s.mu.Lock()
+	var c *utpConn
+	for {
+		recvID := uint16(rand.Uint32())
+		key := utpConnKey{addr: remote.String(), recvID: recvID}
+		if _, taken := s.conns[key]; !taken {
+			c = newUTPConn(s, remote, recvID, recvID+1)
+			s.conns[key] = c
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.synSent = true
+	c.seqNr = 1
+	c.transmit(&utpOutPacket{typ: utpSyn, seq: c.seqNr})
+	c.seqNr++
+
+	deadline := time.Now().Add(timeout)
+	for c.synSent && c.err == nil {
+		if !time.Now().Before(deadline) {
+			c.fail(errUTPTimeout)
+			break
+		}
+		c.waitUntil(deadline)
+	}
+	if c.err != nil {
+		return nil, fmt.Errorf("uTP connect to %s: %w", addr, c.err)
+	}
+	return c, nil
+}
+
+// readLoop routes incoming datagrams to their connections and answers SYNs
+func (s *UTPSocket) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		h, payload, err := parseUTPPacket(buf[:n])
+		if err != nil {
+			continue // Stray datagrams on the port are ignored
+		}
+		s.receive(from, h, append([]byte(nil), payload...))
+	}
+}
+
+// receive hands a packet to its connection, creating one for a new SYN
+func (s *UTPSocket) receive(from *net.UDPAddr, h utpHeader, payload []byte) {
+	key := utpConnKey{addr: from.String(), recvID: h.connID}
+	if h.typ == utpSyn {
+		key.recvID = h.connID + 1 // A SYN carries the initiator's receive ID
+	}
+
+	s.mu.Lock()
+	c, ok := s.conns[key]
+	if !ok && h.typ == utpReset {
+		c, ok = s.resetTarget(from, h.connID)
+	}
+	if !ok && h.typ == utpSyn {
+		c = newUTPConn(s, from, h.connID+1, h.connID)
+		select {
+		case s.backlog <- c:
+			s.conns[key] = c
+		default:
+			c = nil // Backlog full; the reset below refuses the connection
+		}
+	}
+	s.mu.Unlock()
+
+	if c == nil {
+		if h.typ != utpReset {
+			reset := utpHeader{typ: utpReset, connID: h.connID, timestamp: utpNow(), ackNr: h.seqNr}
+			s.conn.WriteToUDP(reset.marshal(nil), from)
+		}
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !ok {
+		c.accept(h)
+		return
+	}
+	c.receive(h, payload)
+}
+
+// resetTarget finds the connection a reset refers to by the connection ID we
+// send with, as a peer that no longer knows the connection echoes the ID of the
+// packet it refuses (assumes lock is held)
+func (s *UTPSocket) resetTarget(from *net.UDPAddr, connID uint16) (*utpConn, bool) {
+	for _, recvID := range []uint16{connID - 1, connID + 1} {
+		c, ok := s.conns[utpConnKey{addr: from.String(), recvID: recvID}]
+		if ok && c.sendID == connID {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// tickLoop drives retransmission timers
+func (s *UTPSocket) tickLoop() {
+	ticker := time.NewTicker(utpTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*utpConn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+
+			for _, c := range conns {
+				c.mu.Lock()
+				c.tick(now)
+				c.mu.Unlock()
+			}
+		}
+	}
+}
+
+// remove forgets a finished connection
+func (s *UTPSocket) remove(c *utpConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := utpConnKey{addr: c.remote.String(), recvID: c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+// utpOutPacket is a sent packet kept until it is acknowledged
+type utpOutPacket struct {
+	typ           byte
+	seq           uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	sacked        bool // Received by the peer past a gap
+}
+
+// utpDelayHistory keeps the minimum one-way delay of recent intervals; their
+// minimum is the base delay, the delay of the path without queuing
+type utpDelayHistory struct {
+	buckets []uint32 // Newest last
+	started time.Time
+}
+
+// add records a delay sample and returns the current base delay
+func (d *utpDelayHistory) add(sample uint32, now time.Time) uint32 {
+	last := len(d.buckets) - 1
+	switch {
+	case last < 0 || now.Sub(d.started) >= utpDelayBucket:
+		d.buckets = append(d.buckets, sample)
+		d.started = now
+		if len(d.buckets) > utpDelayBuckets {
+			d.buckets = d.buckets[1:]
+		}
+	case utpBefore(sample, d.buckets[last]):
+		d.buckets[last] = sample
+	}
+
+	base := d.buckets[0]
+	for _, delay := range d.buckets[1:] {
+		if utpBefore(delay, base) {
+			base = delay
+		}
+	}
+	return base
+}
+
+// utpConn is one uTP connection. Writes are split into packets sent as the
+// LEDBAT congestion window and the peer's receive window allow; received
+// data is reassembled in order for Read.
+type utpConn struct {
+	sock           *UTPSocket
+	remote         *net.UDPAddr
+	recvID, sendID uint16
+
+	synSent bool   // Dialled and waiting for the SYN to be answered
+	seqNr   uint16 // Next sequence number to send
+	ackNr   uint16 // Last sequence number received in order
+
+	inflight      []*utpOutPacket // Sent and not yet acknowledged, in sequence order
+	inflightBytes int
+	sendBuf       []byte  // Written but not yet sent
+	cwnd          float64 // LEDBAT congestion window in bytes
+	peerWnd       uint32  // Peer's free receive buffer
+	rtt, rttVar   time.Duration
+	rto           time.Duration
+	rtoAt         time.Time // When the oldest in-flight packet is sent again
+	retransmits   int       // Consecutive timeouts
+	dupAcks       int
+	recoverTo     uint16 // Packets up to here were sent before the last loss
+	recovering    bool
+	delays        utpDelayHistory
+
+	readBuf    []byte
+	reorder    map[uint16]utpOutPacket // Packets received ahead of a gap
+	heldBytes  int                     // Payload bytes in reorder
+	eof        bool                    // The peer's FIN was reached
+	replyDelay uint32                  // Our latest one-way delay measurement, echoed to the peer
+
+	closing bool  // Close was called; a FIN follows the queued data
+	finSent bool  // The FIN is in flight
+	err     error // Why the connection ended
+
+	readDeadline, writeDeadline time.Time
+	cond                        *sync.Cond
+	mu                          sync.Mutex
+}
+
+func newUTPConn(s *UTPSocket, remote *net.UDPAddr, recvID, sendID uint16) *utpConn {
+	c := &utpConn{
+		sock:    s,
+		remote:  remote,
+		recvID:  recvID,
+		sendID:  sendID,
+		cwnd:    utpInitialWindow,
+		peerWnd: UTPRecvBuffer,
+		rto:     utpInitialTimeout,
+		reorder: make(map[uint16]utpOutPacket),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// accept answers the SYN of a new incoming connection (assumes lock is held)
+func (c *utpConn) accept(h utpHeader) {
+	c.ackNr = h.seqNr
+	c.seqNr = uint16(rand.Uint32())
+	c.peerWnd = h.wndSize
+	c.replyDelay = utpNow() - h.timestamp
+	c.sendState()
+}
+
+// receive processes a packet from the peer (assumes lock is held)
+func (c *utpConn) receive(h utpHeader, payload []byte) {
+	if c.err != nil {
+		return
+	}
+	c.replyDelay = utpNow() - h.timestamp
+	c.peerWnd = h.wndSize
+
+	switch h.typ {
+	case utpReset:
+		c.fail(errUTPReset)
+		return
+	case utpSyn:
+		c.sendState() // Our answer to the SYN was lost
+		return
+	}
+
+	if c.synSent {
+		c.synSent = false
+		c.ackNr = h.seqNr - 1 // The acceptor's first data packet carries this sequence number
+		c.cond.Broadcast()
+	}
+
+	c.processAck(h)
+	if h.typ == utpData || h.typ == utpFin {
+		c.receiveData(h, payload)
+	}
+	c.flush()
+}
+
+// processAck removes acknowledged packets, updates the RTT and the LEDBAT
+// window, and retransmits after three duplicate acks (assumes lock is held)
+func (c *utpConn) processAck(h utpHeader) {
+	now := time.Now()
+	ackedPackets, ackedBytes := 0, 0
+	var newest *utpOutPacket
+	retransmitted := false
+	for len(c.inflight) > 0 && !utpSeqAfter(c.inflight[0].seq, h.ackNr) {
+		newest = c.inflight[0]
+		c.inflight = c.inflight[1:]
+		if !newest.sacked {
+			c.inflightBytes -= len(newest.payload)
+		}
+		ackedPackets++
+		ackedBytes += len(newest.payload)
+		retransmitted = retransmitted || newest.transmissions > 1
+	}
+
+	// Packets held up behind a lost one would overstate the RTT, so only an
+	// ack that covers no retransmission gives a sample (Karn's algorithm)
+	if newest != nil && !retransmitted {
+		c.updateRTT(now.Sub(newest.sentAt))
+	}
+
+	if len(h.sack) > 0 {
+		c.processSelectiveAck(h, now)
+	}
+
+	if ackedPackets == 0 {
+		if h.typ == utpState && len(c.inflight) > 0 && h.ackNr == c.inflight[0].seq-1 && len(h.sack) == 0 {
+			c.dupAcks++
+			if c.dupAcks == utpDupAckThreshold {
+				c.cwnd = max(c.cwnd/2, utpMinWindow)
+				c.startRecovery()
+				c.retransmit(c.inflight[0])
+			}
+		}
+		return
+	}
+
+	c.dupAcks = 0
+	c.retransmits = 0
+	c.rtoAt = now.Add(c.rto)
+	if h.timeDiff != 0 && ackedBytes > 0 {
+		c.ledbat(ackedBytes, h.timeDiff, now)
+	}
+
+	// A partial ack during recovery means the next packet was lost as well
+	if c.recovering {
+		if head := c.firstInflight(); head != nil && !utpSeqAfter(head.seq, c.recoverTo) {
+			if c.resendDue(head, now) {
+				c.retransmit(head)
+			}
+		} else {
+			c.recovering = false
+		}
+	}
+
+	if c.closing && c.finSent && len(c.inflight) == 0 {
+		c.fail(net.ErrClosed) // Our FIN was acknowledged
+	}
+	c.cond.Broadcast()
+}
+
+// processSelectiveAck marks packets the peer received past a gap and resends
+// packets that three later packets overtook (assumes lock is held)
+func (c *utpConn) processSelectiveAck(h utpHeader, now time.Time) {
+	for _, p := range c.inflight {
+		i := int(p.seq - h.ackNr - 2)
+		if i < len(h.sack)*8 && h.sack[i/8]&(1<<(i%8)) != 0 && !p.sacked {
+			p.sacked = true
+			c.inflightBytes -= len(p.payload)
+		}
+	}
+
+	overtaken := 0
+	for i := len(c.inflight) - 1; i >= 0; i-- {
+		p := c.inflight[i]
+		if p.sacked {
+			overtaken++
+			continue
+		}
+		if overtaken < utpDupAckThreshold || !c.resendDue(p, now) {
+			continue
+		}
+		if !c.recovering {
+			c.cwnd = max(c.cwnd/2, utpMinWindow)
+			c.startRecovery()
+		}
+		c.retransmit(p)
+	}
+}
+
+// resendDue reports whether a packet thought lost should be sent again: a
+// first loss is resent at once, a lost retransmission after another RTT
+func (c *utpConn) resendDue(p *utpOutPacket, now time.Time) bool {
+	return p.transmissions == 1 || now.Sub(p.sentAt) > c.rtt+4*c.rttVar
+}
+
+// firstInflight returns the oldest packet the peer has not received, or nil
+func (c *utpConn) firstInflight() *utpOutPacket {
+	for _, p := range c.inflight {
+		if !p.sacked {
+			return p
+		}
+	}
+	return nil
+}
+
+// ledbat grows the window while the queuing delay we add is under the target
+// and shrinks it when above, so background transfers yield to other traffic
+func (c *utpConn) ledbat(ackedBytes int, delay uint32, now time.Time) {
+	base := c.delays.add(delay, now)
+	queuing := float64(delay - base)
+	target := float64(UTPTargetDelay.Microseconds())
+
+	offTarget := (target - queuing) / target
+	windowFactor := float64(ackedBytes) / max(c.cwnd, float64(ackedBytes))
+	c.cwnd += utpMaxCwndIncrease * offTarget * windowFactor
+	c.cwnd = max(c.cwnd, utpMinWindow)
+	if c.cwnd > UTPMaxWindow {
+		c.cwnd = UTPMaxWindow
+	}
+}
+
+// updateRTT feeds an RTT sample into the retransmission timeout (RFC 6298)
+func (c *utpConn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = max(c.rtt+4*c.rttVar, utpMinTimeout)
+	if c.rto > utpMaxTimeout {
+		c.rto = utpMaxTimeout
+	}
+}
+
+// receiveData queues data in order and acknowledges it. Packets that do not
+// fit the receive buffer are dropped unacknowledged, as a peer respecting our
+// window never sends them; it retransmits once Read frees space (assumes lock
+// is held).
+func (c *utpConn) receiveData(h utpHeader, payload []byte) {
+	if len(payload) > utpMaxRecvPayload {
+		return
+	}
+	ahead := h.seqNr - (c.ackNr + 1)
+	switch {
+	case ahead == 0:
+		if len(c.readBuf)+len(payload) > UTPRecvBuffer {
+			return
+		}
+		c.deliver(h.typ, payload)
+		for !c.eof {
+			p, ok := c.reorder[c.ackNr+1]
+			if !ok {
+				break
+			}
+			delete(c.reorder, c.ackNr+1)
+			c.heldBytes -= len(p.payload)
+			c.deliver(p.typ, p.payload)
+		}
+	case ahead < utpReorderLimit && !c.eof:
+		if _, ok := c.reorder[h.seqNr]; ok {
+			break
+		}
+		if len(c.readBuf)+c.heldBytes+len(payload) > UTPRecvBuffer {
+			return
+		}
+		c.reorder[h.seqNr] = utpOutPacket{typ: h.typ, payload: payload}
+		c.heldBytes += len(payload)
+	}
+	c.sendState() // Duplicates are acked again in case our ack was lost
+}
+
+// deliver makes the next in-order packet readable
+func (c *utpConn) deliver(typ byte, payload []byte) {
+	c.ackNr++
+	if typ == utpFin {
+		c.eof = true
+		c.reorder = make(map[uint16]utpOutPacket)
+		c.heldBytes = 0
+	} else {
+		c.readBuf = append(c.readBuf, payload...)
+	}
+	c.cond.Broadcast()
+}
+
+// flush sends queued data as far as the windows allow, then the FIN once
+// Close was called and everything else is out (assumes lock is held)
+func (c *utpConn) flush() {
+	if c.synSent || c.err != nil {
+		return
+	}
+	for len(c.sendBuf) > 0 {
+		n := min(len(c.sendBuf), utpMaxPayload)
+		window := min(int(c.cwnd), int(c.peerWnd))
+		if c.inflightBytes > 0 && c.inflightBytes+n > window {
+			break // With nothing in flight one packet always goes, probing a closed window
+		}
+		payload := append([]byte(nil), c.sendBuf[:n]...)
+		c.sendBuf = c.sendBuf[n:]
+		c.transmit(&utpOutPacket{typ: utpData, seq: c.seqNr, payload: payload})
+		c.seqNr++
+	}
+	if c.closing && !c.finSent && len(c.sendBuf) == 0 {
+		c.finSent = true
+		c.transmit(&utpOutPacket{typ: utpFin, seq: c.seqNr})
+		c.seqNr++
+	}
+	c.cond.Broadcast()
+}
+
+// transmit sends a new packet and keeps it until it is acknowledged
+func (c *utpConn) transmit(p *utpOutPacket) {
+	if len(c.inflight) == 0 {
+		c.rtoAt = time.Now().Add(c.rto)
+	}
+	c.inflight = append(c.inflight, p)
+	c.inflightBytes += len(p.payload)
+	c.send(p)
+}
+
+// retransmit sends an in-flight packet again
+func (c *utpConn) retransmit(p *utpOutPacket) {
+	c.send(p)
+}
+
+// send writes a data, FIN or SYN packet to the socket
+func (c *utpConn) send(p *utpOutPacket) {
+	p.sentAt = time.Now()
+	p.transmissions++
+	connID := c.sendID
+	if p.typ == utpSyn {
+		connID = c.recvID
+	}
+	c.write(utpHeader{typ: p.typ, connID: connID, seqNr: p.seq}, p.payload)
+}
+
+// sendState acknowledges everything received in order
+func (c *utpConn) sendState() {
+	c.write(utpHeader{typ: utpState, connID: c.sendID, seqNr: c.seqNr}, nil)
+}
+
+// write fills in the header fields every packet carries and sends it
+func (c *utpConn) write(h utpHeader, payload []byte) {
+	h.timestamp = utpNow()
+	h.timeDiff = c.replyDelay
+	h.wndSize = uint32(max(UTPRecvBuffer-len(c.readBuf), 0))
+	h.ackNr = c.ackNr
+	h.sack = c.selectiveAck()
+	c.sock.conn.WriteToUDP(h.marshal(payload), c.remote)
+}
+
+// selectiveAck describes the packets received past a gap, in multiples of
+// 4 bytes as BEP 29 requires, or nil if there is no gap
+func (c *utpConn) selectiveAck() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+	var sack []byte
+	for seq := range c.reorder {
+		i := int(seq - c.ackNr - 2)
+		if i >= utpMaxSackBytes*8 {
+			continue
+		}
+		for len(sack) <= i/8 {
+			sack = append(sack, 0, 0, 0, 0)
+		}
+		sack[i/8] |= 1 << (i % 8)
+	}
+	return sack
+}
+
+// tick retransmits the oldest packet when its timer expires; the window
+// drops to one packet and the timeout doubles each time (assumes lock is held)
+func (c *utpConn) tick(now time.Time) {
+	if c.err != nil || len(c.inflight) == 0 || now.Before(c.rtoAt) {
+		return
+	}
+	c.retransmits++
+	if c.retransmits > utpMaxRetransmits {
+		c.fail(errUTPTimeout)
+		return
+	}
+	c.rto *= 2
+	if c.rto > utpMaxTimeout {
+		c.rto = utpMaxTimeout
+	}
+	c.rtoAt = now.Add(c.rto)
+	c.cwnd = utpMinWindow
+	c.startRecovery()
+	if head := c.firstInflight(); head != nil {
+		c.retransmit(head)
+	}
+}
+
+// startRecovery marks the packets sent so far as possibly lost
+func (c *utpConn) startRecovery() {
+	c.recovering = true
+	c.recoverTo = c.seqNr - 1
+}
+
+// fail ends the connection with err and releases it from the socket (assumes lock is held)
+func (c *utpConn) fail(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.inflight = nil
+	c.sendBuf = nil
+	c.cond.Broadcast()
+	c.sock.remove(c)
+	if err != net.ErrClosed && err != errUTPReset {
+		log.Printf("[uTP] Connection to %s failed: %v", c.remote, err)
+	}
+}
+
+// waitUntil waits for a change of state, or until deadline if it is set (assumes lock is held)
+func (c *utpConn) waitUntil(deadline time.Time) {
+	if deadline.IsZero() {
+		c.cond.Wait()
+		return
+	}
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	c.cond.Wait()
+	timer.Stop()
+}
+
+// Read reads data received in order, returning io.EOF after the peer's FIN
+func (c *utpConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.readBuf) == 0 {
+		switch {
+		case c.closing:
+			return 0, net.ErrClosed
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.waitUntil(c.readDeadline)
+	}
+
+	// Reading frees receive buffer; say so if the peer may be waiting on it
+	wasFull := len(c.readBuf) >= UTPRecvBuffer-utpMaxPayload
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	if len(c.readBuf) == 0 {
+		c.readBuf = nil
+	}
+	if wasFull && c.err == nil {
+		c.sendState()
+	}
+	return n, nil
+}
+
+// Write queues data for sending, blocking while the send buffer is full
+func (c *utpConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		switch {
+		case c.closing:
+			return written, net.ErrClosed
+		case c.err != nil:
+			return written, c.err
+		case !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline):
+			return written, os.ErrDeadlineExceeded
+		}
+
+		if space := UTPSendBuffer - len(c.sendBuf); space > 0 {
+			n := min(space, len(b)-written)
+			c.sendBuf = append(c.sendBuf, b[written:written+n]...)
+			written += n
+			c.flush()
+			continue
+		}
+		c.waitUntil(c.writeDeadline)
+	}
+	return written, nil
+}
+
+// Close sends a FIN after any queued data; the connection is released once
+// the FIN is acknowledged or retransmissions give up
+func (c *utpConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return nil
+	}
+	c.closing = true
+	if c.synSent || c.err != nil {
+		c.fail(net.ErrClosed)
+		return nil
+	}
+	c.flush()
+	return nil
+}
+
+func (c *utpConn) LocalAddr() net.Addr  { return c.sock.Addr() }
+func (c *utpConn) RemoteAddr() net.Addr { return utpAddr{c.remote} }
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+// utpNow is the microsecond clock carried in packet headers
+func utpNow() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+// utpSeqAfter reports whether sequence number a comes after b, allowing for wraparound
+func utpSeqAfter(a, b uint16) bool {
+	return int16(a-b) > 0
+}
+
+// utpBefore compares microsecond delays, allowing for wraparound
+func utpBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listenUTPPair opens two uTP sockets on the loopback interface
+func listenUTPPair(t *testing.T) (*UTPSocket, *UTPSocket) {
+	t.Helper()
+	a, err := ListenUTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	b, err := ListenUTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return a, b
+}
+
+// utpRelay forwards datagrams between one client and target, dropping those
+// for which drop returns true, and returns the address to dial
+func utpRelay(t *testing.T, target string, drop func(h utpHeader, toTarget bool) bool) string {
+	t.Helper()
+	targetAddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { relay.Close() })
+
+	go func() {
+		var client *net.UDPAddr
+		buf := make([]byte, 64*1024)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			toTarget := from.String() != targetAddr.String()
+			to := targetAddr
+			if toTarget {
+				client = from
+			} else if client != nil {
+				to = client
+			}
+			if h, _, err := parseUTPPacket(buf[:n]); err == nil && drop(h, toTarget) {
+				continue
+			}
+			relay.WriteToUDP(buf[:n], to)
+		}
+	}()
+	return relay.LocalAddr().String()
+}
+
+// dropFirstEvery drops the first transmission of every nth data packet and
+// of the FIN sent towards the target, so they must be retransmitted
+func dropFirstEvery(n int) func(h utpHeader, toTarget bool) bool {
+	var mu sync.Mutex
+	seen := make(map[uint16]bool)
+	return func(h utpHeader, toTarget bool) bool {
+		if !toTarget || (h.typ != utpData && h.typ != utpFin) {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		first := !seen[h.seqNr]
+		seen[h.seqNr] = true
+		return first && (h.typ == utpFin || int(h.seqNr)%n == 0)
+	}
+}
+
+// setSequence moves a fresh connection's send sequence number, and its
+// peer's record of it, so the transfer that follows crosses seq
+func setSequence(sender, receiver net.Conn, seq uint16) {
+	s, r := sender.(*utpConn), receiver.(*utpConn)
+	s.mu.Lock()
+	s.seqNr = seq
+	s.mu.Unlock()
+	r.mu.Lock()
+	r.ackNr = seq - 1
+	r.mu.Unlock()
+}
+
+func TestUTPTransfer(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		seq  uint16 // Sequence number both sides start sending at, 0 to keep the one picked
+		drop func(h utpHeader, toTarget bool) bool
+	}{
+		{name: "plain", size: 4 << 20},
+		{name: "sequence wraparound", size: 256 << 10, seq: 0xffc0},
+		{name: "retransmission", size: 1 << 20, drop: dropFirstEvery(10)},
+		{name: "retransmission across wraparound", size: 256 << 10, seq: 0xffc0, drop: dropFirstEvery(7)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := listenUTPPair(t)
+			target := a.Addr().String()
+			if tt.drop != nil {
+				target = utpRelay(t, target, tt.drop)
+			}
+
+			data := make([]byte, tt.size)
+			rand.Read(data)
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				c, err := a.Accept()
+				if err != nil {
+					t.Error(err)
+				}
+				accepted <- c
+			}()
+			client, err := b.DialTimeout(target, 3*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := <-accepted
+			if server == nil {
+				return
+			}
+			if tt.seq != 0 {
+				setSequence(client, server, tt.seq)
+				setSequence(server, client, tt.seq)
+			}
+
+			// The server echoes everything back, then both sides close
+			go func() {
+				io.Copy(server, server)
+				server.Close()
+			}()
+			go func() {
+				client.Write(data)
+			}()
+
+			got := make([]byte, len(data))
+			client.SetReadDeadline(time.Now().Add(30 * time.Second))
+			if _, err := io.ReadFull(client, got); err != nil {
+				t.Fatalf("echo: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("echoed data differs")
+			}
+
+			// Close sends a FIN; the echo loop sees EOF and closes its side
+			if err := client.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.Read(got); !errors.Is(err, net.ErrClosed) {
+				t.Fatalf("read after close: %v, want net.ErrClosed", err)
+			}
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				a.mu.Lock()
+				open := len(a.conns)
+				a.mu.Unlock()
+				if open == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("server connection was not released after both FINs")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestUTPReadAfterFIN(t *testing.T) {
+	a, b := listenUTPPair(t)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := a.Accept()
+		accepted <- c
+	}()
+	client, err := b.DialTimeout(a.Addr().String(), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-accepted
+
+	server.Write([]byte("last words"))
+	server.Close()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "last words" {
+		t.Fatalf("got %q before EOF", got)
+	}
+}
+
+func TestUTPBacklog(t *testing.T) {
+	a, b := listenUTPPair(t)
+
+	// Nobody accepts, so the backlog fills and further SYNs are reset
+	for i := 0; i < utpBacklog; i++ {
+		if _, err := b.DialTimeout(a.Addr().String(), 3*time.Second); err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+	}
+	_, err := b.DialTimeout(a.Addr().String(), 3*time.Second)
+	if !errors.Is(err, errUTPReset) {
+		t.Fatalf("dial past the backlog: %v, want %v", err, errUTPReset)
+	}
+
+	if _, err := a.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.DialTimeout(a.Addr().String(), 3*time.Second); err != nil {
+		t.Fatalf("dial after Accept freed a slot: %v", err)
+	}
+}
+
+// newTestUTPConn returns a connection whose packets go to a socket nobody reads
+func newTestUTPConn(t *testing.T) *utpConn {
+	t.Helper()
+	s, err := ListenUTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	return newUTPConn(s, sink.LocalAddr().(*net.UDPAddr), 1, 2)
+}
+
+func TestUTPReceiveData(t *testing.T) {
+	type packet struct {
+		seq     uint16
+		payload []byte
+	}
+	small := []byte("abc")
+
+	tests := []struct {
+		name     string
+		ackNr    uint16
+		buffered int // Bytes already waiting to be read
+		packets  []packet
+		wantAck  uint16
+		wantRead int
+		wantHeld int
+	}{
+		{
+			name:     "in order",
+			ackNr:    10,
+			packets:  []packet{{11, small}, {12, small}},
+			wantAck:  12,
+			wantRead: 6,
+		},
+		{
+			name:     "gap filled across wraparound",
+			ackNr:    0xfffe,
+			packets:  []packet{{0x0000, small}, {0x0001, small}, {0xffff, small}},
+			wantAck:  0x0001,
+			wantRead: 9,
+		},
+		{
+			name:     "held behind a gap",
+			ackNr:    0xfffe,
+			packets:  []packet{{0x0001, small}, {0x0001, small}},
+			wantAck:  0xfffe,
+			wantHeld: 3,
+		},
+		{
+			name:     "duplicate of delivered data",
+			ackNr:    100,
+			packets:  []packet{{100, small}, {99, small}},
+			wantAck:  100,
+			wantRead: 0,
+		},
+		{
+			name:     "past the reorder limit",
+			ackNr:    100,
+			packets:  []packet{{100 + utpReorderLimit + 1, small}},
+			wantAck:  100,
+			wantHeld: 0,
+		},
+		{
+			name:     "oversized payload",
+			ackNr:    100,
+			packets:  []packet{{101, make([]byte, utpMaxRecvPayload+1)}},
+			wantAck:  100,
+			wantRead: 0,
+		},
+		{
+			name:     "receive buffer full",
+			ackNr:    100,
+			buffered: UTPRecvBuffer,
+			packets:  []packet{{101, small}, {102, small}},
+			wantAck:  100,
+			wantRead: UTPRecvBuffer,
+		},
+		{
+			name:     "reorder bounded by the receive buffer",
+			ackNr:    100,
+			buffered: UTPRecvBuffer - 4,
+			packets:  []packet{{102, small}, {103, small}},
+			wantAck:  100,
+			wantRead: UTPRecvBuffer - 4,
+			wantHeld: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestUTPConn(t)
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			c.ackNr = tt.ackNr
+			c.readBuf = make([]byte, tt.buffered)
+			for _, p := range tt.packets {
+				c.receiveData(utpHeader{typ: utpData, seqNr: p.seq}, p.payload)
+			}
+			if c.ackNr != tt.wantAck {
+				t.Errorf("ackNr = %#x, want %#x", c.ackNr, tt.wantAck)
+			}
+			if len(c.readBuf) != tt.wantRead {
+				t.Errorf("readable bytes = %d, want %d", len(c.readBuf), tt.wantRead)
+			}
+			if c.heldBytes != tt.wantHeld {
+				t.Errorf("held bytes = %d, want %d", c.heldBytes, tt.wantHeld)
+			}
+		})
+	}
+}
+
+func TestUTPSelectiveAck(t *testing.T) {
+	tests := []struct {
+		name  string
+		ackNr uint16
+		held  []uint16
+		want  []byte
+	}{
+		{name: "no gap", ackNr: 5, want: nil},
+		{name: "first packet past the gap", ackNr: 5, held: []uint16{7}, want: []byte{0x01, 0, 0, 0}},
+		{name: "several packets", ackNr: 5, held: []uint16{7, 9, 16}, want: []byte{0x05, 0x02, 0, 0}},
+		{name: "across wraparound", ackNr: 0xfffd, held: []uint16{0xffff, 0x0000}, want: []byte{0x03, 0, 0, 0}},
+		{name: "second word", ackNr: 5, held: []uint16{7 + 32}, want: []byte{0, 0, 0, 0, 0x01, 0, 0, 0}},
+		{name: "beyond the extension", ackNr: 5, held: []uint16{7 + utpMaxSackBytes*8}, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestUTPConn(t)
+			c.ackNr = tt.ackNr
+			for _, seq := range tt.held {
+				c.reorder[seq] = utpOutPacket{typ: utpData}
+			}
+			if got := c.selectiveAck(); !bytes.Equal(got, tt.want) {
+				t.Errorf("selectiveAck() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUTPPacketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  utpHeader
+		payload []byte
+	}{
+		{name: "state", header: utpHeader{typ: utpState, connID: 7, seqNr: 1, ackNr: 0xffff}},
+		{name: "data", header: utpHeader{typ: utpData, connID: 0xffff, wndSize: UTPRecvBuffer, seqNr: 0xffff}, payload: []byte("piece")},
+		{name: "selective ack", header: utpHeader{typ: utpState, sack: []byte{1, 2, 3, 4}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, payload, err := parseUTPPacket(tt.header.marshal(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.typ != tt.header.typ || h.connID != tt.header.connID || h.wndSize != tt.header.wndSize ||
+				h.seqNr != tt.header.seqNr || h.ackNr != tt.header.ackNr || !bytes.Equal(h.sack, tt.header.sack) {
+				t.Errorf("header = %+v, want %+v", h, tt.header)
+			}
+			if !bytes.Equal(payload, tt.payload) {
+				t.Errorf("payload = %q, want %q", payload, tt.payload)
+			}
+		})
+	}
+}
+
+func TestUTPSeqAfter(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		want bool
+	}{
+		{2, 1, true},
+		{1, 2, false},
+		{1, 1, false},
+		{0x0000, 0xffff, true},
+		{0xffff, 0x0000, false},
+		{0x7fff, 0x0000, true},
+		{0x8001, 0x0000, false},
+	}
+	for _, tt := range tests {
+		if got := utpSeqAfter(tt.a, tt.b); got != tt.want {
+			t.Errorf("utpSeqAfter(%#x, %#x) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
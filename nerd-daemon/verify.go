@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+
+	"github.com/anacrolix/torrent/merkle"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Penalties for peers that send data failing verification
+const (
+	CorruptDataPenalty = 0.2 // Quality score deducted per corrupt piece or bad hashes
+	MaxCorruptPieces   = 3   // Corrupt pieces tolerated before disconnecting the peer
+)
+
+// verifyPiece checks piece data against the SHA-1 piece hash (v1) or the
+// file's merkle tree (v2); hybrid torrents must match both
+func (t *Torrent) verifyPiece(index int, data []byte) bool {
+	t.mu.RLock()
+	piece := t.Info.Piece(index)
+	v1Hash := piece.V1Hash()
+	var file *v2File
+	var v2Hash [32]byte
+	v2Known := false
+	if t.Info.HasV2() {
+		file = t.v2PieceFiles[index]
+		v2Hash, v2Known = t.pieceHashV2(index)
+	}
+	t.mu.RUnlock()
+
+	if !v1Hash.Ok && !v2Known {
+		return false
+	}
+	if v1Hash.Ok {
+		// v1 pieces of a hybrid torrent run on into the padding after a file
+		if padding := piece.V1Length() - int64(len(data)); padding > 0 {
+			data = append(data[:len(data):len(data)], make([]byte, padding)...)
+		}
+		if sha1.Sum(data) != metainfo.Hash(v1Hash.Value) {
+			return false
+		}
+		data = data[:piece.Length()]
+	}
+	return !v2Known || t.pieceMerkleHash(file, data) == v2Hash
+}
+
+// readPiece reads a piece from storage
+func (t *Torrent) readPiece(index int) ([]byte, error) {
+	piece := t.Info.Piece(index)
+	data := make([]byte, piece.Length())
+	if _, err := t.storage.ReadAt(data, piece.Offset()); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// pieceFailed handles a piece that did not verify. For v2 torrents the block
+// hashes are requested from another peer to find the corrupt blocks, so only
+// those are downloaded again; otherwise the whole piece is discarded.
+func (t *Torrent) pieceFailed(index int, pp *pendingPiece) {
+	t.mu.RLock()
+	var req hashRequest
+	canLocate := false
+	if t.Info.HasV2() {
+		file := t.v2PieceFiles[index]
+		width := t.blockTreeWidth(file)
+		_, known := t.pieceHashV2(index)
+		canLocate = known && width >= 2 && width <= MaxHashesPerRequest
+		req = hashRequest{
+			Root:        file.root,
+			Index:       uint32((index - file.firstPiece) * width),
+			Length:      uint32(width),
+			ProofLayers: uint32(log2(width)),
+		}
+	}
+	t.mu.RUnlock()
+
+	if canLocate {
+		for _, pc := range t.blockHashSources(index, pp) {
+			if err := pc.sendHashRequest(req); err != nil {
+				log.Printf("Failed to request block hashes of piece %d from %s: %v", index, pc.addr, err)
+				pc.takeHashRequest(req)
+				continue
+			}
+			return // The piece stays pending until the hashes arrive
+		}
+	}
+	t.discardPiece(index, pp)
+}
+
+// blockHashSources lists peers that could serve a piece's block hashes,
+// preferring those that sent none of its data
+func (t *Torrent) blockHashSources(index int, pp *pendingPiece) []*PeerConn {
+	t.mu.RLock()
+	sent := make(map[*PeerConn]bool, len(pp.senders))
+	for _, pc := range pp.senders {
+		sent[pc] = true
+	}
+	t.mu.RUnlock()
+
+	var others, senders []*PeerConn
+	for _, pc := range t.connectedPeers() {
+		pc.mu.Lock()
+		usable := pc.bitfield.Has(index) && len(pc.hashRequests) < MaxHashRequestsPerPeer
+		pc.mu.Unlock()
+		switch {
+		case !usable:
+		case sent[pc]:
+			senders = append(senders, pc)
+		default:
+			others = append(others, pc)
+		}
+	}
+	return append(others, senders...)
+}
+
+// discardPiece throws away a corrupt piece so it is downloaded again, and
+// penalises every peer that contributed to it
+func (t *Torrent) discardPiece(index int, pp *pendingPiece) {
+	t.mu.Lock()
+	if t.pending[index] == pp {
+		delete(t.pending, index)
+	}
+	blamed := distinctPeers(pp.senders)
+	t.mu.Unlock()
+
+	for _, pc := range blamed {
+		t.penalize(pc)
+	}
+}
+
+// receiveBlockHashes compares a failed piece's blocks with the block hashes of
+// its merkle tree. Blocks that differ are downloaded again and their senders
+// penalised.
+func (t *Torrent) receiveBlockHashes(req hashRequest, hashes [][32]byte) error {
+	t.mu.Lock()
+
+	file := t.v2Files[req.Root]
+	if file == nil {
+		t.mu.Unlock()
+		return fmt.Errorf("hashes for unknown file root %x", req.Root)
+	}
+	width := t.blockTreeWidth(file)
+	index := file.firstPiece + int(req.Index)/width
+	pp := t.pending[index]
+	if pp == nil || !pp.verifying {
+		t.mu.Unlock()
+		return nil // Piece already resolved
+	}
+
+	pieceHash, _ := t.pieceHashV2(index)
+	if int(req.Length) != width || len(hashes) != width+req.uncleCount() || merkle.Root(hashes[:width]) != pieceHash {
+		t.mu.Unlock()
+		return fmt.Errorf("block hashes do not match piece %d", index)
+	}
+
+	var blamed []*PeerConn
+	for b, hash := range blockHashes(pp.data) {
+		if hash == hashes[b] {
+			continue
+		}
+		blamed = append(blamed, pp.senders[b])
+		pp.received[b] = false
+		pp.requested[b] = 0
+		pp.senders[b] = nil
+		pp.remaining++
+	}
+	pp.verifying = false
+	if len(blamed) == 0 {
+		// The hashes prove the data right, so it was misread; start the piece over
+		delete(t.pending, index)
+	}
+	t.mu.Unlock()
+
+	log.Printf("[Torrent] %s: piece %d has %d corrupt blocks", t.Name(), index, len(blamed))
+	for _, pc := range distinctPeers(blamed) {
+		t.penalize(pc)
+	}
+	t.refillPeers()
+	return nil
+}
+
+// blockHashesUnavailable gives up on locating the corrupt blocks of a piece
+// whose block hash request went unanswered
+func (t *Torrent) blockHashesUnavailable(req hashRequest) {
+	t.mu.RLock()
+	var pp *pendingPiece
+	index := -1
+	if file := t.v2Files[req.Root]; file != nil {
+		index = file.firstPiece + int(req.Index)/t.blockTreeWidth(file)
+		pp = t.pending[index]
+	}
+	t.mu.RUnlock()
+
+	if pp != nil && pp.verifying {
+		t.discardPiece(index, pp)
+		t.refillPeers()
+	}
+}
+
+// penalize reports a peer that sent data or hashes failing verification
+func (t *Torrent) penalize(pc *PeerConn) {
+	if pc != nil && t.corruptData != nil {
+		t.corruptData(pc)
+	}
+}
+
+// refillPeers tops up requests on every connection after blocks became
+// available to request again
+func (t *Torrent) refillPeers() {
+	for _, pc := range t.connectedPeers() {
+		if err := pc.fillRequests(); err != nil {
+			log.Printf("Failed to request blocks from %s: %v", pc.addr, err)
+		}
+	}
+}
+
+// distinctPeers removes nils and duplicates
+func distinctPeers(peers []*PeerConn) []*PeerConn {
+	seen := make(map[*PeerConn]bool, len(peers))
+	var distinct []*PeerConn
+	for _, pc := range peers {
+		if pc != nil && !seen[pc] {
+			seen[pc] = true
+			distinct = append(distinct, pc)
+		}
+	}
+	return distinct
+}